@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
@@ -14,7 +15,227 @@ type ErrOffsetOutOfRange struct {
 func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 	st := status.New(404, fmt.Sprintf("offset out of range: %d", e.Offset))
 	msg := fmt.Sprintf("The requested offset is outside the log's range: %d", e.Offset)
+	return withLocalizedMessage(st, msg)
+}
+
+func (e ErrOffsetOutOfRange) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrCorruptRecord struct {
+	Offset  uint64
+	Segment uint64
+}
+
+func (e ErrCorruptRecord) GRPCStatus() *status.Status {
+	st := status.New(codes.DataLoss, fmt.Sprintf("corrupt record: %d", e.Offset))
+	msg := fmt.Sprintf("The record at offset %d in segment %d failed verification", e.Offset, e.Segment)
+	return withLocalizedMessage(st, msg)
+}
+
+func (e ErrCorruptRecord) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrTopicNotFound struct {
+	Topic string
+}
+
+func (e ErrTopicNotFound) GRPCStatus() *status.Status {
+	st := status.New(codes.NotFound, fmt.Sprintf("topic not found: %s", e.Topic))
+	msg := fmt.Sprintf("The requested topic does not exist: %s", e.Topic)
+	return withLocalizedMessage(st, msg)
+}
+
+func (e ErrTopicNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrTopicExists struct {
+	Topic string
+}
+
+func (e ErrTopicExists) GRPCStatus() *status.Status {
+	st := status.New(codes.AlreadyExists, fmt.Sprintf("topic already exists: %s", e.Topic))
+	msg := fmt.Sprintf("A topic with this name already exists: %s", e.Topic)
+	return withLocalizedMessage(st, msg)
+}
+
+func (e ErrTopicExists) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrInvalidTopic struct {
+	Topic string
+}
+
+func (e ErrInvalidTopic) GRPCStatus() *status.Status {
+	st := status.New(codes.InvalidArgument, fmt.Sprintf("invalid topic name: %q", e.Topic))
+	msg := fmt.Sprintf("Topic names may only contain letters, digits, '.', '_' and '-', and may not start with '__': %q", e.Topic)
+	return withLocalizedMessage(st, msg)
+}
+
+func (e ErrInvalidTopic) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrPartitionNotFound struct {
+	Topic     string
+	Partition uint32
+}
+
+func (e ErrPartitionNotFound) GRPCStatus() *status.Status {
+	st := status.New(codes.NotFound, fmt.Sprintf("partition not found: %s/%d", e.Topic, e.Partition))
+	msg := fmt.Sprintf("Topic %s has no partition %d", e.Topic, e.Partition)
+	return withLocalizedMessage(st, msg)
+}
+
+func (e ErrPartitionNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrInvalidPartitionCount struct {
+	Topic string
+	Count uint32
+}
+
+func (e ErrInvalidPartitionCount) GRPCStatus() *status.Status {
+	st := status.New(codes.InvalidArgument, fmt.Sprintf("invalid partition count: %d", e.Count))
+	msg := fmt.Sprintf("The partition count of topic %s can only be increased, not set to %d", e.Topic, e.Count)
+	return withLocalizedMessage(st, msg)
+}
+
+func (e ErrInvalidPartitionCount) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrNoCommittedOffset struct {
+	Group     string
+	Topic     string
+	Partition uint32
+}
+
+func (e ErrNoCommittedOffset) GRPCStatus() *status.Status {
+	st := status.New(codes.NotFound, fmt.Sprintf("no committed offset: %s/%s/%d", e.Group, e.Topic, e.Partition))
+	msg := fmt.Sprintf("Group %s has not committed an offset for partition %d of topic %s", e.Group, e.Partition, e.Topic)
+	return withLocalizedMessage(st, msg)
+}
+
+func (e ErrNoCommittedOffset) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
 
+type ErrIllegalGeneration struct {
+	Group      string
+	Generation uint64
+}
+
+func (e ErrIllegalGeneration) GRPCStatus() *status.Status {
+	st := status.New(codes.FailedPrecondition, fmt.Sprintf("illegal generation: %s/%d", e.Group, e.Generation))
+	msg := fmt.Sprintf("Group %s has rebalanced since generation %d, rejoin to get the new assignment", e.Group, e.Generation)
+	return withLocalizedMessage(st, msg)
+}
+
+func (e ErrIllegalGeneration) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrUnknownMember struct {
+	Group  string
+	Member string
+}
+
+func (e ErrUnknownMember) GRPCStatus() *status.Status {
+	st := status.New(codes.NotFound, fmt.Sprintf("unknown member: %s/%s", e.Group, e.Member))
+	msg := fmt.Sprintf("%s is not a member of group %s, its session may have expired", e.Member, e.Group)
+	return withLocalizedMessage(st, msg)
+}
+
+func (e ErrUnknownMember) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrUnknownStrategy struct {
+	Strategy string
+}
+
+func (e ErrUnknownStrategy) GRPCStatus() *status.Status {
+	st := status.New(codes.InvalidArgument, fmt.Sprintf("unknown assignment strategy: %q", e.Strategy))
+	msg := fmt.Sprintf("The coordinator has no partition assignment strategy named %q", e.Strategy)
+	return withLocalizedMessage(st, msg)
+}
+
+func (e ErrUnknownStrategy) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrUnknownCompression struct {
+	Codec int32
+}
+
+func (e ErrUnknownCompression) GRPCStatus() *status.Status {
+	st := status.New(codes.InvalidArgument, fmt.Sprintf("unknown compression codec: %d", e.Codec))
+	msg := fmt.Sprintf("Records can't be compressed or decompressed with codec %d", e.Codec)
+	return withLocalizedMessage(st, msg)
+}
+
+func (e ErrUnknownCompression) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrOutOfOrderSequence struct {
+	ProducerID uint64
+	Expected   uint64
+	Sequence   uint64
+}
+
+func (e ErrOutOfOrderSequence) GRPCStatus() *status.Status {
+	st := status.New(codes.FailedPrecondition, fmt.Sprintf("out of order sequence: %d", e.Sequence))
+	msg := fmt.Sprintf("Producer %d sent sequence %d, expected %d", e.ProducerID, e.Sequence, e.Expected)
+	return withLocalizedMessage(st, msg)
+}
+
+func (e ErrOutOfOrderSequence) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrTxnNotFound struct {
+	TxnID uint64
+}
+
+func (e ErrTxnNotFound) GRPCStatus() *status.Status {
+	st := status.New(codes.NotFound, fmt.Sprintf("transaction not found: %d", e.TxnID))
+	msg := fmt.Sprintf("Transaction %d was never begun, has already ended or was begun through another server", e.TxnID)
+	return withLocalizedMessage(st, msg)
+}
+
+func (e ErrTxnNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrNotEnoughReplicas struct {
+	Topic    string
+	InSync   int
+	Required int
+	// Appended is set when the records were appended but not every in-sync replica got them in time
+	Appended bool
+}
+
+func (e ErrNotEnoughReplicas) GRPCStatus() *status.Status {
+	st := status.New(codes.Unavailable, fmt.Sprintf("not enough replicas: %d of %d", e.InSync, e.Required))
+	msg := fmt.Sprintf("Topic %q needs %d in-sync replicas but only %d are", e.Topic, e.Required, e.InSync)
+	if e.Appended {
+		msg = fmt.Sprintf("The records were appended to topic %q but only %d of its %d in-sync replicas acknowledged them in time", e.Topic, e.InSync, e.Required)
+	}
+	return withLocalizedMessage(st, msg)
+}
+
+func (e ErrNotEnoughReplicas) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// withLocalizedMessage attaches a human readable message to st, falling back to st if the details can't be added
+func withLocalizedMessage(st *status.Status, msg string) *status.Status {
 	d := &errdetails.LocalizedMessage{
 		Locale:  "en-US",
 		Message: msg,
@@ -27,7 +248,3 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 
 	return std
 }
-
-func (e ErrOffsetOutOfRange) Error() string {
-	return e.GRPCStatus().Err().Error()
-}
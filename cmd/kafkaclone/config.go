@@ -0,0 +1,303 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/schachte/kafkaclone/internal/agent"
+	"github.com/schachte/kafkaclone/internal/config"
+	"github.com/schachte/kafkaclone/internal/log"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix prefixes the environment variable of every option, KAFKACLONE_DATA_DIR sets data-dir
+const envPrefix = "KAFKACLONE_"
+
+// options is what a node is configured with. Every option has the same name as a flag and as a key
+// of the YAML file, and an environment variable named after it
+type options struct {
+	ConfigFile string `yaml:"-"`
+
+	DataDir        string   `yaml:"data-dir"`
+	NodeName       string   `yaml:"node-name"`
+	BindAddr       string   `yaml:"bind-addr"`
+	RPCPort        int      `yaml:"rpc-port"`
+	StartJoinAddrs []string `yaml:"start-join-addrs"`
+	Bootstrap      bool     `yaml:"bootstrap"`
+
+	ACLModelFile  string `yaml:"acl-model-file"`
+	ACLPolicyFile string `yaml:"acl-policy-file"`
+
+	ServerTLSCertFile string `yaml:"server-tls-cert-file"`
+	ServerTLSKeyFile  string `yaml:"server-tls-key-file"`
+	ServerTLSCAFile   string `yaml:"server-tls-ca-file"`
+	PeerTLSCertFile   string `yaml:"peer-tls-cert-file"`
+	PeerTLSKeyFile    string `yaml:"peer-tls-key-file"`
+	PeerTLSCAFile     string `yaml:"peer-tls-ca-file"`
+
+	MaxStoreBytes uint64        `yaml:"max-store-bytes"`
+	MaxIndexBytes uint64        `yaml:"max-index-bytes"`
+	SyncPolicy    string        `yaml:"sync-policy"`
+	SyncRecords   uint64        `yaml:"sync-records"`
+	SyncInterval  time.Duration `yaml:"sync-interval"`
+	AckTimeout    time.Duration `yaml:"ack-timeout"`
+
+	MetricsAddr   string `yaml:"metrics-addr"`
+	TraceEndpoint string `yaml:"trace-endpoint"`
+	TraceRecords  bool   `yaml:"trace-records"`
+}
+
+func defaultOptions() options {
+	hostname, _ := os.Hostname()
+	return options{
+		NodeName:      hostname,
+		BindAddr:      "127.0.0.1:8401",
+		RPCPort:       8400,
+		MaxStoreBytes: 1 << 30,
+		MaxIndexBytes: 10 << 20,
+		SyncPolicy:    "never",
+	}
+}
+
+// syncPolicies are the names sync-policy takes
+var syncPolicies = map[string]log.SyncPolicy{
+	"never":    log.SyncNever,
+	"records":  log.SyncEveryRecords,
+	"interval": log.SyncInterval,
+	"append":   log.SyncEveryAppend,
+}
+
+// parseOptions builds the options from the defaults, then the YAML file, then the environment and
+// then the flags, each overriding what came before it
+func parseOptions(args []string, getenv func(string) string) (options, error) {
+	o := defaultOptions()
+	fs := flag.NewFlagSet("kafkaclone", flag.ContinueOnError)
+	fs.StringVar(&o.ConfigFile, "config-file", "", "YAML file to read the options from")
+	fs.StringVar(&o.DataDir, "data-dir", o.DataDir, "directory to store the Raft log and the topics in")
+	fs.StringVar(&o.NodeName, "node-name", o.NodeName, "unique name of the node in the cluster")
+	fs.StringVar(&o.BindAddr, "bind-addr", o.BindAddr, "address Serf binds to for cluster membership")
+	fs.IntVar(&o.RPCPort, "rpc-port", o.RPCPort, "port serving gRPC clients and Raft, on the host of bind-addr")
+	fs.Var(stringsValue{&o.StartJoinAddrs}, "start-join-addrs", "comma separated Serf addresses of nodes to join")
+	fs.BoolVar(&o.Bootstrap, "bootstrap", o.Bootstrap, "start a new cluster with this node as its leader")
+	fs.StringVar(&o.ACLModelFile, "acl-model-file", o.ACLModelFile, "casbin model the ACL is checked with")
+	fs.StringVar(&o.ACLPolicyFile, "acl-policy-file", o.ACLPolicyFile, "casbin policy the ACL is checked with")
+	fs.StringVar(&o.ServerTLSCertFile, "server-tls-cert-file", o.ServerTLSCertFile, "certificate served to clients")
+	fs.StringVar(&o.ServerTLSKeyFile, "server-tls-key-file", o.ServerTLSKeyFile, "key of server-tls-cert-file")
+	fs.StringVar(&o.ServerTLSCAFile, "server-tls-ca-file", o.ServerTLSCAFile, "CA client certificates are verified with")
+	fs.StringVar(&o.PeerTLSCertFile, "peer-tls-cert-file", o.PeerTLSCertFile, "certificate presented to other nodes")
+	fs.StringVar(&o.PeerTLSKeyFile, "peer-tls-key-file", o.PeerTLSKeyFile, "key of peer-tls-cert-file")
+	fs.StringVar(&o.PeerTLSCAFile, "peer-tls-ca-file", o.PeerTLSCAFile, "CA the certificates of other nodes are verified with")
+	fs.Uint64Var(&o.MaxStoreBytes, "max-store-bytes", o.MaxStoreBytes, "size segments roll over at")
+	fs.Uint64Var(&o.MaxIndexBytes, "max-index-bytes", o.MaxIndexBytes, "size segment indexes roll over at")
+	fs.StringVar(&o.SyncPolicy, "sync-policy", o.SyncPolicy, "when records are fsynced: never, records, interval or append")
+	fs.Uint64Var(&o.SyncRecords, "sync-records", o.SyncRecords, "records between fsyncs with the records sync policy")
+	fs.DurationVar(&o.SyncInterval, "sync-interval", o.SyncInterval, "time between fsyncs with the interval sync policy")
+	fs.DurationVar(&o.AckTimeout, "ack-timeout", o.AckTimeout, "how long produce requests wait for every in-sync replica")
+	fs.StringVar(&o.MetricsAddr, "metrics-addr", o.MetricsAddr, "address serving Prometheus metrics on /metrics, none when empty")
+	fs.StringVar(&o.TraceEndpoint, "trace-endpoint", o.TraceEndpoint, "OTLP gRPC collector spans are exported to, no tracing when empty")
+	fs.BoolVar(&o.TraceRecords, "trace-records", o.TraceRecords, "persist the trace context of produce requests in the records' headers")
+	if err := fs.Parse(args); err != nil {
+		return options{}, err
+	}
+	if fs.NArg() > 0 {
+		return options{}, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	// The flags are bound to o, so remember the ones given before starting over from the defaults
+	flags := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		flags[f.Name] = f.Value.String()
+	})
+	file := o.ConfigFile
+	if file == "" {
+		file = getenv(envName("config-file"))
+	}
+	o = defaultOptions()
+	o.ConfigFile = file
+	if file != "" {
+		if err := o.load(file); err != nil {
+			return options{}, err
+		}
+	}
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if v := getenv(envName(f.Name)); v != "" && err == nil {
+			if serr := f.Value.Set(v); serr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %v", v, envName(f.Name), serr)
+			}
+		}
+	})
+	if err != nil {
+		return options{}, err
+	}
+	for name, v := range flags {
+		_ = fs.Lookup(name).Value.Set(v)
+	}
+	return o, o.validate()
+}
+
+// load reads the options in the YAML file over o. Unknown keys are refused, so typos don't go unnoticed
+func (o *options) load(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+	defer f.Close()
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err = dec.Decode(o); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("parsing config file %s: %w", file, err)
+	}
+	return nil
+}
+
+// validate catches mistakes that would otherwise only show up once the node is running
+func (o *options) validate() error {
+	var errs []string
+	if o.DataDir == "" {
+		errs = append(errs, "data-dir is required")
+	}
+	if o.NodeName == "" {
+		errs = append(errs, "node-name is required")
+	}
+	if _, _, err := net.SplitHostPort(o.BindAddr); err != nil {
+		errs = append(errs, fmt.Sprintf("bind-addr %q isn't a host:port address", o.BindAddr))
+	}
+	if o.RPCPort <= 0 || o.RPCPort > 65535 {
+		errs = append(errs, fmt.Sprintf("rpc-port %d is out of range", o.RPCPort))
+	}
+	if o.Bootstrap && len(o.StartJoinAddrs) > 0 {
+		errs = append(errs, "bootstrap starts a new cluster and can't be combined with start-join-addrs")
+	}
+	if _, ok := syncPolicies[o.SyncPolicy]; !ok {
+		errs = append(errs, fmt.Sprintf("sync-policy %q isn't one of never, records, interval or append", o.SyncPolicy))
+	}
+	for _, f := range []struct{ name, file string }{
+		{"acl-model-file", o.ACLModelFile},
+		{"acl-policy-file", o.ACLPolicyFile},
+	} {
+		if f.file == "" {
+			errs = append(errs, f.name+" is required")
+		} else if _, err := os.Stat(f.file); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", f.name, err))
+		}
+	}
+	for _, tls := range []struct{ prefix, cert, key, ca string }{
+		{"server-tls", o.ServerTLSCertFile, o.ServerTLSKeyFile, o.ServerTLSCAFile},
+		{"peer-tls", o.PeerTLSCertFile, o.PeerTLSKeyFile, o.PeerTLSCAFile},
+	} {
+		if (tls.cert == "") != (tls.key == "") {
+			errs = append(errs, fmt.Sprintf("%s-cert-file and %s-key-file have to be set together", tls.prefix, tls.prefix))
+		}
+		for i, file := range []string{tls.cert, tls.key, tls.ca} {
+			if file == "" {
+				continue
+			}
+			if _, err := os.Stat(file); err != nil {
+				errs = append(errs, fmt.Sprintf("%s-%s-file: %v", tls.prefix, []string{"cert", "key", "ca"}[i], err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// agentConfig loads the TLS material and builds the agent's configuration
+func (o *options) agentConfig() (agent.Config, error) {
+	c := agent.Config{
+		DataDir:        o.DataDir,
+		BindAddr:       o.BindAddr,
+		RPCPort:        o.RPCPort,
+		NodeName:       o.NodeName,
+		StartJoinAddrs: o.StartJoinAddrs,
+		ACLModelFile:   o.ACLModelFile,
+		ACLPolicyFile:  o.ACLPolicyFile,
+		Bootstrap:      o.Bootstrap,
+		AckTimeout:     o.AckTimeout,
+		MetricsAddr:    o.MetricsAddr,
+		TraceEndpoint:  o.TraceEndpoint,
+		TraceRecords:   o.TraceRecords,
+	}
+	c.LogConfig.Segment.MaxStoreBytes = o.MaxStoreBytes
+	c.LogConfig.Segment.MaxIndexBytes = o.MaxIndexBytes
+	c.LogConfig.Sync.Policy = syncPolicies[o.SyncPolicy]
+	c.LogConfig.Sync.Records = o.SyncRecords
+	c.LogConfig.Sync.Interval = o.SyncInterval
+
+	host, _, err := net.SplitHostPort(o.BindAddr)
+	if err != nil {
+		return c, err
+	}
+	if c.ServerTLSConfig, err = tlsConfig(o.ServerTLSCertFile, o.ServerTLSKeyFile, o.ServerTLSCAFile, host, true); err != nil {
+		return c, fmt.Errorf("server TLS: %w", err)
+	}
+	if c.PeerTLSConfig, err = tlsConfig(o.PeerTLSCertFile, o.PeerTLSKeyFile, o.PeerTLSCAFile, host, false); err != nil {
+		return c, fmt.Errorf("peer TLS: %w", err)
+	}
+	return c, nil
+}
+
+// tlsConfig sets up TLS from the files, or returns nil when none of them are given
+func tlsConfig(certFile, keyFile, caFile, serverAddress string, server bool) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" && caFile == "" {
+		return nil, nil
+	}
+	c := &config.TLSConfig{
+		CertFileName:  certFile,
+		KeyFileName:   keyFile,
+		CAFileName:    caFile,
+		ServerAddress: serverAddress,
+		Server:        server,
+	}
+	for _, f := range []struct {
+		name     string
+		contents *string
+	}{{certFile, &c.CertFile}, {keyFile, &c.KeyFile}, {caFile, &c.CAFile}} {
+		if f.name == "" {
+			continue
+		}
+		b, err := ioutil.ReadFile(f.name)
+		if err != nil {
+			return nil, err
+		}
+		*f.contents = string(b)
+	}
+	return config.SetupTLSConfig(c)
+}
+
+// envName is the environment variable of the option
+func envName(option string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(option, "-", "_"))
+}
+
+// stringsValue is a flag holding a comma separated list
+type stringsValue struct {
+	p *[]string
+}
+
+func (v stringsValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return strings.Join(*v.p, ",")
+}
+
+func (v stringsValue) Set(s string) error {
+	*v.p = nil
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			*v.p = append(*v.p, part)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+// Command kafkaclone runs a node of the cluster.
+//
+// Every option can be set in a YAML file (given with -config-file or KAFKACLONE_CONFIG_FILE), in an
+// environment variable and with a flag. Flags win over environment variables, which win over the file,
+// which wins over the defaults. The YAML keys are the flag names, and the environment variables are the
+// flag names in upper case with dashes turned into underscores and prefixed with KAFKACLONE_:
+//
+//	data-dir: /var/lib/kafkaclone
+//	rpc-port: 8400
+//	start-join-addrs: [10.0.0.1:8401, 10.0.0.2:8401]
+//
+//	KAFKACLONE_DATA_DIR=/var/lib/kafkaclone KAFKACLONE_START_JOIN_ADDRS=10.0.0.1:8401,10.0.0.2:8401
+//
+//	kafkaclone -data-dir /var/lib/kafkaclone -start-join-addrs 10.0.0.1:8401,10.0.0.2:8401
+//
+// Run kafkaclone -h for the full list. The node shuts down cleanly on SIGINT or SIGTERM
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/schachte/kafkaclone/internal/agent"
+)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	err := run(ctx, os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		// the usage was printed already
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// run starts a node configured by args and the environment, and shuts it down once ctx is done
+func run(ctx context.Context, args []string, getenv func(string) string) error {
+	o, err := parseOptions(args, getenv)
+	if err != nil {
+		return err
+	}
+	c, err := o.agentConfig()
+	if err != nil {
+		return err
+	}
+	a, err := agent.New(c)
+	if err != nil {
+		return err
+	}
+	<-ctx.Done()
+	return a.Shutdown()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/schachte/kafkaclone/api/v1/logger"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kafkaclone-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	bindAddr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	rpcPort := freePort(t)
+	file := path.Join(dir, "config.yaml")
+	require.NoError(t, ioutil.WriteFile(file, []byte(fmt.Sprintf(`
+data-dir: %s
+bind-addr: %s
+rpc-port: 1
+bootstrap: true
+acl-model-file: ../../acl/model.conf
+acl-policy-file: ../../acl/policy.csv
+server-tls-cert-file: ../../test_certs/server.pem
+server-tls-key-file: ../../test_certs/server-key.pem
+server-tls-ca-file: ../../test_certs/ca.pem
+peer-tls-cert-file: ../../test_certs/server.pem
+peer-tls-key-file: ../../test_certs/server-key.pem
+peer-tls-ca-file: ../../test_certs/ca.pem
+sync-policy: append
+`, path.Join(dir, "data"), bindAddr)), 0644))
+
+	// The file's rpc-port is overridden by the environment, which is overridden by the flag
+	env := map[string]string{
+		"KAFKACLONE_CONFIG_FILE": file,
+		"KAFKACLONE_RPC_PORT":    "2",
+		"KAFKACLONE_NODE_NAME":   "node-0",
+	}
+	args := []string{"-rpc-port", fmt.Sprint(rpcPort)}
+	o, err := parseOptions(args, func(key string) string { return env[key] })
+	require.NoError(t, err)
+	require.Equal(t, rpcPort, o.RPCPort)
+	require.Equal(t, "node-0", o.NodeName)
+	require.Equal(t, "append", o.SyncPolicy)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- run(ctx, args, func(key string) string { return env[key] })
+	}()
+
+	// server.pem is root's certificate, which may produce
+	clientTLS, err := tlsConfig("../../test_certs/server.pem", "../../test_certs/server-key.pem", "../../test_certs/ca.pem", "127.0.0.1", false)
+	require.NoError(t, err)
+	conn, err := grpc.Dial(fmt.Sprintf("127.0.0.1:%d", rpcPort), grpc.WithTransportCredentials(credentials.NewTLS(clientTLS)))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := logger.NewLogServiceClient(conn)
+	require.Eventually(t, func() bool {
+		_, err := client.Produce(context.Background(), &logger.ProduceRequest{Record: &logger.Record{Value: []byte("hello")}})
+		return err == nil
+	}, 5*time.Second, 50*time.Millisecond)
+
+	cancel()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("run didn't return after its context was canceled")
+	}
+}
+
+func TestParseOptionsErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kafkaclone-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	typo := path.Join(dir, "typo.yaml")
+	require.NoError(t, ioutil.WriteFile(typo, []byte("data-dri: /tmp\n"), 0644))
+
+	valid := []string{
+		"-data-dir", dir,
+		"-acl-model-file", "../../acl/model.conf",
+		"-acl-policy-file", "../../acl/policy.csv",
+	}
+	for name, tc := range map[string]struct {
+		args []string
+		env  map[string]string
+		want string
+	}{
+		"missing data dir":       {args: nil, want: "data-dir is required"},
+		"unknown yaml key":       {args: []string{"-config-file", typo}, want: "field data-dri not found"},
+		"missing config file":    {args: []string{"-config-file", path.Join(dir, "missing.yaml")}, want: "reading config file"},
+		"unknown sync policy":    {args: append([]string{"-sync-policy", "sometimes"}, valid...), want: `sync-policy "sometimes" isn't one of`},
+		"half a key pair":        {args: append([]string{"-server-tls-cert-file", "../../test_certs/server.pem"}, valid...), want: "server-tls-cert-file and server-tls-key-file have to be set together"},
+		"missing acl file":       {args: append(valid, "-acl-policy-file", path.Join(dir, "policy.csv")), want: "acl-policy-file: stat"},
+		"bootstrap and join":     {args: append([]string{"-bootstrap", "-start-join-addrs", "127.0.0.1:8401"}, valid...), want: "can't be combined with start-join-addrs"},
+		"invalid env value":      {args: valid, env: map[string]string{"KAFKACLONE_RPC_PORT": "eighty"}, want: `invalid value "eighty" for KAFKACLONE_RPC_PORT`},
+		"unexpected positionals": {args: append(valid, "extra"), want: "unexpected arguments: extra"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := parseOptions(tc.args, func(key string) string { return tc.env[key] })
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tc.want)
+		})
+	}
+
+	_, err = parseOptions(valid, func(string) string { return "" })
+	require.NoError(t, err)
+}
+
+// freePort asks the kernel for a port that's free right now
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	api_v1 "github.com/schachte/kafkaclone/api/v1"
+	"github.com/schachte/kafkaclone/api/v1/logger"
+)
+
+// fetchRecords is how many records consume asks for at a time
+const fetchRecords = 500
+
+// maxRecordBytes bounds a record read from stdin, whichever the format
+const maxRecordBytes = 16 << 20
+
+// parse parses a command's flags, printing its usage on invalid ones
+func (c *cli) parse(fs *flag.FlagSet, args []string) error {
+	fs.SetOutput(c.stderr)
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(c.stderr, "kcctl %s: unexpected arguments: %s\n", fs.Name(), strings.Join(fs.Args(), " "))
+		return errUsage
+	}
+	return nil
+}
+
+// usageError prints why the arguments are invalid
+func (c *cli) usageError(fs *flag.FlagSet, format string, a ...interface{}) error {
+	fmt.Fprintf(c.stderr, "kcctl %s: %s\n", fs.Name(), fmt.Sprintf(format, a...))
+	return errUsage
+}
+
+// produce sends the records read from stdin, one per line or each prefixed with its length as a uvarint,
+// and prints the partition and offset each of them was appended at
+func produce(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("produce", flag.ContinueOnError)
+	topic := fs.String("topic", "", "topic to produce to, the default topic when empty")
+	partition := fs.Int("partition", -1, "partition to produce to, the server's partitioner picks one when negative")
+	format := fs.String("format", "lines", "how records are read from stdin: lines or length (uvarint length-delimited)")
+	batch := fs.Int("batch", 1, "number of records sent in a single request")
+	acks := fs.String("acks", "leader", "acknowledgment level: none, leader or all")
+	if err := c.parse(fs, args); err != nil {
+		return err
+	}
+	var next func() ([]byte, error)
+	r := bufio.NewReader(c.stdin)
+	switch *format {
+	case "lines":
+		next = linesReader(r)
+	case "length":
+		next = lengthReader(r)
+	default:
+		return c.usageError(fs, "format %q isn't one of lines, length", *format)
+	}
+	level, ok := logger.Acks_value["ACKS_"+strings.ToUpper(*acks)]
+	if !ok || level == int32(logger.Acks_ACKS_UNSPECIFIED) {
+		return c.usageError(fs, "acks %q isn't one of none, leader, all", *acks)
+	}
+	if *batch < 1 {
+		return c.usageError(fs, "batch has to be at least 1")
+	}
+
+	var pinned *uint32
+	if *partition >= 0 {
+		p := uint32(*partition)
+		pinned = &p
+	}
+	var records []*logger.Record
+	send := func() error {
+		if len(records) == 0 {
+			return nil
+		}
+		defer func() { records = records[:0] }()
+		if len(records) == 1 {
+			res, err := c.client.Produce(ctx, &logger.ProduceRequest{
+				Record:    records[0],
+				Topic:     *topic,
+				Partition: pinned,
+				Acks:      logger.Acks(level),
+			})
+			if err != nil {
+				return err
+			}
+			if logger.Acks(level) != logger.Acks_ACKS_NONE {
+				fmt.Fprintf(c.stdout, "%d\t%d\n", res.Partition, res.Offset)
+			}
+			return nil
+		}
+		res, err := c.client.ProduceBatch(ctx, &logger.ProduceBatchRequest{
+			Records:   records,
+			Topic:     *topic,
+			Partition: pinned,
+			Acks:      logger.Acks(level),
+		})
+		if err != nil {
+			return err
+		}
+		if logger.Acks(level) != logger.Acks_ACKS_NONE {
+			for i := range records {
+				fmt.Fprintf(c.stdout, "%d\t%d\n", res.Partition, res.BaseOffset+uint64(i))
+			}
+		}
+		return nil
+	}
+	for {
+		value, err := next()
+		if err == io.EOF {
+			return send()
+		}
+		if err != nil {
+			return err
+		}
+		records = append(records, &logger.Record{Value: value})
+		if len(records) == *batch {
+			if err := send(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// linesReader reads a record per line, without its line ending
+func linesReader(r *bufio.Reader) func() ([]byte, error) {
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, maxRecordBytes)
+	return func() ([]byte, error) {
+		if !s.Scan() {
+			if err := s.Err(); err != nil {
+				return nil, err
+			}
+			return nil, io.EOF
+		}
+		return append([]byte(nil), s.Bytes()...), nil
+	}
+}
+
+// lengthReader reads records prefixed with their length as a uvarint
+func lengthReader(r *bufio.Reader) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			// EOF before a length is the end of the input, anywhere else the input is cut short
+			return nil, err
+		}
+		if n > maxRecordBytes {
+			return nil, fmt.Errorf("record of %d bytes is larger than %d bytes", n, maxRecordBytes)
+		}
+		value := make([]byte, n)
+		if _, err := io.ReadFull(r, value); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		return value, nil
+	}
+}
+
+// consume prints the records of a partition from an offset to its end, or as they're produced with -follow
+func consume(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("consume", flag.ContinueOnError)
+	topic := fs.String("topic", "", "topic to consume from, the default topic when empty")
+	partition := fs.Uint("partition", 0, "partition to consume from")
+	offset := fs.Int64("offset", -1, "offset to start from, the partition's lowest offset when negative")
+	follow := fs.Bool("follow", false, "keep printing records as they're produced")
+	format := fs.String("format", "raw", "how records are printed: raw, json or hex")
+	readCommitted := fs.Bool("read-committed", false, "only print the records of committed transactions")
+	if err := c.parse(fs, args); err != nil {
+		return err
+	}
+	var print func(*logger.Record) error
+	switch *format {
+	case "raw":
+		print = c.printRaw
+	case "json":
+		print = c.printJSON(uint32(*partition), json.NewEncoder(c.stdout))
+	case "hex":
+		print = c.printHex
+	default:
+		return c.usageError(fs, "format %q isn't one of raw, json, hex", *format)
+	}
+	isolation := logger.IsolationLevel_READ_UNCOMMITTED
+	if *readCommitted {
+		isolation = logger.IsolationLevel_READ_COMMITTED
+	}
+
+	offsets, err := c.client.GetOffsets(ctx, &logger.GetOffsetsRequest{Topic: *topic, Partition: uint32(*partition)})
+	if err != nil {
+		return err
+	}
+	from := offsets.Lowest
+	if *offset >= 0 {
+		from = uint64(*offset)
+	}
+	// The offset right after the last record is where a consumer waits for the next one
+	if from < offsets.Lowest || from > offsets.Highest+1 {
+		return api_v1.ErrOffsetOutOfRange{Offset: from}
+	}
+
+	if *follow {
+		stream, err := c.client.ConsumeStream(ctx, &logger.ConsumeRequest{
+			Topic:          *topic,
+			Partition:      uint32(*partition),
+			Offset:         from,
+			IsolationLevel: isolation,
+		})
+		if err != nil {
+			return err
+		}
+		for {
+			res, err := stream.Recv()
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if res.Record.Control != logger.Control_DATA {
+				continue
+			}
+			if err := print(res.Record); err != nil {
+				return err
+			}
+		}
+	}
+
+	for from <= offsets.Highest {
+		res, err := c.client.Fetch(ctx, &logger.FetchRequest{
+			Topic:          *topic,
+			Partition:      uint32(*partition),
+			Offset:         from,
+			MaxRecords:     fetchRecords,
+			IsolationLevel: isolation,
+		})
+		if exitCode(err) == exitOutOfRange {
+			// Nothing is left to read: the partition is empty, or read committed stopped at an open transaction
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(res.Records) == 0 {
+			return nil
+		}
+		for _, record := range res.Records {
+			if record.Offset > offsets.Highest {
+				return nil
+			}
+			if record.Control == logger.Control_DATA {
+				if err := print(record); err != nil {
+					return err
+				}
+			}
+			from = record.Offset + 1
+		}
+	}
+	return nil
+}
+
+func (c *cli) printRaw(record *logger.Record) error {
+	_, err := fmt.Fprintf(c.stdout, "%s\n", record.Value)
+	return err
+}
+
+func (c *cli) printHex(record *logger.Record) error {
+	_, err := fmt.Fprintf(c.stdout, "%d\t%s\n", record.Offset, hex.EncodeToString(record.Value))
+	return err
+}
+
+// jsonRecord is how a record is printed with -format json, keys and values are printed as strings
+type jsonRecord struct {
+	Partition uint32            `json:"partition"`
+	Offset    uint64            `json:"offset"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Key       string            `json:"key,omitempty"`
+	Value     string            `json:"value"`
+	Headers   map[string]string `json:"headers,omitempty"`
+}
+
+func (c *cli) printJSON(partition uint32, enc *json.Encoder) func(*logger.Record) error {
+	return func(record *logger.Record) error {
+		r := jsonRecord{
+			Partition: partition,
+			Offset:    record.Offset,
+			Timestamp: record.Timestamp,
+			Key:       string(record.Key),
+			Value:     string(record.Value),
+		}
+		for _, h := range record.Headers {
+			if r.Headers == nil {
+				r.Headers = make(map[string]string)
+			}
+			r.Headers[h.Key] = string(h.Value)
+		}
+		return enc.Encode(r)
+	}
+}
+
+// offsets prints the lowest and highest offsets of a partition
+func offsets(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("offsets", flag.ContinueOnError)
+	topic := fs.String("topic", "", "topic of the partition, the default topic when empty")
+	partition := fs.Uint("partition", 0, "partition to look up")
+	if err := c.parse(fs, args); err != nil {
+		return err
+	}
+	res, err := c.client.GetOffsets(ctx, &logger.GetOffsetsRequest{Topic: *topic, Partition: uint32(*partition)})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stdout, "lowest\t%d\nhighest\t%d\n", res.Lowest, res.Highest)
+	return nil
+}
+
+// members prints the servers of the cluster and which of them is the leader
+func members(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("members", flag.ContinueOnError)
+	if err := c.parse(fs, args); err != nil {
+		return err
+	}
+	res, err := c.client.GetServers(ctx, &logger.GetServersRequest{})
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(c.stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tRPC ADDRESS\tLEADER")
+	for _, srv := range res.Servers {
+		fmt.Fprintf(w, "%s\t%s\t%t\n", srv.Id, srv.RpcAddr, srv.IsLeader)
+	}
+	return w.Flush()
+}
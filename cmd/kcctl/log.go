@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/schachte/kafkaclone/api/v1/logger"
+	"github.com/schachte/kafkaclone/internal/log"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// errCorrupt is returned when verify found problems with any of the segments
+var errCorrupt = errors.New("segments failed verification")
+
+// logCommand works on the segment files of a data directory while its server is stopped. It doesn't
+// connect to a server
+func logCommand(ctx context.Context, c *cli, args []string) error {
+	subcommands := map[string]func(*cli, []string) error{
+		"dump":   dumpLog,
+		"verify": verifyLog,
+		"repair": repairLog,
+	}
+	if len(args) == 0 || subcommands[args[0]] == nil {
+		fmt.Fprintln(c.stderr, "Usage: kcctl log dump|verify|repair -dir <data dir> [flags]")
+		return errUsage
+	}
+	return subcommands[args[0]](c, args[1:])
+}
+
+// logFlags are the flags every log subcommand takes
+type logFlags struct {
+	fs     *flag.FlagSet
+	dir    *string
+	format *string
+}
+
+func newLogFlags(name string) *logFlags {
+	fs := flag.NewFlagSet("log "+name, flag.ContinueOnError)
+	return &logFlags{
+		fs:     fs,
+		dir:    fs.String("dir", "", "data directory, every directory under it holding segments is used"),
+		format: fs.String("format", "text", "output format: text or json, one object per line"),
+	}
+}
+
+// parse parses the flags and returns the directories under -dir that hold segments
+func (f *logFlags) parse(c *cli, args []string) ([]string, error) {
+	if err := c.parse(f.fs, args); err != nil {
+		return nil, err
+	}
+	if *f.dir == "" {
+		return nil, c.usageError(f.fs, "dir is required")
+	}
+	if *f.format != "text" && *f.format != "json" {
+		return nil, c.usageError(f.fs, "format %q isn't one of text, json", *f.format)
+	}
+	var dirs []string
+	seen := make(map[string]bool)
+	err := filepath.Walk(*f.dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if dir := filepath.Dir(p); !info.IsDir() && path.Ext(p) == ".store" && !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("no segments found under %s", *f.dir)
+	}
+	return dirs, nil
+}
+
+// dumpEntry is a line of log dump -format json
+type dumpEntry struct {
+	Kind     string          `json:"kind"` // index, record or corrupt
+	Dir      string          `json:"dir"`
+	Segment  uint64          `json:"segment"`
+	Offset   *uint64         `json:"offset,omitempty"`
+	Position uint64          `json:"position"`
+	Size     uint64          `json:"size,omitempty"`
+	Record   json.RawMessage `json:"record,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// dumpLog prints the index entries and the records of every segment
+func dumpLog(c *cli, args []string) error {
+	f := newLogFlags("dump")
+	dirs, err := f.parse(c, args)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(c.stdout)
+	w := tabwriter.NewWriter(c.stdout, 0, 8, 2, ' ', 0)
+	for _, dir := range dirs {
+		segments, err := log.Segments(dir)
+		if err != nil {
+			return err
+		}
+		for _, base := range segments {
+			dump, err := log.DumpSegment(dir, base)
+			if err != nil {
+				return err
+			}
+			if *f.format == "json" {
+				if err := dumpJSON(enc, dir, dump); err != nil {
+					return err
+				}
+				continue
+			}
+			dumpText(w, dir, dump)
+		}
+	}
+	return w.Flush()
+}
+
+func dumpJSON(enc *json.Encoder, dir string, dump *log.SegmentDump) error {
+	for _, entry := range dump.Index {
+		offset := entry.Offset
+		if err := enc.Encode(dumpEntry{Kind: "index", Dir: dir, Segment: dump.BaseOffset, Offset: &offset, Position: entry.Position}); err != nil {
+			return err
+		}
+	}
+	marshal := protojson.MarshalOptions{UseProtoNames: true}
+	for _, frame := range dump.Frames {
+		if frame.Err != nil {
+			err := enc.Encode(dumpEntry{Kind: "corrupt", Dir: dir, Segment: dump.BaseOffset, Position: frame.Position, Size: frame.Size, Error: frame.Err.Error()})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		for _, record := range frame.Records {
+			b, err := marshal.Marshal(record)
+			if err != nil {
+				return err
+			}
+			offset := record.Offset
+			err = enc.Encode(dumpEntry{Kind: "record", Dir: dir, Segment: dump.BaseOffset, Offset: &offset, Position: frame.Position, Size: frame.Size, Record: b})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func dumpText(w *tabwriter.Writer, dir string, dump *log.SegmentDump) {
+	fmt.Fprintf(w, "%s: %d store bytes in %d frames, %d index entries\n", path.Join(dir, fmt.Sprint(dump.BaseOffset)), dump.StoreSize, len(dump.Frames), len(dump.Index))
+	for _, entry := range dump.Index {
+		fmt.Fprintf(w, "  index\toffset %d\tposition %d\n", entry.Offset, entry.Position)
+	}
+	if dump.IndexTrailing > 0 {
+		fmt.Fprintf(w, "  index\t%d trailing bytes\t\n", dump.IndexTrailing)
+	}
+	for _, frame := range dump.Frames {
+		if frame.Err != nil {
+			fmt.Fprintf(w, "  corrupt\tposition %d\tsize %d\t%v\n", frame.Position, frame.Size, frame.Err)
+			continue
+		}
+		for _, record := range frame.Records {
+			fmt.Fprintf(w, "  record\toffset %d\tposition %d\tsize %d\t%s\n", record.Offset, frame.Position, frame.Size, describe(record))
+		}
+	}
+}
+
+// describe sums up a record on a line
+func describe(record *logger.Record) string {
+	s := fmt.Sprintf("time %s", time.UnixMilli(record.Timestamp).UTC().Format(time.RFC3339Nano))
+	if len(record.Key) > 0 {
+		s += fmt.Sprintf(" key %q", record.Key)
+	}
+	if record.TxnId != 0 {
+		s += fmt.Sprintf(" txn %d", record.TxnId)
+	}
+	if record.Control != logger.Control_DATA {
+		return s + " " + record.Control.String()
+	}
+	return s + fmt.Sprintf(" value %q", record.Value)
+}
+
+// verifyReport is a line of log verify -format json
+type verifyReport struct {
+	Dir        string   `json:"dir"`
+	Segment    uint64   `json:"segment"`
+	Entries    int      `json:"entries"`
+	Records    int      `json:"records"`
+	NextOffset uint64   `json:"next_offset"`
+	Problems   []string `json:"problems"`
+}
+
+// verifyLog checks every segment and prints what's wrong with them
+func verifyLog(c *cli, args []string) error {
+	f := newLogFlags("verify")
+	allowGaps := f.fs.Bool("allow-gaps", false, "accept gaps between offsets, which compacted topics have")
+	dirs, err := f.parse(c, args)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(c.stdout)
+	failed := false
+	for _, dir := range dirs {
+		reports, err := log.Verify(dir, *allowGaps)
+		if err != nil {
+			return err
+		}
+		for _, report := range reports {
+			failed = failed || len(report.Problems) > 0
+			if *f.format == "json" {
+				problems := report.Problems
+				if problems == nil {
+					problems = []string{}
+				}
+				err := enc.Encode(verifyReport{
+					Dir:        dir,
+					Segment:    report.BaseOffset,
+					Entries:    report.Entries,
+					Records:    report.Records,
+					NextOffset: report.NextOffset,
+					Problems:   problems,
+				})
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			name := path.Join(dir, fmt.Sprint(report.BaseOffset))
+			if len(report.Problems) == 0 {
+				fmt.Fprintf(c.stdout, "%s: ok, %d index entries, %d records\n", name, report.Entries, report.Records)
+				continue
+			}
+			fmt.Fprintf(c.stdout, "%s: %d problems\n", name, len(report.Problems))
+			for _, problem := range report.Problems {
+				fmt.Fprintf(c.stdout, "  %s\n", problem)
+			}
+		}
+	}
+	if failed {
+		return errCorrupt
+	}
+	return nil
+}
+
+// repairReport is a line of log repair -format json
+type repairReport struct {
+	Dir        string `json:"dir"`
+	Segment    uint64 `json:"segment"`
+	Entries    int    `json:"entries"`
+	Unreadable uint64 `json:"unreadable"`
+	Truncated  uint64 `json:"truncated"`
+}
+
+// repairLog rebuilds the indexes of the segments that fail verification, or of every segment with -all.
+// The stores are only truncated at their first unreadable frame with -truncate, otherwise it's reported
+// how many bytes that would cut
+func repairLog(c *cli, args []string) error {
+	f := newLogFlags("repair")
+	allowGaps := f.fs.Bool("allow-gaps", false, "accept gaps between offsets, which compacted topics have")
+	all := f.fs.Bool("all", false, "repair every segment, whether it fails verification or not")
+	truncate := f.fs.Bool("truncate", false, "cut the stores off at their first unreadable frame, losing the records from there on")
+	var config log.Config
+	f.fs.Uint64Var(&config.Segment.TimeIndexIntervalBytes, "time-index-interval", 4096, "bytes of records between time index entries, as the log was configured with")
+	dirs, err := f.parse(c, args)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(c.stdout)
+	repaired := 0
+	for _, dir := range dirs {
+		reports, err := log.Verify(dir, *allowGaps)
+		if err != nil {
+			return err
+		}
+		for _, report := range reports {
+			if len(report.Problems) == 0 && !*all {
+				continue
+			}
+			repair, err := log.RepairSegment(dir, report.BaseOffset, config, *truncate)
+			if err != nil {
+				return err
+			}
+			repaired++
+			if *f.format == "json" {
+				err := enc.Encode(repairReport{
+					Dir:        dir,
+					Segment:    repair.BaseOffset,
+					Entries:    repair.Entries,
+					Unreadable: repair.Unreadable,
+					Truncated:  repair.Truncated,
+				})
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			fmt.Fprintf(c.stdout, "%s: rebuilt the index with %d entries", path.Join(dir, fmt.Sprint(repair.BaseOffset)), repair.Entries)
+			switch {
+			case repair.Truncated > 0:
+				fmt.Fprintf(c.stdout, ", truncated %d bytes off the store", repair.Truncated)
+			case repair.Unreadable > 0:
+				fmt.Fprintf(c.stdout, ", left %d unreadable bytes in the store (-truncate cuts them)", repair.Unreadable)
+			}
+			fmt.Fprintln(c.stdout)
+		}
+	}
+	if repaired == 0 && *f.format == "text" {
+		fmt.Fprintln(c.stdout, "no segment needs repairing")
+	}
+	return nil
+}
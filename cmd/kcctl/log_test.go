@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/schachte/kafkaclone/api/v1/logger"
+	"github.com/schachte/kafkaclone/internal/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKcctlLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kcctl-log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Two partitions of a topic, the first one spread over two segments
+	for partition, records := range []int{4, 2} {
+		c := log.Config{}
+		c.Segment.MaxStoreBytes = 1 << 20
+		c.Segment.MaxIndexBytes = 3 * 12
+		partitionDir := path.Join(dir, "orders", fmt.Sprint(partition))
+		require.NoError(t, os.MkdirAll(partitionDir, 0755))
+		l, err := log.NewLog(partitionDir, c)
+		require.NoError(t, err)
+		for i := 0; i < records; i++ {
+			_, err := l.Append(&logger.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+			require.NoError(t, err)
+		}
+		require.NoError(t, l.Close())
+	}
+	kcctl := func(args ...string) (int, string) {
+		var stdout bytes.Buffer
+		code := run(context.Background(), append([]string{"log"}, args...), strings.NewReader(""), &stdout, ioutil.Discard)
+		return code, stdout.String()
+	}
+
+	code, stdout := kcctl("verify", "-dir", dir)
+	require.Equal(t, exitOK, code)
+	require.Equal(t, fmt.Sprintf(`%[1]s/orders/0/0: ok, 3 index entries, 3 records
+%[1]s/orders/0/3: ok, 1 index entries, 1 records
+%[1]s/orders/1/0: ok, 2 index entries, 2 records
+`, dir), stdout)
+
+	code, stdout = kcctl("dump", "-dir", path.Join(dir, "orders", "1"), "-format", "json")
+	require.Equal(t, exitOK, code)
+	var kinds []string
+	s := bufio.NewScanner(strings.NewReader(stdout))
+	for s.Scan() {
+		var entry struct {
+			Kind   string `json:"kind"`
+			Offset uint64 `json:"offset"`
+			Record struct {
+				Value []byte `json:"value"`
+			} `json:"record"`
+		}
+		require.NoError(t, json.Unmarshal(s.Bytes(), &entry))
+		kinds = append(kinds, entry.Kind)
+		if entry.Kind == "record" {
+			require.Equal(t, fmt.Sprintf("record %d", entry.Offset), string(entry.Record.Value))
+		}
+	}
+	require.Equal(t, []string{"index", "index", "record", "record"}, kinds)
+
+	code, stdout = kcctl("dump", "-dir", path.Join(dir, "orders", "1"))
+	require.Equal(t, exitOK, code)
+	require.Contains(t, stdout, `value "record 1"`)
+
+	// Losing an index is repaired from its store, the sound segments are left alone
+	require.NoError(t, os.Remove(path.Join(dir, "orders", "0", "3.index")))
+	code, stdout = kcctl("verify", "-dir", dir, "-format", "json")
+	require.Equal(t, exitCorrupt, code)
+	require.Contains(t, stdout, `{"dir":"`+dir+`/orders/0","segment":3,"entries":0,"records":1,"next_offset":4,"problems":["record at offset 3 isn't indexed"]}`)
+
+	code, stdout = kcctl("repair", "-dir", dir)
+	require.Equal(t, exitOK, code)
+	require.Equal(t, dir+"/orders/0/3: rebuilt the index with 1 entries\n", stdout)
+	code, _ = kcctl("verify", "-dir", dir)
+	require.Equal(t, exitOK, code)
+	code, stdout = kcctl("repair", "-dir", dir)
+	require.Equal(t, exitOK, code)
+	require.Equal(t, "no segment needs repairing\n", stdout)
+
+	// A torn store is only truncated with -truncate, until then repair says how much that would cut
+	store := path.Join(dir, "orders", "1", "0.store")
+	info, err := os.Stat(store)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(store, info.Size()-2))
+	code, stdout = kcctl("repair", "-dir", path.Join(dir, "orders", "1"), "-format", "json")
+	require.Equal(t, exitOK, code)
+	var repair repairReport
+	require.NoError(t, json.Unmarshal([]byte(stdout), &repair))
+	require.Equal(t, 1, repair.Entries)
+	require.NotZero(t, repair.Unreadable)
+	require.Zero(t, repair.Truncated)
+	untouched, err := os.Stat(store)
+	require.NoError(t, err)
+	require.Equal(t, info.Size()-2, untouched.Size())
+
+	code, stdout = kcctl("repair", "-dir", path.Join(dir, "orders", "1"), "-truncate")
+	require.Equal(t, exitOK, code)
+	require.Equal(t, fmt.Sprintf("%s/orders/1/0: rebuilt the index with 1 entries, truncated %d bytes off the store\n", dir, repair.Unreadable), stdout)
+	code, _ = kcctl("verify", "-dir", dir)
+	require.Equal(t, exitOK, code)
+
+	for _, args := range [][]string{
+		{},
+		{"check"},
+		{"verify"},
+		{"dump", "-dir", dir, "-format", "xml"},
+	} {
+		code, _ = kcctl(args...)
+		require.Equal(t, exitUsage, code, args)
+	}
+	code, _ = kcctl("verify", "-dir", path.Join(dir, "missing"))
+	require.Equal(t, exitError, code)
+}
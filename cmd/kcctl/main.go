@@ -0,0 +1,207 @@
+// Command kcctl talks to a kafkaclone cluster from the command line:
+//
+//	kcctl [global flags] produce  -topic orders < records.txt
+//	kcctl [global flags] consume  -topic orders -offset 42 -follow -format json
+//	kcctl [global flags] offsets  -topic orders -partition 1
+//	kcctl [global flags] members
+//	kcctl log dump|verify|repair -dir /var/lib/kafkaclone
+//
+// The global flags pick the server (-addr) and the certificate, key and CA files the connection is
+// authenticated with, the same files the servers' tests use. Run kcctl <command> -h for a command's flags.
+//
+// The log command doesn't connect to a server, it reads the segment files of a data directory directly
+// and must only be used while the server that owns them is stopped. dump prints the index entries and
+// records of every segment, verify checks that the index entries point at valid record frames and that
+// offsets are contiguous, and repair rebuilds the indexes of the segments that fail verification from
+// their store files. repair only cuts the stores off at a torn or corrupt frame with -truncate, without
+// it reports how many bytes that would cut. Each of them prints JSON, one object per line, with -format json.
+//
+// kcctl exits with 0 on success, 1 on any other error, 2 on a usage error, 3 when the server denied the
+// request, 4 when the requested offset is outside the partition and 5 when segments failed verification
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	api_v1 "github.com/schachte/kafkaclone/api/v1"
+	"github.com/schachte/kafkaclone/api/v1/logger"
+	"github.com/schachte/kafkaclone/internal/config"
+	"github.com/schachte/kafkaclone/pkg/client"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	exitOK = iota
+	exitError
+	exitUsage
+	exitPermissionDenied
+	exitOutOfRange
+	exitCorrupt
+)
+
+// command is a subcommand, it parses its flags from args and uses the client to do its job
+type command struct {
+	usage string
+	run   func(ctx context.Context, c *cli, args []string) error
+	// offline commands don't connect to a server, the client is nil
+	offline bool
+}
+
+var commands = map[string]command{
+	"produce": {usage: "produce records read from stdin", run: produce},
+	"consume": {usage: "print the records of a partition", run: consume},
+	"offsets": {usage: "print the lowest and highest offsets of a partition", run: offsets},
+	"members": {usage: "list the servers of the cluster", run: members},
+	"log":     {usage: "dump, verify or repair the segments of a stopped server", run: logCommand, offline: true},
+}
+
+// cli is what the commands share: the client and where their input comes from and their output goes
+type cli struct {
+	client logger.LogServiceClient
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// errUsage is returned for invalid arguments, after the usage has been printed
+var errUsage = errors.New("usage")
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	os.Exit(run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run runs the command given by args and returns the status to exit with
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("kcctl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	addr := fs.String("addr", "127.0.0.1:8400", "address of the server to connect to")
+	certFile := fs.String("cert-file", "", "path to the client's TLS certificate")
+	keyFile := fs.String("key-file", "", "path to the client's TLS key")
+	caFile := fs.String("ca-file", "", "path to the CA that signed the server's certificate")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: kcctl [global flags] <command> [flags]\n\nCommands:")
+		for _, name := range []string{"produce", "consume", "offsets", "members", "log"} {
+			fmt.Fprintf(stderr, "  %-8s %s\n", name, commands[name].usage)
+		}
+		fmt.Fprintln(stderr, "\nGlobal flags:")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok {
+		fmt.Fprintf(stderr, "kcctl: unknown command %q\n", fs.Arg(0))
+		fs.Usage()
+		return exitUsage
+	}
+
+	c := &cli{stdin: stdin, stdout: stdout, stderr: stderr}
+	if !cmd.offline {
+		tlsConfig, err := clientTLSConfig(*certFile, *keyFile, *caFile, *addr)
+		if err != nil {
+			fmt.Fprintln(stderr, "kcctl:", err)
+			return exitUsage
+		}
+		conn, err := client.Dial(*addr, tlsConfig)
+		if err != nil {
+			fmt.Fprintln(stderr, "kcctl:", err)
+			return exitError
+		}
+		defer conn.Close()
+		c.client = logger.NewLogServiceClient(conn)
+	}
+	err := cmd.run(ctx, c, fs.Args()[1:])
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, flag.ErrHelp):
+		return exitOK
+	case errors.Is(err, errUsage):
+		return exitUsage
+	}
+	fmt.Fprintln(stderr, "kcctl:", errorMessage(err))
+	return exitCode(err)
+}
+
+// exitCode maps an error returned by the server to the status kcctl exits with
+func exitCode(err error) int {
+	if errors.Is(err, errCorrupt) {
+		return exitCorrupt
+	}
+	switch status.Code(err) {
+	case codes.PermissionDenied, codes.Unauthenticated:
+		return exitPermissionDenied
+	case codes.OutOfRange, status.Code(api_v1.ErrOffsetOutOfRange{}.GRPCStatus().Err()):
+		return exitOutOfRange
+	}
+	return exitError
+}
+
+// errorMessage prefers the localized message the server attaches to its errors
+func errorMessage(err error) string {
+	st, ok := status.FromError(err)
+	if !ok {
+		return err.Error()
+	}
+	for _, detail := range st.Details() {
+		if d, ok := detail.(interface{ GetMessage() string }); ok && d.GetMessage() != "" {
+			return d.GetMessage()
+		}
+	}
+	return st.Message()
+}
+
+// clientTLSConfig reads the certificate files, no files means a plain text connection
+func clientTLSConfig(certFile, keyFile, caFile, addr string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" && caFile == "" {
+		return nil, nil
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("cert-file and key-file have to be set together")
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &config.TLSConfig{
+		CertFileName:  certFile,
+		KeyFileName:   keyFile,
+		CAFileName:    caFile,
+		ServerAddress: host,
+	}
+	for _, f := range []struct {
+		name     string
+		contents *string
+	}{{certFile, &c.CertFile}, {keyFile, &c.KeyFile}, {caFile, &c.CAFile}} {
+		if f.name == "" {
+			continue
+		}
+		b, err := ioutil.ReadFile(f.name)
+		if err != nil {
+			return nil, err
+		}
+		*f.contents = string(b)
+	}
+	return config.SetupTLSConfig(c)
+}
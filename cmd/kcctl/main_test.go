@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/schachte/kafkaclone/api/v1/logger"
+	"github.com/schachte/kafkaclone/internal/authorizer"
+	"github.com/schachte/kafkaclone/internal/config"
+	"github.com/schachte/kafkaclone/internal/log"
+	"github.com/schachte/kafkaclone/internal/server"
+	"github.com/schachte/kafkaclone/internal/topic"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+type servers []*logger.Server
+
+func (s servers) GetServers() ([]*logger.Server, error) {
+	return s, nil
+}
+
+// setupTest starts an in-process server and returns a function that runs kcctl against it as root.
+// Certificate files given in args override root's, the last of a repeated flag wins
+func setupTest(t *testing.T) (addr string, kcctl func(stdin string, args ...string) (code int, stdout, stderr string)) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "kcctl-test")
+	require.NoError(t, err)
+	registry, err := topic.New(dir, log.Config{})
+	require.NoError(t, err)
+
+	certFile, certFileName := config.ConfigFile("../../test_certs/server.pem")
+	keyFile, keyFileName := config.ConfigFile("../../test_certs/server-key.pem")
+	caFile, caFileName := config.ConfigFile("../../test_certs/ca.pem")
+	serverTLS, err := config.SetupTLSConfig(&config.TLSConfig{
+		CertFile:      certFile,
+		CertFileName:  certFileName,
+		KeyFile:       keyFile,
+		KeyFileName:   keyFileName,
+		CAFile:        caFile,
+		CAFileName:    caFileName,
+		ServerAddress: "127.0.0.1",
+		Server:        true,
+	})
+	require.NoError(t, err)
+	srv, err := server.NewGRPCServer(&server.Config{
+		CommitLog:  registry,
+		Authorizer: authorizer.New("../../acl/model.conf", "../../acl/policy.csv"),
+		Servers: servers{
+			{Id: "node-0", RpcAddr: "127.0.0.1:8401", IsLeader: true},
+			{Id: "node-1", RpcAddr: "127.0.0.1:8402"},
+		},
+	}, grpc.Creds(credentials.NewTLS(serverTLS)))
+	require.NoError(t, err)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(ln)
+	t.Cleanup(func() {
+		srv.Stop()
+		registry.Close()
+		os.RemoveAll(dir)
+	})
+
+	addr = ln.Addr().String()
+	return addr, func(stdin string, args ...string) (int, string, string) {
+		var stdout, stderr bytes.Buffer
+		code := run(context.Background(), append(rootArgs(addr), args...), strings.NewReader(stdin), &stdout, &stderr)
+		return code, stdout.String(), stderr.String()
+	}
+}
+
+// rootArgs are the global flags to connect to the server as root, server.pem's subject
+func rootArgs(addr string) []string {
+	return []string{
+		"-addr", addr,
+		"-cert-file", "../../test_certs/server.pem",
+		"-key-file", "../../test_certs/server-key.pem",
+		"-ca-file", "../../test_certs/ca.pem",
+	}
+}
+
+func TestKcctl(t *testing.T) {
+	_, kcctl := setupTest(t)
+
+	code, stdout, stderr := kcctl("first\nsecond\nthird\n", "produce")
+	require.Equal(t, exitOK, code, stderr)
+	require.Equal(t, "0\t0\n0\t1\n0\t2\n", stdout)
+
+	var delimited bytes.Buffer
+	for _, value := range []string{"fourth\nline", "fifth"} {
+		delimited.Write(binary.AppendUvarint(nil, uint64(len(value))))
+		delimited.WriteString(value)
+	}
+	code, stdout, stderr = kcctl(delimited.String(), "produce", "-format", "length", "-batch", "2", "-acks", "all")
+	require.Equal(t, exitOK, code, stderr)
+	require.Equal(t, "0\t3\n0\t4\n", stdout)
+
+	code, stdout, _ = kcctl("", "offsets")
+	require.Equal(t, exitOK, code)
+	require.Equal(t, "lowest\t0\nhighest\t4\n", stdout)
+
+	code, stdout, _ = kcctl("", "consume", "-offset", "1")
+	require.Equal(t, exitOK, code)
+	require.Equal(t, "second\nthird\nfourth\nline\nfifth\n", stdout)
+
+	code, stdout, _ = kcctl("", "consume", "-offset", "4", "-format", "json")
+	require.Equal(t, exitOK, code)
+	var record jsonRecord
+	require.NoError(t, json.Unmarshal([]byte(stdout), &record))
+	require.Equal(t, uint64(4), record.Offset)
+	require.Equal(t, "fifth", record.Value)
+	require.NotZero(t, record.Timestamp)
+
+	code, stdout, _ = kcctl("", "consume", "-offset", "2", "-format", "hex")
+	require.Equal(t, exitOK, code)
+	require.True(t, strings.HasPrefix(stdout, "2\t7468697264\n"), stdout)
+
+	// Right after the last record there's nothing to print yet, past it the offset is out of range
+	code, stdout, _ = kcctl("", "consume", "-offset", "5")
+	require.Equal(t, exitOK, code)
+	require.Empty(t, stdout)
+	code, _, stderr = kcctl("", "consume", "-offset", "6")
+	require.Equal(t, exitOutOfRange, code)
+	require.Contains(t, stderr, "outside the log's range")
+
+	code, stdout, _ = kcctl("", "members")
+	require.Equal(t, exitOK, code)
+	require.Equal(t, "ID      RPC ADDRESS     LEADER\nnode-0  127.0.0.1:8401  true\nnode-1  127.0.0.1:8402  false\n", stdout)
+
+	// client.pem is nobody's certificate, which may only consume from topics named nobody-*
+	nobody := []string{"-cert-file", "../../test_certs/client.pem", "-key-file", "../../test_certs/client-key.pem"}
+	code, _, stderr = kcctl("denied\n", append(nobody, "produce")...)
+	require.Equal(t, exitPermissionDenied, code)
+	require.Contains(t, stderr, "nobody")
+	code, _, _ = kcctl("", append(nobody, "consume")...)
+	require.Equal(t, exitPermissionDenied, code)
+
+	for _, args := range [][]string{
+		{},
+		{"unknown"},
+		{"produce", "-format", "csv"},
+		{"produce", "-acks", "some"},
+		{"consume", "-format", "xml"},
+		{"offsets", "extra"},
+	} {
+		code, _, _ = kcctl("", args...)
+		require.Equal(t, exitUsage, code, args)
+	}
+}
+
+func TestKcctlFollow(t *testing.T) {
+	addr, kcctl := setupTest(t)
+	code, _, stderr := kcctl("before\n", "produce")
+	require.Equal(t, exitOK, code, stderr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var stdout syncBuffer
+	done := make(chan int)
+	go func() {
+		args := append(rootArgs(addr), "consume", "-follow")
+		done <- run(ctx, args, strings.NewReader(""), &stdout, ioutil.Discard)
+	}()
+	require.Eventually(t, func() bool { return stdout.String() == "before\n" }, 5*time.Second, 10*time.Millisecond)
+
+	code, _, stderr = kcctl("after\n", "produce")
+	require.Equal(t, exitOK, code, stderr)
+	require.Eventually(t, func() bool { return stdout.String() == "before\nafter\n" }, 5*time.Second, 10*time.Millisecond)
+
+	// Following ends cleanly when kcctl is interrupted
+	cancel()
+	select {
+	case code := <-done:
+		require.Equal(t, exitOK, code)
+	case <-time.After(5 * time.Second):
+		t.Fatal("consume -follow didn't return after its context was canceled")
+	}
+}
+
+// syncBuffer is a buffer that's written by a command while the test reads it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
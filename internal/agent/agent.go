@@ -1,16 +1,28 @@
 package agent
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
 	"sync"
+	"time"
 
-	"github.com/schachte/kafkaclone/api/v1/logger"
+	"github.com/hashicorp/raft"
 	"github.com/schachte/kafkaclone/internal/authorizer"
 	"github.com/schachte/kafkaclone/internal/discovery"
 	"github.com/schachte/kafkaclone/internal/log"
+	"github.com/schachte/kafkaclone/internal/metrics"
 	"github.com/schachte/kafkaclone/internal/server"
+	"github.com/schachte/kafkaclone/internal/topic"
+	"github.com/schachte/kafkaclone/internal/txn"
+	"github.com/schachte/kafkaclone/pkg/tracing"
+	"github.com/soheilhy/cmux"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
@@ -19,10 +31,15 @@ import (
 type Agent struct {
 	Config
 
-	log          *log.Log
+	mux          cmux.CMux
+	topics       *topic.DistributedRegistry
+	groups       *topic.Groups
+	txns         *txn.Coordinator
 	server       *grpc.Server
 	membership   *discovery.Membership
-	replicator   *log.Replicator
+	metrics      *metrics.Metrics
+	metricsSrv   *http.Server
+	tracer       *sdktrace.TracerProvider
 	shutdown     bool
 	shutdowns    chan struct{}
 	shutdownLock sync.Mutex
@@ -38,6 +55,21 @@ type Config struct {
 	StartJoinAddrs  []string
 	ACLModelFile    string
 	ACLPolicyFile   string
+	// LogConfig is the configuration every topic's log starts from, before the topic's own overrides
+	LogConfig log.Config
+	// Bootstrap starts a new Raft cluster with this agent as its leader. Only the first agent of a cluster sets it
+	Bootstrap bool
+	// Raft overrides the Raft timeouts, mostly so tests can elect a leader quickly
+	Raft raft.Config
+	// AckTimeout bounds how long ACKS_ALL produce requests wait for the in-sync replicas, 10s by default
+	AckTimeout time.Duration
+	// MetricsAddr is the address the Prometheus /metrics endpoint listens on, it isn't served when empty
+	MetricsAddr string
+	// TraceEndpoint is the OTLP collector spans are exported to over gRPC in plain text. Tracing is off when
+	// it's empty. The agent installs its tracer provider globally, so only one agent per process should set it
+	TraceEndpoint string
+	// TraceRecords persists the trace context of produce requests in the records' headers, see server.Config
+	TraceRecords bool
 }
 
 func (c Config) RPCAddr() (string, error) {
@@ -56,15 +88,20 @@ func New(config Config) (*Agent, error) {
 
 	setup := []func() error{
 		a.setupLogger,
-		a.setupLog,
+		a.setupTracing,
+		a.setupMux,
+		a.setupTopics,
+		a.setupMetrics,
 		a.setupServer,
 		a.setupMembership,
+		a.serveMetrics,
 	}
 	for _, fn := range setup {
 		if err := fn(); err != nil {
 			return nil, err
 		}
 	}
+	go a.serve()
 	return a, nil
 }
 
@@ -77,13 +114,86 @@ func (a *Agent) setupLogger() error {
 	return nil
 }
 
-func (a *Agent) setupLog() error {
+// setupTracing exports spans to TraceEndpoint, before anything is set up that records them
+func (a *Agent) setupTracing() error {
+	if a.Config.TraceEndpoint == "" {
+		return nil
+	}
+	exporter, err := tracing.NewExporter(context.Background(), a.Config.TraceEndpoint, nil)
+	if err != nil {
+		return err
+	}
+	a.tracer = tracing.NewProvider(a.Config.NodeName, exporter)
+	otel.SetTracerProvider(a.tracer)
+	return nil
+}
+
+// setupMux listens on the RPC address and splits the connections between Raft and gRPC,
+// so every agent only needs the one port
+func (a *Agent) setupMux() error {
+	rpcAddr, err := a.RPCAddr()
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", rpcAddr)
+	if err != nil {
+		return err
+	}
+	a.mux = cmux.New(ln)
+	return nil
+}
+
+func (a *Agent) setupTopics() error {
+	raftLn := a.mux.Match(func(reader io.Reader) bool {
+		b := make([]byte, 1)
+		if _, err := reader.Read(b); err != nil {
+			return false
+		}
+		return bytes.Equal(b, []byte{byte(topic.RaftRPC)})
+	})
+	config := topic.RaftConfig{
+		Config:     a.Config.Raft,
+		Bootstrap:  a.Config.Bootstrap,
+		AckTimeout: a.Config.AckTimeout,
+		StreamLayer: topic.NewStreamLayer(
+			raftLn,
+			a.Config.ServerTLSConfig,
+			a.Config.PeerTLSConfig,
+		),
+	}
+	config.LocalID = raft.ServerID(a.Config.NodeName)
+	if a.Config.PeerTLSConfig != nil {
+		config.DialOptions = append(config.DialOptions, grpc.WithTransportCredentials(
+			credentials.NewTLS(a.Config.PeerTLSConfig),
+		))
+	} else {
+		config.DialOptions = append(config.DialOptions, grpc.WithInsecure())
+	}
 	var err error
-	a.log, err = log.NewLog(
+	a.topics, err = topic.NewDistributedRegistry(
 		a.Config.DataDir,
-		log.Config{},
+		a.Config.LogConfig,
+		config,
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	if a.Config.Bootstrap {
+		return a.topics.WaitForLeader(3 * time.Second)
+	}
+	return nil
+}
+
+// setupMetrics creates the metrics, the membership's are registered once it's set up
+func (a *Agent) setupMetrics() error {
+	a.metrics = metrics.New()
+	if err := a.metrics.RegisterLogs(a.topics.Stats); err != nil {
+		return err
+	}
+	if err := a.metrics.RegisterReplication(a.topics.ReplicationLag); err != nil {
+		return err
+	}
+	return a.metrics.RegisterReplicationOffsets(a.topics.OffsetLag)
 }
 
 func (a *Agent) setupServer() error {
@@ -92,9 +202,17 @@ func (a *Agent) setupServer() error {
 		a.Config.ACLPolicyFile,
 	)
 
+	a.groups = topic.NewGroups(a.topics)
+	a.txns = txn.New(a.topics, a.Config.NodeName)
+	go a.recoverTxns()
 	serverConfig := &server.Config{
-		CommitLog:  a.log,
-		Authorizer: auth,
+		CommitLog:    a.topics,
+		Authorizer:   auth,
+		Groups:       a.groups,
+		Txns:         a.txns,
+		Servers:      a.topics,
+		Metrics:      a.metrics,
+		TraceRecords: a.Config.TraceRecords,
 	}
 	var opts []grpc.ServerOption
 	if a.Config.ServerTLSConfig != nil {
@@ -106,16 +224,9 @@ func (a *Agent) setupServer() error {
 	if err != nil {
 		return err
 	}
-	rpcAddr, err := a.RPCAddr()
-	if err != nil {
-		return err
-	}
-	ln, err := net.Listen("tcp", rpcAddr)
-	if err != nil {
-		return err
-	}
+	grpcLn := a.mux.Match(cmux.Any())
 	go func() {
-		if err := a.server.Serve(ln); err != nil {
+		if err := a.server.Serve(grpcLn); err != nil {
 			_ = a.Shutdown()
 		}
 	}()
@@ -127,24 +238,7 @@ func (a *Agent) setupMembership() error {
 	if err != nil {
 		return err
 	}
-	var opts []grpc.DialOption
-	if a.Config.PeerTLSConfig != nil {
-		opts = append(opts, grpc.WithTransportCredentials(
-			credentials.NewTLS(a.Config.PeerTLSConfig),
-		))
-	}
-	conn, err := grpc.Dial(rpcAddr, opts...)
-	if err != nil {
-		return err
-	}
-
-	client := logger.NewLogServiceClient(conn)
-	a.replicator = &log.Replicator{
-		DialOptions: opts,
-		LocalServer: client,
-	}
-
-	a.membership, err = discovery.New(a.replicator, discovery.Config{
+	a.membership, err = discovery.New(a.topics, discovery.Config{
 		NodeName: a.Config.NodeName,
 		BindAddr: a.Config.BindAddr,
 		Tags: map[string]string{
@@ -152,7 +246,56 @@ func (a *Agent) setupMembership() error {
 		},
 		StartJoinAddrs: a.Config.StartJoinAddrs,
 	})
-	return err
+	if err != nil {
+		return err
+	}
+	return a.metrics.RegisterMembership(a.membership.MemberCounts)
+}
+
+// serveMetrics serves the metrics on MetricsAddr, once everything they're read from is set up
+func (a *Agent) serveMetrics() error {
+	if a.Config.MetricsAddr == "" {
+		return nil
+	}
+	ln, err := net.Listen("tcp", a.Config.MetricsAddr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", a.metrics.Handler())
+	a.metricsSrv = &http.Server{Handler: mux}
+	go func() {
+		if err := a.metricsSrv.Serve(ln); err != http.ErrServerClosed {
+			zap.L().Error("metrics server failed", zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+// recoverTxns ends the transactions this agent left open when it last stopped. There may not be a
+// leader to take the writes yet, so it keeps trying until it succeeds or the agent shuts down
+func (a *Agent) recoverTxns() {
+	for {
+		err := a.txns.Recover()
+		if err == nil {
+			return
+		}
+		zap.L().Warn("failed to recover transactions", zap.Error(err))
+		select {
+		case <-a.shutdowns:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// serve accepts connections for both Raft and gRPC until the agent shuts down
+func (a *Agent) serve() error {
+	if err := a.mux.Serve(); err != nil {
+		_ = a.Shutdown()
+		return err
+	}
+	return nil
 }
 
 func (a *Agent) Shutdown() error {
@@ -166,13 +309,29 @@ func (a *Agent) Shutdown() error {
 	close(a.shutdowns)
 
 	shutdown := []func() error{
+		func() error {
+			if a.metricsSrv == nil {
+				return nil
+			}
+			return a.metricsSrv.Close()
+		},
 		a.membership.Leave,
-		a.replicator.Close,
 		func() error {
 			a.server.GracefulStop()
 			return nil
 		},
-		a.log.Close,
+		a.groups.Close,
+		a.txns.Close,
+		a.topics.Close,
+		func() error {
+			if a.tracer == nil {
+				return nil
+			}
+			// send the spans still buffered, without hanging on a collector that's gone
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			return a.tracer.Shutdown(ctx)
+		},
 	}
 	for _, fn := range shutdown {
 		if err := fn(); err != nil {
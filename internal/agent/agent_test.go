@@ -0,0 +1,347 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	api_v1 "github.com/schachte/kafkaclone/api/v1"
+	"github.com/schachte/kafkaclone/api/v1/logger"
+	"github.com/schachte/kafkaclone/internal/config"
+	"github.com/schachte/kafkaclone/pkg/tracing"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+func TestAgent(t *testing.T) {
+	serverTLSConfig := tlsConfig(t, "../../test_certs/server.pem", "../../test_certs/server-key.pem", true)
+	peerTLSConfig := tlsConfig(t, "../../test_certs/server.pem", "../../test_certs/server-key.pem", false)
+	// every agent records its spans with the same provider, as if they went to the same collector
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+
+	var agents []*Agent
+	for i := 0; i < 3; i++ {
+		bindAddr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+		rpcPort := freePort(t)
+
+		dataDir, err := ioutil.TempDir("", "agent-test")
+		require.NoError(t, err)
+
+		var startJoinAddrs []string
+		if i != 0 {
+			startJoinAddrs = append(startJoinAddrs, agents[0].Config.BindAddr)
+		}
+
+		raftConfig := raft.Config{}
+		raftConfig.HeartbeatTimeout = 50 * time.Millisecond
+		raftConfig.ElectionTimeout = 50 * time.Millisecond
+		raftConfig.LeaderLeaseTimeout = 50 * time.Millisecond
+		raftConfig.CommitTimeout = 5 * time.Millisecond
+
+		// only the leader serves metrics, the followers don't know the replication lag anyway
+		var metricsAddr string
+		if i == 0 {
+			metricsAddr = fmt.Sprintf("127.0.0.1:%d", freePort(t))
+		}
+
+		agent, err := New(Config{
+			NodeName:        fmt.Sprintf("%d", i),
+			Bootstrap:       i == 0,
+			StartJoinAddrs:  startJoinAddrs,
+			BindAddr:        bindAddr,
+			RPCPort:         rpcPort,
+			DataDir:         dataDir,
+			ACLModelFile:    "../../acl/model.conf",
+			ACLPolicyFile:   "../../acl/policy.csv",
+			ServerTLSConfig: serverTLSConfig,
+			PeerTLSConfig:   peerTLSConfig,
+			Raft:            raftConfig,
+			MetricsAddr:     metricsAddr,
+			TraceRecords:    true,
+		})
+		require.NoError(t, err)
+		agents = append(agents, agent)
+	}
+	defer func() {
+		for _, agent := range agents {
+			require.NoError(t, agent.Shutdown())
+			require.NoError(t, os.RemoveAll(agent.Config.DataDir))
+		}
+	}()
+
+	// wait until the followers have joined the cluster
+	require.Eventually(t, func() bool {
+		return len(agents[0].membership.Members()) == 3
+	}, 3*time.Second, 50*time.Millisecond)
+
+	ctx := context.Background()
+	// every agent knows the whole cluster, with the bootstrapping agent leading it
+	for _, agent := range agents {
+		c := client(t, agent, peerTLSConfig)
+		require.Eventually(t, func() bool {
+			res, err := c.GetServers(ctx, &logger.GetServersRequest{})
+			return err == nil && len(res.Servers) == len(agents)
+		}, 3*time.Second, 50*time.Millisecond)
+		res, err := c.GetServers(ctx, &logger.GetServersRequest{})
+		require.NoError(t, err)
+		for i, srv := range res.Servers {
+			rpcAddr, err := agents[i].RPCAddr()
+			require.NoError(t, err)
+			require.Equal(t, agents[i].NodeName, srv.Id)
+			require.Equal(t, rpcAddr, srv.RpcAddr)
+			require.Equal(t, i == 0, srv.IsLeader)
+		}
+	}
+
+	for i, agent := range agents {
+		// every record goes through the leader, whichever agent it's produced on
+		value := []byte(fmt.Sprintf("record %d", i))
+		produce, err := client(t, agent, peerTLSConfig).Produce(ctx, &logger.ProduceRequest{
+			Record: &logger.Record{Value: value},
+		})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), produce.Offset)
+
+		// the leader stamps the record, so every agent stores the same timestamp
+		var timestamps []int64
+		for _, other := range agents {
+			c := client(t, other, peerTLSConfig)
+			require.Eventually(t, func() bool {
+				consume, err := c.Consume(ctx, &logger.ConsumeRequest{Offset: produce.Offset})
+				if err != nil || string(consume.Record.Value) != string(value) {
+					return false
+				}
+				timestamps = append(timestamps, consume.Record.Timestamp)
+				return true
+			}, 3*time.Second, 50*time.Millisecond)
+		}
+		require.NotZero(t, timestamps[0])
+		for _, ts := range timestamps {
+			require.Equal(t, timestamps[0], ts)
+		}
+	}
+
+	// each record exists exactly once, with nothing replicated back in after it
+	for _, agent := range agents {
+		_, err := client(t, agent, peerTLSConfig).Consume(ctx, &logger.ConsumeRequest{Offset: uint64(len(agents))})
+		require.Error(t, err)
+	}
+
+	// A follower's transactions reach the leader with their transaction fields intact
+	follower := client(t, agents[1], peerTLSConfig)
+	txn, err := follower.BeginTxn(ctx, &logger.BeginTxnRequest{})
+	require.NoError(t, err)
+	_, err = follower.AddToTxn(ctx, &logger.AddToTxnRequest{
+		TxnId:   txn.TxnId,
+		Topic:   "txns",
+		Records: []*logger.Record{{Value: []byte("committed")}},
+	})
+	require.NoError(t, err)
+	_, err = follower.CommitTxn(ctx, &logger.CommitTxnRequest{TxnId: txn.TxnId})
+	require.NoError(t, err)
+	committed, err := client(t, agents[0], peerTLSConfig).Fetch(ctx, &logger.FetchRequest{
+		Topic:          "txns",
+		IsolationLevel: logger.IsolationLevel_READ_COMMITTED,
+	})
+	require.NoError(t, err)
+	require.Len(t, committed.Records, 1)
+	require.Equal(t, txn.TxnId, committed.Records[0].TxnId)
+
+	// Consumer groups are coordinated on the leader, so members joining through different agents share one
+	first, err := client(t, agents[1], peerTLSConfig).JoinGroup(ctx, &logger.JoinGroupRequest{
+		Group:  "billing",
+		Topics: []string{"txns"},
+	})
+	require.NoError(t, err)
+	require.Len(t, first.Assignments, 1)
+	second, err := client(t, agents[2], peerTLSConfig).JoinGroup(ctx, &logger.JoinGroupRequest{
+		Group:  "billing",
+		Topics: []string{"txns"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, first.Generation+1, second.Generation)
+	_, err = follower.Heartbeat(ctx, &logger.HeartbeatRequest{
+		Group:      "billing",
+		MemberId:   first.MemberId,
+		Generation: first.Generation,
+	})
+	require.Equal(t, status.Code(api_v1.ErrIllegalGeneration{}.GRPCStatus().Err()), status.Code(err))
+	_, err = client(t, agents[2], peerTLSConfig).LeaveGroup(ctx, &logger.LeaveGroupRequest{
+		Group:    "billing",
+		MemberId: second.MemberId,
+	})
+	require.NoError(t, err)
+
+	// ACKS_ALL records are on every in-sync replica by the time they're acknowledged
+	c := client(t, agents[0], peerTLSConfig)
+	_, err = c.CreateTopic(ctx, &logger.CreateTopicRequest{
+		Name:   "durable",
+		Config: &logger.TopicConfig{MinInsyncReplicas: 3},
+	})
+	require.NoError(t, err)
+	traced, root := otel.Tracer("test").Start(ctx, "produce")
+	produce, err := client(t, agents[1], peerTLSConfig).Produce(traced, &logger.ProduceRequest{
+		Topic:  "durable",
+		Record: &logger.Record{Value: []byte("everywhere")},
+		Acks:   logger.Acks_ACKS_ALL,
+	})
+	require.NoError(t, err)
+	root.End()
+	for _, agent := range agents {
+		consume, err := client(t, agent, peerTLSConfig).Consume(ctx, &logger.ConsumeRequest{Topic: "durable", Offset: produce.Offset})
+		require.NoError(t, err)
+		require.Equal(t, []byte("everywhere"), consume.Record.Value)
+		require.Equal(t, root.SpanContext().TraceID(), tracing.RecordContext(consume.Record).TraceID())
+	}
+
+	// The record is traced from the follower it was produced on, through the leader replicating it, to
+	// every agent applying it. Consuming it later links back to the trace
+	inTrace := func() (spans tracetest.SpanStubs) {
+		for _, span := range exporter.GetSpans() {
+			if span.SpanContext.TraceID() == root.SpanContext().TraceID() {
+				spans = append(spans, span)
+			}
+		}
+		return spans
+	}
+	require.Eventually(t, func() bool {
+		applied := 0
+		for _, span := range inTrace() {
+			if span.Name == "apply" {
+				applied++
+			}
+		}
+		return applied == len(agents)
+	}, 3*time.Second, 50*time.Millisecond)
+	names := make(map[string]int)
+	var replicate trace.SpanID
+	for _, span := range inTrace() {
+		if span.SpanKind != trace.SpanKindClient {
+			names[span.Name]++
+		}
+		if span.Name == "replicate" {
+			replicate = span.SpanContext.SpanID()
+		}
+	}
+	require.Equal(t, 2, names["log.v1.LogService/Produce"], "served by the follower and by the leader it forwards to")
+	require.Equal(t, 1, names["replicate"])
+	require.Equal(t, len(agents), names["log.Append"])
+	servers := make(map[string]bool)
+	for _, span := range inTrace() {
+		if span.Name != "apply" {
+			continue
+		}
+		require.Equal(t, replicate, span.Parent.SpanID())
+		for _, attr := range span.Attributes {
+			if attr.Key == "server" {
+				servers[attr.Value.AsString()] = true
+			}
+		}
+	}
+	require.Len(t, servers, len(agents))
+	linked := false
+	for _, span := range exporter.GetSpans() {
+		if span.Name != "log.v1.LogService/Consume" {
+			continue
+		}
+		for _, link := range span.Links {
+			linked = linked || link.SpanContext.TraceID() == root.SpanContext().TraceID()
+		}
+	}
+	require.True(t, linked)
+
+	// Without enough in-sync replicas ACKS_ALL is refused, the other levels carry on
+	require.NoError(t, agents[2].Shutdown())
+	require.Eventually(t, func() bool {
+		_, err := c.Produce(ctx, &logger.ProduceRequest{
+			Topic:  "durable",
+			Record: &logger.Record{Value: []byte("refused")},
+			Acks:   logger.Acks_ACKS_ALL,
+		})
+		return status.Code(err) == codes.Unavailable
+	}, 3*time.Second, 50*time.Millisecond)
+	_, err = c.Produce(ctx, &logger.ProduceRequest{
+		Topic:  "durable",
+		Record: &logger.Record{Value: []byte("leader")},
+		Acks:   logger.Acks_ACKS_LEADER,
+	})
+	require.NoError(t, err)
+
+	// The leader's metrics show the requests, its partitions, and the follower that went away
+	scrape := func() string {
+		res, err := http.Get("http://" + agents[0].Config.MetricsAddr + "/metrics")
+		require.NoError(t, err)
+		defer res.Body.Close()
+		b, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err)
+		return string(b)
+	}
+	metrics := scrape()
+	require.Contains(t, metrics, `kafkaclone_rpc_requests_total{code="OK",method="Produce"}`)
+	require.Contains(t, metrics, `kafkaclone_rpc_requests_total{code="Unavailable",method="Produce"}`)
+	require.Contains(t, metrics, `kafkaclone_log_highest_offset{partition="0",topic="durable"}`)
+	require.Contains(t, metrics, `kafkaclone_replication_lag_seconds{peer="1"} 0`)
+	require.Eventually(t, func() bool {
+		return strings.Contains(scrape(), `kafkaclone_replication_lag_records{partition="0",peer="1",topic="durable"} 0`)
+	}, 3*time.Second, 50*time.Millisecond)
+	require.Eventually(t, func() bool {
+		metrics := scrape()
+		return strings.Contains(metrics, `kafkaclone_membership_members{status="left"} 1`) &&
+			!strings.Contains(metrics, `kafkaclone_replication_lag_seconds{peer="2"} 0`)
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+func client(t *testing.T, agent *Agent, tlsConfig *tls.Config) logger.LogServiceClient {
+	t.Helper()
+	rpcAddr, err := agent.Config.RPCAddr()
+	require.NoError(t, err)
+	opts := append(tracing.DialOptions(), grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	conn, err := grpc.Dial(rpcAddr, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return logger.NewLogServiceClient(conn)
+}
+
+func tlsConfig(t *testing.T, crtPath, keyPath string, server bool) *tls.Config {
+	t.Helper()
+	certFileContents, certFileName := config.ConfigFile(crtPath)
+	keyFileContents, keyFileName := config.ConfigFile(keyPath)
+	caFileContents, caFileName := config.ConfigFile("../../test_certs/ca.pem")
+	c, err := config.SetupTLSConfig(&config.TLSConfig{
+		CertFile:      certFileContents,
+		CertFileName:  certFileName,
+		KeyFile:       keyFileContents,
+		KeyFileName:   keyFileName,
+		CAFile:        caFileContents,
+		CAFileName:    caFileName,
+		ServerAddress: "127.0.0.1",
+		Server:        server,
+	})
+	require.NoError(t, err)
+	return c
+}
+
+// freePort asks the kernel for a port that's free right now
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
@@ -3,6 +3,7 @@ package discovery
 import (
 	"net"
 
+	"github.com/hashicorp/raft"
 	"github.com/hashicorp/serf/serf"
 	"go.uber.org/zap"
 )
@@ -99,7 +100,7 @@ func (m *Membership) handleJoin(member serf.Member) {
 		member.Name,
 		member.Tags["rpc_addr"],
 	); err != nil {
-		m.logError(err, "failed to leave", member)
+		m.logError(err, "failed to join", member)
 	}
 }
 
@@ -119,12 +120,31 @@ func (m *Membership) Members() []serf.Member {
 	return m.serf.Members()
 }
 
+// MemberCounts returns how many members of the cluster have each status (alive, leaving, left or
+// failed), the local member included. Every status is present, with a zero count if need be
+func (m *Membership) MemberCounts() map[string]int {
+	counts := make(map[string]int)
+	for _, status := range []serf.MemberStatus{serf.StatusAlive, serf.StatusLeaving, serf.StatusLeft, serf.StatusFailed} {
+		counts[status.String()] = 0
+	}
+	for _, member := range m.serf.Members() {
+		counts[member.Status.String()]++
+	}
+	return counts
+}
+
 func (m *Membership) Leave() error {
 	return m.serf.Leave()
 }
 
+// logError logs a failed join or leave. Every server sees the membership events but only the Raft
+// leader can change the cluster, so the followers' raft.ErrNotLeader is expected and only logged at debug level
 func (m *Membership) logError(err error, msg string, member serf.Member) {
-	m.logger.Error(
+	log := m.logger.Error
+	if err == raft.ErrNotLeader {
+		log = m.logger.Debug
+	}
+	log(
 		msg,
 		zap.Error(err),
 		zap.String("name", member.Name),
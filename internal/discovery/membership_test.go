@@ -40,6 +40,7 @@ func TestMembership(t *testing.T) {
 			serf.StatusLeft == m[0].Members()[2].Status &&
 			1 == len(handler.leaves)
 	}, 3*time.Second, 250*time.Millisecond)
+	require.Equal(t, map[string]int{"alive": 2, "leaving": 0, "left": 1, "failed": 0}, m[0].MemberCounts())
 }
 
 func (h *handler) Join(id, addr string) error {
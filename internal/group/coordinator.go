@@ -0,0 +1,300 @@
+// Package group coordinates consumer groups: members join a group to have the partitions of the topics
+// they consume divided between them, and the group rebalances whenever a member joins, leaves or stops
+// heartbeating within its session timeout, or one of the topics is created or gains partitions
+package group
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	api_v1 "github.com/schachte/kafkaclone/api/v1"
+	"github.com/schachte/kafkaclone/api/v1/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultStrategy assigns the partitions of groups whose first member didn't ask for a strategy
+	DefaultStrategy = "range"
+
+	// DefaultSessionTimeout applies to members that join without a session timeout
+	DefaultSessionTimeout = 10 * time.Second
+)
+
+// Partitions tells the coordinator how many partitions a topic has
+type Partitions interface {
+	Partitions(topic string) (uint32, error)
+}
+
+// Coordinator tracks the members of every consumer group and which partitions each of them consumes.
+// Groups live in the memory of the coordinator they were joined through, so all the members of a group
+// have to use the same one
+type Coordinator struct {
+	mu         sync.Mutex
+	partitions Partitions
+	// Strategies are the assignment strategies members can pick from, by name
+	Strategies map[string]Strategy
+	groups     map[string]*group
+	logger     *zap.Logger
+}
+
+type group struct {
+	name       string
+	strategy   Strategy
+	generation uint64
+	members    map[string]*member
+	assignment map[string][]Partition
+	// partitions is how many partitions each topic had when the group last rebalanced, missing topics
+	// have none
+	partitions map[string]uint32
+}
+
+type member struct {
+	id      string
+	topics  []string
+	timeout time.Duration
+	expiry  *time.Timer
+}
+
+func New(partitions Partitions) *Coordinator {
+	return &Coordinator{
+		partitions: partitions,
+		Strategies: map[string]Strategy{
+			"range":      RangeStrategy{},
+			"roundrobin": RoundRobinStrategy{},
+			"sticky":     StickyStrategy{},
+		},
+		groups: make(map[string]*group),
+		logger: zap.L().Named("group"),
+	}
+}
+
+// Join adds a member to the group, or rejoins one after a rebalance, and returns the member's ID, the
+// group's generation and the partitions the member consumes. A new member, or one whose topics changed,
+// makes the group rebalance. The member has to heartbeat within sessionTimeout to stay in the group
+func (c *Coordinator) Join(name, memberID string, topics []string, strategy string, sessionTimeout time.Duration) (string, uint64, []*logger.Assignment, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g, ok := c.groups[name]
+	if !ok {
+		if strategy == "" {
+			strategy = DefaultStrategy
+		}
+		s, ok := c.Strategies[strategy]
+		if !ok {
+			return "", 0, nil, api_v1.ErrUnknownStrategy{Strategy: strategy}
+		}
+		g = &group{name: name, strategy: s, members: make(map[string]*member)}
+		c.groups[name] = g
+	}
+	if sessionTimeout == 0 {
+		sessionTimeout = DefaultSessionTimeout
+	}
+
+	m, ok := g.members[memberID]
+	if !ok {
+		if memberID != "" {
+			return "", 0, nil, api_v1.ErrUnknownMember{Group: name, Member: memberID}
+		}
+		m = &member{id: newMemberID(name)}
+		g.members[m.id] = m
+	}
+	m.timeout = sessionTimeout
+	c.keepAlive(g, m)
+	if !ok || !equal(m.topics, topics) {
+		m.topics = topics
+		if err := c.rebalance(g); err != nil {
+			return "", 0, nil, err
+		}
+	} else if err := c.refresh(g); err != nil {
+		return "", 0, nil, err
+	}
+	return m.id, g.generation, assignments(g.assignment[m.id]), nil
+}
+
+// Heartbeat keeps the member's session alive. It fails with ErrIllegalGeneration once the group has
+// rebalanced since generation, the member has to rejoin to find out what it consumes now
+func (c *Coordinator) Heartbeat(name, memberID string, generation uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g, m, err := c.member(name, memberID)
+	if err != nil {
+		return err
+	}
+	c.keepAlive(g, m)
+	if err := c.refresh(g); err != nil {
+		return err
+	}
+	if generation != g.generation {
+		return api_v1.ErrIllegalGeneration{Group: name, Generation: generation}
+	}
+	return nil
+}
+
+// Leave removes the member from the group straight away, instead of waiting for its session to expire
+func (c *Coordinator) Leave(name, memberID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g, m, err := c.member(name, memberID)
+	if err != nil {
+		return err
+	}
+	return c.remove(g, m)
+}
+
+// Close stops tracking every group
+func (c *Coordinator) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, g := range c.groups {
+		for _, m := range g.members {
+			m.expiry.Stop()
+		}
+	}
+	c.groups = make(map[string]*group)
+	return nil
+}
+
+func (c *Coordinator) member(name, memberID string) (*group, *member, error) {
+	g, ok := c.groups[name]
+	if !ok {
+		return nil, nil, api_v1.ErrUnknownMember{Group: name, Member: memberID}
+	}
+	m, ok := g.members[memberID]
+	if !ok {
+		return nil, nil, api_v1.ErrUnknownMember{Group: name, Member: memberID}
+	}
+	return g, m, nil
+}
+
+// keepAlive restarts the member's session. The caller must hold the lock
+func (c *Coordinator) keepAlive(g *group, m *member) {
+	if m.expiry != nil {
+		m.expiry.Stop()
+	}
+	var expiry *time.Timer
+	expiry = time.AfterFunc(m.timeout, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		// a heartbeat may have raced with the timer firing
+		if g.members[m.id] != m || m.expiry != expiry {
+			return
+		}
+		c.logger.Info(
+			"member session expired",
+			zap.String("group", g.name),
+			zap.String("member", m.id),
+		)
+		if err := c.remove(g, m); err != nil {
+			c.logger.Error("failed to rebalance", zap.String("group", g.name), zap.Error(err))
+		}
+	})
+	m.expiry = expiry
+}
+
+// remove takes the member out of the group, dropping the group once it's empty. The caller must hold the lock
+func (c *Coordinator) remove(g *group, m *member) error {
+	m.expiry.Stop()
+	delete(g.members, m.id)
+	if len(g.members) == 0 {
+		delete(c.groups, g.name)
+		return nil
+	}
+	return c.rebalance(g)
+}
+
+// rebalance reassigns the partitions of every topic the group consumes and starts a new generation.
+// The caller must hold the lock
+func (c *Coordinator) rebalance(g *group) error {
+	members := make(map[string][]string, len(g.members))
+	var topics []string
+	seen := make(map[string]bool)
+	for id, m := range g.members {
+		members[id] = m.topics
+		for _, topic := range m.topics {
+			if !seen[topic] {
+				seen[topic] = true
+				topics = append(topics, topic)
+			}
+		}
+	}
+	var partitions []Partition
+	counts := make(map[string]uint32, len(topics))
+	for _, topic := range topics {
+		n, err := c.count(topic)
+		if err != nil {
+			return err
+		}
+		counts[topic] = n
+		for p := uint32(0); p < n; p++ {
+			partitions = append(partitions, Partition{Topic: topic, Partition: p})
+		}
+	}
+	sortPartitions(partitions)
+	g.assignment = g.strategy.Assign(members, partitions, g.assignment)
+	g.partitions = counts
+	g.generation++
+	c.logger.Info(
+		"rebalanced group",
+		zap.String("group", g.name),
+		zap.Uint64("generation", g.generation),
+		zap.Int("members", len(g.members)),
+	)
+	return nil
+}
+
+// refresh rebalances the group when one of the topics it consumes was created or gained partitions since
+// the last rebalance, which the members find out about on their next heartbeat. The caller must hold the lock
+func (c *Coordinator) refresh(g *group) error {
+	for topic, had := range g.partitions {
+		n, err := c.count(topic)
+		if err != nil {
+			return err
+		}
+		if n != had {
+			return c.rebalance(g)
+		}
+	}
+	return nil
+}
+
+// count returns how many partitions the topic has, none when it doesn't exist (yet)
+func (c *Coordinator) count(topic string) (uint32, error) {
+	n, err := c.partitions.Partitions(topic)
+	if _, ok := err.(api_v1.ErrTopicNotFound); ok {
+		// nothing to consume until the topic is created
+		return 0, nil
+	}
+	return n, err
+}
+
+// assignments groups a member's partitions by topic
+func assignments(partitions []Partition) []*logger.Assignment {
+	var as []*logger.Assignment
+	for _, p := range partitions {
+		if len(as) == 0 || as[len(as)-1].Topic != p.Topic {
+			as = append(as, &logger.Assignment{Topic: p.Topic})
+		}
+		as[len(as)-1].Partitions = append(as[len(as)-1].Partitions, p.Partition)
+	}
+	return as
+}
+
+func newMemberID(group string) string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return group + "-" + hex.EncodeToString(b)
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,170 @@
+package group
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	api_v1 "github.com/schachte/kafkaclone/api/v1"
+	"github.com/schachte/kafkaclone/api/v1/logger"
+	"github.com/stretchr/testify/require"
+)
+
+type partitions map[string]uint32
+
+func (p partitions) Partitions(topic string) (uint32, error) {
+	n, ok := p[topic]
+	if !ok {
+		return 0, api_v1.ErrTopicNotFound{Topic: topic}
+	}
+	return n, nil
+}
+
+func TestCoordinator(t *testing.T) {
+	c := New(partitions{"orders": 4})
+	defer c.Close()
+
+	_, _, _, err := c.Join("billing", "", []string{"orders"}, "fifo", time.Second)
+	require.Equal(t, api_v1.ErrUnknownStrategy{Strategy: "fifo"}, err)
+
+	a, generation, assignment, err := c.Join("billing", "", []string{"orders"}, "range", time.Second)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), generation)
+	require.Equal(t, []*logger.Assignment{{Topic: "orders", Partitions: []uint32{0, 1, 2, 3}}}, assignment)
+
+	b, generation, assignment, err := c.Join("billing", "", []string{"orders"}, "range", time.Second)
+	require.NoError(t, err)
+	require.NotEqual(t, a, b)
+	require.Equal(t, uint64(2), generation)
+	require.Len(t, assignment[0].Partitions, 2)
+
+	// a is behind and has to rejoin, which doesn't rebalance again
+	require.Equal(t, api_v1.ErrIllegalGeneration{Group: "billing", Generation: 1}, c.Heartbeat("billing", a, 1))
+	_, generation, assignment, err = c.Join("billing", a, []string{"orders"}, "", time.Second)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), generation)
+	require.Len(t, assignment[0].Partitions, 2)
+	require.NoError(t, c.Heartbeat("billing", a, 2))
+
+	require.NoError(t, c.Leave("billing", b))
+	require.Equal(t, api_v1.ErrUnknownMember{Group: "billing", Member: b}, c.Heartbeat("billing", b, 2))
+	_, _, _, err = c.Join("billing", b, []string{"orders"}, "", time.Second)
+	require.Equal(t, api_v1.ErrUnknownMember{Group: "billing", Member: b}, err)
+}
+
+func TestCoordinatorTopicChanges(t *testing.T) {
+	topics := partitions{"orders": 2}
+	c := New(topics)
+	defer c.Close()
+
+	a, generation, assignment, err := c.Join("billing", "", []string{"orders", "refunds"}, "range", time.Second)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), generation)
+	require.Equal(t, []*logger.Assignment{{Topic: "orders", Partitions: []uint32{0, 1}}}, assignment)
+	require.NoError(t, c.Heartbeat("billing", a, 1))
+
+	// Creating a topic the group consumes rebalances it, as does adding partitions to one
+	topics["refunds"] = 1
+	require.Equal(t, api_v1.ErrIllegalGeneration{Group: "billing", Generation: 1}, c.Heartbeat("billing", a, 1))
+	_, generation, assignment, err = c.Join("billing", a, []string{"orders", "refunds"}, "", time.Second)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), generation)
+	require.Equal(t, []*logger.Assignment{
+		{Topic: "orders", Partitions: []uint32{0, 1}},
+		{Topic: "refunds", Partitions: []uint32{0}},
+	}, assignment)
+
+	topics["orders"] = 3
+	_, generation, assignment, err = c.Join("billing", a, []string{"orders", "refunds"}, "", time.Second)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), generation)
+	require.Equal(t, []uint32{0, 1, 2}, assignment[0].Partitions)
+	require.NoError(t, c.Heartbeat("billing", a, 3))
+}
+
+// consumer follows the group protocol: heartbeat, and rejoin whenever the group rebalanced
+type consumer struct {
+	mu         sync.Mutex
+	id         string
+	generation uint64
+	owned      []uint32
+	stop       chan struct{}
+}
+
+func startConsumer(t *testing.T, c *Coordinator, sessionTimeout time.Duration) *consumer {
+	con := &consumer{stop: make(chan struct{})}
+	con.join(t, c, sessionTimeout)
+	go func() {
+		ticker := time.NewTicker(sessionTimeout / 5)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-con.stop:
+				return
+			case <-ticker.C:
+				con.mu.Lock()
+				id, generation := con.id, con.generation
+				con.mu.Unlock()
+				if _, ok := c.Heartbeat("billing", id, generation).(api_v1.ErrIllegalGeneration); ok {
+					con.join(t, c, sessionTimeout)
+				}
+			}
+		}
+	}()
+	return con
+}
+
+func (con *consumer) join(t *testing.T, c *Coordinator, sessionTimeout time.Duration) {
+	con.mu.Lock()
+	defer con.mu.Unlock()
+	id, generation, assignment, err := c.Join("billing", con.id, []string{"orders"}, "sticky", sessionTimeout)
+	require.NoError(t, err)
+	con.id, con.generation, con.owned = id, generation, nil
+	for _, a := range assignment {
+		con.owned = append(con.owned, a.Partitions...)
+	}
+}
+
+func (con *consumer) partitions() []uint32 {
+	con.mu.Lock()
+	defer con.mu.Unlock()
+	return con.owned
+}
+
+func TestCoordinatorSessionTimeout(t *testing.T) {
+	c := New(partitions{"orders": 6})
+	defer c.Close()
+
+	sessionTimeout := 200 * time.Millisecond
+	var consumers []*consumer
+	for i := 0; i < 3; i++ {
+		consumers = append(consumers, startConsumer(t, c, sessionTimeout))
+	}
+	// every consumer ends up with an even share once they've all caught up with the last rebalance
+	require.Eventually(t, func() bool {
+		for _, con := range consumers {
+			if len(con.partitions()) != 2 {
+				return false
+			}
+		}
+		return true
+	}, time.Second, 10*time.Millisecond)
+
+	// Kill one consumer, the survivors take over its partitions once its session expires
+	close(consumers[2].stop)
+	killed := time.Now()
+	require.Eventually(t, func() bool {
+		owned := make(map[uint32]bool)
+		for _, con := range consumers[:2] {
+			for _, p := range con.partitions() {
+				owned[p] = true
+			}
+		}
+		return len(owned) == 6
+	}, 2*sessionTimeout, 10*time.Millisecond)
+	require.Less(t, time.Since(killed), 2*sessionTimeout)
+
+	for _, con := range consumers[:2] {
+		close(con.stop)
+	}
+}
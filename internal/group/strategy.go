@@ -0,0 +1,165 @@
+package group
+
+import "sort"
+
+// Partition identifies one partition of a topic, the unit of work divided between a group's members
+type Partition struct {
+	Topic     string
+	Partition uint32
+}
+
+// Strategy divides the partitions of the topics a group consumes between its members
+type Strategy interface {
+	// Assign returns the partitions each member consumes. members maps every member to the topics it
+	// subscribes to, partitions lists every partition of those topics sorted by topic then partition and
+	// previous is the assignment the group had before the rebalance. Every partition is assigned to one
+	// member subscribed to its topic, every member has an entry even if it gets nothing
+	Assign(members map[string][]string, partitions []Partition, previous map[string][]Partition) map[string][]Partition
+}
+
+// RangeStrategy gives each member a contiguous range of every topic's partitions,
+// the first members getting one more when they don't divide evenly
+type RangeStrategy struct{}
+
+func (RangeStrategy) Assign(members map[string][]string, partitions []Partition, _ map[string][]Partition) map[string][]Partition {
+	assignment := emptyAssignment(members)
+	byTopic := make(map[string][]Partition)
+	var topics []string
+	for _, p := range partitions {
+		if _, ok := byTopic[p.Topic]; !ok {
+			topics = append(topics, p.Topic)
+		}
+		byTopic[p.Topic] = append(byTopic[p.Topic], p)
+	}
+	for _, topic := range topics {
+		subscribers := subscribersOf(members, topic)
+		if len(subscribers) == 0 {
+			continue
+		}
+		ps := byTopic[topic]
+		size, extra := len(ps)/len(subscribers), len(ps)%len(subscribers)
+		start := 0
+		for i, member := range subscribers {
+			n := size
+			if i < extra {
+				n++
+			}
+			assignment[member] = append(assignment[member], ps[start:start+n]...)
+			start += n
+		}
+	}
+	return assignment
+}
+
+// RoundRobinStrategy deals the partitions of every topic out one at a time, cycling through the members
+type RoundRobinStrategy struct{}
+
+func (RoundRobinStrategy) Assign(members map[string][]string, partitions []Partition, _ map[string][]Partition) map[string][]Partition {
+	assignment := emptyAssignment(members)
+	ids := sortedMembers(members)
+	next := 0
+	for _, p := range partitions {
+		// skip over the members that don't consume the partition's topic
+		for i := 0; i < len(ids); i++ {
+			member := ids[(next+i)%len(ids)]
+			if subscribed(members[member], p.Topic) {
+				assignment[member] = append(assignment[member], p)
+				next = (next + i + 1) % len(ids)
+				break
+			}
+		}
+	}
+	return assignment
+}
+
+// StickyStrategy balances the partitions like RoundRobinStrategy but moves as few of them as it can:
+// members keep what they had before the rebalance, up to their fair share, and only the partitions of
+// members that left or had too many are handed out again, to whoever has the fewest
+type StickyStrategy struct{}
+
+func (StickyStrategy) Assign(members map[string][]string, partitions []Partition, previous map[string][]Partition) map[string][]Partition {
+	assignment := emptyAssignment(members)
+	fair := (len(partitions) + len(members) - 1) / len(members)
+
+	exists := make(map[Partition]bool, len(partitions))
+	for _, p := range partitions {
+		exists[p] = true
+	}
+	assigned := make(map[Partition]bool, len(partitions))
+	for _, member := range sortedMembers(members) {
+		for _, p := range previous[member] {
+			if len(assignment[member]) >= fair {
+				break
+			}
+			if exists[p] && !assigned[p] && subscribed(members[member], p.Topic) {
+				assignment[member] = append(assignment[member], p)
+				assigned[p] = true
+			}
+		}
+	}
+
+	for _, p := range partitions {
+		if assigned[p] {
+			continue
+		}
+		var least string
+		for _, member := range subscribersOf(members, p.Topic) {
+			if least == "" || len(assignment[member]) < len(assignment[least]) {
+				least = member
+			}
+		}
+		if least != "" {
+			assignment[least] = append(assignment[least], p)
+		}
+	}
+	for member := range assignment {
+		sortPartitions(assignment[member])
+	}
+	return assignment
+}
+
+func emptyAssignment(members map[string][]string) map[string][]Partition {
+	assignment := make(map[string][]Partition, len(members))
+	for member := range members {
+		assignment[member] = nil
+	}
+	return assignment
+}
+
+func sortedMembers(members map[string][]string) []string {
+	ids := make([]string, 0, len(members))
+	for member := range members {
+		ids = append(ids, member)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// subscribersOf returns the members consuming topic, sorted
+func subscribersOf(members map[string][]string, topic string) []string {
+	var subscribers []string
+	for _, member := range sortedMembers(members) {
+		if subscribed(members[member], topic) {
+			subscribers = append(subscribers, member)
+		}
+	}
+	return subscribers
+}
+
+func subscribed(topics []string, topic string) bool {
+	for _, t := range topics {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
+
+func sortPartitions(partitions []Partition) {
+	sort.Slice(partitions, func(i, j int) bool {
+		if partitions[i].Topic != partitions[j].Topic {
+			return partitions[i].Topic < partitions[j].Topic
+		}
+		return partitions[i].Partition < partitions[j].Partition
+	})
+}
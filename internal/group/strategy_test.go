@@ -0,0 +1,74 @@
+package group
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func partitionsOf(topic string, n uint32) []Partition {
+	var ps []Partition
+	for p := uint32(0); p < n; p++ {
+		ps = append(ps, Partition{Topic: topic, Partition: p})
+	}
+	return ps
+}
+
+func TestRangeStrategy(t *testing.T) {
+	members := map[string][]string{
+		"a": {"orders", "payments"},
+		"b": {"orders", "payments"},
+		"c": {"orders"},
+	}
+	partitions := append(partitionsOf("orders", 4), partitionsOf("payments", 3)...)
+	require.Equal(t, map[string][]Partition{
+		"a": {{"orders", 0}, {"orders", 1}, {"payments", 0}, {"payments", 1}},
+		"b": {{"orders", 2}, {"payments", 2}},
+		"c": {{"orders", 3}},
+	}, RangeStrategy{}.Assign(members, partitions, nil))
+}
+
+func TestRoundRobinStrategy(t *testing.T) {
+	members := map[string][]string{
+		"a": {"orders", "payments"},
+		"b": {"orders", "payments"},
+		"c": {"orders"},
+	}
+	partitions := append(partitionsOf("orders", 4), partitionsOf("payments", 3)...)
+	require.Equal(t, map[string][]Partition{
+		"a": {{"orders", 0}, {"orders", 3}, {"payments", 1}},
+		"b": {{"orders", 1}, {"payments", 0}, {"payments", 2}},
+		"c": {{"orders", 2}},
+	}, RoundRobinStrategy{}.Assign(members, partitions, nil))
+}
+
+func TestStickyStrategy(t *testing.T) {
+	partitions := partitionsOf("orders", 6)
+	previous := map[string][]Partition{
+		"a": {{"orders", 0}, {"orders", 3}},
+		"b": {{"orders", 1}, {"orders", 4}},
+		"c": {{"orders", 2}, {"orders", 5}},
+	}
+
+	// c left, only its partitions move
+	assignment := StickyStrategy{}.Assign(map[string][]string{
+		"a": {"orders"},
+		"b": {"orders"},
+	}, partitions, previous)
+	require.Equal(t, map[string][]Partition{
+		"a": {{"orders", 0}, {"orders", 2}, {"orders", 3}},
+		"b": {{"orders", 1}, {"orders", 4}, {"orders", 5}},
+	}, assignment)
+
+	// d joined, it takes one partition from each of the others
+	assignment = StickyStrategy{}.Assign(map[string][]string{
+		"a": {"orders"},
+		"b": {"orders"},
+		"d": {"orders"},
+	}, partitions, assignment)
+	require.Equal(t, map[string][]Partition{
+		"a": {{"orders", 0}, {"orders", 2}},
+		"b": {{"orders", 1}, {"orders", 4}},
+		"d": {{"orders", 3}, {"orders", 5}},
+	}, assignment)
+}
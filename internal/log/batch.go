@@ -0,0 +1,228 @@
+package log
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	api_v1 "github.com/schachte/kafkaclone/api/v1"
+	"github.com/schachte/kafkaclone/api/v1/logger"
+	"github.com/schachte/kafkaclone/pkg/compression"
+	"google.golang.org/protobuf/proto"
+)
+
+// A compressed batch is stored as a single frame holding all of its records (see compression.Batch).
+// Every record still gets its own index entry, they all point at the batch's frame
+
+// batchCache holds the records of the compressed batch that was read last, so reading a batch
+// record by record only decompresses it once
+type batchCache struct {
+	mu      sync.Mutex
+	pos     uint64
+	records []*logger.Record // nil when nothing is cached
+}
+
+func (c *batchCache) get(pos uint64) ([]*logger.Record, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.records, c.records != nil && c.pos == pos
+}
+
+func (c *batchCache) put(pos uint64, records []*logger.Record) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pos, c.records = pos, records
+}
+
+func (c *batchCache) clear() {
+	c.put(0, nil)
+}
+
+// SegmentStats describes how much space the records of a segment take up on disk compared to uncompressed
+type SegmentStats struct {
+	BaseOffset        uint64
+	NextOffset        uint64
+	StoredBytes       uint64
+	UncompressedBytes uint64
+}
+
+// Ratio is how many times bigger the records would be stored uncompressed
+func (s SegmentStats) Ratio() float64 {
+	if s.StoredBytes == 0 {
+		return 1
+	}
+	return float64(s.UncompressedBytes) / float64(s.StoredBytes)
+}
+
+// indexRoom is how many more records the segment's index can take
+func (s *segment) indexRoom() uint64 {
+	return (uint64(len(s.index.mmap)) - s.index.size) / entWidth
+}
+
+// appendBatch stores the records as a single frame compressed with codec. Either the index has room for
+// all of them or none are appended and io.EOF is returned
+func (s *segment) appendBatch(records []*logger.Record, codec logger.Compression) (uint64, error) {
+	if uint64(len(records)) > s.indexRoom() {
+		return 0, io.EOF
+	}
+	base := s.nextOffset
+	now := time.Now()
+	var uncompressed uint64
+	for i, record := range records {
+		record.Offset = base + uint64(i)
+		s.stamp(record, now)
+		uncompressed += headerWidth + uint64(proto.Size(record))
+	}
+	batch, err := compression.Batch(codec, records)
+	if err != nil {
+		return 0, err
+	}
+	p, err := proto.Marshal(batch)
+	if err != nil {
+		return 0, err
+	}
+
+	n, pos, err := s.store.Append(p)
+	if err != nil {
+		return 0, err
+	}
+	for _, record := range records {
+		if err = s.index.Write(uint32(record.Offset-s.baseOffset), pos); err != nil {
+			return 0, err
+		}
+	}
+	s.nextOffset = base + uint64(len(records))
+	s.modTime = now
+	s.uncompressedBytes += uncompressed
+	return base, s.indexTimes(records, n)
+}
+
+// indexTimes tracks the timestamps of the records of a frame that took n bytes. The bytes are counted
+// towards its last record, since the time index can only point a search at the start of a frame
+func (s *segment) indexTimes(records []*logger.Record, n uint64) error {
+	for i, record := range records {
+		var size uint64
+		if i == len(records)-1 {
+			size = n
+		}
+		if err := s.indexTime(record, size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unbatch returns the records of the compressed batch stored at pos
+func (s *segment) unbatch(pos uint64, batch *logger.Record) ([]*logger.Record, error) {
+	if records, ok := s.batches.get(pos); ok {
+		return records, nil
+	}
+	records, err := compression.Unbatch(batch)
+	if err != nil {
+		return nil, err
+	}
+	s.batches.put(pos, records)
+	return records, nil
+}
+
+// readBatch returns the frame holding off, or the next record after it, as it's stored: the whole
+// compressed batch when it's part of one. It also returns the offset after the frame and
+// how many of its records are at or after off
+func (s *segment) readBatch(off uint64) (*logger.Record, uint64, uint32, error) {
+	entry := s.index.search(uint32(off - s.baseOffset))
+	last, pos, err := s.index.Read(entry)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	count := uint32(1)
+	for next := entry + 1; uint64(next)*entWidth < s.index.size; next++ {
+		rel, p, err := s.index.Read(next)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		if p != pos {
+			break
+		}
+		last = rel
+		count++
+	}
+
+	p, err := s.store.Read(pos)
+	if err == errCorruptFrame {
+		return nil, 0, 0, api_v1.ErrCorruptRecord{Offset: off, Segment: s.baseOffset}
+	}
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	record := &logger.Record{}
+	if err = proto.Unmarshal(p, record); err != nil {
+		return nil, 0, 0, api_v1.ErrCorruptRecord{Offset: off, Segment: s.baseOffset}
+	}
+	return record, s.baseOffset + uint64(last) + 1, count, nil
+}
+
+// scanBatches calls fn with every frame in the segment, in offset order: the record it's stored as,
+// the records it holds and its raw payload
+func (s *segment) scanBatches(fn func(frame *logger.Record, records []*logger.Record, p []byte) error) error {
+	var prev uint64
+	for entry := int64(0); uint64(entry)*entWidth < s.index.size; entry++ {
+		_, pos, err := s.index.Read(entry)
+		if err != nil {
+			return err
+		}
+		// The records of a batch all point at the same frame
+		if entry > 0 && pos == prev {
+			continue
+		}
+		prev = pos
+		p, err := s.store.Read(pos)
+		if err != nil {
+			return err
+		}
+		frame := &logger.Record{}
+		if err = proto.Unmarshal(p, frame); err != nil {
+			return err
+		}
+		records, err := compression.Unbatch(frame)
+		if err != nil {
+			return err
+		}
+		if err = fn(frame, records, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scan calls fn with every record in the segment, in offset order
+func (s *segment) scan(fn func(record *logger.Record) error) error {
+	return s.scanBatches(func(_ *logger.Record, records []*logger.Record, _ []byte) error {
+		for _, record := range records {
+			if err := fn(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// stats returns how much space the segment's records take up. How big they'd be uncompressed is
+// only worked out the first time it's asked for, appends keep it up to date from then on
+func (s *segment) stats() (SegmentStats, error) {
+	if !s.statsKnown {
+		s.uncompressedBytes = 0
+		if err := s.scan(func(record *logger.Record) error {
+			s.uncompressedBytes += headerWidth + uint64(proto.Size(record))
+			return nil
+		}); err != nil {
+			return SegmentStats{}, err
+		}
+		s.statsKnown = true
+	}
+	return SegmentStats{
+		BaseOffset:        s.baseOffset,
+		NextOffset:        s.nextOffset,
+		StoredBytes:       s.store.size,
+		UncompressedBytes: s.uncompressedBytes,
+	}, nil
+}
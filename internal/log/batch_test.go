@@ -0,0 +1,189 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api_v1 "github.com/schachte/kafkaclone/api/v1"
+	"github.com/schachte/kafkaclone/api/v1/logger"
+	"github.com/schachte/kafkaclone/pkg/compression"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressedBatch(t *testing.T) {
+	for codec := range logger.Compression_name {
+		codec := logger.Compression(codec)
+		if codec == logger.Compression_NONE {
+			continue
+		}
+		t.Run(codec.String(), func(t *testing.T) {
+			for scenario, fn := range map[string]func(t *testing.T, log *Log, codec logger.Compression){
+				"read and reopen":    testBatchRead,
+				"read compressed":    testReadBatches,
+				"truncate mid batch": testBatchTruncate,
+				"compact":            testBatchCompact,
+				"stats":              testBatchStats,
+			} {
+				t.Run(scenario, func(t *testing.T) {
+					dir, err := ioutil.TempDir("", "batch-test")
+					require.NoError(t, err)
+					defer os.RemoveAll(dir)
+					c := Config{}
+					c.Segment.MaxIndexBytes = entWidth * 4
+					log, err := NewLog(dir, c)
+					require.NoError(t, err)
+					fn(t, log, codec)
+				})
+			}
+		})
+	}
+}
+
+func batchOf(n int) []*logger.Record {
+	var records []*logger.Record
+	for i := 0; i < n; i++ {
+		records = append(records, &logger.Record{
+			Value: bytes.Repeat([]byte(fmt.Sprintf(`{"record":%d}`, i)), 20),
+			Key:   []byte(fmt.Sprintf("key-%d", i%3)),
+		})
+	}
+	return records
+}
+
+func requireRecords(t *testing.T, log *Log, from, to int) {
+	t.Helper()
+	records, err := log.ReadRange(uint64(from), 0, 0)
+	require.NoError(t, err)
+	require.Len(t, records, to-from)
+	want := batchOf(to)
+	for i, record := range records {
+		require.Equal(t, uint64(from+i), record.Offset)
+		require.Equal(t, want[from+i].Value, record.Value)
+	}
+}
+
+func testBatchRead(t *testing.T, log *Log, codec logger.Compression) {
+	base, err := log.AppendBatch(batchOf(10), codec)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), base)
+	// Each segment's index only has room for 4 records, so the batch is split
+	require.Len(t, log.segments, 3)
+	requireRecords(t, log, 0, 10)
+	record, err := log.Read(5)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), record.Offset)
+
+	// Reopen once trusting the indexes, then once rebuilding them from the stores
+	require.NoError(t, log.Close())
+	log, err = NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	requireRecords(t, log, 0, 10)
+	require.NoError(t, log.Close())
+	c := log.Config
+	c.Segment.RecoverAll = true
+	log, err = NewLog(log.Dir, c)
+	require.NoError(t, err)
+	requireRecords(t, log, 0, 10)
+
+	_, err = log.Append(&logger.Record{Value: batchOf(11)[10].Value})
+	require.NoError(t, err)
+	requireRecords(t, log, 0, 11)
+	require.NoError(t, log.Close())
+}
+
+func testReadBatches(t *testing.T, log *Log, codec logger.Compression) {
+	defer log.Close()
+	_, err := log.AppendBatch(batchOf(6), codec)
+	require.NoError(t, err)
+
+	// Reading from the middle of the first batch still gets the whole of it
+	batches, err := log.ReadBatches(1, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, batches, 2)
+	var records []*logger.Record
+	for _, batch := range batches {
+		require.Equal(t, codec, batch.Compression)
+		unbatched, err := compression.Unbatch(batch)
+		require.NoError(t, err)
+		records = append(records, unbatched...)
+	}
+	require.Len(t, records, 6)
+	for i, record := range records {
+		require.Equal(t, uint64(i), record.Offset)
+	}
+
+	// Three records are left in the first batch, so a limit of three stops after it
+	batches, err = log.ReadBatches(1, 3, 0)
+	require.NoError(t, err)
+	require.Len(t, batches, 1)
+
+	_, err = log.ReadBatches(6, 0, 0)
+	require.Equal(t, api_v1.ErrOffsetOutOfRange{Offset: 6}, err)
+}
+
+func testBatchTruncate(t *testing.T, log *Log, codec logger.Compression) {
+	defer log.Close()
+	_, err := log.AppendBatch(batchOf(4), codec)
+	require.NoError(t, err)
+
+	require.NoError(t, log.TruncateFrom(2))
+	requireRecords(t, log, 0, 2)
+	_, err = log.Read(2)
+	require.Equal(t, api_v1.ErrOffsetOutOfRange{Offset: 2}, err)
+
+	// What's left of the batch survives recovery too
+	require.NoError(t, log.activeSegment.recover())
+	requireRecords(t, log, 0, 2)
+	base, err := log.AppendBatch(batchOf(4)[2:], codec)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), base)
+	requireRecords(t, log, 0, 4)
+}
+
+func testBatchCompact(t *testing.T, log *Log, codec logger.Compression) {
+	defer log.Close()
+	// Keys repeat every three records, so only the last three survive compaction
+	_, err := log.AppendBatch(batchOf(8), codec)
+	require.NoError(t, err)
+	require.NoError(t, log.Compact())
+
+	records, err := log.ReadRange(0, 0, 0)
+	require.NoError(t, err)
+	var offsets []uint64
+	for _, record := range records {
+		offsets = append(offsets, record.Offset)
+	}
+	require.Equal(t, []uint64{5, 6, 7}, offsets)
+	// The records left in the first segment are still stored compressed
+	batches, err := log.ReadBatches(5, 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, codec, batches[0].Compression)
+}
+
+func testBatchStats(t *testing.T, log *Log, codec logger.Compression) {
+	defer log.Close()
+	_, err := log.AppendBatch(batchOf(4), codec)
+	require.NoError(t, err)
+	_, err = log.Append(&logger.Record{Value: []byte("uncompressed")})
+	require.NoError(t, err)
+
+	stats, err := log.SegmentStats()
+	require.NoError(t, err)
+	require.Len(t, stats, 2)
+	require.Equal(t, uint64(0), stats[0].BaseOffset)
+	require.Equal(t, uint64(4), stats[0].NextOffset)
+	require.Greater(t, stats[0].Ratio(), 1.0)
+	require.Equal(t, stats[1].StoredBytes, stats[1].UncompressedBytes)
+
+	// Recomputed from scratch after reopening, the same numbers come out
+	require.NoError(t, log.Close())
+	reopened, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer reopened.Close()
+	again, err := reopened.SegmentStats()
+	require.NoError(t, err)
+	require.Equal(t, stats, again)
+}
@@ -0,0 +1,237 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/schachte/kafkaclone/api/v1/logger"
+	"github.com/schachte/kafkaclone/pkg/compression"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+// compactExt marks the files a segment is rewritten into before they're swapped in place of the originals
+const compactExt = ".compacting"
+
+// isTombstone reports whether a record deletes its key
+func isTombstone(record *logger.Record) bool {
+	return len(record.Key) > 0 && len(record.Value) == 0
+}
+
+// Compact rewrites every closed segment so only the latest record for each key survives.
+// Records without a key are always kept and original offsets are preserved, leaving gaps behind.
+// Tombstones are dropped once their segment is older than Config.Compaction.TombstoneRetention.
+// Appends and reads carry on while the segments are rewritten, the lock is only taken to swap them in
+func (l *Log) Compact() error {
+	l.compacting.Lock()
+	defer l.compacting.Unlock()
+
+	// Closed segments aren't written to and nothing else can remove them while compacting is held,
+	// only the active segment has to be read under the lock
+	l.mu.RLock()
+	closed := append([]*segment(nil), l.segments[:len(l.segments)-1]...)
+	// The latest offset of every key across the whole log, including the active segment
+	latest := make(map[string]uint64)
+	err := l.activeSegment.scan(func(record *logger.Record) error {
+		if len(record.Key) > 0 {
+			latest[string(record.Key)] = record.Offset
+		}
+		return nil
+	})
+	l.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	for _, s := range closed {
+		if err := s.scan(func(record *logger.Record) error {
+			if len(record.Key) > 0 && record.Offset > latest[string(record.Key)] {
+				latest[string(record.Key)] = record.Offset
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	for i, s := range closed {
+		dropTombstones := l.Config.Compaction.TombstoneRetention > 0 &&
+			now.Sub(s.modTime) > l.Config.Compaction.TombstoneRetention
+		keep := func(record *logger.Record) bool {
+			if len(record.Key) == 0 {
+				return true
+			}
+			// Keys appended since the scan only mean fewer records are removed this time round
+			if latest[string(record.Key)] != record.Offset {
+				return false
+			}
+			return !(dropTombstones && isTombstone(record))
+		}
+
+		removed, err := l.compactSegment(s, keep)
+		if err != nil {
+			return err
+		}
+		if removed == 0 {
+			continue
+		}
+		l.mu.Lock()
+		compacted, err := l.swapCompacted(s)
+		if err == nil {
+			l.segments[i] = compacted
+		}
+		l.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		l.logger.Info(
+			"compacted segment",
+			zap.Uint64("base_offset", s.baseOffset),
+			zap.Int("records_removed", removed),
+		)
+	}
+	return nil
+}
+
+// compactSegment copies the records of s that keep accepts into temporary files next to the segment's,
+// for swapCompacted to put in its place. It returns how many records were left out, nothing is
+// written if that's none of them
+func (l *Log) compactSegment(s *segment, keep func(*logger.Record) bool) (int, error) {
+	removed := 0
+	if err := s.scan(func(record *logger.Record) error {
+		if !keep(record) {
+			removed++
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+
+	storePath, indexPath, timeIndexPath := l.segmentPaths(s)
+	storeFile, err := os.OpenFile(storePath+compactExt, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	st, err := newStore(storeFile)
+	if err != nil {
+		return 0, err
+	}
+	indexFile, err := os.OpenFile(indexPath+compactExt, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+	idx, err := newIndex(indexFile, s.config)
+	if err != nil {
+		return 0, err
+	}
+	timeIndexFile, err := os.OpenFile(timeIndexPath+compactExt, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+	// Only the time index tracking of a segment is needed to rebuild it from the surviving records
+	times := &segment{baseOffset: s.baseOffset, config: s.config, timeIndex: &timeIndex{file: timeIndexFile}}
+
+	if err = s.scanBatches(func(frame *logger.Record, records []*logger.Record, p []byte) error {
+		var kept []*logger.Record
+		for _, record := range records {
+			if keep(record) {
+				kept = append(kept, record)
+			}
+		}
+		if len(kept) == 0 {
+			return nil
+		}
+		// What's left of a compressed batch is compressed again with the same codec
+		if len(kept) < len(records) {
+			batch, err := compression.Batch(frame.Compression, kept)
+			if err != nil {
+				return err
+			}
+			if p, err = proto.Marshal(batch); err != nil {
+				return err
+			}
+		}
+		n, pos, err := st.Append(p)
+		if err != nil {
+			return err
+		}
+		for _, record := range kept {
+			if err = idx.Write(uint32(record.Offset-s.baseOffset), pos); err != nil {
+				return err
+			}
+		}
+		return times.indexTimes(kept, n)
+	}); err != nil {
+		return 0, err
+	}
+	if err = st.Sync(); err != nil {
+		return 0, err
+	}
+	if err = idx.Close(); err != nil {
+		return 0, err
+	}
+	if err = times.sealTimeIndex(); err != nil {
+		return 0, err
+	}
+	if err = times.timeIndex.Close(); err != nil {
+		return 0, err
+	}
+	if err = st.Close(); err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// swapCompacted renames the files written by compactSegment over the segment's own and opens them.
+// Renaming the store is the commit point: a crash before it leaves the original segment untouched,
+// and a crash between the renames is repaired by rebuilding the index on startup. The caller must hold the lock
+func (l *Log) swapCompacted(s *segment) (*segment, error) {
+	storePath, indexPath, timeIndexPath := l.segmentPaths(s)
+	if err := os.Rename(timeIndexPath+compactExt, timeIndexPath); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(indexPath+compactExt, indexPath); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(storePath+compactExt, storePath); err != nil {
+		return nil, err
+	}
+	// The renames themselves only survive a crash once the directory is on disk
+	if err := syncDir(l.Dir); err != nil {
+		return nil, err
+	}
+
+	compacted, err := newSegment(l.Dir, s.baseOffset, s.config)
+	if err != nil {
+		return nil, err
+	}
+	compacted.modTime = s.modTime
+	// Readers may still be walking the old files, which stay valid until they're closed
+	s.closeWhenIdle()
+	return compacted, nil
+}
+
+// segmentPaths returns the paths of the store, index and time index files of s
+func (l *Log) segmentPaths(s *segment) (string, string, string) {
+	return path.Join(l.Dir, fmt.Sprintf("%d%s", s.baseOffset, storeExt)),
+		path.Join(l.Dir, fmt.Sprintf("%d%s", s.baseOffset, indexExt)),
+		path.Join(l.Dir, fmt.Sprintf("%d%s", s.baseOffset, timeIndexExt))
+}
+
+// syncDir fsyncs a directory, so the files created or renamed in it are durable
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,138 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/schachte/kafkaclone/api/v1/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compact-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 40
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	records := []*logger.Record{
+		{Key: []byte("a"), Value: []byte("a1")}, // 0: superseded by 3
+		{Key: []byte("b"), Value: []byte("b1")}, // 1: deleted by 5
+		{Value: []byte("no key")},               // 2: always kept
+		{Key: []byte("a"), Value: []byte("a2")}, // 3
+		{Key: []byte("c"), Value: []byte("c1")}, // 4
+		{Key: []byte("b")},                      // 5: tombstone
+		{Key: []byte("c"), Value: []byte("c2")}, // 6: superseded by 7 in the active segment
+		{Key: []byte("c"), Value: []byte("c3")}, // 7
+	}
+	for _, record := range records {
+		_, err := log.Append(record)
+		require.NoError(t, err)
+	}
+	require.True(t, len(log.segments) > 2)
+
+	reader := log.Reader()
+	require.NoError(t, log.Compact())
+
+	want := map[uint64]uint64{
+		0: 2,
+		1: 2,
+		2: 2,
+		3: 3,
+		4: 5,
+		5: 5,
+		6: 7,
+		7: 7,
+	}
+	for off, next := range want {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, next, read.Offset)
+	}
+	read, err := log.Read(5)
+	require.NoError(t, err)
+	require.True(t, isTombstone(read))
+
+	// Snapshots taken before compaction still see the original records
+	b, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.NotEmpty(t, b)
+
+	// Compaction survives a restart, and a half finished one is thrown away
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "0"+storeExt+compactExt), []byte("garbage"), 0644))
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for off, next := range want {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, next, read.Offset)
+	}
+	_, err = os.Stat(path.Join(dir, "0"+storeExt+compactExt))
+	require.True(t, os.IsNotExist(err))
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), highest)
+}
+
+func TestCompactWhileAppending(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compact-append-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// Appends and reads carry on while the closed segments are rewritten
+	keys := []string{"a", "b", "c"}
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 300; i++ {
+			key := keys[i%len(keys)]
+			if _, err := log.Append(&logger.Record{Key: []byte(key), Value: []byte{byte(i)}}); err != nil {
+				done <- err
+				return
+			}
+			if _, err := log.Read(uint64(i)); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for compacting := true; compacting; {
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+			compacting = false
+		default:
+			require.NoError(t, log.Compact())
+		}
+	}
+	require.NoError(t, log.Compact())
+
+	// Only the latest record of every key is left in the closed segments
+	for _, s := range log.segments[:len(log.segments)-1] {
+		require.NoError(t, s.scan(func(record *logger.Record) error {
+			if record.Offset < 297 {
+				return fmt.Errorf("record %d survived compaction", record.Offset)
+			}
+			return nil
+		}))
+	}
+	for i := 297; i < 300; i++ {
+		read, err := log.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, []byte{byte(i)}, read.Value)
+	}
+}
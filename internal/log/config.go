@@ -1,9 +1,55 @@
 package log
 
+import (
+	"time"
+
+	"github.com/schachte/kafkaclone/api/v1/logger"
+)
+
+// defaultTimeIndexIntervalBytes is Config.Segment.TimeIndexIntervalBytes when it isn't set
+const defaultTimeIndexIntervalBytes = 4096
+
 type Config struct {
 	Segment struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		// RecoverAll scans and verifies every segment on startup instead of only the active
+		// one and any segment whose index doesn't line up with its store
+		RecoverAll bool
+		// TimeIndexIntervalBytes is roughly how many bytes of records go between two time index entries,
+		// defaults to 4KB. Seeking by time scans at most this much past the entry it starts from
+		TimeIndexIntervalBytes uint64
+	}
+	// Timestamp decides where the timestamps of records come from
+	Timestamp struct {
+		// LogAppendTime stamps every record with the time it's appended, overwriting the producer's timestamp.
+		// Otherwise the producer's timestamp is kept and only records without one are stamped
+		LogAppendTime bool
+	}
+	// Compression decides how batches are stored
+	Compression struct {
+		// Codec compresses batches whose producer didn't pick a codec, see Log.AppendBatch
+		Codec logger.Compression
+	}
+	// Retention decides when whole segments are old or large enough to be deleted by the cleaner.
+	// A zero value disables that particular policy
+	Retention struct {
+		MaxBytes      uint64        // total bytes across all segments
+		MaxAge        time.Duration // age of the newest record in a segment, by timestamp or else when the segment was last written to
+		MaxSegments   int           // number of segments, including the active one
+		CheckInterval time.Duration // how often the cleaner runs, defaults to a minute
+	}
+	// Sync decides when appended records are fsynced to disk, see SyncPolicy
+	Sync struct {
+		Policy   SyncPolicy
+		Records  uint64        // appends between fsyncs for SyncEveryRecords, defaults to 1000
+		Interval time.Duration // time between fsyncs for SyncInterval, defaults to a second
+	}
+	// Compaction keeps only the latest record for each key in closed segments. A record with a key
+	// and an empty value is a tombstone, deleting that key
+	Compaction struct {
+		Enabled            bool
+		TombstoneRetention time.Duration // how long tombstones survive compaction, forever when zero
 	}
 }
@@ -3,6 +3,7 @@ package log
 import (
 	"io"
 	"os"
+	"sort"
 
 	"github.com/tysonmote/gommap"
 )
@@ -94,6 +95,28 @@ func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
 	return out, pos, nil
 }
 
+// Seek returns the first entry whose relative offset is greater than or equal to off
+func (i *index) Seek(off uint32) (out uint32, pos uint64, err error) {
+	entry := i.search(off)
+	if uint64(entry)*entWidth >= i.size {
+		return 0, 0, io.EOF
+	}
+	return i.Read(entry)
+}
+
+// search returns the number of the first entry whose relative offset is greater than or equal to off,
+// or the number of entries if there is none. Offsets are only contiguous until a segment is compacted,
+// so it falls back to a binary search over the entries
+func (i *index) search(off uint32) int64 {
+	if out, _, err := i.Read(int64(off)); err == nil && out == off {
+		return int64(off)
+	}
+	n := int(i.size / entWidth)
+	return int64(sort.Search(n, func(e int) bool {
+		return enc.Uint32(i.mmap[uint64(e)*entWidth:uint64(e)*entWidth+offWidth]) >= off
+	}))
+}
+
 // Write will append a new offset and position value to the index file
 func (i *index) Write(off uint32, pos uint64) error {
 	// Ensure that the mmap doesn't exceed the size of the file after we add a new value to it
@@ -0,0 +1,299 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/schachte/kafkaclone/api/v1/logger"
+	"github.com/schachte/kafkaclone/pkg/compression"
+	"google.golang.org/protobuf/proto"
+)
+
+// The functions in this file work on the files of a log that isn't open, they're meant for tools that
+// look inside a data directory while its server is stopped
+
+// IndexEntry is an entry of a segment's index: the offset of a record and where its frame starts in the store
+type IndexEntry struct {
+	Offset   uint64
+	Position uint64
+}
+
+// Frame is a frame of a segment's store with the records it holds, more than one for a compressed batch
+type Frame struct {
+	Position uint64
+	Size     uint64 // header included
+	Records  []*logger.Record
+	// Err is why the frame couldn't be read or decoded. A frame that can't be read ends the dump, as
+	// there's no telling where the next one starts
+	Err error
+}
+
+// SegmentDump is what the files of a segment hold
+type SegmentDump struct {
+	BaseOffset uint64
+	StoreSize  uint64
+	Index      []IndexEntry
+	// IndexTrailing is the number of bytes at the end of the index that don't make up a whole entry
+	IndexTrailing uint64
+	Frames        []Frame
+}
+
+// Segments returns the base offsets of the segments in dir, lowest first
+func Segments(dir string) ([]uint64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var baseOffsets []uint64
+	for _, file := range files {
+		if path.Ext(file.Name()) != storeExt {
+			continue
+		}
+		off, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), storeExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		baseOffsets = append(baseOffsets, off)
+	}
+	sort.Slice(baseOffsets, func(i, j int) bool { return baseOffsets[i] < baseOffsets[j] })
+	return baseOffsets, nil
+}
+
+// DumpSegment reads the index and the store of a segment without changing either of them
+func DumpSegment(dir string, baseOffset uint64) (*SegmentDump, error) {
+	f, err := os.Open(path.Join(dir, fmt.Sprintf("%d%s", baseOffset, storeExt)))
+	if err != nil {
+		return nil, err
+	}
+	s, err := newStore(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	defer s.Close()
+
+	dump := &SegmentDump{BaseOffset: baseOffset, StoreSize: s.size}
+	// A missing index is dumped as an empty one, it can be rebuilt from the store
+	b, err := ioutil.ReadFile(path.Join(dir, fmt.Sprintf("%d%s", baseOffset, indexExt)))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	n := uint64(len(b)) / entWidth
+	dump.IndexTrailing = uint64(len(b)) % entWidth
+	for i := uint64(0); i < n; i++ {
+		entry := b[i*entWidth : (i+1)*entWidth]
+		dump.Index = append(dump.Index, IndexEntry{
+			Offset:   baseOffset + uint64(enc.Uint32(entry[:offWidth])),
+			Position: enc.Uint64(entry[offWidth:]),
+		})
+	}
+
+	var pos uint64
+	for {
+		p, n, err := s.readFrame(pos)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			dump.Frames = append(dump.Frames, Frame{Position: pos, Size: s.size - pos, Err: err})
+			break
+		}
+		frame := Frame{Position: pos, Size: n}
+		record := &logger.Record{}
+		if err := proto.Unmarshal(p, record); err != nil {
+			frame.Err = err
+		} else if frame.Records, err = compression.Unbatch(record); err != nil {
+			frame.Err = err
+		}
+		dump.Frames = append(dump.Frames, frame)
+		pos += n
+	}
+	return dump, nil
+}
+
+// SegmentReport lists the problems VerifySegment found with a segment, none when it's sound
+type SegmentReport struct {
+	BaseOffset uint64
+	Entries    int
+	Records    int
+	// NextOffset is the offset following the segment's last record, where the next segment should start
+	NextOffset uint64
+	Problems   []string
+}
+
+// VerifySegment checks that every index entry of a segment points at a valid frame holding the entry's
+// record, and that the offsets of the records are contiguous. Compaction leaves gaps between offsets,
+// allowGaps accepts them
+func VerifySegment(dir string, baseOffset uint64, allowGaps bool) (*SegmentReport, error) {
+	dump, err := DumpSegment(dir, baseOffset)
+	if err != nil {
+		return nil, err
+	}
+	report := &SegmentReport{BaseOffset: baseOffset, NextOffset: baseOffset}
+	problem := func(format string, a ...interface{}) {
+		report.Problems = append(report.Problems, fmt.Sprintf(format, a...))
+	}
+
+	if dump.IndexTrailing != 0 {
+		problem("index ends with %d bytes that aren't a whole entry", dump.IndexTrailing)
+	}
+	// An unclean shutdown leaves the index grown to its maximum size, with zeroed entries at its end
+	entries := dump.Index
+	zeroed := 0
+	for len(entries) > 1 && entries[len(entries)-1] == (IndexEntry{Offset: baseOffset}) {
+		entries = entries[:len(entries)-1]
+		zeroed++
+	}
+	if zeroed > 0 {
+		problem("index ends with %d zeroed entries", zeroed)
+	}
+	report.Entries = len(entries)
+
+	frames := make(map[uint64]Frame, len(dump.Frames))
+	stored := make(map[uint64]bool)
+	next := baseOffset
+	for _, frame := range dump.Frames {
+		frames[frame.Position] = frame
+		if frame.Err != nil {
+			problem("frame at position %d is corrupt (%v), %d bytes from there on are unreadable", frame.Position, frame.Err, frame.Size)
+			continue
+		}
+		for _, record := range frame.Records {
+			report.Records++
+			stored[record.Offset] = true
+			if record.Offset < next {
+				problem("record at offset %d in the frame at position %d follows offset %d", record.Offset, frame.Position, next-1)
+			} else if record.Offset > next && !allowGaps {
+				problem("offsets %d to %d are missing from the store", next, record.Offset-1)
+			}
+			next = record.Offset + 1
+		}
+	}
+	report.NextOffset = next
+
+	indexed := make(map[uint64]bool, len(entries))
+	next = baseOffset
+	for i, entry := range entries {
+		indexed[entry.Offset] = true
+		if entry.Offset < next {
+			problem("index entry %d for offset %d follows offset %d", i, entry.Offset, next-1)
+		} else if entry.Offset > next && !allowGaps {
+			problem("index skips offsets %d to %d", next, entry.Offset-1)
+		}
+		next = entry.Offset + 1
+
+		frame, ok := frames[entry.Position]
+		switch {
+		case !ok:
+			problem("index entry %d for offset %d points at position %d, which isn't the start of a frame", i, entry.Offset, entry.Position)
+		case frame.Err != nil:
+			problem("index entry %d for offset %d points at the corrupt frame at position %d", i, entry.Offset, entry.Position)
+		case !holds(frame, entry.Offset):
+			problem("index entry %d for offset %d points at the frame at position %d, which doesn't hold it", i, entry.Offset, entry.Position)
+		}
+	}
+	var unindexed []uint64
+	for off := range stored {
+		if !indexed[off] {
+			unindexed = append(unindexed, off)
+		}
+	}
+	sort.Slice(unindexed, func(i, j int) bool { return unindexed[i] < unindexed[j] })
+	for _, off := range unindexed {
+		problem("record at offset %d isn't indexed", off)
+	}
+	return report, nil
+}
+
+// Verify runs VerifySegment on every segment in dir, also checking that each segment starts right
+// after the records of the one before it
+func Verify(dir string, allowGaps bool) ([]*SegmentReport, error) {
+	baseOffsets, err := Segments(dir)
+	if err != nil {
+		return nil, err
+	}
+	var reports []*SegmentReport
+	for i, baseOffset := range baseOffsets {
+		report, err := VerifySegment(dir, baseOffset, allowGaps)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			prev := reports[i-1].NextOffset
+			if baseOffset < prev || baseOffset > prev && !allowGaps {
+				report.Problems = append(report.Problems, fmt.Sprintf("segment starts at offset %d, the previous one ends before offset %d", baseOffset, prev))
+			}
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// holds reports whether the frame holds the record at offset off
+func holds(frame Frame, off uint64) bool {
+	for _, record := range frame.Records {
+		if record.Offset == off {
+			return true
+		}
+	}
+	return false
+}
+
+// RepairReport is what RepairSegment did to a segment
+type RepairReport struct {
+	BaseOffset uint64
+	Entries    int // entries written to the rebuilt index
+	// Unreadable is the bytes of the store from its first torn or corrupt frame on, which the index
+	// stops short of
+	Unreadable uint64
+	Truncated  uint64 // bytes cut off the store, all of the unreadable ones when truncating
+}
+
+// RepairSegment rebuilds the index and the time index of a segment from the frames of its store up to
+// the first torn or corrupt one, leaving the store itself alone: there's no telling where the frame after
+// a corrupt one starts, so everything from there on is reported as unreadable. With truncate set those
+// bytes are cut off the store and their records lost, the way a log drops a crash's torn tail. Without,
+// a log opening the segment still finds them and recovers it as usual. c is the configuration of the
+// segment's log, which the time index is rebuilt with. The index is sized to fit the segment's records
+// whatever c says
+func RepairSegment(dir string, baseOffset uint64, c Config, truncate bool) (*RepairReport, error) {
+	dump, err := DumpSegment(dir, baseOffset)
+	if err != nil {
+		return nil, err
+	}
+	// The index has to fit both its current entries, which are read when it's opened, and the rebuilt ones
+	records := 0
+	for _, frame := range dump.Frames {
+		records += len(frame.Records)
+	}
+	c.Segment.MaxIndexBytes = uint64(len(dump.Index)+1)*entWidth + dump.IndexTrailing
+	if need := uint64(records+1) * entWidth; need > c.Segment.MaxIndexBytes {
+		c.Segment.MaxIndexBytes = need
+	}
+	if c.Segment.TimeIndexIntervalBytes == 0 {
+		c.Segment.TimeIndexIntervalBytes = defaultTimeIndexIntervalBytes
+	}
+
+	s, err := newSegment(dir, baseOffset, c)
+	if err != nil {
+		return nil, err
+	}
+	unreadable, err := s.repair(truncate)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	report := &RepairReport{
+		BaseOffset: baseOffset,
+		Entries:    int(s.index.size / entWidth),
+		Unreadable: unreadable,
+		Truncated:  dump.StoreSize - s.store.size,
+	}
+	return report, s.Close()
+}
@@ -0,0 +1,109 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/schachte/kafkaclone/api/v1/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inspect-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.TimeIndexIntervalBytes = 1
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&logger.Record{Value: []byte(fmt.Sprintf("record %d", i)), Timestamp: int64(i + 1)})
+		require.NoError(t, err)
+	}
+	// A compressed batch is a single frame holding all of its records
+	_, err = log.AppendBatch([]*logger.Record{
+		{Value: []byte("batched 3")},
+		{Value: []byte("batched 4")},
+	}, logger.Compression_GZIP)
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	segments, err := Segments(dir)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0}, segments)
+
+	dump, err := DumpSegment(dir, 0)
+	require.NoError(t, err)
+	require.Len(t, dump.Index, 5)
+	require.Len(t, dump.Frames, 4)
+	require.Equal(t, dump.Frames[3].Position, dump.Index[3].Position)
+	require.Equal(t, dump.Frames[3].Position, dump.Index[4].Position)
+	require.Equal(t, []byte("batched 4"), dump.Frames[3].Records[1].Value)
+	require.Equal(t, dump.StoreSize, dump.Frames[3].Position+dump.Frames[3].Size)
+
+	report, err := VerifySegment(dir, 0, false)
+	require.NoError(t, err)
+	require.Empty(t, report.Problems)
+	require.Equal(t, 5, report.Entries)
+	require.Equal(t, 5, report.Records)
+	require.Equal(t, uint64(5), report.NextOffset)
+
+	// Point the second entry into the middle of a frame and leave the index grown, as after a crash
+	indexFile := path.Join(dir, "0"+indexExt)
+	b, err := ioutil.ReadFile(indexFile)
+	require.NoError(t, err)
+	enc.PutUint64(b[entWidth+offWidth:], 3)
+	b = append(b, make([]byte, 4*entWidth)...)
+	require.NoError(t, ioutil.WriteFile(indexFile, b, 0644))
+	// and tear the last frame of the store
+	storeFile := path.Join(dir, "0"+storeExt)
+	require.NoError(t, os.Truncate(storeFile, int64(dump.StoreSize-2)))
+
+	report, err = VerifySegment(dir, 0, false)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"index ends with 4 zeroed entries",
+		fmt.Sprintf("frame at position %d is corrupt (corrupt record frame), %d bytes from there on are unreadable", dump.Frames[3].Position, dump.Frames[3].Size-2),
+		"index entry 1 for offset 1 points at position 3, which isn't the start of a frame",
+		fmt.Sprintf("index entry 3 for offset 3 points at the corrupt frame at position %d", dump.Frames[3].Position),
+		fmt.Sprintf("index entry 4 for offset 4 points at the corrupt frame at position %d", dump.Frames[3].Position),
+	}, report.Problems)
+
+	// The index is rebuilt up to the torn frame, which is only cut off the store when asked to
+	repair, err := RepairSegment(dir, 0, c, false)
+	require.NoError(t, err)
+	torn := dump.Frames[3].Size - 2
+	require.Equal(t, &RepairReport{BaseOffset: 0, Entries: 3, Unreadable: torn}, repair)
+	report, err = VerifySegment(dir, 0, false)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		fmt.Sprintf("frame at position %d is corrupt (corrupt record frame), %d bytes from there on are unreadable", dump.Frames[3].Position, torn),
+	}, report.Problems)
+
+	repair, err = RepairSegment(dir, 0, c, true)
+	require.NoError(t, err)
+	require.Equal(t, &RepairReport{BaseOffset: 0, Entries: 3, Unreadable: torn, Truncated: torn}, repair)
+	// The time index is rebuilt at the log's interval, an entry for every surviving record here
+	info, err := os.Stat(path.Join(dir, "0"+timeIndexExt))
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), uint64(info.Size())/timeEntWidth)
+
+	report, err = VerifySegment(dir, 0, false)
+	require.NoError(t, err)
+	require.Empty(t, report.Problems)
+	require.Equal(t, uint64(3), report.NextOffset)
+
+	// The repaired log opens and carries on where the surviving records end
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	off, err := log.Append(&logger.Record{Value: []byte("after repair")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+}
@@ -1,6 +1,7 @@
 package log
 
 import (
+	"context"
 	"io"
 	"io/ioutil"
 	"os"
@@ -9,9 +10,15 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	api_v1 "github.com/schachte/kafkaclone/api/v1"
 	"github.com/schachte/kafkaclone/api/v1/logger"
+	"github.com/schachte/kafkaclone/pkg/compression"
+	"github.com/schachte/kafkaclone/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
 )
 
 type Log struct {
@@ -20,6 +27,25 @@ type Log struct {
 	Config        Config
 	activeSegment *segment
 	segments      []*segment
+	// compacting is held by Compact, and taken before mu by whatever removes or closes segments,
+	// so the closed segments Compact rewrites without the lock stay put
+	compacting sync.Mutex
+
+	logger      *zap.Logger
+	appended    chan struct{}
+	stopCleaner chan struct{}
+	cleaner     sync.WaitGroup
+	stats       RetentionStats
+	producers   *producerStates
+
+	// appends counts the appends since the log was opened, syncs tracks how many of them are on disk
+	appends    uint64
+	syncs      *syncState
+	stopSyncer chan struct{}
+	syncer     sync.WaitGroup
+
+	// appendedBytes counts the bytes appended to the stores since the log was opened
+	appendedBytes uint64
 }
 
 // NewLog will construct a new log from a user-specified directory
@@ -30,11 +56,30 @@ func NewLog(dir string, c Config) (*Log, error) {
 	if c.Segment.MaxIndexBytes == 0 {
 		c.Segment.MaxIndexBytes = 1024
 	}
+	if c.Segment.TimeIndexIntervalBytes == 0 {
+		c.Segment.TimeIndexIntervalBytes = defaultTimeIndexIntervalBytes
+	}
+	if c.Retention.CheckInterval == 0 {
+		c.Retention.CheckInterval = time.Minute
+	}
+	if c.Sync.Records == 0 {
+		c.Sync.Records = 1000
+	}
+	if c.Sync.Interval == 0 {
+		c.Sync.Interval = time.Second
+	}
 	l := &Log{
-		Dir:    dir,
-		Config: c,
+		Dir:      dir,
+		Config:   c,
+		logger:   zap.L().Named("log"),
+		appended: make(chan struct{}),
+		syncs:    newSyncState(),
+	}
+	if err := l.setup(); err != nil {
+		return nil, err
 	}
-	return l, l.setup()
+	l.startSyncing()
+	return l, nil
 }
 
 // setup is an internal function used to initialize a Log. This can be from an existing log or a new one
@@ -47,8 +92,18 @@ func (l *Log) setup() error {
 	var baseOffsets []uint64
 
 	// Each file has a specific format. Here, we will parse the base-offset value from the filename
+	// The store is the source of truth for a segment (the index can be rebuilt from it), so only store files are considered
 	for _, file := range files {
-		// TODO: Look into this function a bit more
+		// Leftovers of a compaction that never got swapped in are incomplete, the originals are still intact
+		if path.Ext(file.Name()) == compactExt {
+			if err = os.Remove(path.Join(l.Dir, file.Name())); err != nil {
+				return err
+			}
+			continue
+		}
+		if path.Ext(file.Name()) != storeExt {
+			continue
+		}
 		offStr := strings.TrimSuffix(
 			file.Name(),
 			path.Ext(file.Name()),
@@ -67,55 +122,443 @@ func (l *Log) setup() error {
 		if err = l.newSegment(baseOffsets[i]); err != nil {
 			return err
 		}
-		i++
+	}
+
+	// Segments are only made consistent on a clean Close, so after a crash any of them may need repair
+	for i, s := range l.segments {
+		active := i == len(l.segments)-1
+		if active || l.Config.Segment.RecoverAll || !s.consistent() {
+			if err = s.recover(); err != nil {
+				return err
+			}
+		}
 	}
 	if l.segments == nil {
 		if err = l.newSegment(l.Config.Segment.InitialOffset); err != nil {
 			return err
 		}
 	}
-	return nil
+	return l.loadProducers()
 }
 
+// Append stores the record at the next offset and returns it, once it's as durable as Config.Sync asks for
 func (l *Log) Append(record *logger.Record) (uint64, error) {
+	return l.AppendContext(context.Background(), record)
+}
+
+// AppendContext is Append traced as a span of ctx's trace, with a child span for the segment it rolls over to
+func (l *Log) AppendContext(ctx context.Context, record *logger.Record) (off uint64, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "log.Append")
+	defer func() {
+		span.SetAttributes(attribute.Int64("offset", int64(off)))
+		tracing.End(span, err)
+	}()
+	off, appends, err := l.append(ctx, record)
+	if err != nil {
+		return off, err
+	}
+	return off, l.syncAppends(appends)
+}
+
+// append is Append up to syncing, it returns the log's count of appends including this one
+func (l *Log) append(ctx context.Context, record *logger.Record) (uint64, uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	size := l.activeSegment.store.size
+	off, err := l.activeSegment.Append(record)
+	if err != nil {
+		return 0, 0, err
+	}
+	l.appendedBytes += l.activeSegment.store.size - size
+	l.track(record)
+	l.notify()
+	l.appends++
+	if l.activeSegment.IsMaxed() {
+		err = l.roll(ctx, off+1)
+	}
+	return off, l.appends, err
+}
+
+// AppendBatch appends the records at consecutive offsets under a single acquisition of the lock and
+// returns the offset of the first one. The batch is atomic: when a record fails to append, the ones
+// before it are rolled back, including any segments the batch rolled over into.
+// With a codec other than logger.Compression_NONE the records are stored compressed together, split
+// into one compressed batch per segment when they don't all fit in the active one.
+// The whole batch counts as a single append for Config.Sync
+func (l *Log) AppendBatch(records []*logger.Record, codec logger.Compression) (uint64, error) {
+	return l.AppendBatchContext(context.Background(), records, codec)
+}
+
+// AppendBatchContext is AppendBatch traced like AppendContext
+func (l *Log) AppendBatchContext(ctx context.Context, records []*logger.Record, codec logger.Compression) (base uint64, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "log.AppendBatch")
+	defer func() {
+		span.SetAttributes(attribute.Int64("base_offset", int64(base)), attribute.Int("records", len(records)))
+		tracing.End(span, err)
+	}()
+	if !compression.Valid(codec) {
+		return 0, api_v1.ErrUnknownCompression{Codec: int32(codec)}
+	}
+	base, appends, err := l.appendBatch(ctx, records, codec)
+	if err != nil {
+		return 0, err
+	}
+	return base, l.syncAppends(appends)
+}
+
+// appendBatch is AppendBatch up to syncing, it returns the log's count of appends including this one
+func (l *Log) appendBatch(ctx context.Context, records []*logger.Record, codec logger.Compression) (uint64, uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	base := l.activeSegment.nextOffset
+	first, size := len(l.segments)-1, l.activeSegment.store.size
+	var err error
+	if codec == logger.Compression_NONE {
+		err = l.appendRecords(ctx, records)
+	} else {
+		err = l.appendCompressed(ctx, records, codec)
+	}
+	if err != nil {
+		if rerr := l.truncateFrom(base); rerr != nil {
+			return 0, 0, rerr
+		}
+		return 0, 0, err
+	}
+	// The batch may have rolled over into new segments, all of them are counted
+	for _, s := range l.segments[first:] {
+		l.appendedBytes += s.store.size
+	}
+	l.appendedBytes -= size
+	l.track(records...)
+	if len(records) > 0 {
+		l.notify()
+		l.appends++
+	}
+	return base, l.appends, nil
+}
+
+// appendRecords appends the records one by one, the caller must hold the lock
+func (l *Log) appendRecords(ctx context.Context, records []*logger.Record) error {
+	for _, record := range records {
+		off, err := l.activeSegment.Append(record)
+		if err == nil && l.activeSegment.IsMaxed() {
+			err = l.roll(ctx, off+1)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendCompressed appends the records as compressed batches, the caller must hold the lock
+func (l *Log) appendCompressed(ctx context.Context, records []*logger.Record, codec logger.Compression) error {
+	for len(records) > 0 {
+		s := l.activeSegment
+		n := s.indexRoom()
+		if n == 0 {
+			if s.index.size == 0 {
+				// Not even an empty segment has room for a record
+				return io.EOF
+			}
+			if err := l.roll(ctx, s.nextOffset); err != nil {
+				return err
+			}
+			continue
+		}
+		if n > uint64(len(records)) {
+			n = uint64(len(records))
+		}
+		if _, err := s.appendBatch(records[:n], codec); err != nil {
+			return err
+		}
+		records = records[n:]
+		if s.IsMaxed() {
+			if err := l.roll(ctx, s.nextOffset); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// AppendAt appends a record keeping the offset it already carries, which must not be lower than the
+// next offset of the log. Offsets in between are left as a gap, the same as after compaction.
+// It's used to rebuild a log from records read out of another one
+func (l *Log) AppendAt(record *logger.Record) error {
+	appends, err := l.appendAt(record)
+	if err != nil {
+		return err
+	}
+	return l.syncAppends(appends)
+}
+
+// appendAt is AppendAt up to syncing, it returns the log's count of appends including this one
+func (l *Log) appendAt(record *logger.Record) (uint64, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if record.Offset < l.activeSegment.nextOffset {
+		return 0, api_v1.ErrOffsetOutOfRange{Offset: record.Offset}
+	}
+	l.activeSegment.nextOffset = record.Offset
+	size := l.activeSegment.store.size
 	off, err := l.activeSegment.Append(record)
 	if err != nil {
 		return 0, err
 	}
+	l.appendedBytes += l.activeSegment.store.size - size
+	l.track(record)
+	l.notify()
+	l.appends++
 	if l.activeSegment.IsMaxed() {
 		err = l.newSegment(off + 1)
 	}
-	return off, err
+	return l.appends, err
+}
+
+// Notify returns a channel that's closed as soon as another record is appended to the log.
+// Get the channel before reading so an append in between isn't missed
+func (l *Log) Notify() <-chan struct{} {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.appended
+}
+
+// notify wakes everyone waiting on Notify, the caller must hold the lock
+func (l *Log) notify() {
+	close(l.appended)
+	l.appended = make(chan struct{})
 }
 
 // Read will take in an offset and search all segments for the segment the offset would exist in
+// Compacted logs have gaps, so when the offset no longer exists the next surviving record is returned
 func (l *Log) Read(off uint64) (*logger.Record, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
-	var s *segment
-	for _, segment := range l.segments {
-		if segment.baseOffset <= off && off < segment.nextOffset {
-			s = segment
+	return l.read(off)
+}
+
+// ReadContext is Read traced as a span of ctx's trace
+func (l *Log) ReadContext(ctx context.Context, off uint64) (record *logger.Record, err error) {
+	_, span := tracing.Tracer().Start(ctx, "log.Read")
+	record, err = l.Read(off)
+	span.SetAttributes(attribute.Int64("offset", int64(off)))
+	if record != nil {
+		span.SetAttributes(attribute.Int64("record_offset", int64(record.Offset)))
+	}
+	tracing.End(span, err)
+	return record, err
+}
+
+// ReadRange reads up to maxRecords records from off on, stopping before the record that would take the
+// total encoded size over maxBytes. The first record is returned whatever its size so a consumer can't get
+// stuck behind a large one. Zero limits mean no limit
+func (l *Log) ReadRange(off uint64, maxRecords uint32, maxBytes uint64) ([]*logger.Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var records []*logger.Record
+	var size uint64
+	for maxRecords == 0 || uint32(len(records)) < maxRecords {
+		record, err := l.read(off)
+		if _, ok := err.(api_v1.ErrOffsetOutOfRange); ok && len(records) > 0 {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		size += uint64(proto.Size(record))
+		if maxBytes != 0 && size > maxBytes && len(records) > 0 {
 			break
 		}
+		records = append(records, record)
+		off = record.Offset + 1
 	}
-	if s == nil || s.nextOffset <= off {
+	return records, nil
+}
+
+// ReadCommitted is ReadRange for read committed consumers: it stops at the last stable offset and skips
+// control records and the records of aborted transactions. When there's nothing but skipped records from
+// off up to the last stable offset, ErrOffsetOutOfRange is returned as if the log ended at off
+func (l *Log) ReadCommitted(off uint64, maxRecords uint32, maxBytes uint64) ([]*logger.Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	stable := l.producers.lastStableOffset(l.activeSegment.nextOffset)
+	var records []*logger.Record
+	var size uint64
+	for next := off; next < stable && (maxRecords == 0 || uint32(len(records)) < maxRecords); {
+		record, err := l.read(next)
+		if _, ok := err.(api_v1.ErrOffsetOutOfRange); ok {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if record.Offset >= stable {
+			break
+		}
+		next = record.Offset + 1
+		if !l.producers.committed(record) {
+			continue
+		}
+		size += uint64(proto.Size(record))
+		if maxBytes != 0 && size > maxBytes && len(records) > 0 {
+			break
+		}
+		records = append(records, record)
+	}
+	if len(records) == 0 {
 		return nil, api_v1.ErrOffsetOutOfRange{Offset: off}
 	}
-	return s.Read(off)
+	return records, nil
+}
+
+// ReadBatches is ReadRange for clients that decompress batches themselves: a compressed batch is returned
+// as it's stored, with all of its records from off on counting towards maxRecords. The first batch can
+// start before off, it's up to the client to skip the records it didn't ask for
+func (l *Log) ReadBatches(off uint64, maxRecords uint32, maxBytes uint64) ([]*logger.Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var batches []*logger.Record
+	var size uint64
+	var count uint32
+	for maxRecords == 0 || count < maxRecords {
+		var batch *logger.Record
+		var next uint64
+		var n uint32
+		err := l.seek(off, func(s *segment, off uint64) (err error) {
+			batch, next, n, err = s.readBatch(off)
+			return err
+		})
+		if _, ok := err.(api_v1.ErrOffsetOutOfRange); ok && len(batches) > 0 {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		size += uint64(proto.Size(batch))
+		if maxBytes != 0 && size > maxBytes && len(batches) > 0 {
+			break
+		}
+		batches = append(batches, batch)
+		count += n
+		off = next
+	}
+	return batches, nil
+}
+
+// read is Read without the lock, the caller must hold it
+func (l *Log) read(off uint64) (*logger.Record, error) {
+	var record *logger.Record
+	err := l.seek(off, func(s *segment, off uint64) (err error) {
+		record, err = s.Read(off)
+		return err
+	})
+	return record, err
+}
+
+// seek calls read with the segment holding off, or the first record after it, and the offset to read
+// from in that segment. When read returns io.EOF it moves on to the next segment
+func (l *Log) seek(off uint64, read func(s *segment, off uint64) error) error {
+	if off < l.segments[0].baseOffset {
+		return api_v1.ErrOffsetOutOfRange{Offset: off}
+	}
+	for _, s := range l.segments {
+		if off >= s.nextOffset {
+			continue
+		}
+		from := off
+		if from < s.baseOffset {
+			from = s.baseOffset
+		}
+		err := read(s, from)
+		if err == io.EOF {
+			// Everything from the offset to the end of this segment was compacted away
+			continue
+		}
+		return err
+	}
+	return api_v1.ErrOffsetOutOfRange{Offset: off}
+}
+
+// SegmentStats reports how much space each segment's records take up compared to uncompressed
+func (l *Log) SegmentStats() ([]SegmentStats, error) {
+	// Working out the uncompressed size the first time updates the segment, so it needs the write lock
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := make([]SegmentStats, 0, len(l.segments))
+	for _, s := range l.segments {
+		st, err := s.stats()
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, st)
+	}
+	return stats, nil
+}
+
+// OffsetForTime returns the earliest offset whose record has a timestamp (in milliseconds since the epoch)
+// greater than or equal to timestamp. When no record is that recent yet, the offset the next record
+// will be appended at is returned, so consuming from it waits for the first newer record
+func (l *Log) OffsetForTime(timestamp int64) (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, s := range l.segments {
+		if s.maxTimestamp < timestamp {
+			continue
+		}
+		off, err := s.offsetForTime(timestamp)
+		if err == io.EOF {
+			continue
+		}
+		return off, err
+	}
+	return l.activeSegment.nextOffset, nil
+}
+
+// Flush writes the records the segments still buffer in memory out to their files, so they survive
+// the process going away. Surviving the machine going away is up to Config.Sync
+func (l *Log) Flush() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, s := range l.segments {
+		if err := s.store.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Close will iterate over all segments for a given log instance and close them
 func (l *Log) Close() error {
+	l.stopCleaning()
+	l.stopSyncing()
+	l.compacting.Lock()
+	defer l.compacting.Unlock()
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if err := l.writeProducers(); err != nil {
+		return err
+	}
+	// Records the policy would have fsynced aren't left to the operating system after closing either
+	if l.Config.Sync.Policy != SyncNever {
+		for _, segment := range l.segments {
+			if err := segment.store.Sync(); err != nil {
+				return err
+			}
+		}
+	}
 	for _, segment := range l.segments {
+		// A Log.Reader snapshot still reading the segment gets to finish, even once the log is deleted
+		if segment.reading() {
+			segment.closeWhenIdle()
+			continue
+		}
 		if err := segment.Close(); err != nil {
 			return err
 		}
 	}
+	// Nothing is appended anymore, whoever's waiting goes back to find the log closed or its topic gone
+	l.notify()
 	return nil
 }
 
@@ -132,7 +575,43 @@ func (l *Log) Reset() error {
 	if err := l.Remove(); err != nil {
 		return err
 	}
-	return l.setup()
+	if err := os.MkdirAll(l.Dir, 0755); err != nil {
+		return err
+	}
+	l.segments = nil
+	l.activeSegment = nil
+	l.producers = nil
+	if err := l.setup(); err != nil {
+		return err
+	}
+	l.startSyncing()
+	return nil
+}
+
+// Stats is a snapshot of how big a log is, see Log.Stats
+type Stats struct {
+	Segments           int
+	ActiveSegmentBytes uint64
+	LowestOffset       uint64
+	HighestOffset      uint64
+	// AppendedBytes is how many bytes were appended since the log was opened, frame headers included
+	AppendedBytes uint64
+}
+
+// Stats returns a snapshot of the log's size and offsets
+func (l *Log) Stats() Stats {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	stats := Stats{
+		Segments:           len(l.segments),
+		ActiveSegmentBytes: l.activeSegment.store.size,
+		LowestOffset:       l.segments[0].baseOffset,
+		AppendedBytes:      l.appendedBytes,
+	}
+	if next := l.activeSegment.nextOffset; next > 0 {
+		stats.HighestOffset = next - 1
+	}
+	return stats
 }
 
 func (l *Log) LowestOffset() (uint64, error) {
@@ -153,12 +632,14 @@ func (l *Log) HighestOffset() (uint64, error) {
 
 // Truncate takes in an uint64 and purges all data that is lower than the user-specified offset number
 func (l *Log) Truncate(lowest uint64) error {
+	l.compacting.Lock()
+	defer l.compacting.Unlock()
 	l.mu.Lock()
 	defer l.mu.Unlock()
 	var segments []*segment
 	for _, s := range l.segments {
 		if s.nextOffset <= lowest+1 {
-			if err := s.Remove(); err != nil {
+			if err := s.removeWhenIdle(); err != nil {
 				return err
 			}
 			continue
@@ -166,32 +647,195 @@ func (l *Log) Truncate(lowest uint64) error {
 		segments = append(segments, s)
 	}
 	l.segments = segments
+	if len(segments) > 0 {
+		l.producers.forget(segments[0].baseOffset)
+	}
 	return nil
 }
 
-func (l *Log) Reader() io.Reader {
+// TruncateFrom is the opposite of Truncate: it drops every record with an offset of from or higher,
+// so the log can be appended to again from there. The first segment is always kept, even if it ends up empty
+func (l *Log) TruncateFrom(from uint64) error {
+	l.compacting.Lock()
+	defer l.compacting.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.truncateFrom(from); err != nil {
+		return err
+	}
+	// The last snapshot is only used when it doesn't go past from, otherwise the state is rebuilt
+	if err := l.loadProducers(); err != nil {
+		return err
+	}
+	return l.writeProducers()
+}
+
+// truncateFrom is TruncateFrom without the lock, the caller must hold it
+func (l *Log) truncateFrom(from uint64) error {
+	segments := l.segments[:1]
+	for _, s := range l.segments[1:] {
+		if s.baseOffset >= from {
+			if err := s.removeWhenIdle(); err != nil {
+				return err
+			}
+			continue
+		}
+		segments = append(segments, s)
+	}
+	l.segments = segments
+	l.activeSegment = segments[len(segments)-1]
+	if err := l.activeSegment.truncateFrom(from); err != nil {
+		return err
+	}
+	if l.activeSegment.IsMaxed() {
+		return l.newSegment(l.activeSegment.nextOffset)
+	}
+	return nil
+}
+
+// Reader returns a snapshot of the whole log as the raw frames of its segments. The segments stay open
+// until the reader reaches the end of them or is closed, so a reader that stops early must be closed
+func (l *Log) Reader() io.ReadCloser {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
+	r := &logReader{segments: make([]*originReader, len(l.segments))}
 	readers := make([]io.Reader, len(l.segments))
 	for i, segment := range l.segments {
-		readers[i] = &originReader{segment.store, 0}
+		// Keep the segment's files open until the reader has drained it, even if it's deleted in the meantime
+		r.segments[i] = &originReader{
+			store:   segment.store,
+			segment: segment.baseOffset,
+			next:    segment.baseOffset,
+			release: segment.read(),
+		}
+		readers[i] = r.segments[i]
 	}
-	return io.MultiReader(readers...)
+	r.Reader = io.MultiReader(readers...)
+	return r
 }
 
+// ReadFrame reads the next frame off a Log.Reader and returns the records it holds, more than one for a
+// compressed batch. It returns io.EOF once the reader is drained
+func ReadFrame(r io.Reader) ([]*logger.Record, error) {
+	header := make([]byte, headerWidth)
+	if _, err := io.ReadFull(r, header[:1]); err != nil {
+		return nil, err
+	}
+	// Legacy records start with a zero byte and carry only their length
+	width := headerWidth
+	if header[0] == 0 {
+		width = lenWidth
+	}
+	if _, err := io.ReadFull(r, header[1:width]); err != nil {
+		return nil, err
+	}
+	p := make([]byte, enc.Uint64(header[width-lenWidth:width]))
+	if _, err := io.ReadFull(r, p); err != nil {
+		return nil, err
+	}
+	record := &logger.Record{}
+	if err := proto.Unmarshal(p, record); err != nil {
+		return nil, err
+	}
+	return compression.Unbatch(record)
+}
+
+// logReader is the io.ReadCloser returned by Log.Reader
+type logReader struct {
+	io.Reader
+	segments []*originReader
+}
+
+// Close lets go of the segments the reader hasn't finished with yet
+func (r *logReader) Close() error {
+	for _, o := range r.segments {
+		o.done()
+	}
+	return nil
+}
+
+// originReader streams the raw frames of a store from the beginning, verifying each frame before handing its bytes out
 type originReader struct {
 	*store
-	off int64
+	segment uint64 // base offset of the segment the store belongs to
+	next    uint64 // offset of the first record of the frame about to be loaded
+	off     int64
+	frame   []byte
+	release func() // called once the reader is done with the segment
 }
 
 func (o *originReader) Read(p []byte) (int, error) {
-	n, err := o.ReadAt(p, o.off)
+	if len(o.frame) == 0 {
+		if err := o.load(); err != nil {
+			o.done()
+			return 0, err
+		}
+	}
+	n := copy(p, o.frame)
+	o.frame = o.frame[n:]
+	return n, nil
+}
+
+// done releases the segment, the first time it's called
+func (o *originReader) done() {
+	if o.release != nil {
+		o.release()
+		o.release = nil
+	}
+}
+
+// load reads and verifies the next whole frame from the store
+func (o *originReader) load() error {
+	o.store.mu.Lock()
+	defer o.store.mu.Unlock()
+	if err := o.buf.Flush(); err != nil {
+		return err
+	}
+	p, n, err := o.readFrame(uint64(o.off))
+	if err == errCorruptFrame {
+		return api_v1.ErrCorruptRecord{Offset: o.next, Segment: o.segment}
+	}
+	if err != nil {
+		return err
+	}
+	o.frame = make([]byte, n)
+	if _, err := o.File.ReadAt(o.frame, o.off); err != nil {
+		return err
+	}
 	o.off += int64(n)
-	return n, err
+	// The next frame starts after this one's last record: a compressed batch holds several, and compaction
+	// leaves gaps. A frame that doesn't decode is counted as a single record
+	o.next++
+	frame := &logger.Record{}
+	if err = proto.Unmarshal(p, frame); err == nil {
+		if records, err := compression.Unbatch(frame); err == nil && len(records) > 0 {
+			o.next = records[len(records)-1].Offset + 1
+		}
+	}
+	return nil
+}
+
+// roll moves on to a new active segment at off once the current one is full, the caller must hold the lock
+func (l *Log) roll(ctx context.Context, off uint64) error {
+	_, span := tracing.Tracer().Start(ctx, "log.roll")
+	span.SetAttributes(attribute.Int64("base_offset", int64(off)))
+	err := l.newSegment(off)
+	tracing.End(span, err)
+	return err
 }
 
 //newSegment will create or reuse an existing segment file (by cross-referencing the file offset value)
 func (l *Log) newSegment(off uint64) error {
+	// The segment being rolled away from won't be written to again, so its time index can be completed
+	if l.activeSegment != nil {
+		if err := l.activeSegment.sealTimeIndex(); err != nil {
+			return err
+		}
+		// Snapshotting the producer state on every roll bounds how many records opening the log replays
+		if err := l.writeProducers(); err != nil {
+			return err
+		}
+	}
 	s, err := newSegment(l.Dir, off, l.Config)
 	if err != nil {
 		return err
@@ -1,13 +1,21 @@
 package log
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
 	"testing"
+	"time"
 
 	api_v1 "github.com/schachte/kafkaclone/api/v1"
 	"github.com/schachte/kafkaclone/api/v1/logger"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -18,7 +26,12 @@ func TestLog(t *testing.T) {
 		// "append and read a record succeeds": testAppendRead,
 		// "offset out of range error":         testOutOfRangeErr,
 		// "init with existing segments":       testInitExisting,
-		"reader": testReader,
+		"reader":         testReader,
+		"corrupt record": testCorruptRecord,
+		"notify":         testNotify,
+		"batch":          testBatch,
+		"stats":          testStats,
+		"tracing":        testTracing,
 		// "truncate":                          testTruncate,
 	} {
 		t.Run(scenario, func(t *testing.T) {
@@ -26,7 +39,7 @@ func TestLog(t *testing.T) {
 			require.NoError(t, err)
 			defer os.RemoveAll(dir)
 			c := Config{}
-			c.Segment.MaxStoreBytes = 32
+			c.Segment.MaxStoreBytes = 64
 			log, err := NewLog(dir, c)
 			require.NoError(t, err)
 			fn(t, log)
@@ -47,6 +60,138 @@ func testAppendRead(t *testing.T, log *Log) {
 	require.Equal(t, append.Value, read.Value)
 }
 
+func testStats(t *testing.T, log *Log) {
+	storeBytes := func() (n uint64) {
+		for _, s := range log.segments {
+			n += s.store.size
+		}
+		return n
+	}
+	require.Equal(t, Stats{Segments: 1}, log.Stats())
+
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&logger.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	// A batch rolls over into new segments, the bytes of every one of them count
+	_, err := log.AppendBatch([]*logger.Record{
+		{Value: []byte("first")},
+		{Value: []byte("second")},
+		{Value: []byte("third")},
+	}, logger.Compression_NONE)
+	require.NoError(t, err)
+
+	stats := log.Stats()
+	require.Equal(t, len(log.segments), stats.Segments)
+	require.Greater(t, stats.Segments, 1)
+	require.Equal(t, log.activeSegment.store.size, stats.ActiveSegmentBytes)
+	require.Equal(t, uint64(0), stats.LowestOffset)
+	require.Equal(t, uint64(5), stats.HighestOffset)
+	require.Equal(t, storeBytes(), stats.AppendedBytes)
+}
+
+func testTracing(t *testing.T, log *Log) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "produce")
+	for i := 0; i < 3; i++ {
+		_, err := log.AppendContext(ctx, &logger.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	_, err := log.ReadContext(ctx, 1)
+	require.NoError(t, err)
+	parent.End()
+
+	// Every append is traced under the caller's span, and so is the segment roll an append triggers
+	spans := exporter.GetSpans()
+	byID := make(map[trace.SpanID]string)
+	for _, span := range spans {
+		byID[span.SpanContext.SpanID()] = span.Name
+	}
+	names := make(map[string]int)
+	for _, span := range spans {
+		require.Equal(t, parent.SpanContext().TraceID(), span.SpanContext.TraceID())
+		names[span.Name]++
+		if span.Name == "log.roll" {
+			require.Equal(t, "log.Append", byID[span.Parent.SpanID()])
+		}
+	}
+	require.Equal(t, 3, names["log.Append"])
+	require.Equal(t, 1, names["log.Read"])
+	require.Equal(t, len(log.segments)-1, names["log.roll"])
+	require.Greater(t, names["log.roll"], 0)
+}
+
+func testNotify(t *testing.T, log *Log) {
+	appended := log.Notify()
+	select {
+	case <-appended:
+		t.Fatal("notified before anything was appended")
+	default:
+	}
+	_, err := log.Append(&logger.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	select {
+	case <-appended:
+	default:
+		t.Fatal("not notified of the append")
+	}
+	require.NotEqual(t, appended, log.Notify())
+}
+
+func testBatch(t *testing.T, log *Log) {
+	var batch []*logger.Record
+	for i := 0; i < 5; i++ {
+		batch = append(batch, &logger.Record{Value: []byte("hello world")})
+	}
+	base, err := log.AppendBatch(batch, logger.Compression_NONE)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), base)
+	require.Greater(t, len(log.segments), 1)
+
+	records, err := log.ReadRange(0, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, records, 5)
+	for i, record := range records {
+		require.Equal(t, uint64(i), record.Offset)
+	}
+	records, err = log.ReadRange(1, 3, 0)
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	require.Equal(t, uint64(1), records[0].Offset)
+	size := uint64(proto.Size(records[0]))
+	records, err = log.ReadRange(2, 0, 2*size)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	// a record bigger than max bytes is still returned on its own
+	records, err = log.ReadRange(2, 0, 1)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	_, err = log.ReadRange(5, 0, 0)
+	require.Equal(t, api_v1.ErrOffsetOutOfRange{Offset: 5}, err)
+
+	// Make the next segment roll fail part way through a batch, none of it should be left behind
+	for off := 5; off < 15; off++ {
+		require.NoError(t, os.Mkdir(path.Join(log.Dir, fmt.Sprintf("%d%s", off, storeExt)), 0755))
+	}
+	segments := len(log.segments)
+	_, err = log.AppendBatch(batch, logger.Compression_NONE)
+	require.Error(t, err)
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), highest)
+	require.Len(t, log.segments, segments)
+	_, err = log.Read(5)
+	require.Equal(t, api_v1.ErrOffsetOutOfRange{Offset: 5}, err)
+
+	for off := 5; off < 15; off++ {
+		require.NoError(t, os.Remove(path.Join(log.Dir, fmt.Sprintf("%d%s", off, storeExt))))
+	}
+	base, err = log.AppendBatch(batch, logger.Compression_NONE)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), base)
+}
+
 func testOutOfRangeErr(t *testing.T, log *Log) {
 	read, err := log.Read(1)
 	require.Nil(t, read)
@@ -93,10 +238,48 @@ func testReader(t *testing.T, log *Log) {
 	reader := log.Reader()
 	b, err := ioutil.ReadAll(reader)
 	require.NoError(t, err)
+	require.NoError(t, reader.Close())
 	read := &logger.Record{}
-	err = proto.Unmarshal(b[lenWidth:], read)
+	err = proto.Unmarshal(b[headerWidth:], read)
 	require.NoError(t, err)
 	require.Equal(t, append.Value, read.Value)
+
+	// Closing a reader that stopped early lets go of the segment
+	reader = log.Reader()
+	_, err = reader.Read(make([]byte, 1))
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	released := make(chan struct{})
+	go func() {
+		log.activeSegment.readers.Wait()
+		close(released)
+	}()
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Fatal("segment still held by the closed reader")
+	}
+}
+
+func testCorruptRecord(t *testing.T, log *Log) {
+	appendRecord := &logger.Record{Value: []byte("hello world")}
+	off, err := log.Append(appendRecord)
+	require.NoError(t, err)
+
+	// Damage the last byte of the only record in the active segment
+	s := log.activeSegment
+	require.NoError(t, s.store.buf.Flush())
+	f, err := os.OpenFile(s.store.Name(), os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff}, int64(s.store.size-1))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = log.Read(off)
+	require.Equal(t, api_v1.ErrCorruptRecord{Offset: off, Segment: s.baseOffset}, err)
+
+	_, err = ioutil.ReadAll(log.Reader())
+	require.Equal(t, api_v1.ErrCorruptRecord{Offset: off, Segment: s.baseOffset}, err)
 }
 
 func testTruncate(t *testing.T, log *Log) {
@@ -113,3 +296,180 @@ func testTruncate(t *testing.T, log *Log) {
 	_, err = log.Read(0)
 	require.Error(t, err)
 }
+
+// TestRecoverUndecodableFrame checks that a frame whose checksum holds but whose payload doesn't decode
+// is reported rather than truncated away along with the records after it
+func TestReaderCorruptAfterBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reader-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	_, err = log.AppendBatch([]*logger.Record{
+		{Value: []byte("first")},
+		{Value: []byte("second")},
+		{Value: []byte("third")},
+	}, logger.Compression_GZIP)
+	require.NoError(t, err)
+	off, err := log.Append(&logger.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+
+	s := log.activeSegment
+	require.NoError(t, s.store.buf.Flush())
+	f, err := os.OpenFile(s.store.Name(), os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff}, int64(s.store.size-1))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// The batch's single frame counts for all three of its records
+	_, err = ioutil.ReadAll(log.Reader())
+	require.Equal(t, api_v1.ErrCorruptRecord{Offset: off, Segment: s.baseOffset}, err)
+}
+
+func TestRecoverUndecodableFrame(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recover-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	defer s.Close()
+	_, err = s.Append(&logger.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	_, pos, err := s.store.Append([]byte{0xff, 0xff, 0xff})
+	require.NoError(t, err)
+	require.NoError(t, s.index.Write(1, pos))
+	s.nextOffset++
+	_, err = s.Append(&logger.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	size := s.store.size
+
+	require.Equal(t, api_v1.ErrCorruptRecord{Offset: 1, Segment: 0}, s.recover())
+	require.Equal(t, size, s.store.size)
+	record, err := s.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+}
+
+func TestRecoverCorruptFrame(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recover-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	defer s.Close()
+	for i := 0; i < 3; i++ {
+		_, err = s.Append(&logger.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.store.buf.Flush())
+	size := s.store.size
+	flip := func(pos uint64) {
+		b := make([]byte, 1)
+		_, err := s.store.File.ReadAt(b, int64(pos))
+		require.NoError(t, err)
+		f, err := os.OpenFile(s.store.Name(), os.O_WRONLY, 0644)
+		require.NoError(t, err)
+		_, err = f.WriteAt([]byte{b[0] ^ 0xff}, int64(pos))
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+	}
+
+	// A damaged frame in the middle of the store leaves the intact frames after it alone
+	_, middle, err := s.index.Read(1)
+	require.NoError(t, err)
+	flip(middle + headerWidth + 1)
+	require.Equal(t, api_v1.ErrCorruptRecord{Offset: 1, Segment: 0}, s.recover())
+	require.Equal(t, size, s.store.size)
+	flip(middle + headerWidth + 1)
+
+	// Only the last frame can be a torn tail, which is cut off
+	_, last, err := s.index.Read(2)
+	require.NoError(t, err)
+	flip(size - 1)
+	require.NoError(t, s.recover())
+	require.Equal(t, last, s.store.size)
+	require.Equal(t, uint64(2), s.nextOffset)
+	record, err := s.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+}
+
+// TestCrashRecovery simulates the process dying at every byte boundary of an append and
+// checks that the log reopens at a consistent offset and keeps accepting writes
+func TestCrashRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crash-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	// Build a reference log with three records and grab its files after a clean close
+	appendRecord := &logger.Record{Value: []byte("hello world")}
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = log.Append(appendRecord)
+		require.NoError(t, err)
+	}
+	_, lastPos, err := log.activeSegment.index.Read(-1)
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	storeBytes, err := ioutil.ReadFile(path.Join(dir, "0"+storeExt))
+	require.NoError(t, err)
+	indexBytes, err := ioutil.ReadFile(path.Join(dir, "0"+indexExt))
+	require.NoError(t, err)
+
+	for cut := lastPos; cut <= uint64(len(storeBytes)); cut++ {
+		// The index entry for the last record may or may not have made it, but the index
+		// file is always left grown to MaxIndexBytes since it was never closed
+		for _, entries := range []int{2, 3} {
+			crashDir, err := ioutil.TempDir("", "crash-test")
+			require.NoError(t, err)
+
+			index := make([]byte, c.Segment.MaxIndexBytes)
+			copy(index, indexBytes[:uint64(entries)*entWidth])
+			require.NoError(t, ioutil.WriteFile(path.Join(crashDir, "0"+indexExt), index, 0644))
+			require.NoError(t, ioutil.WriteFile(path.Join(crashDir, "0"+storeExt), storeBytes[:cut], 0644))
+
+			log, err := NewLog(crashDir, c)
+			require.NoError(t, err)
+
+			want := uint64(1)
+			if cut == uint64(len(storeBytes)) {
+				want = 2
+			}
+			highest, err := log.HighestOffset()
+			require.NoError(t, err)
+			require.Equal(t, want, highest, "cut at byte %d with %d index entries", cut, entries)
+
+			off, err := log.Append(appendRecord)
+			require.NoError(t, err)
+			require.Equal(t, want+1, off)
+			for i := uint64(0); i <= off; i++ {
+				read, err := log.Read(i)
+				require.NoError(t, err)
+				require.Equal(t, i, read.Offset)
+				require.Equal(t, appendRecord.Value, read.Value)
+			}
+
+			require.NoError(t, log.Remove())
+		}
+	}
+}
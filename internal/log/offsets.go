@@ -0,0 +1,143 @@
+package log
+
+import (
+	"sync"
+
+	api_v1 "github.com/schachte/kafkaclone/api/v1"
+	"github.com/schachte/kafkaclone/api/v1/logger"
+)
+
+// GroupOffsets stores the offsets consumer groups have committed. Every commit is appended to a compacted
+// log keyed by group, topic and partition, so only the latest commit of each survives compaction.
+// The log is replayed into memory when it's opened, lookups never touch the disk
+type GroupOffsets struct {
+	mu      sync.RWMutex
+	log     *Log
+	offsets map[GroupPartition]uint64
+}
+
+// GroupPartition identifies the partition a consumer group has committed an offset for
+type GroupPartition struct {
+	Group     string
+	Topic     string
+	Partition uint32
+}
+
+// NewGroupOffsets opens (or creates) the committed offsets stored in dir. Compaction is always enabled
+func NewGroupOffsets(dir string, c Config) (*GroupOffsets, error) {
+	c.Compaction.Enabled = true
+	l, err := NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+	g := &GroupOffsets{
+		log:     l,
+		offsets: make(map[GroupPartition]uint64),
+	}
+	lowest, err := l.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+	for off := lowest; ; {
+		record, err := l.Read(off)
+		if _, ok := err.(api_v1.ErrOffsetOutOfRange); ok {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if gp, ok := decodeGroupPartition(record.Key); ok && len(record.Value) == lenWidth {
+			g.offsets[gp] = enc.Uint64(record.Value)
+		}
+		off = record.Offset + 1
+	}
+	l.StartCleaner()
+	return g, nil
+}
+
+// Commit records offset as the next one the group will consume from the partition
+func (g *GroupOffsets) Commit(gp GroupPartition, offset uint64) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	value := make([]byte, lenWidth)
+	enc.PutUint64(value, offset)
+	if _, err := g.log.Append(&logger.Record{
+		Key:   encodeGroupPartition(gp),
+		Value: value,
+	}); err != nil {
+		return err
+	}
+	g.offsets[gp] = offset
+	return nil
+}
+
+// Fetch returns the offset the group last committed for the partition
+func (g *GroupOffsets) Fetch(gp GroupPartition) (uint64, error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	offset, ok := g.offsets[gp]
+	if !ok {
+		return 0, api_v1.ErrNoCommittedOffset{Group: gp.Group, Topic: gp.Topic, Partition: gp.Partition}
+	}
+	return offset, nil
+}
+
+// All returns a copy of every committed offset
+func (g *GroupOffsets) All() map[GroupPartition]uint64 {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	all := make(map[GroupPartition]uint64, len(g.offsets))
+	for gp, offset := range g.offsets {
+		all[gp] = offset
+	}
+	return all
+}
+
+// Reset forgets every committed offset
+func (g *GroupOffsets) Reset() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.offsets = make(map[GroupPartition]uint64)
+	if err := g.log.Reset(); err != nil {
+		return err
+	}
+	g.log.StartCleaner()
+	return nil
+}
+
+func (g *GroupOffsets) Close() error {
+	return g.log.Close()
+}
+
+// encodeGroupPartition builds the record key of a commit:
+// group length (4 bytes) | group | topic length (4 bytes) | topic | partition (4 bytes)
+func encodeGroupPartition(gp GroupPartition) []byte {
+	key := make([]byte, 12+len(gp.Group)+len(gp.Topic))
+	enc.PutUint32(key, uint32(len(gp.Group)))
+	n := 4 + copy(key[4:], gp.Group)
+	enc.PutUint32(key[n:], uint32(len(gp.Topic)))
+	n += 4 + copy(key[n+4:], gp.Topic)
+	enc.PutUint32(key[n:], gp.Partition)
+	return key
+}
+
+func decodeGroupPartition(key []byte) (gp GroupPartition, ok bool) {
+	field := func() ([]byte, bool) {
+		if len(key) < 4 || uint64(len(key)-4) < uint64(enc.Uint32(key)) {
+			return nil, false
+		}
+		n := enc.Uint32(key)
+		b := key[4 : 4+n]
+		key = key[4+n:]
+		return b, true
+	}
+	group, ok := field()
+	if !ok {
+		return gp, false
+	}
+	topic, ok := field()
+	if !ok || len(key) != 4 {
+		return gp, false
+	}
+	return GroupPartition{Group: string(group), Topic: string(topic), Partition: enc.Uint32(key)}, true
+}
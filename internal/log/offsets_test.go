@@ -0,0 +1,53 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api_v1 "github.com/schachte/kafkaclone/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupOffsets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offsets-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	g, err := NewGroupOffsets(dir, c)
+	require.NoError(t, err)
+
+	orders := GroupPartition{Group: "billing", Topic: "orders", Partition: 1}
+	_, err = g.Fetch(orders)
+	require.Equal(t, api_v1.ErrNoCommittedOffset{Group: "billing", Topic: "orders", Partition: 1}, err)
+
+	for off := uint64(1); off <= 10; off++ {
+		require.NoError(t, g.Commit(orders, off))
+	}
+	payments := GroupPartition{Group: "billing", Topic: "payments"}
+	require.NoError(t, g.Commit(payments, 3))
+	offset, err := g.Fetch(orders)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), offset)
+
+	// Only the latest commit per partition needs to survive compaction
+	require.NoError(t, g.log.Compact())
+	require.NoError(t, g.Close())
+
+	g, err = NewGroupOffsets(dir, c)
+	require.NoError(t, err)
+	defer g.Close()
+	require.Equal(t, map[GroupPartition]uint64{orders: 10, payments: 3}, g.All())
+}
+
+func TestGroupPartitionKey(t *testing.T) {
+	gp := GroupPartition{Group: "a\x00b", Topic: "", Partition: 7}
+	decoded, ok := decodeGroupPartition(encodeGroupPartition(gp))
+	require.True(t, ok)
+	require.Equal(t, gp, decoded)
+
+	_, ok = decodeGroupPartition([]byte{0, 0, 0, 9, 'a'})
+	require.False(t, ok)
+}
@@ -0,0 +1,425 @@
+package log
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/schachte/kafkaclone/api/v1/logger"
+)
+
+const (
+	producersFile = "producers.snapshot"
+
+	// maxProducerRuns is how many runs are remembered per producer. Only retries of a producer's
+	// most recent appends can be recognised as duplicates
+	maxProducerRuns = 5
+)
+
+var errCorruptProducers = errors.New("corrupt producer snapshot")
+
+// producerRun is a stretch of an idempotent producer's records with consecutive sequences
+// stored at consecutive offsets
+type producerRun struct {
+	firstSeq    uint64
+	lastSeq     uint64
+	firstOffset uint64
+}
+
+// txnRange is the offsets a transaction's records take up in a log, from its first record to the
+// control record that ended it
+type txnRange struct {
+	first uint64
+	last  uint64
+}
+
+// producerStates tracks the sequences idempotent producers have appended to a log, so a retried
+// append can be answered with the offset it got the first time instead of being stored twice.
+// It also tracks the transactions that are still open and those that were aborted, which is what
+// read committed consumers need to know to skip records, and the committed ones
+type producerStates struct {
+	runs map[uint64][]producerRun
+	// ongoing holds the first offset of every open transaction
+	ongoing map[uint64]uint64
+	aborted map[uint64]txnRange
+	// commits holds the offset of the control record of every committed transaction
+	commits map[uint64]uint64
+	// next is the offset after the last record tracked
+	next uint64
+}
+
+func newProducerStates() *producerStates {
+	return &producerStates{
+		runs:    make(map[uint64][]producerRun),
+		ongoing: make(map[uint64]uint64),
+		aborted: make(map[uint64]txnRange),
+		commits: make(map[uint64]uint64),
+	}
+}
+
+// track records an appended record, extending the producer's last run when it carries on from it
+func (p *producerStates) track(record *logger.Record) {
+	if record.Offset >= p.next {
+		p.next = record.Offset + 1
+	}
+	if record.TxnId != 0 {
+		p.trackTxn(record)
+	}
+	if record.ProducerId == 0 {
+		return
+	}
+	runs := p.runs[record.ProducerId]
+	if n := len(runs); n > 0 {
+		last := &runs[n-1]
+		if record.Sequence == last.lastSeq+1 && record.Offset == last.firstOffset+record.Sequence-last.firstSeq {
+			last.lastSeq = record.Sequence
+			return
+		}
+	}
+	runs = append(runs, producerRun{
+		firstSeq:    record.Sequence,
+		lastSeq:     record.Sequence,
+		firstOffset: record.Offset,
+	})
+	if len(runs) > maxProducerRuns {
+		runs = append(runs[:0], runs[1:]...)
+	}
+	p.runs[record.ProducerId] = runs
+}
+
+// trackTxn opens the record's transaction with its first record and closes it with its control record
+func (p *producerStates) trackTxn(record *logger.Record) {
+	first, ok := p.ongoing[record.TxnId]
+	if record.Control == logger.Control_DATA {
+		if !ok {
+			p.ongoing[record.TxnId] = record.Offset
+		}
+		return
+	}
+	delete(p.ongoing, record.TxnId)
+	if !ok {
+		return
+	}
+	if record.Control == logger.Control_ABORT {
+		p.aborted[record.TxnId] = txnRange{first: first, last: record.Offset}
+	} else {
+		p.commits[record.TxnId] = record.Offset
+	}
+}
+
+// outcome returns the control record the transaction ended with, or DATA when it hasn't ended in the log
+func (p *producerStates) outcome(id uint64) logger.Control {
+	if _, ok := p.aborted[id]; ok {
+		return logger.Control_ABORT
+	}
+	if _, ok := p.commits[id]; ok {
+		return logger.Control_COMMIT
+	}
+	return logger.Control_DATA
+}
+
+// lastStableOffset returns the first offset of the oldest open transaction, or next when none is open
+func (p *producerStates) lastStableOffset(next uint64) uint64 {
+	for _, first := range p.ongoing {
+		if first < next {
+			next = first
+		}
+	}
+	return next
+}
+
+// committed reports whether a read committed consumer gets to see the record, which has to be below the
+// last stable offset: control records and the records of aborted transactions are skipped
+func (p *producerStates) committed(record *logger.Record) bool {
+	if record.Control != logger.Control_DATA {
+		return false
+	}
+	if record.TxnId == 0 {
+		return true
+	}
+	aborted, ok := p.aborted[record.TxnId]
+	return !ok || record.Offset < aborted.first || record.Offset > aborted.last
+}
+
+// forget drops the transactions that ended below lowest and the producers whose last run did, their
+// records are gone from the log. An expired producer that appends again starts over from sequence 0
+func (p *producerStates) forget(lowest uint64) {
+	for id, runs := range p.runs {
+		last := runs[len(runs)-1]
+		if last.firstOffset+last.lastSeq-last.firstSeq < lowest {
+			delete(p.runs, id)
+		}
+	}
+	for id, aborted := range p.aborted {
+		if aborted.last < lowest {
+			delete(p.aborted, id)
+		}
+	}
+	for id, last := range p.commits {
+		if last < lowest {
+			delete(p.commits, id)
+		}
+	}
+}
+
+// duplicate returns the offset the producer's sequence first was appended at, when first through last
+// were all appended together
+func (p *producerStates) duplicate(producerID, first, last uint64) (uint64, bool) {
+	for _, run := range p.runs[producerID] {
+		if first >= run.firstSeq && last <= run.lastSeq {
+			return run.firstOffset + first - run.firstSeq, true
+		}
+	}
+	return 0, false
+}
+
+// lastSequence returns the last sequence appended for the producer
+func (p *producerStates) lastSequence(producerID uint64) (uint64, bool) {
+	runs := p.runs[producerID]
+	if len(runs) == 0 {
+		return 0, false
+	}
+	return runs[len(runs)-1].lastSeq, true
+}
+
+// marshal encodes the state as next, the number of producers and then for every producer its ID,
+// the number of its runs and the runs themselves. The open transactions follow, as their number and
+// then every one's ID and first offset, and the aborted ones the same way with their last offset too.
+// The committed ones come last, as their number and every one's ID and control record offset
+func (p *producerStates) marshal() []byte {
+	b := make([]byte, 0, 2*lenWidth)
+	put := func(v uint64) {
+		var buf [lenWidth]byte
+		enc.PutUint64(buf[:], v)
+		b = append(b, buf[:]...)
+	}
+	put(p.next)
+	put(uint64(len(p.runs)))
+	for id, runs := range p.runs {
+		put(id)
+		put(uint64(len(runs)))
+		for _, run := range runs {
+			put(run.firstSeq)
+			put(run.lastSeq)
+			put(run.firstOffset)
+		}
+	}
+	put(uint64(len(p.ongoing)))
+	for id, first := range p.ongoing {
+		put(id)
+		put(first)
+	}
+	put(uint64(len(p.aborted)))
+	for id, aborted := range p.aborted {
+		put(id)
+		put(aborted.first)
+		put(aborted.last)
+	}
+	put(uint64(len(p.commits)))
+	for id, last := range p.commits {
+		put(id)
+		put(last)
+	}
+	return b
+}
+
+func unmarshalProducers(b []byte) (*producerStates, error) {
+	get := func() (uint64, error) {
+		if len(b) < lenWidth {
+			return 0, errCorruptProducers
+		}
+		v := enc.Uint64(b)
+		b = b[lenWidth:]
+		return v, nil
+	}
+	p := newProducerStates()
+	var err error
+	if p.next, err = get(); err != nil {
+		return nil, err
+	}
+	producers, err := get()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < producers; i++ {
+		id, err := get()
+		if err != nil {
+			return nil, err
+		}
+		n, err := get()
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 || n > maxProducerRuns {
+			return nil, errCorruptProducers
+		}
+		runs := make([]producerRun, n)
+		for j := range runs {
+			values := make([]uint64, 3)
+			for k := range values {
+				if values[k], err = get(); err != nil {
+					return nil, err
+				}
+			}
+			runs[j] = producerRun{firstSeq: values[0], lastSeq: values[1], firstOffset: values[2]}
+		}
+		p.runs[id] = runs
+	}
+	ongoing, err := get()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < ongoing; i++ {
+		id, err := get()
+		if err != nil {
+			return nil, err
+		}
+		if p.ongoing[id], err = get(); err != nil {
+			return nil, err
+		}
+	}
+	aborted, err := get()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < aborted; i++ {
+		values := make([]uint64, 3)
+		for k := range values {
+			if values[k], err = get(); err != nil {
+				return nil, err
+			}
+		}
+		p.aborted[values[0]] = txnRange{first: values[1], last: values[2]}
+	}
+	commits, err := get()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < commits; i++ {
+		id, err := get()
+		if err != nil {
+			return nil, err
+		}
+		if p.commits[id], err = get(); err != nil {
+			return nil, err
+		}
+	}
+	if len(b) != 0 {
+		return nil, errCorruptProducers
+	}
+	return p, nil
+}
+
+// loadProducers restores the producer state from the snapshot taken when the log last rolled a segment
+// or was closed, then catches up on the records appended after it. A missing or unusable snapshot is
+// rebuilt from the records themselves. The caller must hold the lock, or be setting the log up
+func (l *Log) loadProducers() error {
+	p := newProducerStates()
+	b, err := ioutil.ReadFile(path.Join(l.Dir, producersFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if snapshot, err := unmarshalProducers(b); err == nil && snapshot.next <= l.activeSegment.nextOffset {
+			p = snapshot
+		}
+	}
+	for _, s := range l.segments {
+		if s.nextOffset <= p.next {
+			continue
+		}
+		if err = s.scan(func(record *logger.Record) error {
+			if record.Offset >= p.next {
+				p.track(record)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	l.producers = p
+	return nil
+}
+
+// writeProducers snapshots the producer state, so opening the log only has to replay the records
+// appended after it. The caller must hold the lock
+func (l *Log) writeProducers() error {
+	if l.producers == nil {
+		// The log is still being set up
+		return nil
+	}
+	name := path.Join(l.Dir, producersFile)
+	if err := ioutil.WriteFile(name+".tmp", l.producers.marshal(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// track records the appended records in the producer state. The caller must hold the lock
+func (l *Log) track(records ...*logger.Record) {
+	for _, record := range records {
+		l.producers.track(record)
+	}
+}
+
+// Duplicate reports whether the producer's sequences first through last were already appended together,
+// returning the offset the record with sequence first was appended at
+func (l *Log) Duplicate(producerID, first, last uint64) (uint64, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.producers.duplicate(producerID, first, last)
+}
+
+// LastStableOffset returns the offset read committed consumers can read up to: the first offset of the
+// oldest transaction that is still open, or the next offset of the log when none is
+func (l *Log) LastStableOffset() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.producers.lastStableOffset(l.activeSegment.nextOffset)
+}
+
+// OngoingTransactions returns the IDs of the transactions with records in the log that haven't ended yet
+func (l *Log) OngoingTransactions() []uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	ids := make([]uint64, 0, len(l.producers.ongoing))
+	for id := range l.producers.ongoing {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// TransactionOngoing reports whether the transaction has records in the log and hasn't ended yet
+func (l *Log) TransactionOngoing(id uint64) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	_, ok := l.producers.ongoing[id]
+	return ok
+}
+
+// TransactionOutcome returns the control record the transaction ended with in the log, COMMIT or ABORT,
+// or DATA when it's still open or no record of it is left, commits being forgotten with ForgetCommit
+func (l *Log) TransactionOutcome(id uint64) logger.Control {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.producers.outcome(id)
+}
+
+// ForgetCommit drops the record of the transaction having committed in the log, once it's no use to
+// TransactionOutcome anymore. Its records stay visible to read committed consumers
+func (l *Log) ForgetCommit(id uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.producers.commits, id)
+}
+
+// LastSequence returns the last sequence appended to the log for the producer. Only the sequences of
+// a producer's most recent appends are remembered
+func (l *Log) LastSequence(producerID uint64) (uint64, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.producers.lastSequence(producerID)
+}
@@ -0,0 +1,224 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	api_v1 "github.com/schachte/kafkaclone/api/v1"
+	"github.com/schachte/kafkaclone/api/v1/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProducerState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "producer-state-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 4
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	// Producer 1 appends sequences 0-5 one at a time and producer 2 a batch of 0-2 in between,
+	// rolling a couple of segments along the way
+	for seq := uint64(0); seq < 3; seq++ {
+		_, err = log.Append(&logger.Record{Value: []byte("a"), ProducerId: 1, Sequence: seq})
+		require.NoError(t, err)
+	}
+	_, err = log.AppendBatch([]*logger.Record{
+		{Value: []byte("b"), ProducerId: 2, Sequence: 0},
+		{Value: []byte("b"), ProducerId: 2, Sequence: 1},
+		{Value: []byte("b"), ProducerId: 2, Sequence: 2},
+	}, logger.Compression_SNAPPY)
+	require.NoError(t, err)
+	for seq := uint64(3); seq < 6; seq++ {
+		_, err = log.Append(&logger.Record{Value: []byte("a"), ProducerId: 1, Sequence: seq})
+		require.NoError(t, err)
+	}
+	// Records of producers that aren't idempotent aren't tracked
+	_, err = log.Append(&logger.Record{Value: []byte("c")})
+	require.NoError(t, err)
+
+	check := func(log *Log) {
+		off, ok := log.Duplicate(1, 1, 1)
+		require.True(t, ok)
+		require.Equal(t, uint64(1), off)
+		off, ok = log.Duplicate(1, 4, 4)
+		require.True(t, ok)
+		require.Equal(t, uint64(7), off)
+		off, ok = log.Duplicate(2, 0, 2)
+		require.True(t, ok)
+		require.Equal(t, uint64(3), off)
+		_, ok = log.Duplicate(1, 6, 6)
+		require.False(t, ok)
+		// Sequences that weren't appended together aren't a duplicate
+		_, ok = log.Duplicate(1, 2, 3)
+		require.False(t, ok)
+
+		last, ok := log.LastSequence(1)
+		require.True(t, ok)
+		require.Equal(t, uint64(5), last)
+		last, ok = log.LastSequence(2)
+		require.True(t, ok)
+		require.Equal(t, uint64(2), last)
+		_, ok = log.LastSequence(0)
+		require.False(t, ok)
+	}
+	check(log)
+
+	// The state survives a restart, from the snapshot taken on Close
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	check(log)
+	require.NoError(t, log.Close())
+
+	// A stale snapshot is caught up from the records appended after it, a missing one is rebuilt
+	_, err = os.Stat(path.Join(dir, producersFile))
+	require.NoError(t, err)
+	for _, snapshot := range []*producerStates{{runs: map[uint64][]producerRun{}, next: 6}, nil} {
+		name := path.Join(dir, producersFile)
+		if snapshot == nil {
+			require.NoError(t, os.Remove(name))
+		} else {
+			require.NoError(t, ioutil.WriteFile(name, snapshot.marshal(), 0644))
+		}
+		log, err = NewLog(dir, c)
+		require.NoError(t, err)
+		_, ok := log.LastSequence(2)
+		require.Equal(t, snapshot == nil, ok)
+		last, ok := log.LastSequence(1)
+		require.True(t, ok)
+		require.Equal(t, uint64(5), last)
+		require.NoError(t, log.Close())
+	}
+
+	// Truncating the log forgets the sequences it removes
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.NoError(t, log.TruncateFrom(7))
+	last, ok := log.LastSequence(1)
+	require.True(t, ok)
+	require.Equal(t, uint64(3), last)
+	_, ok = log.Duplicate(1, 4, 4)
+	require.False(t, ok)
+	off, ok := log.Duplicate(1, 3, 3)
+	require.True(t, ok)
+	require.Equal(t, uint64(6), off)
+
+	require.NoError(t, log.Reset())
+	_, ok = log.LastSequence(1)
+	require.False(t, ok)
+	require.NoError(t, log.Close())
+}
+
+func TestProducerExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "producer-expiry-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	// Producer 1's only record is in the first segment, producer 2 carries on into the second
+	for _, record := range []*logger.Record{
+		{Value: []byte("a"), ProducerId: 1, Sequence: 0},
+		{Value: []byte("b"), ProducerId: 2, Sequence: 0},
+		{Value: []byte("b"), ProducerId: 2, Sequence: 1},
+		{Value: []byte("c")},
+	} {
+		_, err = log.Append(record)
+		require.NoError(t, err)
+	}
+
+	// Once the first segment is gone, so is producer 1, for good
+	require.NoError(t, log.Truncate(1))
+	for i := 0; i < 2; i++ {
+		_, ok := log.LastSequence(1)
+		require.False(t, ok)
+		last, ok := log.LastSequence(2)
+		require.True(t, ok)
+		require.Equal(t, uint64(1), last)
+
+		require.NoError(t, log.Close())
+		log, err = NewLog(dir, c)
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+}
+
+func TestTransactionState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transaction-state-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+
+	appendRecord := func(value string, txn uint64, control logger.Control) {
+		_, err := log.Append(&logger.Record{Value: []byte(value), TxnId: txn, Control: control})
+		require.NoError(t, err)
+	}
+	values := func(records []*logger.Record) []string {
+		var values []string
+		for _, record := range records {
+			values = append(values, string(record.Value))
+		}
+		return values
+	}
+
+	appendRecord("plain 0", 0, logger.Control_DATA)
+	appendRecord("txn 1 a", 1, logger.Control_DATA)
+	appendRecord("txn 2 a", 2, logger.Control_DATA)
+	appendRecord("plain 3", 0, logger.Control_DATA)
+	appendRecord("txn 1 b", 1, logger.Control_DATA)
+
+	// Read committed consumers stop at the first record of the oldest open transaction
+	require.Equal(t, uint64(1), log.LastStableOffset())
+	require.Equal(t, []uint64{1, 2}, log.OngoingTransactions())
+	records, err := log.ReadCommitted(0, 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"plain 0"}, values(records))
+	_, err = log.ReadCommitted(1, 0, 0)
+	require.IsType(t, api_v1.ErrOffsetOutOfRange{}, err)
+
+	appendRecord("", 1, logger.Control_ABORT)
+	require.Equal(t, uint64(2), log.LastStableOffset())
+	appendRecord("", 2, logger.Control_COMMIT)
+	require.Equal(t, uint64(7), log.LastStableOffset())
+	require.Empty(t, log.OngoingTransactions())
+
+	check := func(log *Log) {
+		records, err := log.ReadCommitted(0, 0, 0)
+		require.NoError(t, err)
+		require.Equal(t, []string{"plain 0", "txn 2 a", "plain 3"}, values(records))
+		records, err = log.ReadCommitted(1, 1, 0)
+		require.NoError(t, err)
+		require.Equal(t, []string{"txn 2 a"}, values(records))
+		require.Equal(t, logger.Control_ABORT, log.TransactionOutcome(1))
+		require.Equal(t, logger.Control_COMMIT, log.TransactionOutcome(2))
+		require.Equal(t, logger.Control_DATA, log.TransactionOutcome(3))
+	}
+	check(log)
+
+	// Read uncommitted consumers see everything, control records included
+	records, err = log.ReadRange(0, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, records, 7)
+
+	// How the transactions ended survives a restart
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+	check(log)
+
+	// A transaction left open by a truncation holds the last stable offset back again
+	require.NoError(t, log.TruncateFrom(6))
+	require.Equal(t, uint64(2), log.LastStableOffset())
+	require.Equal(t, []uint64{2}, log.OngoingTransactions())
+	require.NoError(t, log.Close())
+}
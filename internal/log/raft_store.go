@@ -0,0 +1,103 @@
+package log
+
+import (
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/schachte/kafkaclone/api/v1/logger"
+)
+
+// RaftStore lets a Log act as Raft's log store. Raft indexes start at 1, so the log is created with
+// that initial offset and every Raft index maps directly onto a log offset
+type RaftStore struct {
+	*Log
+}
+
+var _ raft.LogStore = (*RaftStore)(nil)
+
+// extensionsHeader is the header an entry's extensions are kept in, the trace context of writes. The leader
+// sends its followers the entries as they're read back from the store, so they have to survive it
+const extensionsHeader = "raft-extensions"
+
+// NewRaftStore opens (or creates) the Raft log in dir
+func NewRaftStore(dir string, c Config) (*RaftStore, error) {
+	c.Segment.InitialOffset = 1
+	log, err := NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+	return &RaftStore{log}, nil
+}
+
+func (r *RaftStore) FirstIndex() (uint64, error) {
+	return r.LowestOffset()
+}
+
+func (r *RaftStore) LastIndex() (uint64, error) {
+	return r.HighestOffset()
+}
+
+// GetLog reads the entry at index into out
+func (r *RaftStore) GetLog(index uint64, out *raft.Log) error {
+	in, err := r.Read(index)
+	if err != nil {
+		return err
+	}
+	if in.Offset != index {
+		return raft.ErrLogNotFound
+	}
+	out.Data = in.Value
+	out.Index = in.Offset
+	out.Type = raft.LogType(in.Type)
+	out.Term = in.Term
+	out.AppendedAt = time.Unix(0, in.Timestamp*int64(time.Millisecond))
+	out.Extensions = nil
+	for _, h := range in.Headers {
+		if h.Key == extensionsHeader {
+			out.Extensions = h.Value
+		}
+	}
+	return nil
+}
+
+func (r *RaftStore) StoreLog(record *raft.Log) error {
+	return r.StoreLogs([]*raft.Log{record})
+}
+
+// StoreLogs appends the entries at their own index. After a snapshot is installed the next index can be
+// ahead of the log, the skipped indexes are left as a gap. The time the leader appended an entry is kept
+// as the record's timestamp, followers stamp the records they apply with it
+func (r *RaftStore) StoreLogs(records []*raft.Log) error {
+	for _, record := range records {
+		in := &logger.Record{
+			Value:  record.Data,
+			Offset: record.Index,
+			Term:   record.Term,
+			Type:   uint32(record.Type),
+		}
+		if !record.AppendedAt.IsZero() {
+			in.Timestamp = record.AppendedAt.UnixNano() / int64(time.Millisecond)
+		}
+		if len(record.Extensions) > 0 {
+			in.Headers = []*logger.Header{{Key: extensionsHeader, Value: record.Extensions}}
+		}
+		if err := r.AppendAt(in); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteRange is called with the oldest entries once they're covered by a snapshot, and with the newest
+// ones when a follower has to drop entries that conflict with the leader's log. Removing old entries
+// only drops whole segments, so some of them may linger
+func (r *RaftStore) DeleteRange(min, max uint64) error {
+	first, err := r.FirstIndex()
+	if err != nil {
+		return err
+	}
+	if min > first {
+		return r.TruncateFrom(min)
+	}
+	return r.Truncate(max)
+}
@@ -0,0 +1,183 @@
+package log
+
+import (
+	"io"
+
+	api_v1 "github.com/schachte/kafkaclone/api/v1"
+	"github.com/schachte/kafkaclone/api/v1/logger"
+	"github.com/schachte/kafkaclone/pkg/compression"
+	"google.golang.org/protobuf/proto"
+)
+
+// consistent does a cheap check that the index and store of a segment agree with each other.
+// It only looks at the last index entry, which is where an unclean shutdown leaves its mark:
+// the index file is still grown to MaxIndexBytes (zeroed entries) or the store has a torn tail
+func (s *segment) consistent() bool {
+	if s.index.size%entWidth != 0 {
+		return false
+	}
+	if s.index.size == 0 || s.store.size == 0 {
+		return s.index.size == 0 && s.store.size == 0
+	}
+	off, pos, err := s.index.Read(-1)
+	if err != nil {
+		return false
+	}
+	// Relative offsets only ever increase (compaction may leave gaps), so the last entry can't be
+	// lower than the number of entries. Zeroed entries from a crash fail this check
+	if uint64(off)+1 < s.index.size/entWidth {
+		return false
+	}
+	_, n, err := s.store.readFrame(pos)
+	if err != nil {
+		return false
+	}
+	// The last record must end exactly where the store ends
+	return pos+n == s.store.size
+}
+
+// recover scans every frame in the store, truncates the store when its last frame fails verification
+// (a partial tail record after a crash) and rebuilds the index from what survived. A bad frame with
+// more frames after it, or one that passes its checksum but doesn't decode, wasn't torn by a crash,
+// so rather than dropping it and every record after it the store is left alone and recover fails
+// with ErrCorruptRecord
+func (s *segment) recover() error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	entries, end, torn, err := s.readIntact()
+	if err != nil {
+		return err
+	}
+	if end < s.store.size {
+		if !torn {
+			next := s.baseOffset
+			if len(entries) > 0 {
+				next += uint64(entries[len(entries)-1].off) + 1
+			}
+			return api_v1.ErrCorruptRecord{Offset: next, Segment: s.baseOffset}
+		}
+		if err = s.store.truncate(end); err != nil {
+			return err
+		}
+	}
+	return s.reindex(entries)
+}
+
+// repair rebuilds the index from the frames in front of the store's first bad frame, whatever made it bad,
+// and returns how many bytes there are from that frame on. They're only cut off the store when truncate is set
+func (s *segment) repair(truncate bool) (uint64, error) {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	entries, end, _, err := s.readIntact()
+	if err != nil {
+		return 0, err
+	}
+	unreadable := s.store.size - end
+	if truncate && unreadable > 0 {
+		if err = s.store.truncate(end); err != nil {
+			return 0, err
+		}
+	}
+	return unreadable, s.reindex(entries)
+}
+
+// recoveredEntry is an index entry rebuilt from the store, with what the time index needs of its record
+type recoveredEntry struct {
+	off       uint32
+	pos, n    uint64
+	timestamp int64
+}
+
+// readIntact reads the store's frames in order up to the first one that fails verification, returning the
+// entries of the records in front of it and the position it starts at, the store's size when there's
+// none. torn reports whether the bad frame is the partial tail record a crash leaves behind rather
+// than corruption. The caller must hold the store's lock
+func (s *segment) readIntact() (entries []recoveredEntry, end uint64, torn bool, err error) {
+	if err := s.store.buf.Flush(); err != nil {
+		return nil, 0, false, err
+	}
+	var pos uint64
+	for {
+		p, n, err := s.store.readFrame(pos)
+		if err == io.EOF {
+			return entries, pos, false, nil
+		}
+		if err == errCorruptFrame {
+			return entries, pos, s.store.reachesEnd(pos), nil
+		}
+		if err != nil {
+			return nil, 0, false, err
+		}
+
+		// Every record carries its own offset, which has to follow on from the previous one.
+		// A compressed batch holds several records, all of them found at the batch's frame
+		next := s.baseOffset
+		if len(entries) > 0 {
+			next += uint64(entries[len(entries)-1].off) + 1
+		}
+		records, ok := recoverFrame(p, next)
+		if !ok {
+			// Legacy frames carry no checksum, so a last payload that doesn't decode is the only sign of a torn tail
+			return entries, pos, n != headerWidth+uint64(len(p)) && pos+n == s.store.size, nil
+		}
+		for i, record := range records {
+			e := recoveredEntry{
+				off:       uint32(record.Offset - s.baseOffset),
+				pos:       pos,
+				timestamp: record.Timestamp,
+			}
+			// The frame's bytes are counted towards its last record, as when it was appended
+			if i == len(records)-1 {
+				e.n = n
+			}
+			entries = append(entries, e)
+		}
+		pos += n
+	}
+}
+
+// reindex rewrites both indexes from scratch with the entries, so zeroed or stale entries left behind by
+// a crash are dropped. The caller must hold the store's lock
+func (s *segment) reindex(entries []recoveredEntry) error {
+	s.index.size = 0
+	if err := s.timeIndex.Reset(); err != nil {
+		return err
+	}
+	s.maxTimestamp, s.maxTimestampOff, s.unindexedBytes = 0, 0, 0
+	for _, e := range entries {
+		if err := s.index.Write(e.off, e.pos); err != nil {
+			return err
+		}
+		record := &logger.Record{Offset: s.baseOffset + uint64(e.off), Timestamp: e.timestamp}
+		if err := s.indexTime(record, e.n); err != nil {
+			return err
+		}
+	}
+
+	if off, _, err := s.index.Read(-1); err != nil {
+		s.nextOffset = s.baseOffset
+	} else {
+		s.nextOffset = s.baseOffset + uint64(off) + 1
+	}
+	return s.sealTimeIndex()
+}
+
+// recoverFrame decodes the records held by the payload of a frame, checking that their offsets
+// keep going up from next, the lowest offset the frame's first record can have
+func recoverFrame(p []byte, next uint64) ([]*logger.Record, bool) {
+	frame := &logger.Record{}
+	if err := proto.Unmarshal(p, frame); err != nil {
+		return nil, false
+	}
+	records, err := compression.Unbatch(frame)
+	if err != nil || len(records) == 0 {
+		return nil, false
+	}
+	for _, record := range records {
+		if record.Offset < next {
+			return nil, false
+		}
+		next = record.Offset + 1
+	}
+	return records, true
+}
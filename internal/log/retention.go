@@ -0,0 +1,125 @@
+package log
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RetentionStats summarises what the cleaner has deleted since the log was opened
+type RetentionStats struct {
+	SegmentsDeleted uint64
+	RecordsDeleted  uint64
+	BytesDeleted    uint64
+	LastRun         time.Time
+}
+
+// StartCleaner launches the background goroutine that enforces the retention policies in
+// Config.Retention and compacts the log when Config.Compaction is enabled. It's stopped by Close
+func (l *Log) StartCleaner() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopCleaner != nil {
+		return
+	}
+	l.stopCleaner = make(chan struct{})
+	l.cleaner.Add(1)
+	go l.clean(l.stopCleaner)
+}
+
+// stopCleaning signals the cleaner to exit and waits for it. It must be called without holding the lock
+func (l *Log) stopCleaning() {
+	l.mu.Lock()
+	stop := l.stopCleaner
+	l.stopCleaner = nil
+	l.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		l.cleaner.Wait()
+	}
+}
+
+func (l *Log) clean(stop chan struct{}) {
+	defer l.cleaner.Done()
+	ticker := time.NewTicker(l.Config.Retention.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := l.applyRetention(); err != nil {
+				l.logger.Error("failed to apply retention", zap.Error(err))
+			}
+			if !l.Config.Compaction.Enabled {
+				continue
+			}
+			if err := l.Compact(); err != nil {
+				l.logger.Error("failed to compact", zap.Error(err))
+			}
+		}
+	}
+}
+
+// RetentionStats returns a copy of the cleaner's running totals
+func (l *Log) RetentionStats() RetentionStats {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.stats
+}
+
+// applyRetention deletes the oldest segments for as long as any retention policy is exceeded.
+// Only whole segments are removed and the active segment is always kept, so the log stays contiguous
+func (l *Log) applyRetention() error {
+	l.compacting.Lock()
+	defer l.compacting.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r := l.Config.Retention
+	var total uint64
+	for _, s := range l.segments {
+		total += s.size()
+	}
+
+	now := time.Now()
+	for len(l.segments) > 1 {
+		s := l.segments[0]
+		size := s.size()
+
+		var reason string
+		switch {
+		case r.MaxSegments > 0 && len(l.segments) > r.MaxSegments:
+			reason = "max segments"
+		case r.MaxBytes > 0 && total > r.MaxBytes:
+			reason = "max bytes"
+		case r.MaxAge > 0 && now.Sub(s.newestRecordTime()) > r.MaxAge:
+			reason = "max age"
+		}
+		if reason == "" {
+			break
+		}
+
+		if err := s.removeWhenIdle(); err != nil {
+			return err
+		}
+		l.segments = l.segments[1:]
+		total -= size
+
+		l.stats.SegmentsDeleted++
+		// Compaction leaves gaps in the offsets, the index has an entry for every record still in the segment
+		l.stats.RecordsDeleted += s.index.size / entWidth
+		l.stats.BytesDeleted += size
+		l.logger.Info(
+			"deleted segment",
+			zap.String("reason", reason),
+			zap.Uint64("base_offset", s.baseOffset),
+			zap.Uint64("next_offset", s.nextOffset),
+			zap.Uint64("bytes", size),
+		)
+	}
+	// The transactions that ended in the deleted segments are gone along with them
+	l.producers.forget(l.segments[0].baseOffset)
+	l.stats.LastRun = now
+	return nil
+}
@@ -0,0 +1,189 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/schachte/kafkaclone/api/v1/logger"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestRetention(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, c *Config){
+		"max segments": func(t *testing.T, c *Config) { c.Retention.MaxSegments = 2 },
+		"max bytes":    func(t *testing.T, c *Config) { c.Retention.MaxBytes = 100 },
+		"max age":      func(t *testing.T, c *Config) { c.Retention.MaxAge = time.Nanosecond },
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "retention-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 16
+			fn(t, &c)
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+
+			// Every record fills a segment, so this leaves three closed segments and an empty active one
+			appendRecord := &logger.Record{Value: []byte("hello world")}
+			for i := 0; i < 3; i++ {
+				_, err := log.Append(appendRecord)
+				require.NoError(t, err)
+			}
+
+			// Snapshot taken before the cleaner runs must still be able to read everything
+			reader := log.Reader()
+
+			require.NoError(t, log.applyRetention())
+			stats := log.RetentionStats()
+			require.NotZero(t, stats.SegmentsDeleted)
+			require.Equal(t, stats.SegmentsDeleted, stats.RecordsDeleted)
+
+			lowest, err := log.LowestOffset()
+			require.NoError(t, err)
+			require.Equal(t, stats.RecordsDeleted, lowest)
+			_, err = log.Read(0)
+			require.Error(t, err)
+
+			b, err := ioutil.ReadAll(reader)
+			require.NoError(t, err)
+			for i := uint64(0); i < 3; i++ {
+				read := &logger.Record{}
+				size := enc.Uint64(b[headerWidth-lenWidth : headerWidth])
+				require.NoError(t, proto.Unmarshal(b[headerWidth:headerWidth+size], read))
+				require.Equal(t, i, read.Offset)
+				b = b[headerWidth+size:]
+			}
+		})
+	}
+}
+
+func TestCleaner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cleaner-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 16
+	c.Retention.MaxSegments = 1
+	c.Retention.CheckInterval = 10 * time.Millisecond
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	log.StartCleaner()
+
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&logger.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	require.Eventually(t, func() bool {
+		return log.RetentionStats().SegmentsDeleted == 3
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, log.Close())
+}
+
+func TestRetentionForgetsTransactions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retention-txn-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 16
+	c.Retention.MaxSegments = 1
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// Every record fills a segment, the aborted transaction is deleted along with its segments
+	for _, record := range []*logger.Record{
+		{Value: []byte("txn"), TxnId: 1},
+		{TxnId: 1, Control: logger.Control_ABORT},
+		{Value: []byte("plain")},
+	} {
+		_, err := log.Append(record)
+		require.NoError(t, err)
+	}
+	require.Equal(t, logger.Control_ABORT, log.TransactionOutcome(1))
+	require.NoError(t, log.applyRetention())
+	require.Equal(t, logger.Control_DATA, log.TransactionOutcome(1))
+	require.Empty(t, log.producers.aborted)
+}
+
+// TestRetentionByTimestamp checks that max age goes by the records' timestamps rather than when segments were written
+func TestRetentionByTimestamp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retention-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 16
+	c.Retention.MaxAge = time.Hour
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	now := time.Now()
+	for _, age := range []time.Duration{3 * time.Hour, 2 * time.Hour, time.Minute} {
+		ts := now.Add(-age).UnixNano() / int64(time.Millisecond)
+		_, err := log.Append(&logger.Record{Value: []byte("hello world"), Timestamp: ts})
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, log.applyRetention())
+	require.Equal(t, uint64(2), log.RetentionStats().SegmentsDeleted)
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), lowest)
+}
+
+// TestRetentionCompacted checks that the stats count the records compaction left in the deleted segments and
+// every file they took up on disk
+func TestRetentionCompacted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retention-compacted-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 80
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	// Each key is written three times, compaction only keeps the latest of each in the closed segments
+	for _, key := range []string{"a", "b", "a", "b", "a", "b"} {
+		_, err := log.Append(&logger.Record{Key: []byte(key), Value: []byte(key)})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Compact())
+	closed := log.segments[:len(log.segments)-1]
+	var records uint64
+	for _, s := range closed {
+		records += s.index.size / entWidth
+	}
+	require.True(t, records < log.activeSegment.baseOffset)
+	require.NoError(t, log.Close())
+
+	var bytes uint64
+	for _, s := range closed {
+		for _, ext := range []string{storeExt, indexExt, timeIndexExt} {
+			fi, err := os.Stat(path.Join(dir, fmt.Sprintf("%d%s", s.baseOffset, ext)))
+			require.NoError(t, err)
+			bytes += uint64(fi.Size())
+		}
+	}
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	log.Config.Retention.MaxSegments = 1
+	require.NoError(t, log.applyRetention())
+	stats := log.RetentionStats()
+	require.Equal(t, uint64(len(closed)), stats.SegmentsDeleted)
+	require.Equal(t, records, stats.RecordsDeleted)
+	require.Equal(t, bytes, stats.BytesDeleted)
+}
@@ -1,19 +1,46 @@
 package log
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	api_v1 "github.com/schachte/kafkaclone/api/v1"
 	"github.com/schachte/kafkaclone/api/v1/logger"
+	"github.com/schachte/kafkaclone/pkg/compression"
 	"google.golang.org/protobuf/proto"
 )
 
+const (
+	storeExt = ".store"
+	indexExt = ".index"
+)
+
+// errCompressedRecord is the error of appending a single record marked as a compressed batch
+var errCompressedRecord = errors.New("record claims to be a compressed batch")
+
 type segment struct {
 	store                  *store
 	index                  *index
+	timeIndex              *timeIndex
 	baseOffset, nextOffset uint64
 	config                 Config
+	modTime                time.Time      // when the segment was last written to
+	readers                sync.WaitGroup // open Log.Reader snapshots over this segment
+	readerCount            int32          // how many of them there are, see reading
+
+	maxTimestamp    int64  // largest record timestamp in the segment, zero if none of them have one
+	maxTimestampOff uint64 // offset of the record maxTimestamp came from
+	unindexedBytes  uint64 // bytes appended since the last time index entry
+
+	batches           batchCache
+	uncompressedBytes uint64 // how big the records would be stored uncompressed, once statsKnown
+	statsKnown        bool
 }
 
 // newSegment will generate a new segment given
@@ -28,7 +55,7 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	// Open or create the user-specified segment file
 	// Format is <OFFSET>.store
 	storeFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")),
+		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, storeExt)),
 		os.O_RDWR|os.O_CREATE|os.O_APPEND,
 		0644,
 	)
@@ -40,10 +67,15 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	if s.store, err = newStore(storeFile); err != nil {
 		return nil, err
 	}
+	fi, err := storeFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	s.modTime = fi.ModTime()
 
 	// Create an index file that contains metadata about the record positions within the store
 	indexFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
+		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, indexExt)),
 		os.O_RDWR|os.O_CREATE,
 		0644,
 	)
@@ -60,19 +92,41 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	} else {
 		s.nextOffset = baseOffset + uint64(off) + 1
 	}
+
+	timeIndexFile, err := os.OpenFile(
+		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, timeIndexExt)),
+		os.O_RDWR|os.O_CREATE,
+		0644,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if s.timeIndex, err = newTimeIndex(timeIndexFile); err != nil {
+		return nil, err
+	}
+	if last, ok := s.timeIndex.Last(); ok {
+		s.maxTimestamp = last.timestamp
+		s.maxTimestampOff = baseOffset + uint64(last.off)
+	}
 	return s, nil
 }
 
 // Append will append a record to the store file of a given segment
 func (s *segment) Append(record *logger.Record) (offset uint64, err error) {
+	if record.Compression != logger.Compression_NONE {
+		// Only appendBatch writes compressed batches, a record claiming to be one couldn't be read back
+		return 0, errCompressedRecord
+	}
 	cur := s.nextOffset
 	record.Offset = cur
+	now := time.Now()
+	s.stamp(record, now)
 	p, err := proto.Marshal(record)
 	if err != nil {
 		return 0, err
 	}
 
-	_, pos, err := s.store.Append(p)
+	n, pos, err := s.store.Append(p)
 	if err != nil {
 		return 0, err
 	}
@@ -83,28 +137,210 @@ func (s *segment) Append(record *logger.Record) (offset uint64, err error) {
 		return 0, err
 	}
 	s.nextOffset++
+	s.modTime = now
+	s.uncompressedBytes += n
+	if err = s.indexTime(record, n); err != nil {
+		return 0, err
+	}
 	return cur, nil
 }
 
+// stamp sets the timestamp of a record that doesn't have one, or of every record with log append time
+func (s *segment) stamp(record *logger.Record, now time.Time) {
+	if record.Timestamp == 0 || s.config.Timestamp.LogAppendTime {
+		record.Timestamp = now.UnixNano() / int64(time.Millisecond)
+	}
+}
+
+// indexTime tracks the largest timestamp in the segment and adds it to the time index once
+// enough bytes have been appended since the last entry
+func (s *segment) indexTime(record *logger.Record, n uint64) error {
+	if record.Timestamp > s.maxTimestamp {
+		s.maxTimestamp = record.Timestamp
+		s.maxTimestampOff = record.Offset
+	}
+	s.unindexedBytes += n
+	if s.unindexedBytes < s.config.Segment.TimeIndexIntervalBytes {
+		return nil
+	}
+	s.unindexedBytes = 0
+	return s.sealTimeIndex()
+}
+
+// sealTimeIndex makes sure the time index holds the segment's largest timestamp
+func (s *segment) sealTimeIndex() error {
+	if s.maxTimestamp == 0 {
+		return nil
+	}
+	return s.timeIndex.Write(s.maxTimestamp, uint32(s.maxTimestampOff-s.baseOffset))
+}
+
+// rebuildTimeIndex recreates the time index from the records in the store
+func (s *segment) rebuildTimeIndex() error {
+	if err := s.timeIndex.Reset(); err != nil {
+		return err
+	}
+	s.maxTimestamp, s.maxTimestampOff, s.unindexedBytes = 0, 0, 0
+	if err := s.scanBatches(func(_ *logger.Record, records []*logger.Record, p []byte) error {
+		return s.indexTimes(records, uint64(len(p))+headerWidth)
+	}); err != nil {
+		return err
+	}
+	return s.sealTimeIndex()
+}
+
+// newestRecordTime is the timestamp of the newest record in the segment, falling back to when the segment
+// was last written to if its records don't carry timestamps
+func (s *segment) newestRecordTime() time.Time {
+	if s.maxTimestamp == 0 {
+		return s.modTime
+	}
+	return time.Unix(0, s.maxTimestamp*int64(time.Millisecond))
+}
+
+// offsetForTime returns the earliest offset in the segment whose record's timestamp is greater
+// than or equal to timestamp, or io.EOF if there is none
+func (s *segment) offsetForTime(timestamp int64) (uint64, error) {
+	off := s.baseOffset
+	if entry, ok := s.timeIndex.Before(timestamp); ok {
+		off = s.baseOffset + uint64(entry.off) + 1
+	}
+	for off < s.nextOffset {
+		record, err := s.Read(off)
+		if err != nil {
+			return 0, err
+		}
+		if record.Timestamp >= timestamp {
+			return record.Offset, nil
+		}
+		off = record.Offset + 1
+	}
+	return 0, io.EOF
+}
+
 // Read will unmarshal a record given an offset
+// If the offset was compacted away the next surviving record in the segment is returned instead, or io.EOF when there is none
 func (s *segment) Read(off uint64) (*logger.Record, error) {
 	// Find the location of the record by checking the index file
 	// The only reason we subtract the baseOffset is because the user can specify a base that is a non-zero unsigned integer
-	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	rel, pos, err := s.index.Seek(uint32(off - s.baseOffset))
 	if err != nil {
 		return nil, err
 	}
+	off = s.baseOffset + uint64(rel)
+	if records, ok := s.batches.get(pos); ok {
+		return recordAt(records, off)
+	}
 
 	// Now that we have the location of the record, we need to pull it from the store
 	p, err := s.store.Read(pos)
+	if err == errCorruptFrame {
+		return nil, api_v1.ErrCorruptRecord{Offset: off, Segment: s.baseOffset}
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	// We have the record as a byte array in p, time to marshal into a struct of api.Record
+	// Legacy frames carry no checksum, so a payload that doesn't decode is the only sign of damage
 	record := &logger.Record{}
-	err = proto.Unmarshal(p, record)
-	return record, err
+	if err = proto.Unmarshal(p, record); err != nil {
+		return nil, api_v1.ErrCorruptRecord{Offset: off, Segment: s.baseOffset}
+	}
+	if record.Compression == logger.Compression_NONE {
+		return record, nil
+	}
+	records, err := s.unbatch(pos, record)
+	if err != nil {
+		return nil, api_v1.ErrCorruptRecord{Offset: off, Segment: s.baseOffset}
+	}
+	return recordAt(records, off)
+}
+
+// recordAt picks the record at off out of a batch. It's copied, since the batch is cached
+func recordAt(records []*logger.Record, off uint64) (*logger.Record, error) {
+	for _, record := range records {
+		if record.Offset == off {
+			return proto.Clone(record).(*logger.Record), nil
+		}
+	}
+	return nil, io.EOF
+}
+
+// truncateFrom drops every record with an offset of off or higher
+func (s *segment) truncateFrom(off uint64) error {
+	if off < s.baseOffset {
+		off = s.baseOffset
+	}
+	entry := s.index.search(uint32(off - s.baseOffset))
+	if uint64(entry)*entWidth < s.index.size {
+		_, pos, err := s.index.Read(entry)
+		if err != nil {
+			return err
+		}
+		// off can fall in the middle of a compressed batch, whose records before it have to survive
+		var kept *logger.Record
+		if entry > 0 {
+			if _, prev, err := s.index.Read(entry - 1); err != nil {
+				return err
+			} else if prev == pos {
+				if kept, err = s.keepBefore(pos, off); err != nil {
+					return err
+				}
+			}
+		}
+		s.store.mu.Lock()
+		err = s.store.truncate(pos)
+		s.store.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		s.index.size = uint64(entry) * entWidth
+		s.batches.clear()
+		s.statsKnown = false
+		if kept != nil {
+			// The store ends where the batch used to start, so the index entries of the kept records stay valid
+			p, err := proto.Marshal(kept)
+			if err != nil {
+				return err
+			}
+			if _, _, err = s.store.Append(p); err != nil {
+				return err
+			}
+		}
+	}
+	if s.nextOffset > off {
+		s.nextOffset = off
+	}
+	return s.rebuildTimeIndex()
+}
+
+// keepBefore returns the batch stored at pos cut down to its records before off
+func (s *segment) keepBefore(pos, off uint64) (*logger.Record, error) {
+	p, err := s.store.Read(pos)
+	if err != nil {
+		return nil, err
+	}
+	frame := &logger.Record{}
+	if err = proto.Unmarshal(p, frame); err != nil {
+		return nil, err
+	}
+	records, err := compression.Unbatch(frame)
+	if err != nil {
+		return nil, err
+	}
+	var kept []*logger.Record
+	for _, record := range records {
+		if record.Offset < off {
+			kept = append(kept, record)
+		}
+	}
+	return compression.Batch(frame.Compression, kept)
+}
+
+// size is how many bytes the segment's store and indexes take up on disk
+func (s *segment) size() uint64 {
+	return s.store.size + s.index.size + s.timeIndex.size()
 }
 
 // IsMaxed will check:
@@ -120,16 +356,65 @@ func (s *segment) Remove() error {
 	if err := s.Close(); err != nil {
 		return err
 	}
+	if err := os.Remove(s.timeIndex.Name()); err != nil {
+		return err
+	}
+	if err := os.Remove(s.index.Name()); err != nil {
+		return err
+	}
+	if err := os.Remove(s.store.Name()); err != nil {
+		return err
+	}
+	return nil
+}
+
+// removeWhenIdle deletes the segment's files straight away but only closes them once every
+// Log.Reader snapshot still reading the segment has finished, so those readers aren't cut off
+func (s *segment) removeWhenIdle() error {
+	if err := os.Remove(s.timeIndex.Name()); err != nil {
+		return err
+	}
 	if err := os.Remove(s.index.Name()); err != nil {
 		return err
 	}
 	if err := os.Remove(s.store.Name()); err != nil {
 		return err
 	}
+	s.closeWhenIdle()
 	return nil
 }
 
+// read registers a Log.Reader snapshot over the segment, which keeps its files open until the returned
+// func is called
+func (s *segment) read() func() {
+	s.readers.Add(1)
+	atomic.AddInt32(&s.readerCount, 1)
+	return func() {
+		atomic.AddInt32(&s.readerCount, -1)
+		s.readers.Done()
+	}
+}
+
+// reading reports whether a Log.Reader snapshot is still using the segment
+func (s *segment) reading() bool {
+	return atomic.LoadInt32(&s.readerCount) > 0
+}
+
+// closeWhenIdle closes the segment in the background once no Log.Reader snapshot is using it
+func (s *segment) closeWhenIdle() {
+	go func() {
+		s.readers.Wait()
+		_ = s.Close()
+	}()
+}
+
 func (s *segment) Close() error {
+	if err := s.sealTimeIndex(); err != nil {
+		return err
+	}
+	if err := s.timeIndex.Close(); err != nil {
+		return err
+	}
 	if err := s.index.Close(); err != nil {
 		return err
 	}
@@ -57,3 +57,49 @@ func TestSegment(t *testing.T) {
 	require.NoError(t, err)
 	require.False(t, s.IsMaxed())
 }
+
+func TestSegmentHeaders(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+
+	want := &logger.Record{
+		Value: []byte("hello world"),
+		Key:   []byte("user-1"),
+		Headers: []*logger.Header{
+			{Key: "trace-id", Value: []byte("abc123")},
+			{Key: "content-type", Value: []byte("text/plain")},
+		},
+	}
+	off, err := s.Append(want)
+	require.NoError(t, err)
+	// Records from before keys and headers existed are just records without them
+	legacy, err := s.Append(&logger.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	// Only batches are stored compressed, a lone record claiming to be one is refused
+	_, err = s.Append(&logger.Record{Value: []byte("hello world"), Compression: logger.Compression_GZIP})
+	require.Equal(t, errCompressedRecord, err)
+	require.Equal(t, legacy+1, s.nextOffset)
+	require.NoError(t, s.Close())
+
+	s, err = newSegment(dir, 0, c)
+	require.NoError(t, err)
+	defer s.Close()
+	got, err := s.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, want.Key, got.Key)
+	require.Len(t, got.Headers, 2)
+	for i, h := range want.Headers {
+		require.Equal(t, h.Key, got.Headers[i].Key)
+		require.Equal(t, h.Value, got.Headers[i].Value)
+	}
+	got, err = s.Read(legacy)
+	require.NoError(t, err)
+	require.Empty(t, got.Key)
+	require.Empty(t, got.Headers)
+}
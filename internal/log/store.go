@@ -3,6 +3,9 @@ package log
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
 	"os"
 	"sync"
 )
@@ -14,13 +17,33 @@ var (
 const (
 	// represents the number of bytes used to store the length of the payload array that is of size .. size as a 64 bit integer valued (8 byte val = 64 bits)
 	lenWidth = 8
+
+	// Every record written by the store is wrapped in a frame:
+	// magic (1 byte) | version (1 byte) | crc32c of length+payload (4 bytes) | length (8 bytes) | payload
+	magicWidth   = 1
+	versionWidth = 1
+	crcWidth     = 4
+	headerWidth  = magicWidth + versionWidth + crcWidth + lenWidth
+
+	// frameMagic marks the start of a checksummed frame. Legacy records begin with their
+	// 8 byte big endian length, so their first byte is always zero and can't be confused with it
+	frameMagic   byte = 0xc5
+	frameVersion byte = 1
 )
 
+// errCorruptFrame is returned when a frame fails its checksum, has an unknown header or is cut short
+var errCorruptFrame = errors.New("corrupt record frame")
+
+// crcTable uses the Castagnoli polynomial (CRC32C), which has hardware support on most CPUs
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
 type store struct {
 	*os.File
 	mu   sync.Mutex
 	buf  *bufio.Writer
 	size uint64
+	// synced is how much of the store is known to be on disk
+	synced uint64
 }
 
 func newStore(f *os.File) (*store, error) {
@@ -33,9 +56,10 @@ func newStore(f *os.File) (*store, error) {
 	// We want to store a reference for the size of the file onto the store struct
 	size := uint64(fi.Size())
 	return &store{
-		File: f,
-		size: size,
-		buf:  bufio.NewWriter(f),
+		File:   f,
+		size:   size,
+		synced: size,
+		buf:    bufio.NewWriter(f),
 	}, nil
 }
 
@@ -49,9 +73,9 @@ func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 	// If you want to append to the end of the file, it'll be pos bytes as the insertion point
 	pos = s.size
 
-	// We want to write the length of our payload in binary to the buffer
-	// this allows us to understand the spec (size (bytes) - value of payload (bytes))
-	if err := binary.Write(s.buf, enc, uint64(len(p))); err != nil {
+	// We want to write the frame header (magic, version, checksum and length of our payload) to the buffer
+	// this allows us to understand the spec (header (bytes) - value of payload (bytes))
+	if _, err := s.buf.Write(frameHeader(p)); err != nil {
 		return 0, 0, err
 	}
 
@@ -62,8 +86,8 @@ func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 	}
 
 	// If we wrote all of p, we know w represents the number of bytes written
-	// which means adding the lenWidth for the payload size will represent total bytes written
-	w += lenWidth
+	// which means adding the headerWidth for the frame will represent total bytes written
+	w += headerWidth
 
 	// Once we have the total bytes written for the new record, we append to the total size of the store
 	s.size += uint64(w)
@@ -84,21 +108,103 @@ func (s *store) Read(pos uint64) ([]byte, error) {
 		return nil, err
 	}
 
+	payload, _, err := s.readFrame(pos)
+	return payload, err
+}
+
+// readFrame decodes the frame starting at pos and returns its payload along with the total
+// number of bytes the frame occupies. Legacy frames (length prefix only) are read without verification
+func (s *store) readFrame(pos uint64) (payload []byte, n uint64, err error) {
+	if pos >= s.size {
+		return nil, 0, io.EOF
+	}
+
 	// Let's allocate a byte array to load up the payload size
 	sizeBuffer := make([]byte, lenWidth)
-	if _, err := s.File.ReadAt(sizeBuffer, int64(pos)); err != nil {
-		return nil, err
+	if err := s.readPayload(sizeBuffer, pos); err != nil {
+		return nil, 0, err
+	}
+
+	// A leading zero byte means this record was written before frames were checksummed
+	if sizeBuffer[0] == 0 {
+		size := enc.Uint64(sizeBuffer)
+		if size > s.size {
+			return nil, 0, errCorruptFrame
+		}
+		payload = make([]byte, size)
+		if err := s.readPayload(payload, pos+lenWidth); err != nil {
+			return nil, 0, err
+		}
+		return payload, lenWidth + uint64(len(payload)), nil
+	}
+
+	header := make([]byte, headerWidth)
+	if err := s.readPayload(header, pos); err != nil {
+		return nil, 0, err
+	}
+	if header[0] != frameMagic || header[magicWidth] != frameVersion {
+		return nil, 0, errCorruptFrame
 	}
 
 	// Now that we have the size of the payload (as a byte array)
 	// we need to allocate a payload array that is of size .. size as a 64 bit integer value
-	payload := make([]byte, enc.Uint64(sizeBuffer))
+	size := enc.Uint64(header[headerWidth-lenWidth:])
+	if size > s.size {
+		return nil, 0, errCorruptFrame
+	}
+	payload = make([]byte, size)
 
-	// We read the payload in by reading from the offset position + 8 bytes (skip the size metadata)
-	if _, err := s.File.ReadAt(payload, int64(pos+lenWidth)); err != nil {
-		return nil, err
+	// We read the payload in by reading from the offset position + headerWidth bytes (skip the frame metadata)
+	if err := s.readPayload(payload, pos+headerWidth); err != nil {
+		return nil, 0, err
+	}
+
+	// The checksum covers the length as well, so a flipped bit in the size is caught too
+	crc := crc32.Update(0, crcTable, header[headerWidth-lenWidth:])
+	crc = crc32.Update(crc, crcTable, payload)
+	if crc != enc.Uint32(header[magicWidth+versionWidth:headerWidth-lenWidth]) {
+		return nil, 0, errCorruptFrame
+	}
+	return payload, headerWidth + size, nil
+}
+
+// readPayload fills p from the file starting at pos. Running out of file part way through
+// a record means the write was torn, so it's reported as a corrupt frame
+func (s *store) readPayload(p []byte, pos uint64) error {
+	_, err := s.File.ReadAt(p, int64(pos))
+	if err == io.EOF {
+		return errCorruptFrame
 	}
-	return payload, nil
+	return err
+}
+
+// reachesEnd reports whether the frame at pos, going by the length in its header, runs up to or past
+// the end of the store. Only such a frame can be the torn tail of an interrupted append, a bad frame
+// with more data after it is damage. The caller must hold the lock, with the buffer flushed
+func (s *store) reachesEnd(pos uint64) bool {
+	header := make([]byte, headerWidth)
+	n, _ := s.File.ReadAt(header, int64(pos))
+	// Legacy records start with a zero byte and carry only their length
+	width := uint64(headerWidth)
+	if header[0] == 0 {
+		width = lenWidth
+	}
+	if uint64(n) < width || pos+width >= s.size {
+		return true
+	}
+	return enc.Uint64(header[width-lenWidth:width]) >= s.size-pos-width
+}
+
+// frameHeader builds the header that precedes payload p on disk
+func frameHeader(p []byte) []byte {
+	header := make([]byte, headerWidth)
+	header[0] = frameMagic
+	header[magicWidth] = frameVersion
+	enc.PutUint64(header[headerWidth-lenWidth:], uint64(len(p)))
+	crc := crc32.Update(0, crcTable, header[headerWidth-lenWidth:])
+	crc = crc32.Update(crc, crcTable, p)
+	enc.PutUint32(header[magicWidth+versionWidth:headerWidth-lenWidth], crc)
+	return header
 }
 
 // Read at will return a record of size p at offset off if it exists
@@ -114,6 +220,56 @@ func (s *store) ReadAt(p []byte, off int64) (int, error) {
 	return s.File.ReadAt(p, off)
 }
 
+// truncate drops everything in the store from byte size onwards. The caller must hold the lock
+func (s *store) truncate(size uint64) error {
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	if err := s.File.Truncate(int64(size)); err != nil {
+		return err
+	}
+	s.size = size
+	if s.synced > size {
+		s.synced = size
+	}
+	return nil
+}
+
+// Flush writes the buffered frames out to the file
+func (s *store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Flush()
+}
+
+// Sync writes the buffered frames out to the file and fsyncs it. The fsync runs without the lock, so
+// appends aren't held up by it
+func (s *store) Sync() error {
+	s.mu.Lock()
+	if err := s.buf.Flush(); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	size := s.size
+	s.mu.Unlock()
+	if err := s.File.Sync(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if size > s.synced {
+		s.synced = size
+	}
+	return nil
+}
+
+// dirty reports whether the store holds frames that haven't been fsynced
+func (s *store) dirty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.synced < s.size
+}
+
 // Close will close the file that holds the records on the store struct
 func (s *store) Close() error {
 	s.mu.Lock()
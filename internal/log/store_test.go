@@ -11,8 +11,8 @@ import (
 var (
 	// dummy payload
 	write = []byte("hello world")
-	// entire byte length required for this record (length of value (8 bytes) + value length (11 bytes)) -> 19 bytes total
-	width = uint64(len(write) + lenWidth)
+	// entire byte length required for this record (frame header (14 bytes) + value length (11 bytes)) -> 25 bytes total
+	width = uint64(len(write) + headerWidth)
 )
 
 func TestStoreAppendRead(t *testing.T) {
@@ -70,19 +70,21 @@ func testReadAt(t *testing.T, s *store) {
 	t.Helper()
 	for i, off := uint64(1), int64(0); i < 4; i++ {
 		// We know that for any record we read, we first need to understand how large that record is itself
-		b := make([]byte, lenWidth)
-		n, err := s.ReadAt(b, off) // if offset is 0, then we will read lenWidth bytes from the file starting from the 0th byte
+		b := make([]byte, headerWidth)
+		n, err := s.ReadAt(b, off) // if offset is 0, then we will read headerWidth bytes from the file starting from the 0th byte
 		require.NoError(t, err)
 
-		// The number of bytes we read needs to equal the number of allocated bytes for the payload size in b
-		require.Equal(t, lenWidth, n)
+		// The number of bytes we read needs to equal the number of allocated bytes for the frame header in b
+		require.Equal(t, headerWidth, n)
+		require.Equal(t, frameMagic, b[0])
+		require.Equal(t, frameVersion, b[magicWidth])
 
-		// The offset can increase by the width of the size so we can jump to the payload itself
+		// The offset can increase by the width of the header so we can jump to the payload itself
 		off += int64(n)
 
-		// b is a byte array (binary value representing the size of the payload)
+		// the last lenWidth bytes of the header are a byte array (binary value representing the size of the payload)
 		// converting it into a 64 bit unsigned integer will allow us to treat it like a normal number
-		size := enc.Uint64(b)
+		size := enc.Uint64(b[headerWidth-lenWidth:])
 		b = make([]byte, size)
 
 		// Read the payload into the byte array
@@ -100,6 +102,64 @@ func testReadAt(t *testing.T, s *store) {
 	}
 }
 
+func TestStoreCorruption(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_corruption_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	_, pos, err := s.Append(write)
+	require.NoError(t, err)
+	_, err = s.Read(pos)
+	require.NoError(t, err)
+
+	// Flip a single bit inside the payload, the checksum should no longer match
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, int64(pos+headerWidth))
+	require.NoError(t, err)
+	b[0] ^= 0x01
+	_, err = f.WriteAt(b, int64(pos+headerWidth))
+	require.NoError(t, err)
+
+	_, err = s.Read(pos)
+	require.Equal(t, errCorruptFrame, err)
+
+	// A record cut short by a torn write is reported the same way
+	_, pos, err = s.Append(write)
+	require.NoError(t, err)
+	require.NoError(t, s.buf.Flush())
+	require.NoError(t, f.Truncate(int64(pos+headerWidth+2)))
+	_, err = s.Read(pos)
+	require.Equal(t, errCorruptFrame, err)
+}
+
+func TestStoreReadLegacy(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_legacy_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	// Records written before checksums were added only have an 8 byte length prefix
+	size := make([]byte, lenWidth)
+	enc.PutUint64(size, uint64(len(write)))
+	_, err = f.Write(append(size, write...))
+	require.NoError(t, err)
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+
+	// New frames can be appended after legacy ones and both remain readable
+	_, pos, err := s.Append(write)
+	require.NoError(t, err)
+	require.Equal(t, uint64(lenWidth+len(write)), pos)
+
+	for _, p := range []uint64{0, pos} {
+		read, err := s.Read(p)
+		require.NoError(t, err)
+		require.Equal(t, write, read)
+	}
+}
+
 func TestStoreClose(t *testing.T) {
 	f, err := ioutil.TempFile("", "store_close_test")
 	require.NoError(t, err)
@@ -0,0 +1,208 @@
+package log
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// SyncPolicy decides when a log fsyncs the records appended to it. Until then they're only as safe as the
+// operating system's page cache, or the store's buffer, and are lost when the machine goes down
+type SyncPolicy int
+
+const (
+	// SyncNever leaves writing the records to disk up to the operating system
+	SyncNever SyncPolicy = iota
+	// SyncEveryRecords fsyncs once Config.Sync.Records records were appended since the last fsync.
+	// The append that reaches the threshold waits for it, the others don't
+	SyncEveryRecords
+	// SyncInterval fsyncs every Config.Sync.Interval in the background
+	SyncInterval
+	// SyncEveryAppend fsyncs before every append returns. Appends waiting at the same time share an fsync
+	SyncEveryAppend
+)
+
+// SyncLatencyBuckets are the upper bounds of the fsync latency histogram in SyncStats
+var SyncLatencyBuckets = []time.Duration{
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// SyncStats summarises the fsyncs of a log since it was opened. Latencies[i] counts the fsyncs that took at
+// most SyncLatencyBuckets[i] and longer than the bucket before it, the last one counts those slower than every bucket
+type SyncStats struct {
+	Syncs     uint64
+	Appends   uint64 // appends made durable by the fsyncs, many per fsync when appends are grouped
+	Total     time.Duration
+	Latencies []uint64
+}
+
+// syncState groups appends waiting to be fsynced together: whoever arrives while no fsync is running starts
+// one covering every append made so far, everyone arriving during it waits and then shares the next one
+type syncState struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	syncing bool
+	// synced is the number of appends known to be on disk, requested the number at the last SyncEveryRecords fsync
+	synced    uint64
+	requested uint64
+	stats     SyncStats
+}
+
+func newSyncState() *syncState {
+	s := &syncState{stats: SyncStats{Latencies: make([]uint64, len(SyncLatencyBuckets)+1)}}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// observe adds an fsync covering appends appends to the stats. The caller must hold the lock
+func (s *syncState) observe(took time.Duration, appends uint64) {
+	s.stats.Syncs++
+	s.stats.Appends += appends
+	s.stats.Total += took
+	i := 0
+	for i < len(SyncLatencyBuckets) && took > SyncLatencyBuckets[i] {
+		i++
+	}
+	s.stats.Latencies[i]++
+}
+
+// syncAppends fsyncs as the sync policy asks for after an append that brought the log's count of appends to appends
+func (l *Log) syncAppends(appends uint64) error {
+	switch l.Config.Sync.Policy {
+	case SyncEveryAppend:
+		return l.sync(appends)
+	case SyncEveryRecords:
+		l.syncs.mu.Lock()
+		due := appends-l.syncs.requested >= l.Config.Sync.Records
+		if due {
+			l.syncs.requested = appends
+		}
+		l.syncs.mu.Unlock()
+		if due {
+			return l.sync(appends)
+		}
+	}
+	return nil
+}
+
+// sync returns once the first appends appends are on disk, fsyncing them unless an fsync that already
+// covers them is done. Callers that arrive during an fsync wait for it, and share the next one when it
+// didn't cover them
+func (l *Log) sync(appends uint64) error {
+	s := l.syncs
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.synced < appends {
+		if s.syncing {
+			s.cond.Wait()
+			continue
+		}
+		s.syncing = true
+		s.mu.Unlock()
+		start := time.Now()
+		synced, fsynced, err := l.syncStores()
+		took := time.Since(start)
+		s.mu.Lock()
+		s.syncing = false
+		s.cond.Broadcast()
+		if err != nil {
+			return err
+		}
+		if fsynced {
+			s.observe(took, synced-s.synced)
+		}
+		if synced > s.synced {
+			s.synced = synced
+		}
+	}
+	return nil
+}
+
+// syncStores fsyncs every store holding records that aren't on disk yet, and returns the number of appends
+// that made durable and whether anything needed an fsync. Only the stores are synced, the indexes are
+// rebuilt from them when a segment is recovered. The fsyncs run without the lock, so appends carry on
+// in the meantime and can be grouped into the next one
+func (l *Log) syncStores() (uint64, bool, error) {
+	l.mu.RLock()
+	appends := l.appends
+	var dirty []*store
+	for _, s := range l.segments {
+		if s.store.dirty() {
+			dirty = append(dirty, s.store)
+		}
+	}
+	l.mu.RUnlock()
+	for _, s := range dirty {
+		// Segments removed by the cleaner in the meantime don't need to be durable anymore
+		if err := s.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+			return 0, false, err
+		}
+	}
+	return appends, len(dirty) > 0, nil
+}
+
+// startSyncing launches the background fsyncs of SyncInterval. They're stopped by Close
+func (l *Log) startSyncing() {
+	if l.Config.Sync.Policy != SyncInterval {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopSyncer != nil {
+		return
+	}
+	l.stopSyncer = make(chan struct{})
+	l.syncer.Add(1)
+	go l.syncEvery(l.Config.Sync.Interval, l.stopSyncer)
+}
+
+// stopSyncing signals the background fsyncs to stop and waits for them. It must be called without holding the lock
+func (l *Log) stopSyncing() {
+	l.mu.Lock()
+	stop := l.stopSyncer
+	l.stopSyncer = nil
+	l.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		l.syncer.Wait()
+	}
+}
+
+func (l *Log) syncEvery(interval time.Duration, stop chan struct{}) {
+	defer l.syncer.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			l.mu.RLock()
+			appends := l.appends
+			l.mu.RUnlock()
+			if err := l.sync(appends); err != nil {
+				l.logger.Error("failed to sync", zap.Error(err))
+			}
+		}
+	}
+}
+
+// SyncStats returns a copy of the log's fsync totals and latency histogram
+func (l *Log) SyncStats() SyncStats {
+	l.syncs.mu.Lock()
+	defer l.syncs.mu.Unlock()
+	stats := l.syncs.stats
+	stats.Latencies = append([]uint64(nil), stats.Latencies...)
+	return stats
+}
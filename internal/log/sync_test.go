@@ -0,0 +1,141 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/schachte/kafkaclone/api/v1/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func newSyncLog(t testing.TB, policy SyncPolicy) *Log {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "sync-test")
+	require.NoError(t, err)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 1 << 20
+	c.Sync.Policy = policy
+	c.Sync.Records = 3
+	c.Sync.Interval = 10 * time.Millisecond
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		log.Close()
+		os.RemoveAll(dir)
+	})
+	return log
+}
+
+func TestSyncPolicy(t *testing.T) {
+	record := func() *logger.Record { return &logger.Record{Value: []byte("hello world")} }
+
+	t.Run("never", func(t *testing.T) {
+		log := newSyncLog(t, SyncNever)
+		for i := 0; i < 5; i++ {
+			_, err := log.Append(record())
+			require.NoError(t, err)
+		}
+		require.Zero(t, log.SyncStats().Syncs)
+		require.True(t, log.activeSegment.store.dirty())
+	})
+
+	t.Run("every records", func(t *testing.T) {
+		log := newSyncLog(t, SyncEveryRecords)
+		for i := 0; i < 7; i++ {
+			_, err := log.Append(record())
+			require.NoError(t, err)
+		}
+		stats := log.SyncStats()
+		require.Equal(t, uint64(2), stats.Syncs)
+		require.Equal(t, uint64(6), stats.Appends)
+		// The seventh record waits for the next threshold
+		require.True(t, log.activeSegment.store.dirty())
+	})
+
+	t.Run("interval", func(t *testing.T) {
+		log := newSyncLog(t, SyncInterval)
+		_, err := log.Append(record())
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			return log.SyncStats().Appends == 1
+		}, time.Second, 5*time.Millisecond)
+		require.False(t, log.activeSegment.store.dirty())
+	})
+
+	t.Run("every append", func(t *testing.T) {
+		log := newSyncLog(t, SyncEveryAppend)
+		// Concurrent appends are grouped, so no more fsyncs than appends happen and every append is covered
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := log.Append(record())
+				require.NoError(t, err)
+			}()
+		}
+		wg.Wait()
+		_, err := log.AppendBatch([]*logger.Record{record(), record()}, logger.Compression_NONE)
+		require.NoError(t, err)
+		require.False(t, log.activeSegment.store.dirty())
+
+		stats := log.SyncStats()
+		require.Equal(t, uint64(21), stats.Appends)
+		require.LessOrEqual(t, stats.Syncs, uint64(21))
+		require.NotZero(t, stats.Total)
+		var observed uint64
+		for _, n := range stats.Latencies {
+			observed += n
+		}
+		require.Equal(t, stats.Syncs, observed)
+	})
+}
+
+func BenchmarkAppendSync(b *testing.B) {
+	for _, bench := range []struct {
+		name   string
+		policy SyncPolicy
+	}{
+		{"never", SyncNever},
+		{"every records", SyncEveryRecords},
+		{"interval", SyncInterval},
+		{"every append", SyncEveryAppend},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "sync-bench")
+			require.NoError(b, err)
+			defer os.RemoveAll(dir)
+			c := Config{}
+			c.Segment.MaxStoreBytes = 64 << 20
+			c.Segment.MaxIndexBytes = 64 << 20
+			c.Sync.Policy = bench.policy
+			log, err := NewLog(dir, c)
+			require.NoError(b, err)
+			defer log.Close()
+
+			value := []byte(fmt.Sprintf("%0128d", 0))
+			b.SetBytes(int64(len(value)))
+			// Appending from many goroutines at once is what lets their fsyncs be grouped
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := log.Append(&logger.Record{Value: value}); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+			b.StopTimer()
+			if stats := log.SyncStats(); stats.Syncs > 0 {
+				b.ReportMetric(float64(stats.Appends)/float64(stats.Syncs), "appends/fsync")
+				b.ReportMetric(float64(stats.Total.Microseconds())/float64(stats.Syncs), "µs/fsync")
+			}
+		})
+	}
+}
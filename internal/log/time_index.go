@@ -0,0 +1,104 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+const timeIndexExt = ".timeindex"
+
+// These "width" constants make up the size of each entry within the time index file
+var (
+	tsWidth      uint64 = 8
+	timeEntWidth        = tsWidth + offWidth
+)
+
+// timeIndex is a sparse index from record timestamps to relative offsets. Each entry holds the largest timestamp
+// seen in the segment so far and the offset of the record it came from, so every record before that offset is
+// older. Entries are only added every Config.Segment.TimeIndexIntervalBytes of records, plus a final one holding the
+// segment's largest timestamp when it's closed. It's small enough to be kept in memory
+type timeIndex struct {
+	file    *os.File
+	entries []timeEntry
+}
+
+type timeEntry struct {
+	timestamp int64
+	off       uint32
+}
+
+func newTimeIndex(f *os.File) (*timeIndex, error) {
+	t := &timeIndex{file: f}
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i+timeEntWidth <= uint64(len(b)); i += timeEntWidth {
+		t.entries = append(t.entries, timeEntry{
+			timestamp: int64(enc.Uint64(b[i : i+tsWidth])),
+			off:       enc.Uint32(b[i+tsWidth : i+timeEntWidth]),
+		})
+	}
+	return t, nil
+}
+
+// Write appends an entry, unless it wouldn't raise the largest timestamp in the index
+func (t *timeIndex) Write(timestamp int64, off uint32) error {
+	if last, ok := t.Last(); ok && timestamp <= last.timestamp {
+		return nil
+	}
+	b := make([]byte, timeEntWidth)
+	enc.PutUint64(b[:tsWidth], uint64(timestamp))
+	enc.PutUint32(b[tsWidth:], off)
+	if _, err := t.file.WriteAt(b, int64(len(t.entries))*int64(timeEntWidth)); err != nil {
+		return err
+	}
+	t.entries = append(t.entries, timeEntry{timestamp: timestamp, off: off})
+	return nil
+}
+
+// Last returns the entry with the largest timestamp
+func (t *timeIndex) Last() (timeEntry, bool) {
+	if len(t.entries) == 0 {
+		return timeEntry{}, false
+	}
+	return t.entries[len(t.entries)-1], true
+}
+
+// Before returns the last entry older than timestamp. Every record up to and including the entry's
+// offset is older, so a search for timestamp can start right after it
+func (t *timeIndex) Before(timestamp int64) (timeEntry, bool) {
+	i := sort.Search(len(t.entries), func(i int) bool {
+		return t.entries[i].timestamp >= timestamp
+	})
+	if i == 0 {
+		return timeEntry{}, false
+	}
+	return t.entries[i-1], true
+}
+
+// Reset drops every entry
+func (t *timeIndex) Reset() error {
+	t.entries = nil
+	return t.file.Truncate(0)
+}
+
+// size is how many bytes the entries take up in the file
+func (t *timeIndex) size() uint64 {
+	return uint64(len(t.entries)) * timeEntWidth
+}
+
+func (t *timeIndex) Close() error {
+	if err := t.file.Truncate(int64(t.size())); err != nil {
+		return err
+	}
+	if err := t.file.Sync(); err != nil {
+		return err
+	}
+	return t.file.Close()
+}
+
+func (t *timeIndex) Name() string {
+	return t.file.Name()
+}
@@ -0,0 +1,108 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/schachte/kafkaclone/api/v1/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeIndex(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "time_index_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	idx, err := newTimeIndex(f)
+	require.NoError(t, err)
+	_, ok := idx.Last()
+	require.False(t, ok)
+
+	require.NoError(t, idx.Write(100, 0))
+	require.NoError(t, idx.Write(200, 4))
+	// Entries that don't raise the largest timestamp are dropped
+	require.NoError(t, idx.Write(150, 6))
+	require.Len(t, idx.entries, 2)
+
+	_, ok = idx.Before(100)
+	require.False(t, ok)
+	entry, ok := idx.Before(101)
+	require.True(t, ok)
+	require.Equal(t, timeEntry{timestamp: 100, off: 0}, entry)
+	entry, ok = idx.Before(1000)
+	require.True(t, ok)
+	require.Equal(t, timeEntry{timestamp: 200, off: 4}, entry)
+	require.NoError(t, idx.Close())
+
+	f, err = os.OpenFile(f.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	idx, err = newTimeIndex(f)
+	require.NoError(t, err)
+	last, ok := idx.Last()
+	require.True(t, ok)
+	require.Equal(t, timeEntry{timestamp: 200, off: 4}, last)
+	require.NoError(t, idx.Close())
+}
+
+func TestOffsetForTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offset-for-time-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 128
+	c.Segment.TimeIndexIntervalBytes = 48
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	// Timestamps mostly go up but not always, like producers with skewed clocks
+	timestamps := []int64{10, 20, 30, 25, 40, 50, 45, 60, 70, 80, 90, 85, 100, 110, 120}
+	for _, ts := range timestamps {
+		_, err := log.Append(&logger.Record{Value: []byte("hello world"), Timestamp: ts})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.segments), 2)
+
+	// The earliest offset with a timestamp at or after the one asked for
+	want := func(ts int64) uint64 {
+		for off, t := range timestamps {
+			if t >= ts {
+				return uint64(off)
+			}
+		}
+		return uint64(len(timestamps))
+	}
+	check := func() {
+		for ts := int64(0); ts <= 130; ts += 5 {
+			off, err := log.OffsetForTime(ts)
+			require.NoError(t, err)
+			require.Equal(t, want(ts), off, "timestamp %d", ts)
+		}
+	}
+	check()
+
+	// The time index is rebuilt when the log is reopened, even after losing it
+	require.NoError(t, log.Close())
+	require.NoError(t, os.Remove(log.segments[0].timeIndex.Name()))
+	c.Segment.RecoverAll = true
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	check()
+
+	// Records without a timestamp are stamped when they're appended, or always with log append time
+	record := &logger.Record{Value: []byte("hello world")}
+	_, err = log.Append(record)
+	require.NoError(t, err)
+	require.NotZero(t, record.Timestamp)
+	require.NoError(t, log.Close())
+
+	c.Timestamp.LogAppendTime = true
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	record = &logger.Record{Value: []byte("hello world"), Timestamp: 1}
+	_, err = log.Append(record)
+	require.NoError(t, err)
+	require.NotEqual(t, int64(1), record.Timestamp)
+}
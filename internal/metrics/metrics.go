@@ -0,0 +1,213 @@
+// Package metrics exposes an agent's metrics to Prometheus. The names and labels below are what
+// dashboards and alerts are built on, so they're only ever added to, never renamed or relabeled:
+//
+//	kafkaclone_rpc_requests_total{method, code}             counter    RPCs handled, by method and gRPC status code
+//	kafkaclone_rpc_request_duration_seconds{method, code}   histogram  how long RPCs took, streams for their whole life
+//	kafkaclone_log_appended_bytes_total{topic, partition}   counter    bytes appended to a partition since its log was opened
+//	kafkaclone_log_segments{topic, partition}               gauge      segments of a partition
+//	kafkaclone_log_active_segment_bytes{topic, partition}   gauge      size of a partition's active segment store
+//	kafkaclone_log_lowest_offset{topic, partition}          gauge      lowest offset of a partition
+//	kafkaclone_log_highest_offset{topic, partition}         gauge      highest offset of a partition
+//	kafkaclone_replication_lag_seconds{peer}                gauge      how long since the leader last heard from a follower it
+//	                                                                   fails to heartbeat, zero while the follower keeps up.
+//	                                                                   Only the leader reports it
+//	kafkaclone_replication_lag_records{peer, topic, partition}  gauge  how many records a follower's copy of a partition is
+//	                                                                   behind the leader's. Only the leader reports it
+//	kafkaclone_membership_members{status}                   gauge      members of the cluster by status: alive, leaving, left or failed
+//
+// The log metrics only cover partitions whose log is open, the ones used since the agent started.
+// The Go runtime and process metrics of the standard collectors are exposed as well
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/schachte/kafkaclone/internal/topic"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const namespace = "kafkaclone"
+
+// Metrics holds an agent's metrics. The RPC metrics are recorded by its interceptors, everything else is
+// read from the sources registered with it whenever the metrics are scraped
+type Metrics struct {
+	registry  *prometheus.Registry
+	requests  *prometheus.CounterVec
+	durations *prometheus.HistogramVec
+}
+
+// New creates the metrics with the RPC metrics and the standard Go and process collectors registered
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "rpc",
+			Name:      "requests_total",
+			Help:      "RPCs handled, by method and gRPC status code.",
+		}, []string{"method", "code"}),
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "rpc",
+			Name:      "request_duration_seconds",
+			Help:      "How long RPCs took, by method and gRPC status code. Streams are timed for their whole life.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}, []string{"method", "code"}),
+	}
+	m.registry.MustRegister(
+		m.requests,
+		m.durations,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// observe records an RPC, fullMethod is the gRPC method name such as /log.v1.LogService/Produce
+func (m *Metrics) observe(fullMethod string, start time.Time, err error) {
+	labels := prometheus.Labels{"method": path.Base(fullMethod), "code": status.Code(err).String()}
+	m.requests.With(labels).Inc()
+	m.durations.With(labels).Observe(time.Since(start).Seconds())
+}
+
+// UnaryInterceptor records the count and latency of unary RPCs
+func (m *Metrics) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	res, err := handler(ctx, req)
+	m.observe(info.FullMethod, start, err)
+	return res, err
+}
+
+// StreamInterceptor records the count and latency of streaming RPCs
+func (m *Metrics) StreamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, stream)
+	m.observe(info.FullMethod, start, err)
+	return err
+}
+
+// collector reports metrics computed when they're scraped
+type collector struct {
+	descs   []*prometheus.Desc
+	collect func(ch chan<- prometheus.Metric)
+}
+
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range c.descs {
+		ch <- desc
+	}
+}
+
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	c.collect(ch)
+}
+
+var (
+	appendedBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "log", "appended_bytes_total"),
+		"Bytes appended to a partition since its log was opened, frame headers included.",
+		[]string{"topic", "partition"}, nil,
+	)
+	segmentsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "log", "segments"),
+		"Segments of a partition.",
+		[]string{"topic", "partition"}, nil,
+	)
+	activeSegmentBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "log", "active_segment_bytes"),
+		"Size of the store of a partition's active segment.",
+		[]string{"topic", "partition"}, nil,
+	)
+	lowestOffsetDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "log", "lowest_offset"),
+		"Lowest offset of a partition.",
+		[]string{"topic", "partition"}, nil,
+	)
+	highestOffsetDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "log", "highest_offset"),
+		"Highest offset of a partition.",
+		[]string{"topic", "partition"}, nil,
+	)
+	replicationLagDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "replication", "lag_seconds"),
+		"How long since the leader last heard from a follower it fails to heartbeat, zero while the follower keeps up.",
+		[]string{"peer"}, nil,
+	)
+	replicationLagRecordsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "replication", "lag_records"),
+		"How many records a follower's copy of a partition is behind the leader's.",
+		[]string{"peer", "topic", "partition"}, nil,
+	)
+	membersDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "membership", "members"),
+		"Members of the cluster by status.",
+		[]string{"status"}, nil,
+	)
+)
+
+// RegisterLogs exposes the log metrics of the partitions returned by stats
+func (m *Metrics) RegisterLogs(stats func() []topic.PartitionStats) error {
+	return m.registry.Register(&collector{
+		descs: []*prometheus.Desc{appendedBytesDesc, segmentsDesc, activeSegmentBytesDesc, lowestOffsetDesc, highestOffsetDesc},
+		collect: func(ch chan<- prometheus.Metric) {
+			for _, p := range stats() {
+				partition := strconv.FormatUint(uint64(p.Partition), 10)
+				ch <- prometheus.MustNewConstMetric(appendedBytesDesc, prometheus.CounterValue, float64(p.AppendedBytes), p.Topic, partition)
+				ch <- prometheus.MustNewConstMetric(segmentsDesc, prometheus.GaugeValue, float64(p.Segments), p.Topic, partition)
+				ch <- prometheus.MustNewConstMetric(activeSegmentBytesDesc, prometheus.GaugeValue, float64(p.ActiveSegmentBytes), p.Topic, partition)
+				ch <- prometheus.MustNewConstMetric(lowestOffsetDesc, prometheus.GaugeValue, float64(p.LowestOffset), p.Topic, partition)
+				ch <- prometheus.MustNewConstMetric(highestOffsetDesc, prometheus.GaugeValue, float64(p.HighestOffset), p.Topic, partition)
+			}
+		},
+	})
+}
+
+// RegisterReplication exposes the replication lag of the followers returned by lag, by peer ID
+func (m *Metrics) RegisterReplication(lag func() map[string]time.Duration) error {
+	return m.registry.Register(&collector{
+		descs: []*prometheus.Desc{replicationLagDesc},
+		collect: func(ch chan<- prometheus.Metric) {
+			for peer, d := range lag() {
+				ch <- prometheus.MustNewConstMetric(replicationLagDesc, prometheus.GaugeValue, d.Seconds(), peer)
+			}
+		},
+	})
+}
+
+// RegisterReplicationOffsets exposes how many records the followers' partitions returned by lag are behind
+func (m *Metrics) RegisterReplicationOffsets(lag func() []topic.PartitionLag) error {
+	return m.registry.Register(&collector{
+		descs: []*prometheus.Desc{replicationLagRecordsDesc},
+		collect: func(ch chan<- prometheus.Metric) {
+			for _, p := range lag() {
+				partition := strconv.FormatUint(uint64(p.Partition), 10)
+				ch <- prometheus.MustNewConstMetric(replicationLagRecordsDesc, prometheus.GaugeValue, float64(p.Records), p.Peer, p.Topic, partition)
+			}
+		},
+	})
+}
+
+// RegisterMembership exposes the member counts returned by counts, by status
+func (m *Metrics) RegisterMembership(counts func() map[string]int) error {
+	return m.registry.Register(&collector{
+		descs: []*prometheus.Desc{membersDesc},
+		collect: func(ch chan<- prometheus.Metric) {
+			for status, n := range counts() {
+				ch <- prometheus.MustNewConstMetric(membersDesc, prometheus.GaugeValue, float64(n), status)
+			}
+		},
+	})
+}
@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/schachte/kafkaclone/internal/log"
+	"github.com/schachte/kafkaclone/internal/topic"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMetrics(t *testing.T) {
+	m := New()
+	require.NoError(t, m.RegisterLogs(func() []topic.PartitionStats {
+		return []topic.PartitionStats{{
+			Topic:     "orders",
+			Partition: 1,
+			Stats: log.Stats{
+				Segments:           2,
+				ActiveSegmentBytes: 512,
+				LowestOffset:       10,
+				HighestOffset:      41,
+				AppendedBytes:      2048,
+			},
+		}}
+	}))
+	require.NoError(t, m.RegisterReplication(func() map[string]time.Duration {
+		return map[string]time.Duration{"node-1": 0, "node-2": 1500 * time.Millisecond}
+	}))
+	require.NoError(t, m.RegisterReplicationOffsets(func() []topic.PartitionLag {
+		return []topic.PartitionLag{{Peer: "node-1", Topic: "orders", Partition: 1, Records: 3}}
+	}))
+	require.NoError(t, m.RegisterMembership(func() map[string]int {
+		return map[string]int{"alive": 2, "failed": 1}
+	}))
+
+	unary := func(method string, err error) {
+		_, _ = m.UnaryInterceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/log.v1.LogService/" + method},
+			func(ctx context.Context, req interface{}) (interface{}, error) { return nil, err })
+	}
+	unary("Produce", nil)
+	unary("Produce", nil)
+	unary("Consume", status.Error(codes.PermissionDenied, "denied"))
+	_ = m.StreamInterceptor(nil, nil, &grpc.StreamServerInfo{FullMethod: "/log.v1.LogService/ConsumeStream"},
+		func(srv interface{}, stream grpc.ServerStream) error { return nil })
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	b, err := ioutil.ReadAll(rec.Body)
+	require.NoError(t, err)
+	body := string(b)
+	for _, line := range []string{
+		`kafkaclone_rpc_requests_total{code="OK",method="Produce"} 2`,
+		`kafkaclone_rpc_requests_total{code="PermissionDenied",method="Consume"} 1`,
+		`kafkaclone_rpc_requests_total{code="OK",method="ConsumeStream"} 1`,
+		`kafkaclone_rpc_request_duration_seconds_count{code="OK",method="Produce"} 2`,
+		`kafkaclone_log_appended_bytes_total{partition="1",topic="orders"} 2048`,
+		`kafkaclone_log_segments{partition="1",topic="orders"} 2`,
+		`kafkaclone_log_active_segment_bytes{partition="1",topic="orders"} 512`,
+		`kafkaclone_log_lowest_offset{partition="1",topic="orders"} 10`,
+		`kafkaclone_log_highest_offset{partition="1",topic="orders"} 41`,
+		`kafkaclone_replication_lag_seconds{peer="node-1"} 0`,
+		`kafkaclone_replication_lag_seconds{peer="node-2"} 1.5`,
+		`kafkaclone_replication_lag_records{partition="1",peer="node-1",topic="orders"} 3`,
+		`kafkaclone_membership_members{status="alive"} 2`,
+		`kafkaclone_membership_members{status="failed"} 1`,
+		`go_goroutines`,
+	} {
+		require.Contains(t, body, line)
+	}
+}
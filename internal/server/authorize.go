@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+
+	"github.com/schachte/kafkaclone/internal/topic"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// methodPrefix is what the full names of the log service's methods start with
+const methodPrefix = "/log.v1.LogService/"
+
+// permission is the action a method needs on the object its request names
+type permission struct {
+	action string
+	object func(req interface{}) string
+}
+
+// permissions maps every method of the log service to the permission it needs. Methods that aren't
+// listed are refused, so a new method can't go out without authorization by accident
+var permissions = map[string]permission{
+	methodPrefix + "Produce":       {produceAction, byTopic},
+	methodPrefix + "ProduceBatch":  {produceAction, byTopic},
+	methodPrefix + "ProduceStream": {produceAction, byTopic},
+	methodPrefix + "AddToTxn":      {produceAction, byTopic},
+	// Transactions can span topics, beginning and ending them needs produce rights on all of them
+	methodPrefix + "BeginTxn":  {produceAction, wildcard},
+	methodPrefix + "CommitTxn": {produceAction, wildcard},
+	methodPrefix + "AbortTxn":  {produceAction, wildcard},
+
+	methodPrefix + "Consume":         {consumeAction, byTopic},
+	methodPrefix + "ConsumeStream":   {consumeAction, byTopic},
+	methodPrefix + "Fetch":           {consumeAction, byTopic},
+	methodPrefix + "GetOffsets":      {consumeAction, byTopic},
+	methodPrefix + "GetSegmentStats": {consumeAction, byTopic},
+	methodPrefix + "OffsetForTime":   {consumeAction, byTopic},
+	methodPrefix + "ListTopics":      {consumeAction, wildcard},
+	methodPrefix + "GetServers":      {consumeAction, wildcard},
+
+	methodPrefix + "CommitOffset":         {consumeAction, byGroup},
+	methodPrefix + "FetchCommittedOffset": {consumeAction, byGroup},
+	methodPrefix + "JoinGroup":            {consumeAction, byGroup},
+	methodPrefix + "Heartbeat":            {consumeAction, byGroup},
+	methodPrefix + "LeaveGroup":           {consumeAction, byGroup},
+
+	methodPrefix + "CreateTopic":      {adminAction, byName},
+	methodPrefix + "DeleteTopic":      {adminAction, byName},
+	methodPrefix + "CreatePartitions": {adminAction, byTopic},
+}
+
+// authorizeUnary refuses requests the caller isn't permitted to make
+func (s *grpcServer) authorizeUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := s.authorize(ctx, info.FullMethod, req); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// authorizeStream authorizes every request received on the stream, each of them can name another topic
+func (s *grpcServer) authorizeStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, &authorizedStream{ServerStream: ss, server: s, method: info.FullMethod})
+}
+
+type authorizedStream struct {
+	grpc.ServerStream
+	server *grpcServer
+	method string
+}
+
+func (a *authorizedStream) RecvMsg(m interface{}) error {
+	if err := a.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return a.server.authorize(a.Context(), a.method, m)
+}
+
+func (s *grpcServer) authorize(ctx context.Context, method string, req interface{}) error {
+	p, ok := permissions[method]
+	if !ok {
+		return status.Errorf(codes.PermissionDenied, "%s not permitted to call %s", subject(ctx), method)
+	}
+	if err := s.Authorizer.Authorize(subject(ctx), p.object(req), p.action); err != nil {
+		return err
+	}
+	// Forwarded writes keep transaction fields only coordinators set, so only servers may forward them
+	if f, ok := req.(interface{ GetForwarded() bool }); ok && f.GetForwarded() {
+		return s.Authorizer.Authorize(subject(ctx), p.object(req), replicateAction)
+	}
+	return nil
+}
+
+// topicName is the object of a topic, the empty name being the default topic
+func topicName(name string) string {
+	if name == "" {
+		name = topic.DefaultTopic
+	}
+	return topicObject + name
+}
+
+func byTopic(req interface{}) string {
+	return topicName(req.(interface{ GetTopic() string }).GetTopic())
+}
+
+func byName(req interface{}) string {
+	return topicName(req.(interface{ GetName() string }).GetName())
+}
+
+func byGroup(req interface{}) string {
+	return groupObject + req.(interface{ GetGroup() string }).GetGroup()
+}
+
+func wildcard(interface{}) string {
+	return objectWildcard
+}
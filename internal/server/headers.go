@@ -0,0 +1,36 @@
+package server
+
+import "github.com/schachte/kafkaclone/api/v1/logger"
+
+// Headers returns the headers of every record carried by msg, which can be any request or response
+// of the log service. It lets interceptors, chained onto the server with grpc.ChainUnaryInterceptor or
+// grpc.ChainStreamInterceptor, act on them, e.g. to pick up the trace ID of a produced record.
+// Messages that don't carry records have no headers
+func Headers(msg interface{}) []*logger.Header {
+	var records []*logger.Record
+	switch m := msg.(type) {
+	case *logger.ProduceRequest:
+		records = []*logger.Record{m.Record}
+	case *logger.ProduceBatchRequest:
+		records = m.Records
+	case *logger.ConsumeResponse:
+		records = []*logger.Record{m.Record}
+	case *logger.FetchResponse:
+		records = m.Records
+	}
+	var headers []*logger.Header
+	for _, record := range records {
+		headers = append(headers, record.GetHeaders()...)
+	}
+	return headers
+}
+
+// Header returns the value of the first header named key
+func Header(headers []*logger.Header, key string) ([]byte, bool) {
+	for _, h := range headers {
+		if h.Key == key {
+			return h.Value, true
+		}
+	}
+	return nil, false
+}
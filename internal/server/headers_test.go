@@ -0,0 +1,30 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/schachte/kafkaclone/api/v1/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeaders(t *testing.T) {
+	traced := &logger.Record{Headers: []*logger.Header{{Key: "trace-id", Value: []byte("abc123")}}}
+	typed := &logger.Record{Headers: []*logger.Header{{Key: "content-type", Value: []byte("text/plain")}}}
+
+	headers := Headers(&logger.ProduceRequest{Record: traced})
+	value, ok := Header(headers, "trace-id")
+	require.True(t, ok)
+	require.Equal(t, []byte("abc123"), value)
+	_, ok = Header(headers, "content-type")
+	require.False(t, ok)
+
+	headers = Headers(&logger.ProduceBatchRequest{Records: []*logger.Record{traced, typed}})
+	require.Len(t, headers, 2)
+	headers = Headers(&logger.FetchResponse{Records: []*logger.Record{typed}})
+	value, ok = Header(headers, "content-type")
+	require.True(t, ok)
+	require.Equal(t, []byte("text/plain"), value)
+
+	require.Empty(t, Headers(&logger.ConsumeRequest{}))
+	require.Empty(t, Headers(&logger.ProduceRequest{}))
+}
@@ -2,12 +2,19 @@ package server
 
 import (
 	"context"
+	"time"
 
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	grpc_auth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
 	api_v1 "github.com/schachte/kafkaclone/api/v1"
 	"github.com/schachte/kafkaclone/api/v1/logger"
 	"github.com/schachte/kafkaclone/internal/config"
+	"github.com/schachte/kafkaclone/internal/log"
+	"github.com/schachte/kafkaclone/internal/metrics"
+	"github.com/schachte/kafkaclone/pkg/compression"
+	"github.com/schachte/kafkaclone/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
@@ -17,19 +24,81 @@ import (
 
 const (
 	objectWildcard = "*"
-	produceAction  = "produce"
-	consumeAction  = "consume"
+	// groupObject prefixes the consumer group an offset request is authorized against
+	groupObject = "group:"
+	// topicObject prefixes the topic a request reads, writes or manages
+	topicObject   = "topic:"
+	produceAction = "produce"
+	consumeAction = "consume"
+	adminAction   = "admin"
+	// replicateAction lets a subject forward writes to the leader as a server, see ProduceRequest.forwarded
+	replicateAction = "replicate"
 )
 
+// CommitLog stores records in the partitions of named topics. An empty topic name refers to the default topic.
+// Append, AppendBatch and Read trace their work in the trace of ctx
 type CommitLog interface {
-	Append(*logger.Record) (uint64, error)
-	Read(uint64) (*logger.Record, error)
+	// Append stores the record in partition, or one chosen by the log's partitioner when it's nil. It returns
+	// once the record got as far as acks asks for, failing with ErrNotEnoughReplicas when it can't get there
+	Append(ctx context.Context, topic string, partition *uint32, record *logger.Record, acks logger.Acks) (uint32, uint64, error)
+	// AppendBatch stores the records atomically in one partition and returns the offset of the first.
+	// They're compressed with codec, or the topic's default codec when it's nil
+	AppendBatch(ctx context.Context, topic string, partition *uint32, records []*logger.Record, codec *logger.Compression, acks logger.Acks) (uint32, uint64, error)
+	Read(ctx context.Context, topic string, partition uint32, offset uint64) (*logger.Record, error)
+	ReadRange(topic string, partition uint32, offset uint64, maxRecords uint32, maxBytes uint64) ([]*logger.Record, error)
+	// ReadBatches is ReadRange returning compressed batches as they're stored
+	ReadBatches(topic string, partition uint32, offset uint64, maxRecords uint32, maxBytes uint64) ([]*logger.Record, error)
+	// ReadCommitted is ReadRange for read committed consumers, it stops at the last stable offset and
+	// skips control records and the records of aborted transactions
+	ReadCommitted(topic string, partition uint32, offset uint64, maxRecords uint32, maxBytes uint64) ([]*logger.Record, error)
+	SegmentStats(topic string, partition uint32) ([]log.SegmentStats, error)
+	// Notify returns a channel that's closed once another record is appended to the partition
+	Notify(topic string, partition uint32) (<-chan struct{}, error)
+	Offsets(topic string, partition uint32) (lowest, highest uint64, err error)
+	// OffsetForTime returns the earliest offset whose record's timestamp is at or after timestamp (ms since the epoch)
+	OffsetForTime(topic string, partition uint32, timestamp int64) (uint64, error)
+	CreateTopic(name string, config *logger.TopicConfig) error
+	// CommitOffset records offset as the next one the consumer group will read from the partition
+	CommitOffset(group, topic string, partition uint32, offset uint64) error
+	CommittedOffset(group, topic string, partition uint32) (uint64, error)
+	CreatePartitions(topic string, count uint32) error
+	DeleteTopic(name string) error
+	Topics() []string
+}
+
+// GroupCoordinator divides the partitions consumer groups consume between their members
+type GroupCoordinator interface {
+	Join(group, member string, topics []string, strategy string, sessionTimeout time.Duration) (string, uint64, []*logger.Assignment, error)
+	Heartbeat(group, member string, generation uint64) error
+	Leave(group, member string) error
+}
+
+// TxnCoordinator appends records as part of transactions and ends them with control records
+type TxnCoordinator interface {
+	Begin(timeout time.Duration) (uint64, error)
+	Add(id uint64, topic string, partition *uint32, records []*logger.Record) (uint32, uint64, error)
+	Commit(id uint64) error
+	Abort(id uint64) error
+}
+
+// ServerRetriever lists the members of the cluster
+type ServerRetriever interface {
+	GetServers() ([]*logger.Server, error)
 }
 
 type Config struct {
 	TLSConfig  config.TLSConfig
 	CommitLog  CommitLog
 	Authorizer Authorizer
+	Groups     GroupCoordinator
+	Txns       TxnCoordinator
+	// Servers is nil when the server doesn't run as part of a cluster
+	Servers ServerRetriever
+	// Metrics records the count and latency of every RPC when it's set, rejected ones included
+	Metrics *metrics.Metrics
+	// TraceRecords persists the trace context of the request producing a record in the record's headers,
+	// so whoever consumes it later links to the span that produced it. Every RPC is traced regardless
+	TraceRecords bool
 }
 
 type grpcServer struct {
@@ -43,19 +112,29 @@ type Authorizer interface {
 
 type subjectContextKey struct{}
 
+// NewGRPCServer registers the log service on a new gRPC server. Interceptors passed in opts with
+// grpc.ChainUnaryInterceptor or grpc.ChainStreamInterceptor run after the caller is authenticated and
+// authorized (see permissions)
 func NewGRPCServer(config *Config, opts ...grpc.ServerOption) (*grpc.Server, error) {
-	opts = append(opts, grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(
-		grpc_auth.StreamServerInterceptor(authenticate),
-	)), grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(
-		grpc_auth.UnaryServerInterceptor(authenticate),
-	)))
-
-	gsrv := grpc.NewServer(opts...)
 	srv, err := grpcFactory(config)
 	if err != nil {
 		return nil, err
 	}
+	streamInterceptors := []grpc.StreamServerInterceptor{tracing.StreamServerInterceptor}
+	unaryInterceptors := []grpc.UnaryServerInterceptor{tracing.UnaryServerInterceptor}
+	if config.Metrics != nil {
+		streamInterceptors = append(streamInterceptors, config.Metrics.StreamInterceptor)
+		unaryInterceptors = append(unaryInterceptors, config.Metrics.UnaryInterceptor)
+	}
+	opts = append(opts, grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(append(streamInterceptors,
+		grpc_auth.StreamServerInterceptor(authenticate),
+		srv.authorizeStream,
+	)...)), grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(append(unaryInterceptors,
+		grpc_auth.UnaryServerInterceptor(authenticate),
+		srv.authorizeUnary,
+	)...)))
 
+	gsrv := grpc.NewServer(opts...)
 	logger.RegisterLogServiceServer(gsrv, srv)
 	return gsrv, nil
 }
@@ -65,29 +144,180 @@ func grpcFactory(config *Config) (srv *grpcServer, err error) {
 	return srv, nil
 }
 
+// fromClient clears what a client has no say in on a record it produces. Only the log marks the compressed
+// batches it writes, a record claiming to be one would be unbatched when it's read back. Only the Raft log
+// has terms and types, and only the transaction coordinator sets the transaction fields: a forged control
+// record would end another producer's transaction. A write forwarded by a server keeps the transaction
+// fields its coordinator set
+func fromClient(record *logger.Record, forwarded bool) {
+	record.Compression = logger.Compression_NONE
+	record.Term, record.Type = 0, 0
+	if !forwarded {
+		record.TxnId, record.Control = 0, logger.Control_DATA
+	}
+}
+
+// checkRecords refuses requests with a missing record, there's nothing to store for it
+func checkRecords(records ...*logger.Record) error {
+	for i, record := range records {
+		if record == nil {
+			return status.Errorf(codes.InvalidArgument, "record %d is missing", i)
+		}
+	}
+	return nil
+}
+
 func (s *grpcServer) Produce(ctx context.Context, req *logger.ProduceRequest) (*logger.ProduceResponse, error) {
-	if err := s.Authorizer.Authorize(
-		subject(ctx),
-		objectWildcard,
-		produceAction,
-	); err != nil {
+	if err := checkRecords(req.Record); err != nil {
 		return nil, err
 	}
-	offset, err := s.CommitLog.Append(req.Record)
+	fromClient(req.Record, req.Forwarded)
+	// The request is what identifies an idempotent producer's record, not whatever the record itself carries
+	req.Record.ProducerId, req.Record.Sequence = req.ProducerId, req.Sequence
+	if s.TraceRecords {
+		tracing.InjectRecord(ctx, req.Record)
+	}
+	partition, offset, err := s.CommitLog.Append(ctx, req.Topic, req.Partition, req.Record, req.Acks)
 	if err != nil {
 		return nil, err
 	}
-	return &logger.ProduceResponse{Offset: offset}, nil
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("topic", req.Topic),
+		attribute.Int64("partition", int64(partition)),
+		attribute.Int64("offset", int64(offset)),
+	)
+	if req.Acks == logger.Acks_ACKS_NONE {
+		// The offset isn't known for sure until the record is appended, which isn't waited for
+		return &logger.ProduceResponse{Partition: partition}, nil
+	}
+	return &logger.ProduceResponse{Offset: offset, Partition: partition}, nil
 }
 
+// Consume reads the record at the requested offset. With max_wait_ms set, an offset that hasn't been
+// produced yet is waited for up to that long before giving up with ErrOffsetOutOfRange. Read committed
+// consumers get the first committed record from the offset on, waiting while it's behind an open transaction
 func (s *grpcServer) Consume(ctx context.Context, req *logger.ConsumeRequest) (*logger.ConsumeResponse, error) {
-	record, err := s.CommitLog.Read(req.Offset)
+	if req.MaxWaitMs > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(req.MaxWaitMs)*time.Millisecond)
+		defer cancel()
+	}
+	record, err := s.read(ctx, req, req.MaxWaitMs > 0)
 	if err != nil {
 		return nil, err
 	}
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(
+		attribute.String("topic", req.Topic),
+		attribute.Int64("partition", int64(req.Partition)),
+		attribute.Int64("offset", int64(record.Offset)),
+	)
+	tracing.LinkRecords(span, record)
 	return &logger.ConsumeResponse{Record: record}, nil
 }
 
+// read returns the record at the requested offset, waiting for it when wait is set (see waitFor)
+func (s *grpcServer) read(ctx context.Context, req *logger.ConsumeRequest, wait bool) (record *logger.Record, err error) {
+	err = s.waitFor(ctx, req.Topic, req.Partition, wait, func() error {
+		if req.IsolationLevel == logger.IsolationLevel_READ_COMMITTED {
+			records, err := s.CommitLog.ReadCommitted(req.Topic, req.Partition, req.Offset, 1, 0)
+			if err == nil {
+				record = records[0]
+			}
+			return err
+		}
+		record, err = s.CommitLog.Read(ctx, req.Topic, req.Partition, req.Offset)
+		return err
+	})
+	return record, err
+}
+
+// waitFor calls read until it returns something other than ErrOffsetOutOfRange. When wait is set, it blocks
+// in between until a record is appended to the partition or ctx is done, rather than polling the log.
+// Closing the log wakes it up too, getting the channel again then fails with ErrTopicNotFound once
+// the topic is deleted
+func (s *grpcServer) waitFor(ctx context.Context, topic string, partition uint32, wait bool, read func() error) error {
+	for {
+		appended, err := s.CommitLog.Notify(topic, partition)
+		if err != nil {
+			return err
+		}
+		err = read()
+		if _, ok := err.(api_v1.ErrOffsetOutOfRange); !ok || !wait {
+			return err
+		}
+		select {
+		case <-appended:
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// ProduceBatch appends all of the records to one partition, or none of them. The records of an idempotent
+// producer take consecutive sequences from the request's base sequence on
+func (s *grpcServer) ProduceBatch(ctx context.Context, req *logger.ProduceBatchRequest) (*logger.ProduceBatchResponse, error) {
+	if req.Compression != nil && !compression.Valid(*req.Compression) {
+		return nil, api_v1.ErrUnknownCompression{Codec: int32(*req.Compression)}
+	}
+	if err := checkRecords(req.Records...); err != nil {
+		return nil, err
+	}
+	for i, record := range req.Records {
+		fromClient(record, req.Forwarded)
+		record.ProducerId, record.Sequence = req.ProducerId, req.BaseSequence+uint64(i)
+		if s.TraceRecords {
+			tracing.InjectRecord(ctx, record)
+		}
+	}
+	partition, base, err := s.CommitLog.AppendBatch(ctx, req.Topic, req.Partition, req.Records, req.Compression, req.Acks)
+	if err != nil {
+		return nil, err
+	}
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("topic", req.Topic),
+		attribute.Int64("partition", int64(partition)),
+		attribute.Int64("base_offset", int64(base)),
+		attribute.Int("records", len(req.Records)),
+	)
+	if req.Acks == logger.Acks_ACKS_NONE {
+		return &logger.ProduceBatchResponse{Count: uint32(len(req.Records)), Partition: partition}, nil
+	}
+	return &logger.ProduceBatchResponse{
+		BaseOffset: base,
+		Count:      uint32(len(req.Records)),
+		Partition:  partition,
+	}, nil
+}
+
+// Fetch reads the records from the requested offset on, up to max_records of them and max_bytes in total.
+// Like Consume, it waits up to max_wait_ms for the offset to be produced. Clients that accept compressed
+// batches get them as they're stored, sparing the server from decompressing them
+func (s *grpcServer) Fetch(ctx context.Context, req *logger.FetchRequest) (*logger.FetchResponse, error) {
+	if req.MaxWaitMs > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(req.MaxWaitMs)*time.Millisecond)
+		defer cancel()
+	}
+	read := s.CommitLog.ReadRange
+	if req.IsolationLevel == logger.IsolationLevel_READ_COMMITTED {
+		// Batches may hold records of aborted transactions, so read committed clients never get them
+		read = s.CommitLog.ReadCommitted
+	} else if req.AcceptCompressed {
+		read = s.CommitLog.ReadBatches
+	}
+	var records []*logger.Record
+	err := s.waitFor(ctx, req.Topic, req.Partition, req.MaxWaitMs > 0, func() (err error) {
+		records, err = read(req.Topic, req.Partition, req.Offset, req.MaxRecords, req.MaxBytes)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	tracing.LinkRecords(trace.SpanFromContext(ctx), records...)
+	return &logger.FetchResponse{Records: records}, nil
+}
+
 func (s *grpcServer) ProduceStream(stream logger.LogService_ProduceStreamServer) error {
 	for {
 		req, err := stream.Recv()
@@ -104,26 +334,197 @@ func (s *grpcServer) ProduceStream(stream logger.LogService_ProduceStreamServer)
 	}
 }
 
+// ConsumeStream sends every record from the requested offset on, waiting for new ones to be produced
+// once it has caught up, until the client goes away. Its span links to the spans that produced the records
 func (s *grpcServer) ConsumeStream(req *logger.ConsumeRequest, stream logger.LogService_ConsumeStreamServer) error {
+	ctx := stream.Context()
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.String("topic", req.Topic), attribute.Int64("partition", int64(req.Partition)))
 	for {
-		select {
-		case <-stream.Context().Done():
+		record, err := s.read(ctx, req, true)
+		if ctx.Err() != nil {
 			return nil
-		default:
-			res, err := s.Consume(stream.Context(), req)
-			switch err.(type) {
-			case nil:
-			case api_v1.ErrOffsetOutOfRange:
-				continue
-			default:
-				return err
-			}
-			if err = stream.Send(res); err != nil {
-				return err
-			}
-			req.Offset++
 		}
+		if err != nil {
+			return err
+		}
+		if err = stream.Send(&logger.ConsumeResponse{Record: record}); err != nil {
+			return err
+		}
+		tracing.LinkRecords(span, record)
+		// Compacted logs skip offsets, so carry on from the record that was actually returned
+		req.Offset = record.Offset + 1
+	}
+}
+
+func (s *grpcServer) CreateTopic(ctx context.Context, req *logger.CreateTopicRequest) (*logger.CreateTopicResponse, error) {
+	if codec := req.Config.GetCompression(); !compression.Valid(codec) {
+		return nil, api_v1.ErrUnknownCompression{Codec: int32(codec)}
+	}
+	if err := s.CommitLog.CreateTopic(req.Name, req.Config); err != nil {
+		return nil, err
+	}
+	return &logger.CreateTopicResponse{}, nil
+}
+
+func (s *grpcServer) DeleteTopic(ctx context.Context, req *logger.DeleteTopicRequest) (*logger.DeleteTopicResponse, error) {
+	if err := s.CommitLog.DeleteTopic(req.Name); err != nil {
+		return nil, err
+	}
+	return &logger.DeleteTopicResponse{}, nil
+}
+
+func (s *grpcServer) ListTopics(ctx context.Context, req *logger.ListTopicsRequest) (*logger.ListTopicsResponse, error) {
+	return &logger.ListTopicsResponse{Topics: s.CommitLog.Topics()}, nil
+}
+
+func (s *grpcServer) CreatePartitions(ctx context.Context, req *logger.CreatePartitionsRequest) (*logger.CreatePartitionsResponse, error) {
+	if err := s.CommitLog.CreatePartitions(req.Topic, req.Count); err != nil {
+		return nil, err
+	}
+	return &logger.CreatePartitionsResponse{}, nil
+}
+
+func (s *grpcServer) GetOffsets(ctx context.Context, req *logger.GetOffsetsRequest) (*logger.GetOffsetsResponse, error) {
+	lowest, highest, err := s.CommitLog.Offsets(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	return &logger.GetOffsetsResponse{Lowest: lowest, Highest: highest}, nil
+}
+
+// GetSegmentStats reports how much space the records in each segment of a partition take up on disk
+// compared to how much they would uncompressed
+func (s *grpcServer) GetSegmentStats(ctx context.Context, req *logger.GetSegmentStatsRequest) (*logger.GetSegmentStatsResponse, error) {
+	stats, err := s.CommitLog.SegmentStats(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	res := &logger.GetSegmentStatsResponse{}
+	for _, st := range stats {
+		res.Segments = append(res.Segments, &logger.SegmentStats{
+			BaseOffset:        st.BaseOffset,
+			NextOffset:        st.NextOffset,
+			StoredBytes:       st.StoredBytes,
+			UncompressedBytes: st.UncompressedBytes,
+			Ratio:             st.Ratio(),
+		})
+	}
+	return res, nil
+}
+
+// OffsetForTime finds where to start consuming a partition to see every record from a point in time onwards.
+// When nothing is that recent yet it returns the offset the next record will be written at
+func (s *grpcServer) OffsetForTime(ctx context.Context, req *logger.OffsetForTimeRequest) (*logger.OffsetForTimeResponse, error) {
+	offset, err := s.CommitLog.OffsetForTime(req.Topic, req.Partition, req.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+	return &logger.OffsetForTimeResponse{Offset: offset}, nil
+}
+
+// CommitOffset stores the consumer group's position in a partition. Subjects need to be allowed
+// to consume as the group, so one team can't move another team's offsets
+func (s *grpcServer) CommitOffset(ctx context.Context, req *logger.CommitOffsetRequest) (*logger.CommitOffsetResponse, error) {
+	if err := s.CommitLog.CommitOffset(req.Group, req.Topic, req.Partition, req.Offset); err != nil {
+		return nil, err
+	}
+	return &logger.CommitOffsetResponse{}, nil
+}
+
+func (s *grpcServer) FetchCommittedOffset(ctx context.Context, req *logger.FetchCommittedOffsetRequest) (*logger.FetchCommittedOffsetResponse, error) {
+	offset, err := s.CommitLog.CommittedOffset(req.Group, req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	return &logger.FetchCommittedOffsetResponse{Offset: offset}, nil
+}
+
+func (s *grpcServer) BeginTxn(ctx context.Context, req *logger.BeginTxnRequest) (*logger.BeginTxnResponse, error) {
+	id, err := s.Txns.Begin(time.Duration(req.TimeoutMs) * time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	return &logger.BeginTxnResponse{TxnId: id}, nil
+}
+
+// AddToTxn appends the records to one partition as part of the transaction, they stay hidden from
+// read committed consumers until it commits
+func (s *grpcServer) AddToTxn(ctx context.Context, req *logger.AddToTxnRequest) (*logger.AddToTxnResponse, error) {
+	if err := checkRecords(req.Records...); err != nil {
+		return nil, err
+	}
+	for _, record := range req.Records {
+		fromClient(record, false)
+	}
+	partition, base, err := s.Txns.Add(req.TxnId, req.Topic, req.Partition, req.Records)
+	if err != nil {
+		return nil, err
+	}
+	return &logger.AddToTxnResponse{
+		BaseOffset: base,
+		Count:      uint32(len(req.Records)),
+		Partition:  partition,
+	}, nil
+}
+
+func (s *grpcServer) CommitTxn(ctx context.Context, req *logger.CommitTxnRequest) (*logger.CommitTxnResponse, error) {
+	if err := s.Txns.Commit(req.TxnId); err != nil {
+		return nil, err
+	}
+	return &logger.CommitTxnResponse{}, nil
+}
+
+func (s *grpcServer) AbortTxn(ctx context.Context, req *logger.AbortTxnRequest) (*logger.AbortTxnResponse, error) {
+	if err := s.Txns.Abort(req.TxnId); err != nil {
+		return nil, err
+	}
+	return &logger.AbortTxnResponse{}, nil
+}
+
+// JoinGroup adds the caller to a consumer group and returns the partitions it consumes until the next rebalance
+func (s *grpcServer) JoinGroup(ctx context.Context, req *logger.JoinGroupRequest) (*logger.JoinGroupResponse, error) {
+	member, generation, assignments, err := s.Groups.Join(
+		req.Group,
+		req.MemberId,
+		req.Topics,
+		req.Strategy,
+		time.Duration(req.SessionTimeoutMs)*time.Millisecond,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &logger.JoinGroupResponse{
+		MemberId:    member,
+		Generation:  generation,
+		Assignments: assignments,
+	}, nil
+}
+
+func (s *grpcServer) Heartbeat(ctx context.Context, req *logger.HeartbeatRequest) (*logger.HeartbeatResponse, error) {
+	if err := s.Groups.Heartbeat(req.Group, req.MemberId, req.Generation); err != nil {
+		return nil, err
+	}
+	return &logger.HeartbeatResponse{}, nil
+}
+
+func (s *grpcServer) LeaveGroup(ctx context.Context, req *logger.LeaveGroupRequest) (*logger.LeaveGroupResponse, error) {
+	if err := s.Groups.Leave(req.Group, req.MemberId); err != nil {
+		return nil, err
+	}
+	return &logger.LeaveGroupResponse{}, nil
+}
+
+// GetServers lists the members of the cluster and which of them is the leader
+func (s *grpcServer) GetServers(ctx context.Context, req *logger.GetServersRequest) (*logger.GetServersResponse, error) {
+	if s.Servers == nil {
+		return nil, status.Error(codes.Unimplemented, "not running as part of a cluster")
+	}
+	servers, err := s.Servers.GetServers()
+	if err != nil {
+		return nil, err
 	}
+	return &logger.GetServersResponse{Servers: servers}, nil
 }
 
 func authenticate(ctx context.Context) (context.Context, error) {
@@ -4,15 +4,23 @@ import (
 	"bytes"
 	"context"
 	"encoding/gob"
+	"fmt"
 	"io/ioutil"
 	"net"
+	"os"
+	"syscall"
 	"testing"
+	"time"
 
 	api_v1 "github.com/schachte/kafkaclone/api/v1"
 	"github.com/schachte/kafkaclone/api/v1/logger"
 	"github.com/schachte/kafkaclone/internal/authorizer"
 	"github.com/schachte/kafkaclone/internal/config"
+	"github.com/schachte/kafkaclone/internal/group"
 	"github.com/schachte/kafkaclone/internal/log"
+	"github.com/schachte/kafkaclone/internal/topic"
+	"github.com/schachte/kafkaclone/internal/txn"
+	"github.com/schachte/kafkaclone/pkg/compression"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
@@ -57,7 +65,20 @@ func TestServer(t *testing.T) {
 	testGrid.addEntry("produce/consume a message to/from the log succeeds", testProduceConsume)
 	testGrid.addEntry("consume past log boundary fails", testConsumePastBoundary)
 	testGrid.addEntry("produce/consume stream succeeds", testProduceConsumeStream)
+	testGrid.addEntry("idle consumers wait for records without spinning", testConsumeWait)
+	testGrid.addEntry("produce batch/fetch succeeds", testProduceBatchFetch)
+	testGrid.addEntry("compressed batches are stored and fetched", testCompression)
+	testGrid.addEntry("offsets can be looked up by time", testOffsetForTime)
+	testGrid.addEntry("keys and headers round trip", testHeaders)
+	testGrid.addEntry("idempotent producers don't store retries twice", testIdempotentProduce)
+	testGrid.addEntry("producers pick how far records get before they're acknowledged", testAcks)
+	testGrid.addEntry("read committed consumers only see committed transactions", testTransactions)
+	testGrid.addEntry("consumer groups commit offsets", testCommitOffsets)
+	testGrid.addEntry("consumer groups divide partitions", testGroups)
 	testGrid.addEntry("unauthorized fails", testUnauthorized)
+	testGrid.addEntry("unauthorized reads fail", testUnauthorizedReads)
+	testGrid.addEntry("topics are isolated and manageable", testTopics)
+	testGrid.addEntry("partitions are addressable", testPartitions)
 
 	for scenario, fn := range testGrid {
 		t.Run(scenario, func(t *testing.T) {
@@ -89,6 +110,161 @@ func testUnauthorized(t *testing.T, _ *TestConnections, clients []logger.LogServ
 	}
 }
 
+func testUnauthorizedReads(t *testing.T, _ *TestConnections, clients []logger.LogServiceClient, config *Config) {
+	ctx := context.Background()
+	root, nobody := clients[0], clients[1]
+	for _, name := range []string{"", "nobody-feed"} {
+		_, err := root.Produce(ctx, &logger.ProduceRequest{
+			Topic:  name,
+			Record: &logger.Record{Value: []byte("secret")},
+		})
+		require.NoError(t, err)
+	}
+
+	// nobody may only read the topics it owns, whichever way it reads them
+	_, err := nobody.Consume(ctx, &logger.ConsumeRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = nobody.Fetch(ctx, &logger.FetchRequest{Topic: "default"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = nobody.GetOffsets(ctx, &logger.GetOffsetsRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	stream, err := nobody.ConsumeStream(ctx, &logger.ConsumeRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	consume, err := nobody.Consume(ctx, &logger.ConsumeRequest{Topic: "nobody-feed"})
+	require.NoError(t, err)
+	require.Equal(t, []byte("secret"), consume.Record.Value)
+	stream, err = nobody.ConsumeStream(ctx, &logger.ConsumeRequest{Topic: "nobody-feed"})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("secret"), res.Record.Value)
+
+	// Reading a topic doesn't allow writing to it, not even one request into a stream
+	produce, err := nobody.ProduceStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, produce.Send(&logger.ProduceRequest{
+		Topic:  "nobody-feed",
+		Record: &logger.Record{Value: []byte("forged")},
+	}))
+	_, err = produce.Recv()
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = nobody.DeleteTopic(ctx, &logger.DeleteTopicRequest{Name: "nobody-feed"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func testTopics(t *testing.T, _ *TestConnections, clients []logger.LogServiceClient, config *Config) {
+	ctx := context.Background()
+	client := clients[0]
+
+	_, err := client.CreateTopic(ctx, &logger.CreateTopicRequest{
+		Name:   "orders",
+		Config: &logger.TopicConfig{MaxStoreBytes: 4096},
+	})
+	require.NoError(t, err)
+	_, err = client.CreateTopic(ctx, &logger.CreateTopicRequest{Name: "orders"})
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+	_, err = client.CreateTopic(ctx, &logger.CreateTopicRequest{Name: "../escape"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// Each topic has its own offsets
+	for _, name := range []string{"orders", "payments", "orders"} {
+		_, err = client.Produce(ctx, &logger.ProduceRequest{
+			Topic:  name,
+			Record: &logger.Record{Value: []byte(name)},
+		})
+		require.NoError(t, err)
+	}
+	consume, err := client.Consume(ctx, &logger.ConsumeRequest{Topic: "orders", Offset: 1})
+	require.NoError(t, err)
+	require.Equal(t, []byte("orders"), consume.Record.Value)
+	_, err = client.Consume(ctx, &logger.ConsumeRequest{Topic: "payments", Offset: 1})
+	require.Equal(t, status.Code(api_v1.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+
+	list, err := client.ListTopics(ctx, &logger.ListTopicsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"orders", "payments"}, list.Topics)
+
+	_, err = client.DeleteTopic(ctx, &logger.DeleteTopicRequest{Name: "payments"})
+	require.NoError(t, err)
+	_, err = client.Consume(ctx, &logger.ConsumeRequest{Topic: "payments", Offset: 0})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// Consumers waiting on a topic give up as soon as it's deleted
+	consumed := make(chan error)
+	go func() {
+		_, err := client.Consume(ctx, &logger.ConsumeRequest{Topic: "orders", Offset: 2, MaxWaitMs: 5000})
+		consumed <- err
+	}()
+	stream, err := client.ConsumeStream(ctx, &logger.ConsumeRequest{Topic: "orders", Offset: 2})
+	require.NoError(t, err)
+	streamed := make(chan error)
+	go func() {
+		_, err := stream.Recv()
+		streamed <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	_, err = client.DeleteTopic(ctx, &logger.DeleteTopicRequest{Name: "orders"})
+	require.NoError(t, err)
+	for _, waiting := range []chan error{consumed, streamed} {
+		select {
+		case err := <-waiting:
+			require.Equal(t, codes.NotFound, status.Code(err))
+		case <-time.After(time.Second):
+			t.Fatal("consumer kept waiting on a deleted topic")
+		}
+	}
+
+	// Only root may manage topics
+	_, err = clients[1].CreateTopic(ctx, &logger.CreateTopicRequest{Name: "nobody"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func testPartitions(t *testing.T, _ *TestConnections, clients []logger.LogServiceClient, config *Config) {
+	ctx := context.Background()
+	client := clients[0]
+
+	_, err := client.CreateTopic(ctx, &logger.CreateTopicRequest{
+		Name:   "events",
+		Config: &logger.TopicConfig{Partitions: 2},
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		partition := uint32(1)
+		produce, err := client.Produce(ctx, &logger.ProduceRequest{
+			Topic:     "events",
+			Partition: &partition,
+			Record:    &logger.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+		require.Equal(t, partition, produce.Partition)
+		require.Equal(t, uint64(i), produce.Offset)
+	}
+
+	offsets, err := client.GetOffsets(ctx, &logger.GetOffsetsRequest{Topic: "events", Partition: 1})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offsets.Lowest)
+	require.Equal(t, uint64(2), offsets.Highest)
+
+	consume, err := client.Consume(ctx, &logger.ConsumeRequest{Topic: "events", Partition: 1, Offset: 2})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), consume.Record.Offset)
+	_, err = client.Consume(ctx, &logger.ConsumeRequest{Topic: "events", Partition: 0, Offset: 2})
+	require.Equal(t, status.Code(api_v1.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+	_, err = client.GetOffsets(ctx, &logger.GetOffsetsRequest{Topic: "events", Partition: 2})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = client.CreatePartitions(ctx, &logger.CreatePartitionsRequest{Topic: "events", Count: 3})
+	require.NoError(t, err)
+	_, err = client.GetOffsets(ctx, &logger.GetOffsetsRequest{Topic: "events", Partition: 2})
+	require.NoError(t, err)
+	_, err = client.CreatePartitions(ctx, &logger.CreatePartitionsRequest{Topic: "events", Count: 1})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
 func testProduceConsumeStream(
 	t *testing.T,
 	conns *TestConnections,
@@ -132,11 +308,458 @@ func testProduceConsumeStream(
 	for i, record := range records {
 		res, err := consumerStream.Recv()
 		require.NoError(t, err)
+		require.NotZero(t, res.Record.Timestamp)
 		require.Equal(t, res.Record, &logger.Record{
-			Value:  record.Value,
-			Offset: uint64(i),
+			Value:     record.Value,
+			Offset:    uint64(i),
+			Timestamp: res.Record.Timestamp,
+		})
+	}
+}
+
+func testConsumeWait(t *testing.T, conns *TestConnections, clients []logger.LogServiceClient, config *Config) {
+	ctx := context.Background()
+	_, err := clients[0].Produce(ctx, &logger.ProduceRequest{
+		Record: &logger.Record{Value: []byte("first message")},
+	})
+	require.NoError(t, err)
+
+	// A consume past the end waits for max_wait_ms before giving up
+	start := time.Now()
+	_, err = clients[0].Consume(ctx, &logger.ConsumeRequest{Offset: 1, MaxWaitMs: 100})
+	require.Equal(t, status.Code(api_v1.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+	require.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+	stream, err := clients[0].ConsumeStream(ctx, &logger.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Record.Offset)
+
+	// Caught up, the stream should sit idle rather than burn a core polling the log
+	idle := 500 * time.Millisecond
+	before := cpuTime(t)
+	time.Sleep(idle)
+	require.Less(t, cpuTime(t)-before, idle/10)
+
+	received := make(chan time.Time)
+	go func() {
+		res, err := stream.Recv()
+		if err == nil && res.Record.Offset == 1 {
+			received <- time.Now()
+		}
+	}()
+	produced := time.Now()
+	_, err = clients[0].Produce(ctx, &logger.ProduceRequest{
+		Record: &logger.Record{Value: []byte("second message")},
+	})
+	require.NoError(t, err)
+	select {
+	case at := <-received:
+		require.Less(t, at.Sub(produced), 50*time.Millisecond)
+	case <-time.After(time.Second):
+		t.Fatal("stream didn't wake up for the produced record")
+	}
+
+	// A waiting consume returns as soon as its offset is produced
+	consumed := make(chan *logger.ConsumeResponse)
+	go func() {
+		res, _ := clients[0].Consume(ctx, &logger.ConsumeRequest{Offset: 2, MaxWaitMs: 5000})
+		consumed <- res
+	}()
+	time.Sleep(50 * time.Millisecond)
+	_, err = clients[0].Produce(ctx, &logger.ProduceRequest{
+		Record: &logger.Record{Value: []byte("third message")},
+	})
+	require.NoError(t, err)
+	select {
+	case res := <-consumed:
+		require.Equal(t, []byte("third message"), res.GetRecord().GetValue())
+	case <-time.After(time.Second):
+		t.Fatal("consume didn't wake up for the produced record")
+	}
+}
+
+// cpuTime returns the user and system CPU time used by the test process so far
+func cpuTime(t *testing.T) time.Duration {
+	t.Helper()
+	var usage syscall.Rusage
+	require.NoError(t, syscall.Getrusage(syscall.RUSAGE_SELF, &usage))
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+func testProduceBatchFetch(t *testing.T, conns *TestConnections, clients []logger.LogServiceClient, config *Config) {
+	ctx := context.Background()
+	_, err := clients[0].Produce(ctx, &logger.ProduceRequest{
+		Record: &logger.Record{Value: []byte("first message")},
+	})
+	require.NoError(t, err)
+
+	batch, err := clients[0].ProduceBatch(ctx, &logger.ProduceBatchRequest{
+		Records: []*logger.Record{
+			{Value: []byte("second message")},
+			{Value: []byte("third message")},
+			{Value: []byte("fourth message")},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), batch.BaseOffset)
+	require.Equal(t, uint32(3), batch.Count)
+
+	fetch, err := clients[0].Fetch(ctx, &logger.FetchRequest{Offset: 1, MaxRecords: 2})
+	require.NoError(t, err)
+	require.Len(t, fetch.Records, 2)
+	require.Equal(t, []byte("second message"), fetch.Records[0].Value)
+	require.Equal(t, []byte("third message"), fetch.Records[1].Value)
+
+	fetch, err = clients[0].Fetch(ctx, &logger.FetchRequest{Offset: 0})
+	require.NoError(t, err)
+	require.Len(t, fetch.Records, 4)
+
+	_, err = clients[0].Fetch(ctx, &logger.FetchRequest{Offset: 4, MaxWaitMs: 10})
+	require.Equal(t, status.Code(api_v1.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+
+	_, err = clients[1].ProduceBatch(ctx, &logger.ProduceBatchRequest{
+		Records: []*logger.Record{{Value: []byte("denied")}},
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// Requests without a record are refused rather than reaching the log
+	_, err = clients[0].Produce(ctx, &logger.ProduceRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	fetch, err = clients[0].Fetch(ctx, &logger.FetchRequest{Offset: 0})
+	require.NoError(t, err)
+	require.Len(t, fetch.Records, 4)
+}
+
+func testCompression(t *testing.T, conns *TestConnections, clients []logger.LogServiceClient, config *Config) {
+	ctx := context.Background()
+	var records []*logger.Record
+	for i := 0; i < 4; i++ {
+		records = append(records, &logger.Record{Value: []byte(fmt.Sprintf(`{"event":"login","user":%d}`, i))})
+	}
+	codec := logger.Compression_GZIP
+	_, err := clients[0].ProduceBatch(ctx, &logger.ProduceBatchRequest{Records: records, Compression: &codec})
+	require.NoError(t, err)
+
+	// Clients that don't accept compression get the records decompressed
+	fetch, err := clients[0].Fetch(ctx, &logger.FetchRequest{Offset: 1})
+	require.NoError(t, err)
+	require.Len(t, fetch.Records, 3)
+	require.Equal(t, records[1].Value, fetch.Records[0].Value)
+
+	// The others get the batch as it's stored
+	fetch, err = clients[0].Fetch(ctx, &logger.FetchRequest{Offset: 1, AcceptCompressed: true})
+	require.NoError(t, err)
+	require.Len(t, fetch.Records, 1)
+	batch, err := compression.Unbatch(fetch.Records[0])
+	require.NoError(t, err)
+	require.Len(t, batch, 4)
+	require.Equal(t, records[3].Value, batch[3].Value)
+
+	stats, err := clients[0].GetSegmentStats(ctx, &logger.GetSegmentStatsRequest{})
+	require.NoError(t, err)
+	require.NotEmpty(t, stats.Segments)
+	require.Equal(t, uint64(4), stats.Segments[0].NextOffset)
+	require.NotZero(t, stats.Segments[0].StoredBytes)
+
+	unknown := logger.Compression(42)
+	_, err = clients[0].ProduceBatch(ctx, &logger.ProduceBatchRequest{Records: records, Compression: &unknown})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// Records can't pass themselves off as compressed batches, only the log decides which frames are
+	for _, value := range []string{"a", "b", "c"} {
+		record := &logger.Record{Value: []byte(value)}
+		if value == "b" {
+			record.Compression = logger.Compression_GZIP
+		}
+		_, err = clients[0].Produce(ctx, &logger.ProduceRequest{Topic: "plain", Record: record})
+		require.NoError(t, err)
+	}
+	for off, value := range []string{"a", "b", "c"} {
+		consume, err := clients[0].Consume(ctx, &logger.ConsumeRequest{Topic: "plain", Offset: uint64(off)})
+		require.NoError(t, err)
+		require.Equal(t, value, string(consume.Record.Value))
+		require.Equal(t, logger.Compression_NONE, consume.Record.Compression)
+	}
+}
+
+func testOffsetForTime(t *testing.T, conns *TestConnections, clients []logger.LogServiceClient, config *Config) {
+	ctx := context.Background()
+	for _, ts := range []int64{1000, 2000, 3000} {
+		_, err := clients[0].Produce(ctx, &logger.ProduceRequest{
+			Record: &logger.Record{Value: []byte("message"), Timestamp: ts},
+		})
+		require.NoError(t, err)
+	}
+
+	res, err := clients[0].OffsetForTime(ctx, &logger.OffsetForTimeRequest{Timestamp: 1500})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), res.Offset)
+
+	consume, err := clients[0].Consume(ctx, &logger.ConsumeRequest{Offset: res.Offset})
+	require.NoError(t, err)
+	require.Equal(t, int64(2000), consume.Record.Timestamp)
+
+	// Nothing is that recent yet, so consuming starts with the next record
+	res, err = clients[0].OffsetForTime(ctx, &logger.OffsetForTimeRequest{Timestamp: 4000})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), res.Offset)
+
+	// Records produced without a timestamp get the time they were appended
+	before := time.Now().UnixNano() / int64(time.Millisecond)
+	produce, err := clients[0].Produce(ctx, &logger.ProduceRequest{Record: &logger.Record{Value: []byte("now")}})
+	require.NoError(t, err)
+	consume, err = clients[0].Consume(ctx, &logger.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, consume.Record.Timestamp, before)
+}
+
+func testHeaders(t *testing.T, conns *TestConnections, clients []logger.LogServiceClient, config *Config) {
+	ctx := context.Background()
+	record := &logger.Record{
+		Value:   []byte("message"),
+		Key:     []byte("user-1"),
+		Headers: []*logger.Header{{Key: "trace-id", Value: []byte("abc123")}},
+	}
+	produce, err := clients[0].Produce(ctx, &logger.ProduceRequest{Record: record})
+	require.NoError(t, err)
+
+	consume, err := clients[0].Consume(ctx, &logger.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	require.Equal(t, record.Key, consume.Record.Key)
+	value, ok := Header(Headers(consume), "trace-id")
+	require.True(t, ok)
+	require.Equal(t, []byte("abc123"), value)
+}
+
+func testIdempotentProduce(t *testing.T, conns *TestConnections, clients []logger.LogServiceClient, config *Config) {
+	ctx := context.Background()
+	_, err := clients[0].CreateTopic(ctx, &logger.CreateTopicRequest{
+		Name:   "payments",
+		Config: &logger.TopicConfig{Partitions: 3},
+	})
+	require.NoError(t, err)
+
+	produce := func(seq uint64) (*logger.ProduceResponse, error) {
+		return clients[0].Produce(ctx, &logger.ProduceRequest{
+			Topic:      "payments",
+			Record:     &logger.Record{Value: []byte(fmt.Sprintf("payment %d", seq))},
+			ProducerId: 7,
+			Sequence:   seq,
+		})
+	}
+	first, err := produce(0)
+	require.NoError(t, err)
+	_, err = produce(1)
+	require.NoError(t, err)
+
+	// Retries get the partition and offset the record was stored at the first time, even though
+	// the partitioner would have sent them elsewhere
+	for i := 0; i < 3; i++ {
+		retry, err := produce(0)
+		require.NoError(t, err)
+		require.Equal(t, first.Partition, retry.Partition)
+		require.Equal(t, first.Offset, retry.Offset)
+	}
+	var stored uint64
+	for p := uint32(0); p < 3; p++ {
+		fetch, err := clients[0].Fetch(ctx, &logger.FetchRequest{Topic: "payments", Partition: p})
+		if err == nil {
+			stored += uint64(len(fetch.Records))
+		}
+	}
+	require.Equal(t, uint64(2), stored)
+
+	// A sequence can't be skipped
+	_, err = produce(3)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	batch, err := clients[0].ProduceBatch(ctx, &logger.ProduceBatchRequest{
+		Topic:        "payments",
+		Records:      []*logger.Record{{Value: []byte("payment 2")}, {Value: []byte("payment 3")}},
+		ProducerId:   7,
+		BaseSequence: 2,
+	})
+	require.NoError(t, err)
+	record, err := clients[0].Consume(ctx, &logger.ConsumeRequest{
+		Topic:     "payments",
+		Partition: batch.Partition,
+		Offset:    batch.BaseOffset + 1,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), record.Record.Sequence)
+}
+
+func testAcks(t *testing.T, conns *TestConnections, clients []logger.LogServiceClient, config *Config) {
+	ctx := context.Background()
+	for i, acks := range []logger.Acks{logger.Acks_ACKS_LEADER, logger.Acks_ACKS_ALL} {
+		produce, err := clients[0].Produce(ctx, &logger.ProduceRequest{
+			Record: &logger.Record{Value: []byte("acknowledged")},
+			Acks:   acks,
+		})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), produce.Offset)
+	}
+
+	// Fire and forget requests don't learn their offset, but the records are still stored
+	produce, err := clients[0].Produce(ctx, &logger.ProduceRequest{
+		Record: &logger.Record{Value: []byte("forgotten")},
+		Acks:   logger.Acks_ACKS_NONE,
+	})
+	require.NoError(t, err)
+	require.Zero(t, produce.Offset)
+	batch, err := clients[0].ProduceBatch(ctx, &logger.ProduceBatchRequest{
+		Records: []*logger.Record{{Value: []byte("forgotten")}, {Value: []byte("forgotten")}},
+		Acks:    logger.Acks_ACKS_NONE,
+	})
+	require.NoError(t, err)
+	require.Zero(t, batch.BaseOffset)
+	require.Equal(t, uint32(2), batch.Count)
+	fetch, err := clients[0].Fetch(ctx, &logger.FetchRequest{})
+	require.NoError(t, err)
+	require.Len(t, fetch.Records, 5)
+
+	// A single server can't satisfy topics that need more in-sync replicas
+	_, err = clients[0].CreateTopic(ctx, &logger.CreateTopicRequest{
+		Name:   "durable",
+		Config: &logger.TopicConfig{MinInsyncReplicas: 2},
+	})
+	require.NoError(t, err)
+	_, err = clients[0].Produce(ctx, &logger.ProduceRequest{
+		Topic:  "durable",
+		Record: &logger.Record{Value: []byte("refused")},
+		Acks:   logger.Acks_ACKS_ALL,
+	})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func testTransactions(t *testing.T, conns *TestConnections, clients []logger.LogServiceClient, config *Config) {
+	ctx := context.Background()
+	committed := &logger.ConsumeRequest{IsolationLevel: logger.IsolationLevel_READ_COMMITTED}
+
+	commit, err := clients[0].BeginTxn(ctx, &logger.BeginTxnRequest{})
+	require.NoError(t, err)
+	abort, err := clients[0].BeginTxn(ctx, &logger.BeginTxnRequest{})
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = clients[0].AddToTxn(ctx, &logger.AddToTxnRequest{
+			TxnId:   abort.TxnId,
+			Records: []*logger.Record{{Value: []byte(fmt.Sprintf("aborted %d", i))}},
 		})
+		require.NoError(t, err)
+		_, err = clients[0].AddToTxn(ctx, &logger.AddToTxnRequest{
+			TxnId:   commit.TxnId,
+			Records: []*logger.Record{{Value: []byte(fmt.Sprintf("committed %d", i))}},
+		})
+		require.NoError(t, err)
+	}
+
+	// Read uncommitted consumers see the records straight away, read committed ones wait for the commit
+	consume, err := clients[0].Consume(ctx, &logger.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	require.Equal(t, []byte("aborted 0"), consume.Record.Value)
+	_, err = clients[0].Consume(ctx, committed)
+	require.Equal(t, status.Code(api_v1.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+
+	// Producers can't end a transaction with a control record of their own, it's stored as plain data
+	_, err = clients[0].Produce(ctx, &logger.ProduceRequest{
+		Record: &logger.Record{Value: []byte("forged"), TxnId: commit.TxnId, Control: logger.Control_COMMIT, Term: 7, Type: 1},
+	})
+	require.NoError(t, err)
+	_, err = clients[0].Consume(ctx, committed)
+	require.Equal(t, status.Code(api_v1.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+
+	stream, err := clients[0].ConsumeStream(ctx, committed)
+	require.NoError(t, err)
+	_, err = clients[0].CommitTxn(ctx, &logger.CommitTxnRequest{TxnId: commit.TxnId})
+	require.NoError(t, err)
+	_, err = clients[0].AbortTxn(ctx, &logger.AbortTxnRequest{TxnId: abort.TxnId})
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("committed %d", i)), res.Record.Value)
 	}
+
+	fetch, err := clients[0].Fetch(ctx, &logger.FetchRequest{
+		IsolationLevel:   logger.IsolationLevel_READ_COMMITTED,
+		AcceptCompressed: true,
+	})
+	require.NoError(t, err)
+	require.Len(t, fetch.Records, 3)
+	forged := fetch.Records[2]
+	require.Equal(t, []byte("forged"), forged.Value)
+	require.Zero(t, forged.TxnId)
+	require.Equal(t, logger.Control_DATA, forged.Control)
+	require.Zero(t, forged.Term)
+	require.Zero(t, forged.Type)
+
+	_, err = clients[0].CommitTxn(ctx, &logger.CommitTxnRequest{TxnId: commit.TxnId})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = clients[1].BeginTxn(ctx, &logger.BeginTxnRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func testCommitOffsets(t *testing.T, conns *TestConnections, clients []logger.LogServiceClient, config *Config) {
+	ctx := context.Background()
+	root, nobody := clients[0], clients[1]
+
+	_, err := root.FetchCommittedOffset(ctx, &logger.FetchCommittedOffsetRequest{Group: "billing", Topic: "orders"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = root.CommitOffset(ctx, &logger.CommitOffsetRequest{Group: "billing", Topic: "orders", Offset: 5})
+	require.NoError(t, err)
+	res, err := root.FetchCommittedOffset(ctx, &logger.FetchCommittedOffsetRequest{Group: "billing", Topic: "orders"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), res.Offset)
+
+	// nobody may only manage the groups it owns
+	_, err = nobody.CommitOffset(ctx, &logger.CommitOffsetRequest{Group: "billing", Topic: "orders", Offset: 0})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = nobody.FetchCommittedOffset(ctx, &logger.FetchCommittedOffsetRequest{Group: "billing", Topic: "orders"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = nobody.CommitOffset(ctx, &logger.CommitOffsetRequest{Group: "nobody-audit", Topic: "orders", Offset: 2})
+	require.NoError(t, err)
+	res, err = nobody.FetchCommittedOffset(ctx, &logger.FetchCommittedOffsetRequest{Group: "nobody-audit", Topic: "orders"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), res.Offset)
+
+	res, err = root.FetchCommittedOffset(ctx, &logger.FetchCommittedOffsetRequest{Group: "billing", Topic: "orders"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), res.Offset)
+}
+
+func testGroups(t *testing.T, conns *TestConnections, clients []logger.LogServiceClient, config *Config) {
+	ctx := context.Background()
+	root, nobody := clients[0], clients[1]
+	_, err := root.CreateTopic(ctx, &logger.CreateTopicRequest{
+		Name:   "orders",
+		Config: &logger.TopicConfig{Partitions: 2},
+	})
+	require.NoError(t, err)
+
+	first, err := root.JoinGroup(ctx, &logger.JoinGroupRequest{Group: "billing", Topics: []string{"orders"}})
+	require.NoError(t, err)
+	require.Equal(t, []uint32{0, 1}, first.Assignments[0].Partitions)
+	second, err := root.JoinGroup(ctx, &logger.JoinGroupRequest{Group: "billing", Topics: []string{"orders"}})
+	require.NoError(t, err)
+	require.Len(t, second.Assignments[0].Partitions, 1)
+
+	_, err = root.Heartbeat(ctx, &logger.HeartbeatRequest{Group: "billing", MemberId: first.MemberId, Generation: first.Generation})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	first, err = root.JoinGroup(ctx, &logger.JoinGroupRequest{Group: "billing", MemberId: first.MemberId, Topics: []string{"orders"}})
+	require.NoError(t, err)
+	require.Len(t, first.Assignments[0].Partitions, 1)
+	require.NotEqual(t, second.Assignments[0].Partitions, first.Assignments[0].Partitions)
+	_, err = root.Heartbeat(ctx, &logger.HeartbeatRequest{Group: "billing", MemberId: first.MemberId, Generation: first.Generation})
+	require.NoError(t, err)
+
+	_, err = root.LeaveGroup(ctx, &logger.LeaveGroupRequest{Group: "billing", MemberId: second.MemberId})
+	require.NoError(t, err)
+
+	_, err = nobody.JoinGroup(ctx, &logger.JoinGroupRequest{Group: "billing", Topics: []string{"orders"}})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
 }
 
 func testConsumePastBoundary(t *testing.T, conns *TestConnections, clients []logger.LogServiceClient, config *Config) {
@@ -222,14 +845,18 @@ func setupTest(t *testing.T, tlsConfig config.TLSConfig) (clients []logger.LogSe
 	dir, err := ioutil.TempDir("", "server-test")
 	require.NoError(t, err)
 
-	clog, err := log.NewLog(dir, log.Config{})
+	clog, err := topic.New(dir, log.Config{})
 	require.NoError(t, err)
 
 	authorizer := authorizer.New(tlsConfig.ACLModelFile.Name(), tlsConfig.ACLPolicyFile.Name())
+	groups := group.New(clog)
+	txns := txn.New(clog, "server-test")
 	serverConfig := &Config{
 		TLSConfig:  tlsConfig,
 		CommitLog:  clog,
 		Authorizer: authorizer,
+		Groups:     groups,
+		Txns:       txns,
 	}
 
 	copyConfig := tlsConfig
@@ -251,7 +878,10 @@ func setupTest(t *testing.T, tlsConfig config.TLSConfig) (clients []logger.LogSe
 		rootCon.Close()
 		nobodyCon.Close()
 		l.Close()
-		clog.Remove()
+		groups.Close()
+		txns.Close()
+		clog.Close()
+		os.RemoveAll(dir)
 	}
 }
 
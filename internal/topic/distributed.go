@@ -0,0 +1,1075 @@
+package topic
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	api_v1 "github.com/schachte/kafkaclone/api/v1"
+	"github.com/schachte/kafkaclone/api/v1/logger"
+	"github.com/schachte/kafkaclone/internal/log"
+	"github.com/schachte/kafkaclone/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// RaftConfig configures how a DistributedRegistry takes part in the Raft cluster
+type RaftConfig struct {
+	raft.Config
+	StreamLayer *StreamLayer
+	// Bootstrap starts a new cluster with this server as its only voter
+	Bootstrap bool
+	// DialOptions are used to forward writes that arrive at a follower to the leader, and by the leader
+	// to wait for followers to acknowledge ACKS_ALL writes
+	DialOptions []grpc.DialOption
+	// AckTimeout bounds how long an ACKS_ALL write waits for the in-sync followers, 10s by default
+	AckTimeout time.Duration
+}
+
+// DistributedRegistry replicates a Registry with Raft. Every write (records and topic changes) goes through
+// the leader and is applied by every server in the same order, so a record ends up at the same offset
+// everywhere. Reads are served from the local registry
+type DistributedRegistry struct {
+	config   RaftConfig
+	registry *Registry
+	raftLog  *log.RaftStore
+	raft     *raft.Raft
+
+	mu    sync.Mutex
+	conns map[raft.ServerAddress]*grpc.ClientConn
+	// lagging holds the followers the leader has failed to heartbeat, which drop out of the in-sync replicas,
+	// with when the leader last heard from them
+	lagging      map[raft.ServerID]time.Time
+	observations chan raft.Observation
+	observer     *raft.Observer
+}
+
+// NewDistributedRegistry sets up the Raft log, its stable and snapshot stores under dataDir/raft and the
+// replicated topics under dataDir/topics. The topics are derived from the Raft log, so they're rebuilt
+// from it (and the latest snapshot) on every start instead of being trusted
+func NewDistributedRegistry(dataDir string, logConfig log.Config, config RaftConfig) (*DistributedRegistry, error) {
+	d := &DistributedRegistry{
+		config:       config,
+		conns:        make(map[raft.ServerAddress]*grpc.ClientConn),
+		lagging:      make(map[raft.ServerID]time.Time),
+		observations: make(chan raft.Observation, 16),
+	}
+	if d.config.AckTimeout == 0 {
+		d.config.AckTimeout = 10 * time.Second
+	}
+
+	topicsDir := path.Join(dataDir, "topics")
+	if err := os.RemoveAll(topicsDir); err != nil {
+		return nil, err
+	}
+	var err error
+	if d.registry, err = New(topicsDir, logConfig); err != nil {
+		return nil, err
+	}
+	// The FSM stamps records with the time the leader appended them to the Raft log, so every server stores the same timestamps
+	d.registry.keepTimestamps = true
+
+	raftDir := path.Join(dataDir, "raft")
+	if err = os.MkdirAll(path.Join(raftDir, "log"), 0755); err != nil {
+		return nil, err
+	}
+	// Retention and compaction only apply to topics, Raft trims its own log after snapshots
+	raftLogConfig := log.Config{}
+	raftLogConfig.Segment = logConfig.Segment
+	if d.raftLog, err = log.NewRaftStore(path.Join(raftDir, "log"), raftLogConfig); err != nil {
+		return nil, err
+	}
+	stableStore, err := raftboltdb.NewBoltStore(path.Join(raftDir, "stable"))
+	if err != nil {
+		return nil, err
+	}
+	snapshotStore, err := raft.NewFileSnapshotStore(raftDir, 1, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	transport := raft.NewNetworkTransport(config.StreamLayer, 5, 10*time.Second, os.Stderr)
+
+	raftConfig := raft.DefaultConfig()
+	raftConfig.LocalID = config.LocalID
+	if config.HeartbeatTimeout != 0 {
+		raftConfig.HeartbeatTimeout = config.HeartbeatTimeout
+	}
+	if config.ElectionTimeout != 0 {
+		raftConfig.ElectionTimeout = config.ElectionTimeout
+	}
+	if config.LeaderLeaseTimeout != 0 {
+		raftConfig.LeaderLeaseTimeout = config.LeaderLeaseTimeout
+	}
+	if config.CommitTimeout != 0 {
+		raftConfig.CommitTimeout = config.CommitTimeout
+	}
+	if config.SnapshotThreshold != 0 {
+		raftConfig.SnapshotThreshold = config.SnapshotThreshold
+	}
+	if config.SnapshotInterval != 0 {
+		raftConfig.SnapshotInterval = config.SnapshotInterval
+	}
+
+	d.raft, err = raft.NewRaft(raftConfig, &fsm{registry: d.registry, id: config.LocalID}, d.raftLog, stableStore, snapshotStore, transport)
+	if err != nil {
+		return nil, err
+	}
+	d.observer = raft.NewObserver(d.observations, false, func(o *raft.Observation) bool {
+		switch o.Data.(type) {
+		case raft.FailedHeartbeatObservation, raft.ResumedHeartbeatObservation, raft.PeerObservation, raft.LeaderObservation:
+			return true
+		}
+		return false
+	})
+	d.raft.RegisterObserver(d.observer)
+	go d.observe()
+	hasState, err := raft.HasExistingState(d.raftLog, stableStore, snapshotStore)
+	if err != nil {
+		return nil, err
+	}
+	if config.Bootstrap && !hasState {
+		err = d.raft.BootstrapCluster(raft.Configuration{
+			Servers: []raft.Server{{
+				ID:      raftConfig.LocalID,
+				Address: transport.LocalAddr(),
+			}},
+		}).Error()
+	}
+	return d, err
+}
+
+// Append replicates a record to a partition of the topic, creating the topic first if it doesn't exist.
+// The leader picks the partition when none is given so every server applies the record to the same one.
+// A record is committed once a majority of the servers stored it, ACKS_LEADER also flushes it on the
+// leader and ACKS_ALL on every server, waiting for all the in-sync replicas to apply it (see waitForReplicas).
+// ACKS_NONE returns as soon as the leader queued the record, without its offset.
+// The record is traced in ctx's trace, from the leader replicating it to every server applying it
+func (d *DistributedRegistry) Append(ctx context.Context, topic string, partition *uint32, record *logger.Record, acks logger.Acks) (uint32, uint64, error) {
+	if d.raft.State() != raft.Leader {
+		client, err := d.leader()
+		if err != nil {
+			return 0, 0, err
+		}
+		res, err := client.Produce(ctx, &logger.ProduceRequest{
+			Topic:      topic,
+			Partition:  partition,
+			Record:     record,
+			ProducerId: record.ProducerId,
+			Sequence:   record.Sequence,
+			Acks:       acks,
+			Forwarded:  true,
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+		return res.Partition, res.Offset, nil
+	}
+
+	topic, partition, err := d.route(topic, partition, record)
+	if err != nil {
+		return 0, 0, err
+	}
+	req := &logger.ProduceRequest{
+		Topic:     topic,
+		Partition: partition,
+		Record:    record,
+		Acks:      acks,
+	}
+	ctx, span := startReplicate(ctx, topic, *partition)
+	p, off, err := d.append(ctx, appendRequestType, req, topic, *partition, acks)
+	tracing.End(span, err)
+	return p, off, err
+}
+
+// startReplicate starts the leader's span replicating a write to a partition, see fsm.startApply
+func startReplicate(ctx context.Context, topic string, partition uint32) (context.Context, trace.Span) {
+	return tracing.Tracer().Start(ctx, "replicate", trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(
+		attribute.String("topic", topic),
+		attribute.Int64("partition", int64(partition)),
+	))
+}
+
+// append replicates a ProduceRequest or ProduceBatchRequest to the partition on the leader and acknowledges
+// it as acks asks for, returning the partition and the offset of the (first) record
+func (d *DistributedRegistry) append(ctx context.Context, reqType requestType, req proto.Message, topic string, partition uint32, acks logger.Acks) (uint32, uint64, error) {
+	if acks == logger.Acks_ACKS_NONE {
+		return partition, 0, d.enqueue(ctx, reqType, req)
+	}
+	replicas, err := d.inSyncFollowers(topic, acks)
+	if err != nil {
+		return 0, 0, err
+	}
+	res, err := d.apply(ctx, reqType, req)
+	if err != nil {
+		return 0, 0, err
+	}
+	var first, last uint64
+	switch res := res.(type) {
+	case *logger.ProduceResponse:
+		partition, first, last = res.Partition, res.Offset, res.Offset
+	case *logger.ProduceBatchResponse:
+		if res.Count == 0 {
+			return res.Partition, res.BaseOffset, nil
+		}
+		partition, first, last = res.Partition, res.BaseOffset, res.BaseOffset+uint64(res.Count)-1
+	}
+	if err = d.acknowledge(ctx, topic, partition, last, acks, replicas); err != nil {
+		return 0, 0, err
+	}
+	return partition, first, nil
+}
+
+// AppendBatch replicates the records to one partition of the topic as a single Raft entry, so the batch is
+// applied atomically on every server. It's acknowledged and traced the same way as by Append
+func (d *DistributedRegistry) AppendBatch(ctx context.Context, topic string, partition *uint32, records []*logger.Record, codec *logger.Compression, acks logger.Acks) (uint32, uint64, error) {
+	if d.raft.State() != raft.Leader {
+		client, err := d.leader()
+		if err != nil {
+			return 0, 0, err
+		}
+		req := &logger.ProduceBatchRequest{
+			Topic:       topic,
+			Partition:   partition,
+			Records:     records,
+			Compression: codec,
+			Acks:        acks,
+			Forwarded:   true,
+		}
+		if len(records) > 0 {
+			req.ProducerId, req.BaseSequence = records[0].ProducerId, records[0].Sequence
+		}
+		res, err := client.ProduceBatch(ctx, req)
+		if err != nil {
+			return 0, 0, err
+		}
+		return res.Partition, res.BaseOffset, nil
+	}
+
+	var first *logger.Record
+	if len(records) > 0 {
+		first = records[0]
+	}
+	topic, partition, err := d.route(topic, partition, first)
+	if err != nil {
+		return 0, 0, err
+	}
+	req := &logger.ProduceBatchRequest{
+		Topic:       topic,
+		Partition:   partition,
+		Records:     records,
+		Compression: codec,
+		Acks:        acks,
+	}
+	ctx, span := startReplicate(ctx, topic, *partition)
+	span.SetAttributes(attribute.Int("records", len(records)))
+	p, off, err := d.append(ctx, appendBatchRequestType, req, topic, *partition, acks)
+	tracing.End(span, err)
+	return p, off, err
+}
+
+// inSyncFollowers returns the addresses of the followers in sync with the leader for ACKS_ALL writes, failing
+// with ErrNotEnoughReplicas when the topic needs more in-sync replicas than there are
+func (d *DistributedRegistry) inSyncFollowers(topic string, acks logger.Acks) ([]raft.ServerAddress, error) {
+	if acks != logger.Acks_ACKS_ALL {
+		return nil, nil
+	}
+	future := d.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	var followers []raft.ServerAddress
+	for _, srv := range future.Configuration().Servers {
+		if srv.Suffrage != raft.Voter || srv.ID == d.config.LocalID {
+			continue
+		}
+		if _, ok := d.lagging[srv.ID]; !ok {
+			followers = append(followers, srv.Address)
+		}
+	}
+	d.mu.Unlock()
+	// the leader is always in sync with itself
+	if err := d.registry.checkInSync(topic, len(followers)+1); err != nil {
+		return nil, err
+	}
+	return followers, nil
+}
+
+// acknowledge flushes the leader's copy of the records for ACKS_LEADER, ACKS_ALL writes are flushed by every
+// server when applying them and wait for the in-sync followers to apply them up to offset
+func (d *DistributedRegistry) acknowledge(ctx context.Context, topic string, partition uint32, offset uint64, acks logger.Acks, followers []raft.ServerAddress) error {
+	switch acks {
+	case logger.Acks_ACKS_ALL:
+		return d.waitForReplicas(ctx, topic, partition, offset, followers)
+	default:
+		return d.registry.Flush(topic, partition)
+	}
+}
+
+// waitForReplicas waits until every follower has applied the partition up to offset, long-polling each of
+// them for the record. It fails with ErrNotEnoughReplicas when some didn't within the ack timeout, the
+// records are appended regardless and retrying the write stores them again. The polls are traced in ctx's
+// trace but only the ack timeout ends them
+func (d *DistributedRegistry) waitForReplicas(ctx context.Context, topic string, partition uint32, offset uint64, followers []raft.ServerAddress) error {
+	ctx, cancel := context.WithTimeout(trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(ctx)), d.config.AckTimeout)
+	defer cancel()
+	acked := make(chan bool, len(followers))
+	for _, addr := range followers {
+		go func(addr raft.ServerAddress) {
+			acked <- d.waitForReplica(ctx, addr, topic, partition, offset)
+		}(addr)
+	}
+	inSync := 1
+	for range followers {
+		if <-acked {
+			inSync++
+		}
+	}
+	if inSync < len(followers)+1 {
+		return api_v1.ErrNotEnoughReplicas{
+			Topic:    topic,
+			InSync:   inSync,
+			Required: len(followers) + 1,
+			Appended: true,
+		}
+	}
+	return nil
+}
+
+// waitForReplica reports whether the follower applied the record at offset before ctx is done
+func (d *DistributedRegistry) waitForReplica(ctx context.Context, addr raft.ServerAddress, topic string, partition uint32, offset uint64) bool {
+	for {
+		deadline, _ := ctx.Deadline()
+		client, err := d.client(addr)
+		if err == nil {
+			_, err = client.Consume(ctx, &logger.ConsumeRequest{
+				Topic:     topic,
+				Partition: partition,
+				Offset:    offset,
+				MaxWaitMs: uint32(time.Until(deadline) / time.Millisecond),
+			})
+			if err == nil {
+				return true
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// observe keeps track of the followers the leader fails to heartbeat until the observer is deregistered
+func (d *DistributedRegistry) observe() {
+	for o := range d.observations {
+		d.mu.Lock()
+		switch o := o.Data.(type) {
+		case raft.FailedHeartbeatObservation:
+			// a follower that was never reached starts lagging now
+			if o.LastContact.IsZero() {
+				o.LastContact = time.Now()
+			}
+			d.lagging[o.PeerID] = o.LastContact
+		case raft.ResumedHeartbeatObservation:
+			delete(d.lagging, o.PeerID)
+		case raft.PeerObservation:
+			delete(d.lagging, o.Peer.ID)
+		case raft.LeaderObservation:
+			// a new leader heartbeats the followers from scratch
+			d.lagging = make(map[raft.ServerID]time.Time)
+		}
+		d.mu.Unlock()
+	}
+}
+
+// route creates the topic if it doesn't exist yet and picks the partition for the record when none is given
+func (d *DistributedRegistry) route(topic string, partition *uint32, record *logger.Record) (string, *uint32, error) {
+	if topic == "" {
+		topic = DefaultTopic
+	}
+	partitions, err := d.registry.Partitions(topic)
+	if _, ok := err.(api_v1.ErrTopicNotFound); ok {
+		err = d.CreateTopic(topic, nil)
+		if _, ok := err.(api_v1.ErrTopicExists); ok {
+			err = nil
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		partitions, err = d.registry.Partitions(topic)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	if partition == nil {
+		var p uint32
+		if record != nil {
+			p = d.registry.Partitioner.Partition(topic, record, partitions)
+		}
+		partition = &p
+	}
+	return topic, partition, nil
+}
+
+func (d *DistributedRegistry) Read(ctx context.Context, topic string, partition uint32, offset uint64) (*logger.Record, error) {
+	return d.registry.Read(ctx, topic, partition, offset)
+}
+
+func (d *DistributedRegistry) ReadRange(topic string, partition uint32, offset uint64, maxRecords uint32, maxBytes uint64) ([]*logger.Record, error) {
+	return d.registry.ReadRange(topic, partition, offset, maxRecords, maxBytes)
+}
+
+func (d *DistributedRegistry) ReadBatches(topic string, partition uint32, offset uint64, maxRecords uint32, maxBytes uint64) ([]*logger.Record, error) {
+	return d.registry.ReadBatches(topic, partition, offset, maxRecords, maxBytes)
+}
+
+func (d *DistributedRegistry) ReadCommitted(topic string, partition uint32, offset uint64, maxRecords uint32, maxBytes uint64) ([]*logger.Record, error) {
+	return d.registry.ReadCommitted(topic, partition, offset, maxRecords, maxBytes)
+}
+
+// OngoingTransactions returns the transactions with records in the partition on this server that haven't ended yet
+func (d *DistributedRegistry) OngoingTransactions(topic string, partition uint32) ([]uint64, error) {
+	return d.registry.OngoingTransactions(topic, partition)
+}
+
+// TransactionOutcome returns how a transaction ended in the partition on this server
+func (d *DistributedRegistry) TransactionOutcome(topic string, partition uint32, id uint64) (logger.Control, error) {
+	return d.registry.TransactionOutcome(topic, partition, id)
+}
+
+// SegmentStats describes the segments of the partition on this server
+func (d *DistributedRegistry) SegmentStats(topic string, partition uint32) ([]log.SegmentStats, error) {
+	return d.registry.SegmentStats(topic, partition)
+}
+
+func (d *DistributedRegistry) OffsetForTime(topic string, partition uint32, timestamp int64) (uint64, error) {
+	return d.registry.OffsetForTime(topic, partition, timestamp)
+}
+
+// Notify wakes up once a record is applied to the partition on this server
+func (d *DistributedRegistry) Notify(topic string, partition uint32) (<-chan struct{}, error) {
+	return d.registry.Notify(topic, partition)
+}
+
+func (d *DistributedRegistry) Offsets(topic string, partition uint32) (lowest, highest uint64, err error) {
+	return d.registry.Offsets(topic, partition)
+}
+
+// CommitOffset replicates the consumer group's offset for the partition
+func (d *DistributedRegistry) CommitOffset(group, topic string, partition uint32, offset uint64) error {
+	req := &logger.CommitOffsetRequest{Group: group, Topic: topic, Partition: partition, Offset: offset}
+	if d.raft.State() != raft.Leader {
+		client, err := d.leader()
+		if err != nil {
+			return err
+		}
+		_, err = client.CommitOffset(context.Background(), req)
+		return err
+	}
+	_, err := d.apply(context.Background(), commitOffsetRequestType, req)
+	return err
+}
+
+func (d *DistributedRegistry) CommittedOffset(group, topic string, partition uint32) (uint64, error) {
+	return d.registry.CommittedOffset(group, topic, partition)
+}
+
+func (d *DistributedRegistry) Partitions(topic string) (uint32, error) {
+	return d.registry.Partitions(topic)
+}
+
+// Stats returns a snapshot of every open partition log of this server's replica (see Registry.Stats)
+func (d *DistributedRegistry) Stats() []PartitionStats {
+	return d.registry.Stats()
+}
+
+// ReplicationLag returns how far behind the leader each follower is, by ID, as the time since the leader
+// last heard from the followers it's failing to heartbeat. Followers keeping up lag by zero. Only the
+// leader knows, the other servers return nil
+func (d *DistributedRegistry) ReplicationLag() map[string]time.Duration {
+	if d.raft.State() != raft.Leader {
+		return nil
+	}
+	future := d.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil
+	}
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	lag := make(map[string]time.Duration)
+	for _, srv := range future.Configuration().Servers {
+		if srv.ID == d.config.LocalID {
+			continue
+		}
+		lag[string(srv.ID)] = 0
+		if lastContact, ok := d.lagging[srv.ID]; ok {
+			lag[string(srv.ID)] = now.Sub(lastContact)
+		}
+	}
+	return lag
+}
+
+// PartitionLag is how many records a follower's copy of a partition is behind the leader's
+type PartitionLag struct {
+	Peer      string
+	Topic     string
+	Partition uint32
+	Records   uint64
+}
+
+// offsetLagTimeout bounds how long OffsetLag waits for the followers to report their offsets
+const offsetLagTimeout = time.Second
+
+// OffsetLag asks every follower for the offsets of the partitions open on the leader and returns how many
+// records each of them is behind, the leader's highest offset minus the follower's. Partitions a follower
+// doesn't answer for within offsetLagTimeout are left out, ReplicationLag covers followers that are gone.
+// Only the leader knows, the other servers return nil
+func (d *DistributedRegistry) OffsetLag() []PartitionLag {
+	if d.raft.State() != raft.Leader {
+		return nil
+	}
+	future := d.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), offsetLagTimeout)
+	defer cancel()
+	partitions := d.registry.Stats()
+	var lags []PartitionLag
+	for _, srv := range future.Configuration().Servers {
+		if srv.ID == d.config.LocalID {
+			continue
+		}
+		client, err := d.client(srv.Address)
+		if err != nil {
+			continue
+		}
+		for _, p := range partitions {
+			res, err := client.GetOffsets(ctx, &logger.GetOffsetsRequest{Topic: p.Topic, Partition: p.Partition})
+			if err != nil {
+				continue
+			}
+			lag := PartitionLag{Peer: string(srv.ID), Topic: p.Topic, Partition: p.Partition}
+			if p.HighestOffset > res.Highest {
+				lag.Records = p.HighestOffset - res.Highest
+			}
+			lags = append(lags, lag)
+		}
+	}
+	return lags
+}
+
+func (d *DistributedRegistry) Topics() []string {
+	return d.registry.Topics()
+}
+
+func (d *DistributedRegistry) CreateTopic(name string, config *logger.TopicConfig) error {
+	req := &logger.CreateTopicRequest{Name: name, Config: config}
+	if d.raft.State() != raft.Leader {
+		client, err := d.leader()
+		if err != nil {
+			return err
+		}
+		_, err = client.CreateTopic(context.Background(), req)
+		return err
+	}
+	_, err := d.apply(context.Background(), createTopicRequestType, req)
+	return err
+}
+
+func (d *DistributedRegistry) CreatePartitions(topic string, count uint32) error {
+	req := &logger.CreatePartitionsRequest{Topic: topic, Count: count}
+	if d.raft.State() != raft.Leader {
+		client, err := d.leader()
+		if err != nil {
+			return err
+		}
+		_, err = client.CreatePartitions(context.Background(), req)
+		return err
+	}
+	_, err := d.apply(context.Background(), createPartitionsRequestType, req)
+	return err
+}
+
+func (d *DistributedRegistry) DeleteTopic(name string) error {
+	req := &logger.DeleteTopicRequest{Name: name}
+	if d.raft.State() != raft.Leader {
+		client, err := d.leader()
+		if err != nil {
+			return err
+		}
+		_, err = client.DeleteTopic(context.Background(), req)
+		return err
+	}
+	_, err := d.apply(context.Background(), deleteTopicRequestType, req)
+	return err
+}
+
+// apply replicates a command through Raft and returns what the local FSM produced for it
+func (d *DistributedRegistry) apply(ctx context.Context, reqType requestType, req proto.Message) (interface{}, error) {
+	future, err := d.submit(ctx, reqType, req)
+	if err != nil {
+		return nil, err
+	}
+	if future.Error() != nil {
+		return nil, future.Error()
+	}
+	res := future.Response()
+	if err, ok := res.(error); ok {
+		return nil, err
+	}
+	return res, nil
+}
+
+// enqueue hands a command to Raft without waiting for it to be committed. Raft keeps the commands it's handed
+// in order, so they're still applied in the order they were enqueued, but whether they fail goes unnoticed
+func (d *DistributedRegistry) enqueue(ctx context.Context, reqType requestType, req proto.Message) error {
+	_, err := d.submit(ctx, reqType, req)
+	return err
+}
+
+// submit hands a command to Raft, with the trace context of ctx in the entry's extensions so the servers
+// applying it continue the trace (see fsm.startApply)
+func (d *DistributedRegistry) submit(ctx context.Context, reqType requestType, req proto.Message) (raft.ApplyFuture, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(byte(reqType))
+	b, err := proto.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(b)
+
+	timeout := 10 * time.Second
+	return d.raft.ApplyLog(raft.Log{Data: buf.Bytes(), Extensions: tracing.Marshal(ctx)}, timeout), nil
+}
+
+// leader returns a client for the current leader, which writes are forwarded to
+func (d *DistributedRegistry) leader() (logger.LogServiceClient, error) {
+	addr, _ := d.raft.LeaderWithID()
+	if addr == "" {
+		return nil, status.Error(codes.Unavailable, "no leader elected")
+	}
+	return d.client(addr)
+}
+
+// client returns a client for the server at addr, reusing its connection
+func (d *DistributedRegistry) client(addr raft.ServerAddress) (logger.LogServiceClient, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	cc, ok := d.conns[addr]
+	if !ok {
+		var err error
+		opts := append(tracing.DialOptions(), d.config.DialOptions...)
+		if cc, err = grpc.Dial(string(addr), opts...); err != nil {
+			return nil, err
+		}
+		d.conns[addr] = cc
+	}
+	return logger.NewLogServiceClient(cc), nil
+}
+
+// GetServers lists the servers in the Raft cluster, the leader among them
+func (d *DistributedRegistry) GetServers() ([]*logger.Server, error) {
+	future := d.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	_, leader := d.raft.LeaderWithID()
+	var servers []*logger.Server
+	for _, srv := range future.Configuration().Servers {
+		servers = append(servers, &logger.Server{
+			Id:       string(srv.ID),
+			RpcAddr:  string(srv.Address),
+			IsLeader: srv.ID == leader,
+		})
+	}
+	return servers, nil
+}
+
+// Join adds the server to the Raft cluster as a voter. It's called through discovery when a server joins
+func (d *DistributedRegistry) Join(id, addr string) error {
+	configFuture := d.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return err
+	}
+	serverID := raft.ServerID(id)
+	serverAddr := raft.ServerAddress(addr)
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.ID == serverID || srv.Address == serverAddr {
+			if srv.ID == serverID && srv.Address == serverAddr {
+				// server has already joined
+				return nil
+			}
+			// remove the existing server
+			if err := d.raft.RemoveServer(serverID, 0, 0).Error(); err != nil {
+				return err
+			}
+		}
+	}
+	return d.raft.AddVoter(serverID, serverAddr, 0, 0).Error()
+}
+
+// Leave removes the server from the Raft cluster
+func (d *DistributedRegistry) Leave(id string) error {
+	return d.raft.RemoveServer(raft.ServerID(id), 0, 0).Error()
+}
+
+// WaitForLeader blocks until the cluster has elected a leader or the timeout passes
+func (d *DistributedRegistry) WaitForLeader(timeout time.Duration) error {
+	timeoutc := time.After(timeout)
+	ticker := time.NewTicker(time.Second / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-timeoutc:
+			return status.Error(codes.DeadlineExceeded, "timed out waiting for a leader")
+		case <-ticker.C:
+			if addr, _ := d.raft.LeaderWithID(); addr != "" {
+				return nil
+			}
+		}
+	}
+}
+
+func (d *DistributedRegistry) Close() error {
+	d.raft.DeregisterObserver(d.observer)
+	close(d.observations)
+	if err := d.raft.Shutdown().Error(); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	for addr, cc := range d.conns {
+		_ = cc.Close()
+		delete(d.conns, addr)
+	}
+	d.mu.Unlock()
+	if err := d.registry.Close(); err != nil {
+		return err
+	}
+	return d.raftLog.Close()
+}
+
+type requestType uint8
+
+const (
+	appendRequestType requestType = iota
+	createTopicRequestType
+	createPartitionsRequestType
+	deleteTopicRequestType
+	appendBatchRequestType
+	commitOffsetRequestType
+)
+
+// fsm applies committed Raft entries to the local registry
+type fsm struct {
+	registry *Registry
+	id       raft.ServerID
+}
+
+var _ raft.FSM = (*fsm)(nil)
+
+func (f *fsm) Apply(record *raft.Log) interface{} {
+	buf := record.Data
+	switch requestType(buf[0]) {
+	case appendRequestType:
+		req := &logger.ProduceRequest{}
+		if err := proto.Unmarshal(buf[1:], req); err != nil {
+			return err
+		}
+		f.stamp(req.Topic, record.AppendedAt, req.Record)
+		ctx, span := f.startApply(record, req.Topic)
+		partition, offset, err := f.registry.Append(ctx, req.Topic, req.Partition, req.Record, replicaAcks(req.Acks))
+		span.SetAttributes(attribute.Int64("partition", int64(partition)), attribute.Int64("offset", int64(offset)))
+		tracing.End(span, err)
+		if err != nil {
+			return err
+		}
+		return &logger.ProduceResponse{Offset: offset, Partition: partition}
+	case appendBatchRequestType:
+		req := &logger.ProduceBatchRequest{}
+		if err := proto.Unmarshal(buf[1:], req); err != nil {
+			return err
+		}
+		f.stamp(req.Topic, record.AppendedAt, req.Records...)
+		ctx, span := f.startApply(record, req.Topic)
+		partition, base, err := f.registry.AppendBatch(ctx, req.Topic, req.Partition, req.Records, req.Compression, replicaAcks(req.Acks))
+		span.SetAttributes(attribute.Int64("partition", int64(partition)), attribute.Int64("base_offset", int64(base)))
+		tracing.End(span, err)
+		if err != nil {
+			return err
+		}
+		return &logger.ProduceBatchResponse{BaseOffset: base, Count: uint32(len(req.Records)), Partition: partition}
+	case commitOffsetRequestType:
+		req := &logger.CommitOffsetRequest{}
+		if err := proto.Unmarshal(buf[1:], req); err != nil {
+			return err
+		}
+		return f.registry.CommitOffset(req.Group, req.Topic, req.Partition, req.Offset)
+	case createTopicRequestType:
+		req := &logger.CreateTopicRequest{}
+		if err := proto.Unmarshal(buf[1:], req); err != nil {
+			return err
+		}
+		return f.registry.CreateTopic(req.Name, req.Config)
+	case createPartitionsRequestType:
+		req := &logger.CreatePartitionsRequest{}
+		if err := proto.Unmarshal(buf[1:], req); err != nil {
+			return err
+		}
+		return f.registry.CreatePartitions(req.Topic, req.Count)
+	case deleteTopicRequestType:
+		req := &logger.DeleteTopicRequest{}
+		if err := proto.Unmarshal(buf[1:], req); err != nil {
+			return err
+		}
+		return f.registry.DeleteTopic(req.Name)
+	}
+	return nil
+}
+
+// startApply starts the span of this server applying a write, a child of the leader's span replicating it
+// when the entry carries its trace context. Entries replayed on restart are traced again in their trace
+func (f *fsm) startApply(entry *raft.Log, topic string) (context.Context, trace.Span) {
+	return tracing.Tracer().Start(tracing.Unmarshal(entry.Extensions), "apply",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("server", string(f.id)),
+			attribute.Int64("raft.index", int64(entry.Index)),
+			attribute.String("topic", topic),
+		),
+	)
+}
+
+// replicaAcks is how every server acknowledges applying a write: ACKS_ALL writes are flushed everywhere, the
+// leader flushes ACKS_LEADER writes itself once they're committed (see DistributedRegistry.acknowledge)
+func replicaAcks(acks logger.Acks) logger.Acks {
+	if acks == logger.Acks_ACKS_ALL {
+		return logger.Acks_ACKS_LEADER
+	}
+	return logger.Acks_ACKS_NONE
+}
+
+// stamp sets the timestamp of records that don't have one, or of every record on log append time topics,
+// to when the leader appended them to the Raft log
+func (f *fsm) stamp(topic string, appendedAt time.Time, records ...*logger.Record) {
+	// Entries from before Raft recorded append times are left to be stamped by the log
+	if appendedAt.IsZero() {
+		return
+	}
+	logAppendTime := f.registry.logAppendTime(topic)
+	for _, record := range records {
+		if record.Timestamp == 0 || logAppendTime {
+			record.Timestamp = appendedAt.UnixNano() / int64(time.Millisecond)
+		}
+	}
+}
+
+// Snapshot captures the topics and how far each partition goes right now. Records appended while the
+// snapshot is being persisted are left out, Raft replays them on top of it. Every partition is read
+// through a log.Log.Reader, which keeps the segments it started with open until it's done, so retention,
+// compaction and deleting topics carry on meanwhile.
+// Persisting rewrites every record the partitions hold, so it costs about as much as copying the topics'
+// data directory. RaftConfig.SnapshotThreshold and SnapshotInterval bound how often that happens
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	s := &snapshot{}
+	fail := func(err error) (raft.FSMSnapshot, error) {
+		s.Release()
+		return nil, err
+	}
+	for _, name := range f.registry.Topics() {
+		config, err := f.registry.TopicConfig(name)
+		if err != nil {
+			return fail(err)
+		}
+		s.topics = append(s.topics, snapshotTopic{name: name, config: config})
+		t := &s.topics[len(s.topics)-1]
+		for p := uint32(0); p < config.Partitions; p++ {
+			l, release, err := f.registry.acquire(name, p)
+			if err != nil {
+				return fail(err)
+			}
+			highest, err := l.HighestOffset()
+			if err != nil {
+				release()
+				return fail(err)
+			}
+			t.partitions = append(t.partitions, snapshotPartition{reader: l.Reader(), highest: highest})
+			release()
+		}
+	}
+	s.offsets = f.registry.CommittedOffsets()
+	return s, nil
+}
+
+// Restore replaces the registry with the contents of a snapshot
+func (f *fsm) Restore(r io.ReadCloser) error {
+	defer r.Close()
+	if err := f.registry.Reset(); err != nil {
+		return err
+	}
+	header := make([]byte, 1+lenWidth)
+	for {
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		b := make([]byte, enc.Uint64(header[1:]))
+		if _, err := io.ReadFull(r, b); err != nil {
+			return err
+		}
+		switch header[0] {
+		case snapshotTopicType:
+			req := &logger.CreateTopicRequest{}
+			if err := proto.Unmarshal(b, req); err != nil {
+				return err
+			}
+			if err := f.registry.CreateTopic(req.Name, req.Config); err != nil {
+				return err
+			}
+		case snapshotRecordType:
+			req := &logger.ProduceRequest{}
+			if err := proto.Unmarshal(b, req); err != nil {
+				return err
+			}
+			if err := f.registry.AppendAt(req.Topic, req.GetPartition(), req.Record); err != nil {
+				return err
+			}
+		case snapshotOffsetType:
+			req := &logger.CommitOffsetRequest{}
+			if err := proto.Unmarshal(b, req); err != nil {
+				return err
+			}
+			if err := f.registry.CommitOffset(req.Group, req.Topic, req.Partition, req.Offset); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+const (
+	lenWidth = 8
+
+	snapshotTopicType  byte = 0
+	snapshotRecordType byte = 1
+	snapshotOffsetType byte = 2
+)
+
+var enc = binary.BigEndian
+
+// snapshot is a point in time view of the registry. It's written out as a sequence of
+// type (1 byte) | length (8 bytes) | message entries: each topic followed by its records, then the committed offsets
+type snapshot struct {
+	topics  []snapshotTopic
+	offsets map[log.GroupPartition]uint64
+}
+
+type snapshotTopic struct {
+	name       string
+	config     *logger.TopicConfig
+	partitions []snapshotPartition
+}
+
+type snapshotPartition struct {
+	reader  io.ReadCloser
+	highest uint64
+}
+
+var _ raft.FSMSnapshot = (*snapshot)(nil)
+
+func (s *snapshot) Persist(sink raft.SnapshotSink) error {
+	if err := s.persist(sink); err != nil {
+		_ = sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+// persist writes the snapshot out record by record. Compressed batches are written out decompressed,
+// so a server restored from a snapshot stores their records uncompressed
+func (s *snapshot) persist(w io.Writer) error {
+	for _, t := range s.topics {
+		if err := writeEntry(w, snapshotTopicType, &logger.CreateTopicRequest{Name: t.name, Config: t.config}); err != nil {
+			return err
+		}
+		for p, partition := range t.partitions {
+			if err := persistPartition(w, t.name, uint32(p), partition); err != nil {
+				return err
+			}
+		}
+	}
+	for gp, offset := range s.offsets {
+		if err := writeEntry(w, snapshotOffsetType, &logger.CommitOffsetRequest{
+			Group:     gp.Group,
+			Topic:     gp.Topic,
+			Partition: gp.Partition,
+			Offset:    offset,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// persistPartition writes out the records of the partition up to the highest offset it had when the
+// snapshot was taken, and lets go of its reader
+func persistPartition(w io.Writer, topic string, partition uint32, p snapshotPartition) error {
+	defer p.reader.Close()
+	for {
+		records, err := log.ReadFrame(p.reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			if record.Offset > p.highest {
+				return nil
+			}
+			if err = writeEntry(w, snapshotRecordType, &logger.ProduceRequest{
+				Topic:     topic,
+				Partition: &partition,
+				Record:    record,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func writeEntry(w io.Writer, entryType byte, m proto.Message) error {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, 1+lenWidth)
+	header[0] = entryType
+	enc.PutUint64(header[1:], uint64(len(b)))
+	if _, err = w.Write(header); err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func (s *snapshot) Release() {
+	for _, t := range s.topics {
+		for _, p := range t.partitions {
+			p.reader.Close()
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package topic
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/schachte/kafkaclone/api/v1/logger"
+	"github.com/schachte/kafkaclone/internal/log"
+	"github.com/stretchr/testify/require"
+)
+
+// sink collects a persisted snapshot in memory
+type sink struct {
+	bytes.Buffer
+}
+
+func (s *sink) ID() string    { return "test" }
+func (s *sink) Cancel() error { return nil }
+func (s *sink) Close() error  { return nil }
+
+func TestSnapshotRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	r, err := New(dir+"/from", log.Config{})
+	require.NoError(t, err)
+	defer r.Close()
+	require.NoError(t, r.CreateTopic("orders", &logger.TopicConfig{Partitions: 2, Compaction: true}))
+	for i := 0; i < 3; i++ {
+		_, _, err = r.Append(context.Background(), "orders", nil, &logger.Record{Value: []byte{byte(i)}}, logger.Acks_ACKS_LEADER)
+		require.NoError(t, err)
+	}
+	require.NoError(t, r.CommitOffset("billing", "orders", 1, 2))
+	f := &fsm{registry: r}
+	snap, err := f.Snapshot()
+	require.NoError(t, err)
+
+	// records appended after the snapshot was taken are left to be replayed from the Raft log
+	_, _, err = r.Append(context.Background(), "orders", nil, &logger.Record{Value: []byte("later")}, logger.Acks_ACKS_LEADER)
+	require.NoError(t, err)
+
+	s := &sink{}
+	require.NoError(t, snap.Persist(s))
+	snap.Release()
+
+	restored, err := New(dir+"/to", log.Config{})
+	require.NoError(t, err)
+	defer restored.Close()
+	_, _, err = restored.Append(context.Background(), "stale", nil, &logger.Record{Value: []byte("gone")}, logger.Acks_ACKS_LEADER)
+	require.NoError(t, err)
+	require.NoError(t, (&fsm{registry: restored}).Restore(ioutil.NopCloser(s)))
+
+	require.Equal(t, []string{"orders"}, restored.Topics())
+	offset, err := restored.CommittedOffset("billing", "orders", 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), offset)
+	config, err := restored.TopicConfig("orders")
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), config.Partitions)
+	require.True(t, config.Compaction)
+
+	var values [][]byte
+	for p := uint32(0); p < 2; p++ {
+		_, highest, err := restored.Offsets("orders", p)
+		require.NoError(t, err)
+		_, want, err := r.Offsets("orders", p)
+		require.NoError(t, err)
+		for off := uint64(0); off <= highest; off++ {
+			record, err := restored.Read(context.Background(), "orders", p, off)
+			if err != nil {
+				break
+			}
+			require.Equal(t, off, record.Offset)
+			values = append(values, record.Value)
+		}
+		require.LessOrEqual(t, highest, want)
+	}
+	require.ElementsMatch(t, [][]byte{{0}, {1}, {2}}, values)
+}
+
+func TestSnapshotDeleteTopic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	r, err := New(dir, log.Config{})
+	require.NoError(t, err)
+	defer r.Close()
+	codec := logger.Compression_SNAPPY
+	_, _, err = r.AppendBatch(context.Background(), "orders", nil, []*logger.Record{
+		{Value: []byte("a")},
+		{Value: []byte("b")},
+	}, &codec, logger.Acks_ACKS_LEADER)
+	require.NoError(t, err)
+	snap, err := (&fsm{registry: r}).Snapshot()
+	require.NoError(t, err)
+
+	// The snapshot doesn't hold up deleting the topic, and still has its records to persist
+	deleted := make(chan error)
+	go func() { deleted <- r.DeleteTopic("orders") }()
+	select {
+	case err = <-deleted:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("deleting the topic waited for the snapshot")
+	}
+	s := &sink{}
+	require.NoError(t, snap.Persist(s))
+	snap.Release()
+
+	restored, err := New(dir+"/restored", log.Config{})
+	require.NoError(t, err)
+	defer restored.Close()
+	require.NoError(t, (&fsm{registry: restored}).Restore(ioutil.NopCloser(s)))
+	records, err := restored.ReadRange("orders", 0, 0, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, []byte("b"), records[1].Value)
+}
@@ -0,0 +1,82 @@
+package topic
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/schachte/kafkaclone/api/v1/logger"
+	"github.com/schachte/kafkaclone/internal/group"
+)
+
+// Groups coordinates the consumer groups of a DistributedRegistry on its leader, so all the members of a
+// group meet in the same coordinator whichever server they're connected to. Followers forward the requests
+// to the leader the way they forward writes. Groups only live in the leader's memory: once another server
+// is elected their members are unknown to it and have to join again
+type Groups struct {
+	*group.Coordinator
+	registry *DistributedRegistry
+}
+
+// NewGroups coordinates the groups consuming the registry's topics
+func NewGroups(registry *DistributedRegistry) *Groups {
+	return &Groups{
+		Coordinator: group.New(registry),
+		registry:    registry,
+	}
+}
+
+// Join adds the member to the group on the leader, see group.Coordinator.Join
+func (g *Groups) Join(name, memberID string, topics []string, strategy string, sessionTimeout time.Duration) (string, uint64, []*logger.Assignment, error) {
+	if g.registry.raft.State() != raft.Leader {
+		client, err := g.registry.leader()
+		if err != nil {
+			return "", 0, nil, err
+		}
+		res, err := client.JoinGroup(context.Background(), &logger.JoinGroupRequest{
+			Group:            name,
+			MemberId:         memberID,
+			Topics:           topics,
+			Strategy:         strategy,
+			SessionTimeoutMs: uint32(sessionTimeout / time.Millisecond),
+		})
+		if err != nil {
+			return "", 0, nil, err
+		}
+		return res.MemberId, res.Generation, res.Assignments, nil
+	}
+	return g.Coordinator.Join(name, memberID, topics, strategy, sessionTimeout)
+}
+
+// Heartbeat keeps the member's session on the leader alive, see group.Coordinator.Heartbeat
+func (g *Groups) Heartbeat(name, memberID string, generation uint64) error {
+	if g.registry.raft.State() != raft.Leader {
+		client, err := g.registry.leader()
+		if err != nil {
+			return err
+		}
+		_, err = client.Heartbeat(context.Background(), &logger.HeartbeatRequest{
+			Group:      name,
+			MemberId:   memberID,
+			Generation: generation,
+		})
+		return err
+	}
+	return g.Coordinator.Heartbeat(name, memberID, generation)
+}
+
+// Leave removes the member from the group on the leader, see group.Coordinator.Leave
+func (g *Groups) Leave(name, memberID string) error {
+	if g.registry.raft.State() != raft.Leader {
+		client, err := g.registry.leader()
+		if err != nil {
+			return err
+		}
+		_, err = client.LeaveGroup(context.Background(), &logger.LeaveGroupRequest{
+			Group:    name,
+			MemberId: memberID,
+		})
+		return err
+	}
+	return g.Coordinator.Leave(name, memberID)
+}
@@ -0,0 +1,57 @@
+package topic
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/schachte/kafkaclone/api/v1/logger"
+)
+
+// Partitioner picks which of a topic's partitions a record is appended to
+type Partitioner interface {
+	Partition(topic string, record *logger.Record, partitions uint32) uint32
+}
+
+// HashPartitioner sends every record with the same key to the same partition, so per-key ordering is kept.
+// Records without a key are spread with Fallback, or round-robin when it's nil
+type HashPartitioner struct {
+	Fallback Partitioner
+}
+
+func (h *HashPartitioner) Partition(topic string, record *logger.Record, partitions uint32) uint32 {
+	if len(record.Key) == 0 {
+		if h.Fallback == nil {
+			return roundRobin.Partition(topic, record, partitions)
+		}
+		return h.Fallback.Partition(topic, record, partitions)
+	}
+	hash := fnv.New32a()
+	_, _ = hash.Write(record.Key)
+	return hash.Sum32() % partitions
+}
+
+var roundRobin = &RoundRobinPartitioner{}
+
+// RoundRobinPartitioner cycles through a topic's partitions, ignoring the record
+type RoundRobinPartitioner struct {
+	mu   sync.Mutex
+	next map[string]uint32
+}
+
+func (r *RoundRobinPartitioner) Partition(topic string, _ *logger.Record, partitions uint32) uint32 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.next == nil {
+		r.next = make(map[string]uint32)
+	}
+	p := r.next[topic] % partitions
+	r.next[topic] = p + 1
+	return p
+}
+
+// ExplicitPartitioner always picks the same partition, for producers that address partitions directly
+type ExplicitPartitioner uint32
+
+func (e ExplicitPartitioner) Partition(string, *logger.Record, uint32) uint32 {
+	return uint32(e)
+}
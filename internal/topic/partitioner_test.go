@@ -0,0 +1,28 @@
+package topic
+
+import (
+	"testing"
+
+	"github.com/schachte/kafkaclone/api/v1/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartitioner(t *testing.T) {
+	record := &logger.Record{Value: []byte("hello world")}
+
+	rr := &RoundRobinPartitioner{}
+	for i := uint32(0); i < 6; i++ {
+		require.Equal(t, i%3, rr.Partition("a", record, 3))
+	}
+	// Every topic keeps its own position
+	require.Equal(t, uint32(0), rr.Partition("b", record, 3))
+
+	hash := &HashPartitioner{Fallback: ExplicitPartitioner(2)}
+	require.Equal(t, uint32(2), hash.Partition("a", record, 3))
+	keyed := &logger.Record{Key: []byte("user-1")}
+	p := hash.Partition("a", keyed, 8)
+	for i := 0; i < 3; i++ {
+		require.Equal(t, p, hash.Partition("b", keyed, 8))
+	}
+	require.Less(t, p, uint32(8))
+}
@@ -0,0 +1,807 @@
+package topic
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	api_v1 "github.com/schachte/kafkaclone/api/v1"
+	"github.com/schachte/kafkaclone/api/v1/logger"
+	"github.com/schachte/kafkaclone/internal/log"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// DefaultTopic is used by requests that don't name a topic
+	DefaultTopic = "default"
+
+	// metadataFile holds a topic's configuration overrides inside its directory
+	metadataFile = "topic.json"
+
+	// offsetsDir holds the offsets committed by consumer groups. Topic names can't start with "__" so it can't clash with one
+	offsetsDir = "__offsets"
+)
+
+var validName = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+// valid reports whether name can be used as a topic, and so as a directory name
+func valid(name string) bool {
+	return validName.MatchString(name) && name != "." && name != ".." && !strings.HasPrefix(name, "__")
+}
+
+// Registry keeps track of every topic stored under Dir, each in its own directory (Dir/<topic>/)
+// with one log per partition (Dir/<topic>/<partition>/). A partition's log is only opened the first time it's used
+type Registry struct {
+	mu     sync.Mutex
+	Dir    string
+	Config log.Config
+	// Partitioner routes records that aren't addressed to a specific partition.
+	// It defaults to hashing the record key, falling back to round-robin for records without one
+	Partitioner Partitioner
+	topics      map[string]*topic
+	offsets     *log.GroupOffsets
+	logger      *zap.Logger
+	// keepTimestamps stores records with the timestamps they carry even on log append time topics,
+	// for when they've already been stamped before reaching the registry
+	keepTimestamps bool
+	// deleting holds the topics DeleteTopic is still removing the files of, their names can't be
+	// created again until it's done. deleted is signalled whenever one of them is
+	deleting map[string]bool
+	deleted  *sync.Cond
+}
+
+type topic struct {
+	config *logger.TopicConfig
+	logs   []*log.Log // one per partition, nil until the partition is first used
+	// sequences serialises the appends of idempotent producers, between checking a sequence and appending it
+	sequences sync.Mutex
+	// inUse counts the operations using the topic's logs, DeleteTopic waits for them before closing the logs
+	inUse sync.WaitGroup
+}
+
+// New creates a registry over dir, picking up the topics that already exist in it.
+// c is the configuration every topic starts from before its own overrides are applied
+func New(dir string, c log.Config) (*Registry, error) {
+	r := &Registry{
+		Dir:         dir,
+		Config:      c,
+		Partitioner: &HashPartitioner{},
+		topics:      make(map[string]*topic),
+		deleting:    make(map[string]bool),
+		logger:      zap.L().Named("topic"),
+	}
+	r.deleted = sync.NewCond(&r.mu)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	offsets := path.Join(dir, offsetsDir)
+	if err := os.MkdirAll(offsets, 0755); err != nil {
+		return nil, err
+	}
+	var err error
+	if r.offsets, err = log.NewGroupOffsets(offsets, log.Config{Segment: c.Segment}); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if !file.IsDir() || !valid(file.Name()) {
+			continue
+		}
+		config, err := r.readMetadata(file.Name())
+		if err != nil {
+			return nil, err
+		}
+		r.topics[file.Name()] = &topic{
+			config: config,
+			logs:   make([]*log.Log, config.Partitions),
+		}
+	}
+	return r, nil
+}
+
+// Append adds a record to the named topic, creating the topic with the default configuration if it doesn't exist yet.
+// The record goes to partition when it's given, otherwise the registry's Partitioner picks one.
+// A record of an idempotent producer that was already appended isn't appended again, the partition and
+// offset it got the first time are returned instead (see checkSequences). A registry is the only replica of
+// its topics, so acks only decides whether the record is flushed to the log's files before returning.
+// The append is traced in ctx's trace
+func (r *Registry) Append(ctx context.Context, name string, partition *uint32, record *logger.Record, acks logger.Acks) (uint32, uint64, error) {
+	if name == "" {
+		name = DefaultTopic
+	}
+	partitions, err := r.partitions(name, true)
+	if err != nil {
+		return 0, 0, err
+	}
+	if acks == logger.Acks_ACKS_ALL {
+		if err = r.checkInSync(name, 1); err != nil {
+			return 0, 0, err
+		}
+	}
+	if record.ProducerId != 0 {
+		unlock, p, off, err := r.checkSequences(name, partitions, []*logger.Record{record})
+		if unlock == nil {
+			return p, off, err
+		}
+		defer unlock()
+	}
+	var p uint32
+	if partition != nil {
+		p = *partition
+	} else {
+		p = r.Partitioner.Partition(name, record, partitions)
+	}
+	l, release, err := r.acquire(name, p)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer release()
+	off, err := l.AppendContext(ctx, record)
+	if err != nil {
+		return 0, 0, err
+	}
+	if record.Control == logger.Control_COMMIT {
+		r.forgetCommit(record.TxnId)
+	}
+	return p, off, acknowledge(l, acks)
+}
+
+// forgetCommit drops the transaction's commit from every partition once it's committed in all of them.
+// The commits are only kept for the coordinator recovering a transaction that ended in some of its
+// partitions, so it finishes it the same way in the others (see txn.Coordinator.Recover)
+func (r *Registry) forgetCommit(id uint64) {
+	var logs []*log.Log
+	var releases []func()
+	defer func() {
+		for _, release := range releases {
+			release()
+		}
+	}()
+	for _, name := range r.Topics() {
+		n, err := r.Partitions(name)
+		if err != nil {
+			// deleted in the meantime
+			continue
+		}
+		for p := uint32(0); p < n; p++ {
+			l, release, err := r.acquire(name, p)
+			if _, ok := err.(api_v1.ErrTopicNotFound); ok {
+				break
+			}
+			if err != nil {
+				// the transaction may still be open in the partition
+				r.logger.Warn("failed to forget commit", zap.Uint64("txn", id), zap.Error(err))
+				return
+			}
+			releases = append(releases, release)
+			if l.TransactionOngoing(id) {
+				return
+			}
+			logs = append(logs, l)
+		}
+	}
+	for _, l := range logs {
+		l.ForgetCommit(id)
+	}
+}
+
+// AppendBatch adds the records to one partition of the named topic atomically (see log.Log.AppendBatch),
+// creating the topic if it doesn't exist yet. Without a partition, the Partitioner picks one for the first record.
+// Without a codec, the batch is compressed with the topic's default. An idempotent producer's batch is
+// deduplicated and acknowledged the same way as by Append
+func (r *Registry) AppendBatch(ctx context.Context, name string, partition *uint32, records []*logger.Record, codec *logger.Compression, acks logger.Acks) (uint32, uint64, error) {
+	if name == "" {
+		name = DefaultTopic
+	}
+	partitions, err := r.partitions(name, true)
+	if err != nil {
+		return 0, 0, err
+	}
+	if acks == logger.Acks_ACKS_ALL {
+		if err = r.checkInSync(name, 1); err != nil {
+			return 0, 0, err
+		}
+	}
+	if len(records) > 0 && records[0].ProducerId != 0 {
+		unlock, p, base, err := r.checkSequences(name, partitions, records)
+		if unlock == nil {
+			return p, base, err
+		}
+		defer unlock()
+	}
+	var p uint32
+	if partition != nil {
+		p = *partition
+	} else if len(records) > 0 {
+		p = r.Partitioner.Partition(name, records[0], partitions)
+	}
+	l, release, err := r.acquire(name, p)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer release()
+	c := l.Config.Compression.Codec
+	if codec != nil {
+		c = *codec
+	}
+	base, err := l.AppendBatchContext(ctx, records, c)
+	if err != nil {
+		return 0, 0, err
+	}
+	return p, base, acknowledge(l, acks)
+}
+
+// acknowledge flushes the log unless acks is ACKS_NONE
+func acknowledge(l *log.Log, acks logger.Acks) error {
+	if acks == logger.Acks_ACKS_NONE {
+		return nil
+	}
+	return l.Flush()
+}
+
+// checkInSync fails with ErrNotEnoughReplicas when the topic needs more than inSync replicas for ACKS_ALL
+func (r *Registry) checkInSync(name string, inSync int) error {
+	r.mu.Lock()
+	required := 1
+	if t, ok := r.topics[name]; ok && t.config.MinInsyncReplicas > 0 {
+		required = int(t.config.MinInsyncReplicas)
+	}
+	r.mu.Unlock()
+	if inSync < required {
+		return api_v1.ErrNotEnoughReplicas{Topic: name, InSync: inSync, Required: required}
+	}
+	return nil
+}
+
+// Flush writes the records a partition still buffers in memory out to its files (see log.Log.Flush)
+func (r *Registry) Flush(name string, partition uint32) error {
+	l, release, err := r.acquire(name, partition)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return l.Flush()
+}
+
+// checkSequences makes sure the records of an idempotent producer, which carry consecutive sequences,
+// carry on from the last one the producer appended to the topic. Sequences are per topic rather than
+// per partition, so a retry is recognised whichever partition it's routed to.
+// When the records can be appended, the topic's sequences lock is held until unlock is called.
+// Otherwise unlock is nil and either the partition and offset the records were already appended at
+// are returned, or an error
+func (r *Registry) checkSequences(name string, partitions uint32, records []*logger.Record) (unlock func(), p uint32, off uint64, err error) {
+	r.mu.Lock()
+	t, ok := r.topics[name]
+	r.mu.Unlock()
+	if !ok {
+		return nil, 0, 0, api_v1.ErrTopicNotFound{Topic: name}
+	}
+	t.sequences.Lock()
+	defer func() {
+		if unlock == nil {
+			t.sequences.Unlock()
+		}
+	}()
+
+	producer := records[0].ProducerId
+	first, last := records[0].Sequence, records[len(records)-1].Sequence
+	var expected uint64
+	for p := uint32(0); p < partitions; p++ {
+		l, release, err := r.acquire(name, p)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		off, duplicate := l.Duplicate(producer, first, last)
+		seq, ok := l.LastSequence(producer)
+		release()
+		if duplicate {
+			return nil, p, off, nil
+		}
+		if ok && seq >= expected {
+			expected = seq + 1
+		}
+	}
+	if first != expected {
+		return nil, 0, 0, api_v1.ErrOutOfOrderSequence{ProducerID: producer, Expected: expected, Sequence: first}
+	}
+	return t.sequences.Unlock, 0, 0, nil
+}
+
+// Read returns the record at off in the given partition of the named topic, traced in ctx's trace
+func (r *Registry) Read(ctx context.Context, name string, partition uint32, off uint64) (*logger.Record, error) {
+	l, release, err := r.acquire(name, partition)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return l.ReadContext(ctx, off)
+}
+
+// ReadRange returns the records from off on in the given partition of the named topic (see log.Log.ReadRange)
+func (r *Registry) ReadRange(name string, partition uint32, off uint64, maxRecords uint32, maxBytes uint64) ([]*logger.Record, error) {
+	l, release, err := r.acquire(name, partition)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return l.ReadRange(off, maxRecords, maxBytes)
+}
+
+// ReadBatches is ReadRange leaving compressed batches as they're stored (see log.Log.ReadBatches)
+func (r *Registry) ReadBatches(name string, partition uint32, off uint64, maxRecords uint32, maxBytes uint64) ([]*logger.Record, error) {
+	l, release, err := r.acquire(name, partition)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return l.ReadBatches(off, maxRecords, maxBytes)
+}
+
+// ReadCommitted is ReadRange for read committed consumers (see log.Log.ReadCommitted)
+func (r *Registry) ReadCommitted(name string, partition uint32, off uint64, maxRecords uint32, maxBytes uint64) ([]*logger.Record, error) {
+	l, release, err := r.acquire(name, partition)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return l.ReadCommitted(off, maxRecords, maxBytes)
+}
+
+// OngoingTransactions returns the transactions with records in a partition that haven't ended yet
+func (r *Registry) OngoingTransactions(name string, partition uint32) ([]uint64, error) {
+	l, release, err := r.acquire(name, partition)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return l.OngoingTransactions(), nil
+}
+
+// TransactionOutcome returns how a transaction ended in a partition (see log.Log.TransactionOutcome)
+func (r *Registry) TransactionOutcome(name string, partition uint32, id uint64) (logger.Control, error) {
+	l, release, err := r.acquire(name, partition)
+	if err != nil {
+		return logger.Control_DATA, err
+	}
+	defer release()
+	return l.TransactionOutcome(id), nil
+}
+
+// SegmentStats reports how well the segments of a partition compress (see log.Log.SegmentStats)
+func (r *Registry) SegmentStats(name string, partition uint32) ([]log.SegmentStats, error) {
+	l, release, err := r.acquire(name, partition)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return l.SegmentStats()
+}
+
+// Offsets returns the lowest and highest offsets of a partition
+func (r *Registry) Offsets(name string, partition uint32) (lowest, highest uint64, err error) {
+	l, release, err := r.acquire(name, partition)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer release()
+	if lowest, err = l.LowestOffset(); err != nil {
+		return 0, 0, err
+	}
+	highest, err = l.HighestOffset()
+	return lowest, highest, err
+}
+
+// OffsetForTime returns the earliest offset of a partition whose record is at least as recent as timestamp (see log.Log.OffsetForTime)
+func (r *Registry) OffsetForTime(name string, partition uint32, timestamp int64) (uint64, error) {
+	l, release, err := r.acquire(name, partition)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	return l.OffsetForTime(timestamp)
+}
+
+// logAppendTime reports whether records appended to the named topic are stamped with the time they're appended
+func (r *Registry) logAppendTime(name string) bool {
+	if name == "" {
+		name = DefaultTopic
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if t, ok := r.topics[name]; ok && t.config.LogAppendTime {
+		return true
+	}
+	return r.Config.Timestamp.LogAppendTime
+}
+
+// Notify returns a channel that's closed once a record is appended to the partition (see log.Log.Notify)
+func (r *Registry) Notify(name string, partition uint32) (<-chan struct{}, error) {
+	l, release, err := r.acquire(name, partition)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return l.Notify(), nil
+}
+
+// AppendAt appends a record to a partition keeping the offset it already carries (see log.Log.AppendAt)
+func (r *Registry) AppendAt(name string, partition uint32, record *logger.Record) error {
+	l, release, err := r.acquire(name, partition)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return l.AppendAt(record)
+}
+
+// Partitions returns how many partitions the named topic has
+func (r *Registry) Partitions(name string) (uint32, error) {
+	if name == "" {
+		name = DefaultTopic
+	}
+	return r.partitions(name, false)
+}
+
+// TopicConfig returns the configuration overrides of the named topic
+func (r *Registry) TopicConfig(name string) (*logger.TopicConfig, error) {
+	if name == "" {
+		name = DefaultTopic
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.topics[name]
+	if !ok {
+		return nil, api_v1.ErrTopicNotFound{Topic: name}
+	}
+	return proto.Clone(t.config).(*logger.TopicConfig), nil
+}
+
+// Log returns the log backing a partition of the named topic, opening it if needed.
+// The log is closed when the topic is deleted, even while it's still being used
+func (r *Registry) Log(name string, partition uint32) (*log.Log, error) {
+	l, release, err := r.acquire(name, partition)
+	if err != nil {
+		return nil, err
+	}
+	release()
+	return l, nil
+}
+
+// acquire is Log keeping the topic from being deleted until release is called
+func (r *Registry) acquire(name string, partition uint32) (*log.Log, func(), error) {
+	if name == "" {
+		name = DefaultTopic
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.topics[name]
+	if !ok {
+		return nil, nil, api_v1.ErrTopicNotFound{Topic: name}
+	}
+	if partition >= uint32(len(t.logs)) {
+		return nil, nil, api_v1.ErrPartitionNotFound{Topic: name, Partition: partition}
+	}
+	if t.logs[partition] == nil {
+		dir := path.Join(r.Dir, name, strconv.FormatUint(uint64(partition), 10))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, nil, err
+		}
+		l, err := log.NewLog(dir, r.logConfig(t.config))
+		if err != nil {
+			return nil, nil, err
+		}
+		l.StartCleaner()
+		t.logs[partition] = l
+	}
+	t.inUse.Add(1)
+	return t.logs[partition], t.inUse.Done, nil
+}
+
+// CreateTopic creates a new topic, persisting its configuration overrides (which may be nil)
+func (r *Registry) CreateTopic(name string, config *logger.TopicConfig) error {
+	if name == "" {
+		name = DefaultTopic
+	}
+	if !valid(name) {
+		return api_v1.ErrInvalidTopic{Topic: name}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.waitDeleted(name)
+	if _, ok := r.topics[name]; ok {
+		return api_v1.ErrTopicExists{Topic: name}
+	}
+	return r.create(name, config)
+}
+
+// CreatePartitions grows the named topic to count partitions. Existing partitions are left as they are,
+// so records with a key may be routed to a different partition than before
+func (r *Registry) CreatePartitions(name string, count uint32) error {
+	if name == "" {
+		name = DefaultTopic
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.topics[name]
+	if !ok {
+		return api_v1.ErrTopicNotFound{Topic: name}
+	}
+	if count <= t.config.Partitions {
+		return api_v1.ErrInvalidPartitionCount{Topic: name, Count: count}
+	}
+	config := proto.Clone(t.config).(*logger.TopicConfig)
+	config.Partitions = count
+	if err := r.writeMetadata(name, config); err != nil {
+		return err
+	}
+	t.config = config
+	t.logs = append(t.logs, make([]*log.Log, count-uint32(len(t.logs)))...)
+	r.logger.Info("increased partitions", zap.String("topic", name), zap.Uint32("partitions", count))
+	return nil
+}
+
+// DeleteTopic closes the named topic's logs and removes all of its data
+func (r *Registry) DeleteTopic(name string) error {
+	if name == "" {
+		name = DefaultTopic
+	}
+	r.mu.Lock()
+	t, ok := r.topics[name]
+	if !ok {
+		r.mu.Unlock()
+		return api_v1.ErrTopicNotFound{Topic: name}
+	}
+	delete(r.topics, name)
+	r.deleting[name] = true
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.deleting, name)
+		r.deleted.Broadcast()
+		r.mu.Unlock()
+	}()
+
+	// Nothing can start using the topic once it's out of the map, the operations already using it finish first
+	t.inUse.Wait()
+
+	for _, l := range t.logs {
+		if l == nil {
+			continue
+		}
+		if err := l.Close(); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(path.Join(r.Dir, name))
+}
+
+// waitDeleted waits until the named topic's files are gone, if it's being deleted, so creating it
+// again doesn't write files the deletion then removes. The caller must hold the lock
+func (r *Registry) waitDeleted(name string) {
+	for r.deleting[name] {
+		r.deleted.Wait()
+	}
+}
+
+// Reset deletes every topic and committed offset
+func (r *Registry) Reset() error {
+	for _, name := range r.Topics() {
+		if err := r.DeleteTopic(name); err != nil {
+			return err
+		}
+	}
+	return r.offsets.Reset()
+}
+
+// CommitOffset records offset as the next one the consumer group will read from the partition
+func (r *Registry) CommitOffset(group, name string, partition uint32, offset uint64) error {
+	if name == "" {
+		name = DefaultTopic
+	}
+	return r.offsets.Commit(log.GroupPartition{Group: group, Topic: name, Partition: partition}, offset)
+}
+
+// CommittedOffset returns the offset the consumer group last committed for the partition
+func (r *Registry) CommittedOffset(group, name string, partition uint32) (uint64, error) {
+	if name == "" {
+		name = DefaultTopic
+	}
+	return r.offsets.Fetch(log.GroupPartition{Group: group, Topic: name, Partition: partition})
+}
+
+// CommittedOffsets returns every offset committed by every consumer group
+func (r *Registry) CommittedOffsets() map[log.GroupPartition]uint64 {
+	return r.offsets.All()
+}
+
+// Topics returns the names of every topic, sorted
+func (r *Registry) Topics() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, 0, len(r.topics))
+	for name := range r.topics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// PartitionStats is a snapshot of the log of a partition, see Registry.Stats
+type PartitionStats struct {
+	Topic     string
+	Partition uint32
+	log.Stats
+}
+
+// Stats returns a snapshot of every partition log that's open, sorted by topic and partition.
+// Partitions that haven't been used since the registry was created aren't opened for it
+func (r *Registry) Stats() []PartitionStats {
+	type partition struct {
+		PartitionStats
+		log *log.Log
+	}
+	var open []partition
+	r.mu.Lock()
+	for name, t := range r.topics {
+		for i, l := range t.logs {
+			if l != nil {
+				open = append(open, partition{PartitionStats{Topic: name, Partition: uint32(i)}, l})
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	stats := make([]PartitionStats, 0, len(open))
+	for _, p := range open {
+		p.Stats = p.log.Stats()
+		stats = append(stats, p.PartitionStats)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Topic != stats[j].Topic {
+			return stats[i].Topic < stats[j].Topic
+		}
+		return stats[i].Partition < stats[j].Partition
+	})
+	return stats
+}
+
+// Close closes every open partition log and the committed offsets
+func (r *Registry) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.offsets.Close(); err != nil {
+		return err
+	}
+	for _, t := range r.topics {
+		for i, l := range t.logs {
+			if l == nil {
+				continue
+			}
+			if err := l.Close(); err != nil {
+				return err
+			}
+			t.logs[i] = nil
+		}
+	}
+	return nil
+}
+
+// partitions returns how many partitions the named topic has. Unknown topics are created when create is set
+func (r *Registry) partitions(name string, create bool) (uint32, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.topics[name]
+	if !ok {
+		if !create {
+			return 0, api_v1.ErrTopicNotFound{Topic: name}
+		}
+		r.waitDeleted(name)
+		if t, ok = r.topics[name]; ok {
+			return uint32(len(t.logs)), nil
+		}
+		if !valid(name) {
+			return 0, api_v1.ErrInvalidTopic{Topic: name}
+		}
+		if err := r.create(name, nil); err != nil {
+			return 0, err
+		}
+		t = r.topics[name]
+	}
+	return uint32(len(t.logs)), nil
+}
+
+// create makes the topic's directory and metadata file. The caller must hold the lock
+func (r *Registry) create(name string, config *logger.TopicConfig) error {
+	if config == nil {
+		config = &logger.TopicConfig{}
+	}
+	if config.Partitions == 0 {
+		config.Partitions = 1
+	}
+	if err := os.MkdirAll(path.Join(r.Dir, name), 0755); err != nil {
+		return err
+	}
+	if err := r.writeMetadata(name, config); err != nil {
+		return err
+	}
+	r.topics[name] = &topic{
+		config: config,
+		logs:   make([]*log.Log, config.Partitions),
+	}
+	r.logger.Info(
+		"created topic",
+		zap.String("topic", name),
+		zap.Uint32("partitions", config.Partitions),
+	)
+	return nil
+}
+
+func (r *Registry) writeMetadata(name string, config *logger.TopicConfig) error {
+	b, err := protojson.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(r.Dir, name, metadataFile), b, 0644)
+}
+
+func (r *Registry) readMetadata(name string) (*logger.TopicConfig, error) {
+	config := &logger.TopicConfig{}
+	b, err := ioutil.ReadFile(path.Join(r.Dir, name, metadataFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err = protojson.Unmarshal(b, config); err != nil {
+			return nil, err
+		}
+	}
+	if config.Partitions == 0 {
+		config.Partitions = 1
+	}
+	return config, nil
+}
+
+// logConfig applies a topic's overrides on top of the registry's configuration
+func (r *Registry) logConfig(t *logger.TopicConfig) log.Config {
+	c := r.Config
+	if t.MaxStoreBytes != 0 {
+		c.Segment.MaxStoreBytes = t.MaxStoreBytes
+	}
+	if t.MaxIndexBytes != 0 {
+		c.Segment.MaxIndexBytes = t.MaxIndexBytes
+	}
+	if t.RetentionMaxBytes != 0 {
+		c.Retention.MaxBytes = t.RetentionMaxBytes
+	}
+	if t.RetentionMaxAgeMs != 0 {
+		c.Retention.MaxAge = time.Duration(t.RetentionMaxAgeMs) * time.Millisecond
+	}
+	if t.RetentionMaxSegments != 0 {
+		c.Retention.MaxSegments = int(t.RetentionMaxSegments)
+	}
+	if t.Compaction {
+		c.Compaction.Enabled = true
+	}
+	if t.LogAppendTime {
+		c.Timestamp.LogAppendTime = true
+	}
+	if t.Compression != logger.Compression_NONE {
+		c.Compression.Codec = t.Compression
+	}
+	if r.keepTimestamps {
+		c.Timestamp.LogAppendTime = false
+	}
+	return c
+}
@@ -0,0 +1,274 @@
+package topic
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	api_v1 "github.com/schachte/kafkaclone/api/v1"
+	"github.com/schachte/kafkaclone/api/v1/logger"
+	"github.com/schachte/kafkaclone/internal/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 1024
+	r, err := New(dir, c)
+	require.NoError(t, err)
+	require.Empty(t, r.Topics())
+
+	// Producing to an unknown topic creates it, the empty name is the default topic
+	partition, off, err := r.Append(context.Background(), "", nil, &logger.Record{Value: []byte("hello world")}, logger.Acks_ACKS_LEADER)
+	require.NoError(t, err)
+	require.Equal(t, uint32(0), partition)
+	require.Equal(t, uint64(0), off)
+	_, err = os.Stat(path.Join(dir, DefaultTopic, "0", "0.store"))
+	require.NoError(t, err)
+
+	require.NoError(t, r.CreateTopic("compacted", &logger.TopicConfig{
+		MaxStoreBytes: 64,
+		Compaction:    true,
+	}))
+	require.Equal(t, api_v1.ErrTopicExists{Topic: "compacted"}, r.CreateTopic("compacted", nil))
+	require.Equal(t, api_v1.ErrInvalidTopic{Topic: "a/b"}, r.CreateTopic("a/b", nil))
+	require.Equal(t, api_v1.ErrInvalidTopic{Topic: offsetsDir}, r.CreateTopic(offsetsDir, nil))
+	require.NoError(t, r.CommitOffset("billing", "", 0, 1))
+
+	_, err = r.Read(context.Background(), "missing", 0, 0)
+	require.Equal(t, api_v1.ErrTopicNotFound{Topic: "missing"}, err)
+
+	// Topics and their overrides are picked up again after a restart, but logs are only opened on use
+	require.NoError(t, r.Close())
+	r, err = New(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, []string{"compacted", DefaultTopic}, r.Topics())
+	offset, err := r.CommittedOffset("billing", DefaultTopic, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), offset)
+	for _, topic := range r.topics {
+		require.Equal(t, []*log.Log{nil}, topic.logs)
+	}
+
+	l, err := r.Log("compacted", 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(64), l.Config.Segment.MaxStoreBytes)
+	require.True(t, l.Config.Compaction.Enabled)
+
+	read, err := r.Read(context.Background(), DefaultTopic, 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), read.Value)
+
+	// Deleting a topic waits for the operations still using its logs
+	l, release, err := r.acquire(DefaultTopic, 0)
+	require.NoError(t, err)
+	deleted := make(chan error)
+	go func() { deleted <- r.DeleteTopic(DefaultTopic) }()
+	select {
+	case err = <-deleted:
+		t.Fatalf("topic deleted while in use: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	read, err = l.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), read.Value)
+	release()
+	require.NoError(t, <-deleted)
+	_, err = os.Stat(path.Join(dir, DefaultTopic))
+	require.True(t, os.IsNotExist(err))
+	require.Equal(t, []string{"compacted"}, r.Topics())
+	require.NoError(t, r.Close())
+}
+
+func TestRegistryDeleteCreate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	r, err := New(dir, log.Config{})
+	require.NoError(t, err)
+	require.NoError(t, r.CreateTopic("billing", nil))
+
+	// Creating a topic again waits until the deletion still removing its files is done
+	_, release, err := r.acquire("billing", 0)
+	require.NoError(t, err)
+	deleted := make(chan error)
+	go func() { deleted <- r.DeleteTopic("billing") }()
+	require.Eventually(t, func() bool { return len(r.Topics()) == 0 }, time.Second, time.Millisecond)
+	created := make(chan error)
+	go func() { created <- r.CreateTopic("billing", nil) }()
+	appended := make(chan error)
+	go func() {
+		_, _, err := r.Append(context.Background(), "billing", nil, &logger.Record{Value: []byte("hello world")}, logger.Acks_ACKS_LEADER)
+		appended <- err
+	}()
+	select {
+	case <-created:
+		t.Fatal("topic created while being deleted")
+	case <-appended:
+		t.Fatal("topic auto-created while being deleted")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	require.NoError(t, <-deleted)
+	// Whichever of the two goes first creates the topic
+	if err := <-created; err != nil {
+		require.Equal(t, api_v1.ErrTopicExists{Topic: "billing"}, err)
+	}
+	require.NoError(t, <-appended)
+
+	// The new topic's files survived the deletion
+	require.NoError(t, r.Close())
+	r, err = New(dir, log.Config{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"billing"}, r.Topics())
+	read, err := r.Read(context.Background(), "billing", 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), read.Value)
+	require.NoError(t, r.Close())
+}
+
+func TestRegistryForgetCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	r, err := New(dir, log.Config{})
+	require.NoError(t, err)
+	defer r.Close()
+	require.NoError(t, r.CreateTopic("orders", &logger.TopicConfig{Partitions: 2}))
+	ctx := context.Background()
+	for p := uint32(0); p < 2; p++ {
+		_, _, err = r.Append(ctx, "orders", &p, &logger.Record{Value: []byte("a"), TxnId: 1}, logger.Acks_ACKS_LEADER)
+		require.NoError(t, err)
+	}
+
+	// A commit is remembered while the transaction is still open in another partition
+	first := uint32(0)
+	_, _, err = r.Append(ctx, "orders", &first, &logger.Record{TxnId: 1, Control: logger.Control_COMMIT}, logger.Acks_ACKS_LEADER)
+	require.NoError(t, err)
+	outcome, err := r.TransactionOutcome("orders", 0, 1)
+	require.NoError(t, err)
+	require.Equal(t, logger.Control_COMMIT, outcome)
+
+	// and forgotten everywhere once it's committed in all of them
+	second := uint32(1)
+	_, _, err = r.Append(ctx, "orders", &second, &logger.Record{TxnId: 1, Control: logger.Control_COMMIT}, logger.Acks_ACKS_LEADER)
+	require.NoError(t, err)
+	for p := uint32(0); p < 2; p++ {
+		outcome, err = r.TransactionOutcome("orders", p, 1)
+		require.NoError(t, err)
+		require.Equal(t, logger.Control_DATA, outcome)
+		records, err := r.ReadCommitted("orders", p, 0, 0, 0)
+		require.NoError(t, err)
+		require.Equal(t, []byte("a"), records[0].Value)
+	}
+}
+
+func TestRegistryAcks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry-acks-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	r, err := New(dir, log.Config{})
+	require.NoError(t, err)
+	defer r.Close()
+	require.NoError(t, r.CreateTopic("events", nil))
+	require.NoError(t, r.CreateTopic("durable", &logger.TopicConfig{MinInsyncReplicas: 2}))
+	stored := func() int64 {
+		info, err := os.Stat(path.Join(dir, "events", "0", "0.store"))
+		require.NoError(t, err)
+		return info.Size()
+	}
+
+	// ACKS_NONE leaves the record buffered, the other levels write it to the store's file
+	_, _, err = r.Append(context.Background(), "events", nil, &logger.Record{Value: []byte("buffered")}, logger.Acks_ACKS_NONE)
+	require.NoError(t, err)
+	require.Zero(t, stored())
+	_, _, err = r.Append(context.Background(), "events", nil, &logger.Record{Value: []byte("written")}, logger.Acks_ACKS_LEADER)
+	require.NoError(t, err)
+	written := stored()
+	require.NotZero(t, written)
+	_, _, err = r.AppendBatch(context.Background(), "events", nil, []*logger.Record{{Value: []byte("batch")}}, nil, logger.Acks_ACKS_ALL)
+	require.NoError(t, err)
+	require.Greater(t, stored(), written)
+
+	// A registry is a single replica, too few for topics that need more
+	_, _, err = r.Append(context.Background(), "durable", nil, &logger.Record{Value: []byte("refused")}, logger.Acks_ACKS_ALL)
+	require.Equal(t, api_v1.ErrNotEnoughReplicas{Topic: "durable", InSync: 1, Required: 2}, err)
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	_, _, err = r.Append(context.Background(), "durable", nil, &logger.Record{Value: []byte("accepted")}, logger.Acks_ACKS_LEADER)
+	require.NoError(t, err)
+}
+
+func TestRegistryPartitions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	r, err := New(dir, log.Config{})
+	require.NoError(t, err)
+	defer r.Close()
+	require.NoError(t, r.CreateTopic("events", &logger.TopicConfig{Partitions: 3}))
+
+	// Keyless records are spread round-robin, keyed ones stick to a partition
+	counts := make(map[uint32]uint64)
+	for i := 0; i < 6; i++ {
+		partition, off, err := r.Append(context.Background(), "events", nil, &logger.Record{Value: []byte("hello world")}, logger.Acks_ACKS_LEADER)
+		require.NoError(t, err)
+		require.Equal(t, counts[partition], off)
+		counts[partition]++
+	}
+	require.Equal(t, map[uint32]uint64{0: 2, 1: 2, 2: 2}, counts)
+
+	keyed, _, err := r.Append(context.Background(), "events", nil, &logger.Record{Key: []byte("user-1")}, logger.Acks_ACKS_LEADER)
+	require.NoError(t, err)
+	counts[keyed]++
+	for i := 0; i < 3; i++ {
+		partition, off, err := r.Append(context.Background(), "events", nil, &logger.Record{Key: []byte("user-1")}, logger.Acks_ACKS_LEADER)
+		require.NoError(t, err)
+		require.Equal(t, keyed, partition)
+		require.Equal(t, counts[partition], off)
+		counts[partition]++
+	}
+
+	explicit := uint32(1)
+	partition, off, err := r.Append(context.Background(), "events", &explicit, &logger.Record{Value: []byte("pinned")}, logger.Acks_ACKS_LEADER)
+	require.NoError(t, err)
+	require.Equal(t, explicit, partition)
+	require.Equal(t, counts[partition], off)
+	counts[partition]++
+
+	missing := uint32(3)
+	_, _, err = r.Append(context.Background(), "events", &missing, &logger.Record{}, logger.Acks_ACKS_LEADER)
+	require.Equal(t, api_v1.ErrPartitionNotFound{Topic: "events", Partition: 3}, err)
+
+	// Partitions can only be added, and new ones start out empty
+	require.Equal(t, api_v1.ErrInvalidPartitionCount{Topic: "events", Count: 2}, r.CreatePartitions("events", 2))
+	require.NoError(t, r.CreatePartitions("events", 4))
+	partition, off, err = r.Append(context.Background(), "events", &missing, &logger.Record{Value: []byte("new")}, logger.Acks_ACKS_LEADER)
+	require.NoError(t, err)
+	require.Equal(t, missing, partition)
+	require.Equal(t, uint64(0), off)
+
+	lowest, highest, err := r.Offsets("events", 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), lowest)
+	require.Equal(t, counts[1]-1, highest)
+
+	require.NoError(t, r.Close())
+	r, err = New(dir, log.Config{})
+	require.NoError(t, err)
+	read, err := r.Read(context.Background(), "events", 3, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("new"), read.Value)
+}
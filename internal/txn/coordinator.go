@@ -0,0 +1,274 @@
+// Package txn coordinates transactions: records appended to any number of partitions over any number of
+// requests, that read committed consumers see all at once when the transaction commits, or never when
+// it aborts. The records are appended as they're added, the transaction ends with a control record
+// appended to every partition it touched
+package txn
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	api_v1 "github.com/schachte/kafkaclone/api/v1"
+	"github.com/schachte/kafkaclone/api/v1/logger"
+	"go.uber.org/zap"
+)
+
+// DefaultTimeout applies to transactions begun without a timeout
+const DefaultTimeout = time.Minute
+
+// Log is where the coordinator appends the records of transactions and their control records
+type Log interface {
+	Append(ctx context.Context, topic string, partition *uint32, record *logger.Record, acks logger.Acks) (uint32, uint64, error)
+	AppendBatch(ctx context.Context, topic string, partition *uint32, records []*logger.Record, codec *logger.Compression, acks logger.Acks) (uint32, uint64, error)
+	Topics() []string
+	Partitions(topic string) (uint32, error)
+	// OngoingTransactions returns the transactions with records in the partition that haven't ended yet
+	OngoingTransactions(topic string, partition uint32) ([]uint64, error)
+	// TransactionOutcome returns the control record a transaction ended with in the partition, DATA if none.
+	// Commits are only remembered while the transaction is still open in another partition
+	TransactionOutcome(topic string, partition uint32, id uint64) (logger.Control, error)
+}
+
+// Coordinator tracks the open transactions and the partitions each of them appended to. Transactions live
+// in the memory of the coordinator they were begun through, so all of a transaction's requests have to
+// go to the same one. The upper half of every transaction ID identifies the coordinator, so it can end
+// the transactions it left open when it's restarted (see Recover)
+type Coordinator struct {
+	mu     sync.Mutex
+	log    Log
+	owner  uint32
+	txns   map[uint64]*transaction
+	logger *zap.Logger
+}
+
+type transaction struct {
+	mu         sync.Mutex
+	id         uint64
+	partitions map[partition]struct{}
+	expiry     *time.Timer
+	// outcome is set once the transaction starts ending, retries finish it the same way
+	outcome logger.Control
+	done    bool
+}
+
+type partition struct {
+	topic     string
+	partition uint32
+}
+
+// New creates a coordinator appending to log. owner names the coordinator and has to stay the same
+// across restarts, such as the name of the node it runs on. Only a 32-bit FNV-1a hash of it goes into
+// the transaction IDs, so two coordinators whose names hash the same would end each other's abandoned
+// transactions on restart. The odds are negligible for a cluster's worth of names, but not zero
+func New(log Log, owner string) *Coordinator {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(owner))
+	return &Coordinator{
+		log:    log,
+		owner:  h.Sum32(),
+		txns:   make(map[uint64]*transaction),
+		logger: zap.L().Named("txn"),
+	}
+}
+
+// Begin opens a transaction and returns its ID. It's aborted when it hasn't been committed within timeout
+func (c *Coordinator) Begin(timeout time.Duration) (uint64, error) {
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &transaction{partitions: make(map[partition]struct{})}
+	for t.id == 0 || c.txns[t.id] != nil {
+		t.id = c.newID()
+	}
+	c.txns[t.id] = t
+	t.expiry = time.AfterFunc(timeout, func() {
+		c.logger.Info("transaction timed out", zap.Uint64("txn", t.id))
+		if err := c.end(t.id, logger.Control_ABORT); err != nil {
+			c.logger.Error("failed to abort transaction", zap.Uint64("txn", t.id), zap.Error(err))
+		}
+	})
+	return t.id, nil
+}
+
+// Add appends the records to a partition of the topic as part of the transaction (see
+// topic.Registry.AppendBatch) and returns the partition and the offset of the first record
+func (c *Coordinator) Add(id uint64, topic string, p *uint32, records []*logger.Record) (uint32, uint64, error) {
+	t, err := c.lock(id)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer t.mu.Unlock()
+	if t.outcome != logger.Control_DATA {
+		return 0, 0, api_v1.ErrTxnNotFound{TxnID: id}
+	}
+	for _, record := range records {
+		record.TxnId, record.Control = id, logger.Control_DATA
+	}
+	n, base, err := c.log.AppendBatch(context.Background(), topic, p, records, nil, logger.Acks_ACKS_LEADER)
+	if err != nil {
+		return 0, 0, err
+	}
+	t.partitions[partition{topic: topic, partition: n}] = struct{}{}
+	return n, base, nil
+}
+
+// Commit makes the transaction's records visible to read committed consumers. When it fails part way,
+// retrying either Commit or Abort finishes committing
+func (c *Coordinator) Commit(id uint64) error {
+	return c.end(id, logger.Control_COMMIT)
+}
+
+// Abort hides the transaction's records from read committed consumers for good. When it fails part way,
+// retrying either Commit or Abort finishes aborting
+func (c *Coordinator) Abort(id uint64) error {
+	return c.end(id, logger.Control_ABORT)
+}
+
+// Recover ends the transactions this coordinator began before it was restarted, which would otherwise
+// hold back read committed consumers forever. A transaction that had already started ending, with a
+// control record in some of its partitions, is finished the same way. The others can't be committed
+// anymore and are aborted
+func (c *Coordinator) Recover() error {
+	// The partitions every abandoned transaction is still open in
+	abandoned := make(map[uint64][]partition)
+	var all []partition
+	for _, topic := range c.log.Topics() {
+		n, err := c.log.Partitions(topic)
+		if err != nil {
+			return err
+		}
+		for p := uint32(0); p < n; p++ {
+			all = append(all, partition{topic: topic, partition: p})
+			ids, err := c.log.OngoingTransactions(topic, p)
+			if err != nil {
+				return err
+			}
+			for _, id := range ids {
+				if uint32(id>>32) != c.owner {
+					continue
+				}
+				c.mu.Lock()
+				_, open := c.txns[id]
+				c.mu.Unlock()
+				if open {
+					continue
+				}
+				abandoned[id] = append(abandoned[id], partition{topic: topic, partition: p})
+			}
+		}
+	}
+
+	for id, partitions := range abandoned {
+		outcome, err := c.outcome(id, all)
+		if err != nil {
+			return err
+		}
+		for _, p := range partitions {
+			n := p.partition
+			if _, _, err = c.log.Append(context.Background(), p.topic, &n, &logger.Record{TxnId: id, Control: outcome}, logger.Acks_ACKS_LEADER); err != nil {
+				return err
+			}
+			c.logger.Info(
+				"ended abandoned transaction",
+				zap.Uint64("txn", id),
+				zap.Stringer("outcome", outcome),
+				zap.String("topic", p.topic),
+				zap.Uint32("partition", p.partition),
+			)
+		}
+	}
+	return nil
+}
+
+// outcome returns how the transaction ended in whichever of the partitions it has a control record in,
+// and ABORT when it hasn't ended in any of them
+func (c *Coordinator) outcome(id uint64, partitions []partition) (logger.Control, error) {
+	for _, p := range partitions {
+		outcome, err := c.log.TransactionOutcome(p.topic, p.partition, id)
+		if err != nil {
+			return logger.Control_DATA, err
+		}
+		if outcome != logger.Control_DATA {
+			return outcome, nil
+		}
+	}
+	return logger.Control_ABORT, nil
+}
+
+// Close aborts every open transaction, none of them can be committed once the coordinator is gone
+func (c *Coordinator) Close() error {
+	c.mu.Lock()
+	ids := make([]uint64, 0, len(c.txns))
+	for id := range c.txns {
+		ids = append(ids, id)
+	}
+	c.mu.Unlock()
+	var err error
+	for _, id := range ids {
+		aerr := c.Abort(id)
+		if _, ok := aerr.(api_v1.ErrTxnNotFound); ok {
+			// it ended in the meantime
+			continue
+		}
+		if aerr != nil && err == nil {
+			err = aerr
+		}
+	}
+	return err
+}
+
+// end appends a control record with the outcome to every partition the transaction appended to, and
+// forgets the transaction once all of them are written
+func (c *Coordinator) end(id uint64, outcome logger.Control) error {
+	t, err := c.lock(id)
+	if err != nil {
+		return err
+	}
+	defer t.mu.Unlock()
+	t.expiry.Stop()
+	if t.outcome == logger.Control_DATA {
+		t.outcome = outcome
+	}
+	for p := range t.partitions {
+		n := p.partition
+		if _, _, err = c.log.Append(context.Background(), p.topic, &n, &logger.Record{TxnId: id, Control: t.outcome}, logger.Acks_ACKS_LEADER); err != nil {
+			return err
+		}
+		delete(t.partitions, p)
+	}
+	t.done = true
+	c.mu.Lock()
+	delete(c.txns, id)
+	c.mu.Unlock()
+	return nil
+}
+
+// lock returns the open transaction with its lock held
+func (c *Coordinator) lock(id uint64) (*transaction, error) {
+	c.mu.Lock()
+	t, ok := c.txns[id]
+	c.mu.Unlock()
+	if !ok {
+		return nil, api_v1.ErrTxnNotFound{TxnID: id}
+	}
+	t.mu.Lock()
+	// the transaction may have ended while waiting for the lock
+	if t.done {
+		t.mu.Unlock()
+		return nil, api_v1.ErrTxnNotFound{TxnID: id}
+	}
+	return t, nil
+}
+
+// newID puts the coordinator's owner in the upper half of the ID and random bits in the lower. The caller must hold the lock
+func (c *Coordinator) newID() uint64 {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return uint64(c.owner)<<32 | uint64(binary.BigEndian.Uint32(b))
+}
@@ -0,0 +1,154 @@
+package txn
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	api_v1 "github.com/schachte/kafkaclone/api/v1"
+	"github.com/schachte/kafkaclone/api/v1/logger"
+	"github.com/schachte/kafkaclone/internal/log"
+	"github.com/schachte/kafkaclone/internal/topic"
+	"github.com/stretchr/testify/require"
+)
+
+func setupRegistry(t *testing.T) *topic.Registry {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "txn-test")
+	require.NoError(t, err)
+	r, err := topic.New(dir, log.Config{})
+	require.NoError(t, err)
+	require.NoError(t, r.CreateTopic("orders", &logger.TopicConfig{Partitions: 2}))
+	require.NoError(t, r.CreateTopic("payments", nil))
+	t.Cleanup(func() {
+		r.Close()
+		os.RemoveAll(dir)
+	})
+	return r
+}
+
+// committed returns the values read committed consumers see in a partition
+func committed(t *testing.T, r *topic.Registry, name string, partition uint32) []string {
+	t.Helper()
+	records, err := r.ReadCommitted(name, partition, 0, 0, 0)
+	if _, ok := err.(api_v1.ErrOffsetOutOfRange); ok {
+		return nil
+	}
+	require.NoError(t, err)
+	var values []string
+	for _, record := range records {
+		values = append(values, string(record.Value))
+	}
+	return values
+}
+
+func TestCoordinator(t *testing.T) {
+	r := setupRegistry(t)
+	c := New(r, "node-0")
+	defer c.Close()
+
+	orders, payments := uint32(1), uint32(0)
+	commit, err := c.Begin(0)
+	require.NoError(t, err)
+	abort, err := c.Begin(0)
+	require.NoError(t, err)
+	require.NotEqual(t, commit, abort)
+
+	_, _, err = c.Add(abort, "orders", &orders, []*logger.Record{{Value: []byte("order 1")}})
+	require.NoError(t, err)
+	_, _, err = c.Add(commit, "orders", &orders, []*logger.Record{{Value: []byte("order 2")}})
+	require.NoError(t, err)
+	_, _, err = c.Add(commit, "payments", &payments, []*logger.Record{{Value: []byte("payment 1")}, {Value: []byte("payment 2")}})
+	require.NoError(t, err)
+
+	// Nothing is visible until the transactions end
+	require.Empty(t, committed(t, r, "orders", orders))
+	require.Empty(t, committed(t, r, "payments", payments))
+
+	require.NoError(t, c.Commit(commit))
+	require.Equal(t, []string{"payment 1", "payment 2"}, committed(t, r, "payments", payments))
+	// The committed order is still behind the open transaction
+	require.Empty(t, committed(t, r, "orders", orders))
+
+	require.NoError(t, c.Abort(abort))
+	require.Equal(t, []string{"order 2"}, committed(t, r, "orders", orders))
+
+	// Ended transactions are gone
+	_, _, err = c.Add(commit, "orders", &orders, []*logger.Record{{Value: []byte("late")}})
+	require.Equal(t, api_v1.ErrTxnNotFound{TxnID: commit}, err)
+	require.Equal(t, api_v1.ErrTxnNotFound{TxnID: abort}, c.Commit(abort))
+}
+
+func TestCoordinatorTimeout(t *testing.T) {
+	r := setupRegistry(t)
+	c := New(r, "node-0")
+	defer c.Close()
+
+	id, err := c.Begin(50 * time.Millisecond)
+	require.NoError(t, err)
+	_, _, err = c.Add(id, "payments", nil, []*logger.Record{{Value: []byte("payment")}})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		ongoing, err := r.OngoingTransactions("payments", 0)
+		require.NoError(t, err)
+		return len(ongoing) == 0
+	}, time.Second, 10*time.Millisecond)
+	require.Empty(t, committed(t, r, "payments", 0))
+	require.Equal(t, api_v1.ErrTxnNotFound{TxnID: id}, c.Commit(id))
+}
+
+func TestCoordinatorRecover(t *testing.T) {
+	r := setupRegistry(t)
+	crashed, other := New(r, "node-0"), New(r, "node-1")
+	defer other.Close()
+
+	abandoned, err := crashed.Begin(time.Hour)
+	require.NoError(t, err)
+	_, _, err = crashed.Add(abandoned, "payments", nil, []*logger.Record{{Value: []byte("abandoned")}})
+	require.NoError(t, err)
+	open, err := other.Begin(time.Hour)
+	require.NoError(t, err)
+	_, _, err = other.Add(open, "payments", nil, []*logger.Record{{Value: []byte("open")}})
+	require.NoError(t, err)
+
+	// The restarted coordinator only aborts the transactions it began itself
+	restarted := New(r, "node-0")
+	defer restarted.Close()
+	require.NoError(t, restarted.Recover())
+	ongoing, err := r.OngoingTransactions("payments", 0)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{open}, ongoing)
+
+	require.NoError(t, other.Commit(open))
+	require.Equal(t, []string{"open"}, committed(t, r, "payments", 0))
+}
+
+func TestCoordinatorRecoverPartialCommit(t *testing.T) {
+	r := setupRegistry(t)
+	crashed := New(r, "node-0")
+
+	orders := uint32(0)
+	id, err := crashed.Begin(time.Hour)
+	require.NoError(t, err)
+	_, _, err = crashed.Add(id, "orders", &orders, []*logger.Record{{Value: []byte("order")}})
+	require.NoError(t, err)
+	_, _, err = crashed.Add(id, "payments", nil, []*logger.Record{{Value: []byte("payment")}})
+	require.NoError(t, err)
+	// The coordinator went down after committing in one partition but not the other
+	_, _, err = r.Append(context.Background(), "payments", nil, &logger.Record{TxnId: id, Control: logger.Control_COMMIT}, logger.Acks_ACKS_LEADER)
+	require.NoError(t, err)
+	require.Equal(t, []string{"payment"}, committed(t, r, "payments", 0))
+	require.Empty(t, committed(t, r, "orders", 0))
+
+	// Recovering finishes committing rather than aborting the rest
+	restarted := New(r, "node-0")
+	defer restarted.Close()
+	require.NoError(t, restarted.Recover())
+	ongoing, err := r.OngoingTransactions("orders", 0)
+	require.NoError(t, err)
+	require.Empty(t, ongoing)
+	require.Equal(t, []string{"order"}, committed(t, r, "orders", 0))
+}
@@ -0,0 +1,38 @@
+// Package client is a Go client for the log service. It wraps the generated gRPC stubs with a buffering,
+// retrying Producer and a Consumer that follows a partition across reconnects
+package client
+
+import (
+	"crypto/tls"
+	"time"
+
+	"github.com/schachte/kafkaclone/pkg/tracing"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// Dial connects to a server at addr. With a tlsConfig (see config.SetupTLSConfig) the connection is
+// encrypted and authenticated with the client's certificate, otherwise it's made in plain text.
+// Requests continue the trace of their context on the server (see package tracing)
+func Dial(addr string, tlsConfig *tls.Config, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	opts = append(tracing.DialOptions(), opts...)
+	if tlsConfig != nil {
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+	return grpc.Dial(addr, opts...)
+}
+
+// retryable reports whether a request that failed with err can be tried again: the server couldn't be
+// reached, or there's no Raft leader to take writes right now
+func retryable(err error) bool {
+	return status.Code(err) == codes.Unavailable
+}
+
+// backoff returns how long to wait before the given (zero based) retry, doubling the delay every time
+func backoff(initial time.Duration, retry int) time.Duration {
+	return initial << uint(retry)
+}
@@ -0,0 +1,95 @@
+package client
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/schachte/kafkaclone/internal/authorizer"
+	"github.com/schachte/kafkaclone/internal/config"
+	"github.com/schachte/kafkaclone/internal/log"
+	"github.com/schachte/kafkaclone/internal/server"
+	"github.com/schachte/kafkaclone/internal/topic"
+	"github.com/schachte/kafkaclone/internal/txn"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// testServer is an in-process server that can be stopped and started again on the same address
+type testServer struct {
+	t        *testing.T
+	addr     string
+	registry *topic.Registry
+	server   *grpc.Server
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "client-test")
+	require.NoError(t, err)
+	registry, err := topic.New(dir, log.Config{})
+	require.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &testServer{t: t, addr: ln.Addr().String(), registry: registry}
+	s.serve(ln)
+	t.Cleanup(func() {
+		s.stop()
+		registry.Close()
+		os.RemoveAll(dir)
+	})
+	return s
+}
+
+func (s *testServer) start() {
+	ln, err := net.Listen("tcp", s.addr)
+	require.NoError(s.t, err)
+	s.serve(ln)
+}
+
+func (s *testServer) serve(ln net.Listener) {
+	tlsConfig := tlsConfig(s.t, "../../test_certs/server.pem", "../../test_certs/server-key.pem", true)
+	var err error
+	s.server, err = server.NewGRPCServer(&server.Config{
+		CommitLog:  s.registry,
+		Authorizer: authorizer.New("../../acl/model.conf", "../../acl/policy.csv"),
+		Txns:       txn.New(s.registry, "client-test"),
+	}, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	require.NoError(s.t, err)
+	go s.server.Serve(ln)
+}
+
+func (s *testServer) stop() {
+	s.server.Stop()
+}
+
+// dial connects to the server as the root user
+func (s *testServer) dial(opts ...grpc.DialOption) *grpc.ClientConn {
+	conn, err := Dial(s.addr, tlsConfig(s.t, "../../test_certs/server.pem", "../../test_certs/server-key.pem", false), opts...)
+	require.NoError(s.t, err)
+	s.t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func tlsConfig(t *testing.T, crtPath, keyPath string, server bool) *tls.Config {
+	t.Helper()
+	certFileContents, certFileName := config.ConfigFile(crtPath)
+	keyFileContents, keyFileName := config.ConfigFile(keyPath)
+	caFileContents, caFileName := config.ConfigFile("../../test_certs/ca.pem")
+	c, err := config.SetupTLSConfig(&config.TLSConfig{
+		CertFile:      certFileContents,
+		CertFileName:  certFileName,
+		KeyFile:       keyFileContents,
+		KeyFileName:   keyFileName,
+		CAFile:        caFileContents,
+		CAFileName:    caFileName,
+		ServerAddress: "127.0.0.1",
+		Server:        server,
+	})
+	require.NoError(t, err)
+	return c
+}
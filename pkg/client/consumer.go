@@ -0,0 +1,141 @@
+package client
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/schachte/kafkaclone/api/v1/logger"
+	"google.golang.org/grpc"
+)
+
+type ConsumerConfig struct {
+	// Topic the records are consumed from, the default topic when empty
+	Topic     string
+	Partition uint32
+	// Offset is where consuming starts from
+	Offset uint64
+	// Backoff is the delay before reconnecting a broken stream, it doubles while reconnecting keeps failing
+	Backoff time.Duration
+	// MaxBackoff caps the delay between reconnects
+	MaxBackoff time.Duration
+	// IsolationLevel READ_COMMITTED only delivers the records of committed transactions
+	IsolationLevel logger.IsolationLevel
+}
+
+// Consumer iterates over the records of a partition as they're produced:
+//
+//	for consumer.Next() {
+//		record := consumer.Record()
+//	}
+//	if err := consumer.Err(); err != nil {
+//
+// When the stream breaks because the server went away, it's reopened from the offset after the
+// last record delivered, so no record is skipped or delivered twice
+type Consumer struct {
+	client logger.LogServiceClient
+	config ConsumerConfig
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	stream logger.LogService_ConsumeStreamClient
+	offset uint64
+	record *logger.Record
+	err    error
+}
+
+func NewConsumer(conn grpc.ClientConnInterface, config ConsumerConfig) *Consumer {
+	if config.Backoff == 0 {
+		config.Backoff = 100 * time.Millisecond
+	}
+	if config.MaxBackoff == 0 {
+		config.MaxBackoff = 5 * time.Second
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Consumer{
+		client: logger.NewLogServiceClient(conn),
+		config: config,
+		ctx:    ctx,
+		cancel: cancel,
+		offset: config.Offset,
+	}
+}
+
+// Next blocks until the next record arrives and reports whether there is one. It returns false
+// once the consumer is closed or fails with an error that reconnecting can't fix, see Err
+func (c *Consumer) Next() bool {
+	for retry := 0; ; {
+		if c.stream == nil {
+			stream, err := c.client.ConsumeStream(c.ctx, &logger.ConsumeRequest{
+				Topic:          c.config.Topic,
+				Partition:      c.config.Partition,
+				Offset:         c.offset,
+				IsolationLevel: c.config.IsolationLevel,
+			})
+			if err != nil {
+				if !c.wait(err, retry) {
+					return false
+				}
+				retry++
+				continue
+			}
+			c.stream = stream
+		}
+		res, err := c.stream.Recv()
+		if err != nil {
+			c.stream = nil
+			if !c.wait(err, retry) {
+				return false
+			}
+			retry++
+			continue
+		}
+		c.record = res.Record
+		// Compacted partitions skip offsets, so resume from the record actually delivered
+		c.offset = res.Record.Offset + 1
+		return true
+	}
+}
+
+// wait sleeps before reconnecting after err, or records err and returns false when it can't be retried
+func (c *Consumer) wait(err error, retry int) bool {
+	if c.ctx.Err() != nil {
+		return false
+	}
+	// The server ends streams cleanly when it shuts down
+	if err != io.EOF && !retryable(err) {
+		c.err = err
+		return false
+	}
+	delay := backoff(c.config.Backoff, retry)
+	if delay > c.config.MaxBackoff || delay <= 0 {
+		delay = c.config.MaxBackoff
+	}
+	select {
+	case <-time.After(delay):
+		return true
+	case <-c.ctx.Done():
+		return false
+	}
+}
+
+// Record returns the record Next moved to
+func (c *Consumer) Record() *logger.Record {
+	return c.record
+}
+
+// Offset returns the offset consuming continues from, the one after the last record delivered
+func (c *Consumer) Offset() uint64 {
+	return c.offset
+}
+
+// Err returns the error that stopped Next, or nil if it was stopped by Close
+func (c *Consumer) Err() error {
+	return c.err
+}
+
+// Close stops the consumer, a Next blocked waiting for records returns false
+func (c *Consumer) Close() error {
+	c.cancel()
+	return nil
+}
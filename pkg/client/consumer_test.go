@@ -0,0 +1,54 @@
+package client
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/schachte/kafkaclone/api/v1/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsumer(t *testing.T) {
+	s := newTestServer(t)
+	conn := s.dial()
+	p := NewProducer(conn, ProducerConfig{})
+	defer p.Close()
+	produce := func(from, to int) {
+		for i := from; i < to; i++ {
+			p.Send(&logger.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		}
+		p.Flush()
+	}
+	produce(0, 3)
+
+	c := NewConsumer(conn, ConsumerConfig{Offset: 1, Backoff: 10 * time.Millisecond})
+	for i := 1; i < 3; i++ {
+		require.True(t, c.Next())
+		require.Equal(t, uint64(i), c.Record().Offset)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), c.Record().Value)
+	}
+	require.Equal(t, uint64(3), c.Offset())
+
+	// The stream is reopened after the server restarts, carrying on after the last record delivered
+	s.stop()
+	s.start()
+	produce(3, 5)
+	for i := 3; i < 5; i++ {
+		require.True(t, c.Next())
+		require.Equal(t, uint64(i), c.Record().Offset)
+	}
+
+	// Close stops a Next that's waiting for records
+	stopped := make(chan bool)
+	go func() { stopped <- c.Next() }()
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, c.Close())
+	select {
+	case next := <-stopped:
+		require.False(t, next)
+	case <-time.After(time.Second):
+		t.Fatal("Next didn't return after Close")
+	}
+	require.NoError(t, c.Err())
+}
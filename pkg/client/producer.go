@@ -0,0 +1,269 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/schachte/kafkaclone/api/v1/logger"
+	"google.golang.org/grpc"
+)
+
+// ErrProducerClosed is the error of records sent after the producer was closed
+var ErrProducerClosed = errors.New("producer is closed")
+
+type ProducerConfig struct {
+	// Topic the records are produced to, the default topic when empty
+	Topic string
+	// Linger is how long a record may wait for others to fill up its batch before the batch is sent anyway
+	Linger time.Duration
+	// BatchSize is the number of records a batch is sent at, without waiting for Linger. Batches are
+	// kept per key (see Producer), so it only applies to records with the same key: with many distinct
+	// keys most batches go out after Linger holding a record or two, each in its own request
+	BatchSize int
+	// MaxInFlight bounds the batches waiting on the server at once, Send blocks once it's reached.
+	// Batches in flight together may be stored in any order, set it to 1 to keep the order records are sent in
+	MaxInFlight int
+	// Retries is how many times a batch is retried when the server is unavailable
+	Retries int
+	// Backoff is the delay before the first retry, it doubles with each one after that
+	Backoff time.Duration
+	// Compression is the codec batches are stored with, the topic's default codec is used when it's nil
+	Compression *logger.Compression
+	// Idempotent numbers the records with sequences, so the server stores a batch only once however many
+	// times it's retried. It keeps a single batch in flight, overriding MaxInFlight
+	Idempotent bool
+	// Acks is how far a batch has to get before the server acknowledges it, see logger.Acks. With ACKS_NONE
+	// records resolve without their offset
+	Acks logger.Acks
+}
+
+// Producer sends records asynchronously. Records are buffered into batches and every batch goes
+// out in a single ProduceBatch request. Records with the same key share batches, so each batch is
+// placed by the server's partitioner the same way its records would have been on their own. The
+// producer doesn't know how the server partitions, so records with different keys never share a
+// batch even when they'd land on the same partition, and batching does little for high-cardinality keys
+type Producer struct {
+	client logger.LogServiceClient
+	config ProducerConfig
+
+	mu      sync.RWMutex
+	closed  bool
+	records chan *pending
+	flushes chan chan struct{}
+	done    chan struct{}
+
+	inFlight chan struct{}
+	sending  sync.WaitGroup
+
+	// producerID and sequence identify the next batch of an idempotent producer. Only one batch is in
+	// flight at a time, so they're only touched by whichever of batch and send holds the in flight slot
+	producerID uint64
+	sequence   uint64
+}
+
+// Future is the eventual result of sending a record
+type Future struct {
+	done      chan struct{}
+	partition uint32
+	offset    uint64
+	err       error
+}
+
+type pending struct {
+	record *logger.Record
+	future *Future
+}
+
+func NewProducer(conn grpc.ClientConnInterface, config ProducerConfig) *Producer {
+	if config.Linger == 0 {
+		config.Linger = 5 * time.Millisecond
+	}
+	if config.BatchSize == 0 {
+		config.BatchSize = 100
+	}
+	if config.MaxInFlight == 0 {
+		config.MaxInFlight = 5
+	}
+	if config.Idempotent {
+		// Batches in flight together could be stored out of order, which the sequences don't allow
+		config.MaxInFlight = 1
+	}
+	if config.Retries == 0 {
+		config.Retries = 5
+	}
+	if config.Backoff == 0 {
+		config.Backoff = 100 * time.Millisecond
+	}
+	p := &Producer{
+		client:   logger.NewLogServiceClient(conn),
+		config:   config,
+		records:  make(chan *pending),
+		flushes:  make(chan chan struct{}),
+		done:     make(chan struct{}),
+		inFlight: make(chan struct{}, config.MaxInFlight),
+	}
+	if config.Idempotent {
+		p.producerID = newProducerID()
+	}
+	go p.batch()
+	return p
+}
+
+// newProducerID picks a random ID for an idempotent producer, 0 is left for producers that aren't
+func newProducerID() uint64 {
+	b := make([]byte, 8)
+	for {
+		if _, err := rand.Read(b); err != nil {
+			panic(err)
+		}
+		if id := binary.BigEndian.Uint64(b); id != 0 {
+			return id
+		}
+	}
+}
+
+// Send queues the record to be produced and returns a Future for its offset
+func (p *Producer) Send(record *logger.Record) *Future {
+	f := &Future{done: make(chan struct{})}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		f.resolve(0, 0, ErrProducerClosed)
+		return f
+	}
+	p.records <- &pending{record: record, future: f}
+	return f
+}
+
+// Flush sends every buffered record straight away and waits until all of them are acknowledged
+func (p *Producer) Flush() {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return
+	}
+	flushed := make(chan struct{})
+	p.flushes <- flushed
+	<-flushed
+}
+
+// Close flushes the buffered records and stops the producer
+func (p *Producer) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.records)
+	p.mu.Unlock()
+	<-p.done
+	return nil
+}
+
+// batch buffers the records per key until their batch is full or has lingered long enough
+func (p *Producer) batch() {
+	defer close(p.done)
+	batches := make(map[string][]*pending)
+	var linger <-chan time.Time
+	sendAll := func() {
+		for key, batch := range batches {
+			p.send(batch)
+			delete(batches, key)
+		}
+		linger = nil
+	}
+	for {
+		select {
+		case r, ok := <-p.records:
+			if !ok {
+				sendAll()
+				p.sending.Wait()
+				return
+			}
+			key := string(r.record.Key)
+			batches[key] = append(batches[key], r)
+			if len(batches[key]) >= p.config.BatchSize {
+				p.send(batches[key])
+				delete(batches, key)
+			} else if linger == nil {
+				linger = time.After(p.config.Linger)
+			}
+		case <-linger:
+			sendAll()
+		case flushed := <-p.flushes:
+			sendAll()
+			p.sending.Wait()
+			close(flushed)
+		}
+	}
+}
+
+// send produces the batch in the background, once there's room for another request in flight
+func (p *Producer) send(batch []*pending) {
+	p.inFlight <- struct{}{}
+	p.sending.Add(1)
+	req := &logger.ProduceBatchRequest{Topic: p.config.Topic, Compression: p.config.Compression, Acks: p.config.Acks}
+	if p.config.Idempotent {
+		req.ProducerId, req.BaseSequence = p.producerID, p.sequence
+		p.sequence += uint64(len(batch))
+	}
+	go func() {
+		defer p.sending.Done()
+		defer func() { <-p.inFlight }()
+		req.Records = make([]*logger.Record, len(batch))
+		for i, r := range batch {
+			req.Records[i] = r.record
+		}
+		res, err := p.produce(req)
+		if err != nil && p.config.Idempotent {
+			// Whether the batch was stored is unknown, so the sequences can't carry on from it.
+			// Starting over as a new producer keeps the batches after it from being rejected
+			p.producerID, p.sequence = newProducerID(), 0
+		}
+		for i, r := range batch {
+			if err != nil {
+				r.future.resolve(0, 0, err)
+				continue
+			}
+			if p.config.Acks == logger.Acks_ACKS_NONE {
+				r.future.resolve(res.Partition, 0, nil)
+				continue
+			}
+			r.future.resolve(res.Partition, res.BaseOffset+uint64(i), nil)
+		}
+	}()
+}
+
+// produce sends a batch, retrying with backoff while the server is unavailable. Retries resend the
+// same request, so an idempotent producer's batch keeps its sequences
+func (p *Producer) produce(req *logger.ProduceBatchRequest) (*logger.ProduceBatchResponse, error) {
+	for retry := 0; ; retry++ {
+		res, err := p.client.ProduceBatch(context.Background(), req)
+		if err == nil || !retryable(err) || retry >= p.config.Retries {
+			return res, err
+		}
+		time.Sleep(backoff(p.config.Backoff, retry))
+	}
+}
+
+func (f *Future) resolve(partition uint32, offset uint64, err error) {
+	f.partition, f.offset, f.err = partition, offset, err
+	close(f.done)
+}
+
+// Done is closed once the record has been acknowledged or failed
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait blocks until the record has been acknowledged and returns the partition and offset it was stored at.
+// The offset is 0 for producers that don't wait for acknowledgments
+func (f *Future) Wait() (partition uint32, offset uint64, err error) {
+	<-f.done
+	return f.partition, f.offset, f.err
+}
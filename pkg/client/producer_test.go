@@ -0,0 +1,143 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/schachte/kafkaclone/api/v1/logger"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestProducer(t *testing.T) {
+	s := newTestServer(t)
+	p := NewProducer(s.dial(), ProducerConfig{BatchSize: 4, Linger: 10 * time.Millisecond, MaxInFlight: 1})
+
+	var futures []*Future
+	for i := 0; i < 10; i++ {
+		futures = append(futures, p.Send(&logger.Record{Value: []byte(fmt.Sprintf("record %d", i))}))
+	}
+	for i, f := range futures {
+		partition, offset, err := f.Wait()
+		require.NoError(t, err)
+		require.Equal(t, uint32(0), partition)
+		require.Equal(t, uint64(i), offset)
+	}
+
+	require.NoError(t, p.Close())
+	_, _, err := p.Send(&logger.Record{Value: []byte("late")}).Wait()
+	require.Equal(t, ErrProducerClosed, err)
+
+	// Flush doesn't wait for the linger
+	p = NewProducer(s.dial(), ProducerConfig{Linger: time.Hour})
+	defer p.Close()
+	f := p.Send(&logger.Record{Value: []byte("flushed")})
+	p.Flush()
+	select {
+	case <-f.Done():
+	default:
+		t.Fatal("record wasn't sent by Flush")
+	}
+	_, offset, err := f.Wait()
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), offset)
+}
+
+func TestProducerRetries(t *testing.T) {
+	s := newTestServer(t)
+	conn := s.dial()
+	s.stop()
+
+	p := NewProducer(conn, ProducerConfig{Backoff: 50 * time.Millisecond, Retries: 10})
+	defer p.Close()
+	f := p.Send(&logger.Record{Value: []byte("hello world")})
+
+	// The server comes back while the producer is backing off
+	time.Sleep(100 * time.Millisecond)
+	s.start()
+	_, offset, err := f.Wait()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offset)
+}
+
+func TestProducerCompression(t *testing.T) {
+	s := newTestServer(t)
+	codec := logger.Compression_ZSTD
+	p := NewProducer(s.dial(), ProducerConfig{BatchSize: 5, Linger: time.Hour, MaxInFlight: 1, Compression: &codec})
+	defer p.Close()
+
+	var futures []*Future
+	for i := 0; i < 5; i++ {
+		futures = append(futures, p.Send(&logger.Record{Value: []byte(fmt.Sprintf("record %d", i))}))
+	}
+	for i, f := range futures {
+		_, offset, err := f.Wait()
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), offset)
+	}
+
+	// The whole batch is stored as a single compressed record
+	batches, err := s.registry.ReadBatches("", 0, 0, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, batches, 1)
+	require.Equal(t, codec, batches[0].Compression)
+	record, err := s.registry.Read(context.Background(), "", 0, 3)
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 3"), record.Value)
+}
+
+func TestIdempotentProducer(t *testing.T) {
+	for _, idempotent := range []bool{true, false} {
+		t.Run(fmt.Sprintf("idempotent %v", idempotent), func(t *testing.T) {
+			s := newTestServer(t)
+			// Every batch is stored but the response to its first attempt is lost, so it's retried
+			var calls int32
+			drop := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+				err := invoker(ctx, method, req, reply, cc, opts...)
+				if err == nil && strings.HasSuffix(method, "/ProduceBatch") && atomic.AddInt32(&calls, 1)%2 == 1 {
+					return status.Error(codes.Unavailable, "response dropped")
+				}
+				return err
+			}
+			p := NewProducer(s.dial(grpc.WithUnaryInterceptor(drop)), ProducerConfig{
+				BatchSize:  2,
+				Linger:     time.Hour,
+				Backoff:    time.Millisecond,
+				Idempotent: idempotent,
+			})
+			defer p.Close()
+
+			var futures []*Future
+			for i := 0; i < 10; i++ {
+				futures = append(futures, p.Send(&logger.Record{Value: []byte(fmt.Sprintf("record %d", i))}))
+			}
+			for i, f := range futures {
+				_, offset, err := f.Wait()
+				require.NoError(t, err)
+				if idempotent {
+					require.Equal(t, uint64(i), offset)
+				}
+			}
+
+			records, err := s.registry.ReadRange("", 0, 0, 0, 0)
+			require.NoError(t, err)
+			if !idempotent {
+				// Without sequences, every retry is stored again
+				require.Len(t, records, 20)
+				return
+			}
+			require.Len(t, records, 10)
+			for i, record := range records {
+				require.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+				require.Equal(t, uint64(i), record.Sequence)
+				require.NotZero(t, record.ProducerId)
+			}
+		})
+	}
+}
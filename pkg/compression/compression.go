@@ -0,0 +1,117 @@
+// Package compression implements the codecs record batches can be stored and fetched with.
+// A compressed batch travels as a single record, see logger.Record.Compression
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	api_v1 "github.com/schachte/kafkaclone/api/v1"
+	"github.com/schachte/kafkaclone/api/v1/logger"
+	"google.golang.org/protobuf/proto"
+)
+
+// The zstd encoder and decoder are safe for concurrent use and expensive to set up, so they're shared
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// Compress compresses p with codec. With logger.Compression_NONE p is returned as it is
+func Compress(codec logger.Compression, p []byte) ([]byte, error) {
+	switch codec {
+	case logger.Compression_NONE:
+		return p, nil
+	case logger.Compression_GZIP:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(p); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case logger.Compression_SNAPPY:
+		return snappy.Encode(nil, p), nil
+	case logger.Compression_ZSTD:
+		return zstdEncoder.EncodeAll(p, nil), nil
+	case logger.Compression_LZ4:
+		var buf bytes.Buffer
+		w := lz4.NewWriter(&buf)
+		if _, err := w.Write(p); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, api_v1.ErrUnknownCompression{Codec: int32(codec)}
+}
+
+// Decompress reverses Compress
+func Decompress(codec logger.Compression, p []byte) ([]byte, error) {
+	switch codec {
+	case logger.Compression_NONE:
+		return p, nil
+	case logger.Compression_GZIP:
+		r, err := gzip.NewReader(bytes.NewReader(p))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	case logger.Compression_SNAPPY:
+		return snappy.Decode(nil, p)
+	case logger.Compression_ZSTD:
+		return zstdDecoder.DecodeAll(p, nil)
+	case logger.Compression_LZ4:
+		return ioutil.ReadAll(lz4.NewReader(bytes.NewReader(p)))
+	}
+	return nil, api_v1.ErrUnknownCompression{Codec: int32(codec)}
+}
+
+// Valid reports whether codec is one of the supported codecs
+func Valid(codec logger.Compression) bool {
+	_, ok := logger.Compression_name[int32(codec)]
+	return ok
+}
+
+// Batch packs records into a single record holding them compressed with codec, which can't be
+// logger.Compression_NONE: uncompressed records are never batched. The batch takes the offset of
+// its first record, the records must already have theirs
+func Batch(codec logger.Compression, records []*logger.Record) (*logger.Record, error) {
+	p, err := proto.Marshal(&logger.RecordBatch{Records: records})
+	if err != nil {
+		return nil, err
+	}
+	if p, err = Compress(codec, p); err != nil {
+		return nil, err
+	}
+	batch := &logger.Record{Value: p, Compression: codec}
+	if len(records) > 0 {
+		batch.Offset = records[0].Offset
+	}
+	return batch, nil
+}
+
+// Unbatch returns the records a record holds: the records of a compressed batch, or just the record itself otherwise
+func Unbatch(record *logger.Record) ([]*logger.Record, error) {
+	if record.Compression == logger.Compression_NONE {
+		return []*logger.Record{record}, nil
+	}
+	p, err := Decompress(record.Compression, record.Value)
+	if err != nil {
+		return nil, err
+	}
+	batch := &logger.RecordBatch{}
+	if err = proto.Unmarshal(p, batch); err != nil {
+		return nil, err
+	}
+	return batch.Records, nil
+}
@@ -0,0 +1,60 @@
+package compression
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	api_v1 "github.com/schachte/kafkaclone/api/v1"
+	"github.com/schachte/kafkaclone/api/v1/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompression(t *testing.T) {
+	p := bytes.Repeat([]byte(`{"user":"gopher","action":"login"}`), 100)
+	for codec := range logger.Compression_name {
+		codec := logger.Compression(codec)
+		t.Run(codec.String(), func(t *testing.T) {
+			compressed, err := Compress(codec, p)
+			require.NoError(t, err)
+			if codec != logger.Compression_NONE {
+				require.Less(t, len(compressed), len(p))
+			}
+			decompressed, err := Decompress(codec, compressed)
+			require.NoError(t, err)
+			require.Equal(t, p, decompressed)
+			if codec == logger.Compression_NONE {
+				return
+			}
+
+			var records []*logger.Record
+			for i := uint64(0); i < 3; i++ {
+				records = append(records, &logger.Record{Value: []byte(fmt.Sprintf("record %d", i)), Offset: 10 + i})
+			}
+			batch, err := Batch(codec, records)
+			require.NoError(t, err)
+			require.Equal(t, uint64(10), batch.Offset)
+			unbatched, err := Unbatch(batch)
+			require.NoError(t, err)
+			require.Len(t, unbatched, 3)
+			for i, record := range unbatched {
+				require.Equal(t, records[i].Value, record.Value)
+				require.Equal(t, records[i].Offset, record.Offset)
+			}
+		})
+	}
+}
+
+func TestUnknownCompression(t *testing.T) {
+	require.False(t, Valid(logger.Compression(42)))
+	_, err := Compress(logger.Compression(42), []byte("hello"))
+	require.Equal(t, api_v1.ErrUnknownCompression{Codec: 42}, err)
+	_, err = Decompress(logger.Compression(42), []byte("hello"))
+	require.Equal(t, api_v1.ErrUnknownCompression{Codec: 42}, err)
+
+	// an uncompressed record is only ever itself
+	record := &logger.Record{Value: []byte("hello")}
+	records, err := Unbatch(record)
+	require.NoError(t, err)
+	require.Equal(t, []*logger.Record{record}, records)
+}
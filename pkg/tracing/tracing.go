@@ -0,0 +1,241 @@
+// Package tracing follows records with OpenTelemetry from the producer through replication to the consumer.
+// Spans are recorded with the global tracer provider, which drops them until one is installed with
+// otel.SetTracerProvider, e.g. NewProvider with an OTLP exporter from NewExporter, or with an in-memory
+// exporter from go.opentelemetry.io/otel/sdk/trace/tracetest in tests.
+//
+// The trace context travels between servers and clients in gRPC metadata (see the interceptors) and
+// can be persisted in a record's headers with InjectRecord, so whoever consumes the record later can
+// link to the span that produced it (see RecordContext)
+package tracing
+
+import (
+	"context"
+	"crypto/tls"
+	"path"
+	"strings"
+
+	"github.com/schachte/kafkaclone/api/v1/logger"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// TracerName is the name of the tracer every span of the service is recorded with
+const TracerName = "github.com/schachte/kafkaclone"
+
+// propagator reads and writes the W3C traceparent and tracestate fields
+var propagator = propagation.TraceContext{}
+
+// Tracer returns the service's tracer from the global tracer provider
+func Tracer() trace.Tracer {
+	return otel.Tracer(TracerName)
+}
+
+// NewProvider creates a tracer provider that sends the spans of the named service to exporter in batches.
+// Shut it down to send the spans it still buffers
+func NewProvider(serviceName string, exporter sdktrace.SpanExporter) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+}
+
+// NewExporter exports spans to the OTLP collector at endpoint over gRPC, encrypted with tlsConfig when it's
+// set and in plain text otherwise
+func NewExporter(ctx context.Context, endpoint string, tlsConfig *tls.Config) (sdktrace.SpanExporter, error) {
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(endpoint)}
+	if tlsConfig != nil {
+		opts = append(opts, otlptracegrpc.WithTLSCredentials(credentials.NewTLS(tlsConfig)))
+	} else {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	return otlptracegrpc.New(ctx, opts...)
+}
+
+// InjectRecord stores the trace context of ctx in the record's traceparent and tracestate headers, replacing
+// any it already had. When ctx carries no span the record is left alone
+func InjectRecord(ctx context.Context, record *logger.Record) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return
+	}
+	propagator.Inject(ctx, recordCarrier{record})
+}
+
+// RecordContext returns the context of the span that produced the record, when it was persisted in the
+// record's headers with InjectRecord. The span context isn't valid otherwise
+func RecordContext(record *logger.Record) trace.SpanContext {
+	return trace.SpanContextFromContext(propagator.Extract(context.Background(), recordCarrier{record}))
+}
+
+// LinkRecords links span to the spans that produced the records, skipping the ones without a trace
+// context and the ones produced in span's own trace, which are already part of it
+func LinkRecords(span trace.Span, records ...*logger.Record) {
+	own := span.SpanContext().TraceID()
+	for _, record := range records {
+		if sc := RecordContext(record); sc.IsValid() && sc.TraceID() != own {
+			span.AddLink(trace.Link{SpanContext: sc})
+		}
+	}
+}
+
+// Marshal encodes the traceparent of ctx, to carry it along with something other than gRPC metadata or
+// records. It's empty when ctx carries no span
+func Marshal(ctx context.Context) []byte {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	return []byte(carrier.Get("traceparent"))
+}
+
+// Unmarshal returns a context with the span encoded by Marshal as its remote parent, or an empty context
+func Unmarshal(b []byte) context.Context {
+	return propagator.Extract(context.Background(), propagation.MapCarrier{"traceparent": string(b)})
+}
+
+// recordCarrier reads and writes the trace context in a record's headers
+type recordCarrier struct {
+	record *logger.Record
+}
+
+func (c recordCarrier) Get(key string) string {
+	for _, h := range c.record.GetHeaders() {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+func (c recordCarrier) Set(key, value string) {
+	for _, h := range c.record.Headers {
+		if h.Key == key {
+			h.Value = []byte(value)
+			return
+		}
+	}
+	c.record.Headers = append(c.record.Headers, &logger.Header{Key: key, Value: []byte(value)})
+}
+
+func (c recordCarrier) Keys() []string {
+	keys := make([]string, 0, len(c.record.GetHeaders()))
+	for _, h := range c.record.GetHeaders() {
+		keys = append(keys, h.Key)
+	}
+	return keys
+}
+
+// metadataCarrier reads and writes the trace context in gRPC metadata
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if values := metadata.MD(c).Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Inject returns ctx with its trace context added to the outgoing gRPC metadata
+func Inject(ctx context.Context) context.Context {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = md.Copy()
+	propagator.Inject(ctx, metadataCarrier(md))
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// Extract returns ctx with the trace context of the incoming gRPC metadata as its remote parent span
+func Extract(ctx context.Context) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return propagator.Extract(ctx, metadataCarrier(md))
+}
+
+// startRPC starts the span of an RPC, named after its method like log.v1.LogService/Produce
+func startRPC(ctx context.Context, fullMethod string, kind trace.SpanKind) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, strings.TrimPrefix(fullMethod, "/"),
+		trace.WithSpanKind(kind),
+		trace.WithAttributes(
+			attribute.String("rpc.system", "grpc"),
+			attribute.String("rpc.method", path.Base(fullMethod)),
+		),
+	)
+}
+
+// End ends span, recording err on it when it isn't nil. gRPC errors keep their status code
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		if st, ok := status.FromError(err); ok {
+			span.SetAttributes(attribute.String("rpc.grpc.status_code", st.Code().String()))
+			span.SetStatus(otelcodes.Error, st.Message())
+		} else {
+			span.SetStatus(otelcodes.Error, err.Error())
+		}
+	}
+	span.End()
+}
+
+// UnaryServerInterceptor traces unary RPCs, continuing the caller's trace when it sent one along
+func UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, span := startRPC(Extract(ctx), info.FullMethod, trace.SpanKindServer)
+	res, err := handler(ctx, req)
+	End(span, err)
+	return res, err
+}
+
+// StreamServerInterceptor traces streaming RPCs for their whole life, the stream's context carries the span
+func StreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, span := startRPC(Extract(ss.Context()), info.FullMethod, trace.SpanKindServer)
+	err := handler(srv, &tracedStream{ServerStream: ss, ctx: ctx})
+	End(span, err)
+	return err
+}
+
+type tracedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *tracedStream) Context() context.Context {
+	return s.ctx
+}
+
+// UnaryClientInterceptor traces outgoing unary RPCs and sends their trace context along to the server
+func UnaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	ctx, span := startRPC(ctx, method, trace.SpanKindClient)
+	err := invoker(Inject(ctx), method, req, reply, cc, opts...)
+	End(span, err)
+	return err
+}
+
+// StreamClientInterceptor sends the trace context of outgoing streams along to the server. Streams outlive
+// the call that opens them, so they're left to the server to trace
+func StreamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return streamer(Inject(ctx), desc, cc, method, opts...)
+}
+
+// DialOptions installs the client interceptors on a connection
+func DialOptions() []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(UnaryClientInterceptor),
+		grpc.WithChainStreamInterceptor(StreamClientInterceptor),
+	}
+}
@@ -0,0 +1,86 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/schachte/kafkaclone/api/v1/logger"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+
+	// Records are left alone outside of a trace
+	record := &logger.Record{Value: []byte("hello world")}
+	InjectRecord(context.Background(), record)
+	require.Empty(t, record.Headers)
+	require.False(t, RecordContext(record).IsValid())
+
+	ctx, produce := Tracer().Start(context.Background(), "produce")
+	InjectRecord(ctx, record)
+	require.Len(t, record.Headers, 1)
+	require.Equal(t, produce.SpanContext().TraceID(), RecordContext(record).TraceID())
+	require.Equal(t, produce.SpanContext().SpanID(), RecordContext(record).SpanID())
+	// injecting again replaces the trace context rather than piling up headers
+	InjectRecord(ctx, record)
+	require.Len(t, record.Headers, 1)
+	produce.End()
+
+	// Spans of other traces link to the producer, its own trace doesn't need to
+	_, consume := Tracer().Start(context.Background(), "consume")
+	LinkRecords(consume, record, &logger.Record{})
+	consume.End()
+	_, child := Tracer().Start(ctx, "child")
+	LinkRecords(child, record)
+	child.End()
+	spans := exporter.GetSpans()
+	require.Len(t, spans[1].Links, 1)
+	require.Equal(t, produce.SpanContext().SpanID(), spans[1].Links[0].SpanContext.SpanID())
+	require.Empty(t, spans[2].Links)
+
+	require.Empty(t, Marshal(context.Background()))
+	require.False(t, trace.SpanContextFromContext(Unmarshal(nil)).IsValid())
+	unmarshaled := trace.SpanContextFromContext(Unmarshal(Marshal(ctx)))
+	require.True(t, unmarshaled.IsRemote())
+	require.Equal(t, produce.SpanContext().SpanID(), unmarshaled.SpanID())
+}
+
+func TestInterceptors(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+
+	// The client's metadata arrives as the server's incoming metadata
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		md, _ := metadata.FromOutgoingContext(ctx)
+		_, err := UnaryServerInterceptor(metadata.NewIncomingContext(context.Background(), md), req,
+			&grpc.UnaryServerInfo{FullMethod: method},
+			func(ctx context.Context, req interface{}) (interface{}, error) {
+				return nil, status.Error(codes.Unavailable, "no leader elected")
+			})
+		return err
+	}
+	err := UnaryClientInterceptor(context.Background(), "/log.v1.LogService/Produce", nil, nil, nil, invoker)
+	require.Equal(t, codes.Unavailable, status.Code(err))
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 2)
+	server, client := spans[0], spans[1]
+	require.Equal(t, "log.v1.LogService/Produce", server.Name)
+	require.Equal(t, trace.SpanKindServer, server.SpanKind)
+	require.Equal(t, trace.SpanKindClient, client.SpanKind)
+	require.Equal(t, client.SpanContext.TraceID(), server.SpanContext.TraceID())
+	require.Equal(t, client.SpanContext.SpanID(), server.Parent.SpanID())
+	require.Contains(t, server.Attributes, attribute.String("rpc.grpc.status_code", "Unavailable"))
+	require.Contains(t, server.Attributes, attribute.String("rpc.method", "Produce"))
+}